@@ -0,0 +1,168 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/bytemare/opaque/message"
+)
+
+var (
+	// ErrRecordNotFound indicates that no record is stored for the credential identifier.
+	ErrRecordNotFound = errors.New("record not found")
+
+	// ErrRecordExists indicates that a record is already stored for the credential identifier.
+	ErrRecordExists = errors.New("record already exists")
+)
+
+// RecordStore stores client records by their credential identifier.
+type RecordStore interface {
+	// Get returns the record for the credential identifier, or ErrRecordNotFound.
+	Get(credentialIdentifier []byte) (*ClientRecord, error)
+
+	// Put stores the record under its credential identifier, or returns ErrRecordExists if one is already stored.
+	Put(record *ClientRecord) error
+
+	// Replace stores the record under its credential identifier, replacing any previous one.
+	Replace(record *ClientRecord) error
+}
+
+// MemoryStore is an in-memory RecordStore, safe for concurrent use.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	records map[string]*ClientRecord
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]*ClientRecord)}
+}
+
+// Get implements RecordStore.
+func (m *MemoryStore) Get(credentialIdentifier []byte) (*ClientRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	record, ok := m.records[string(credentialIdentifier)]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return record, nil
+}
+
+// Put implements RecordStore.
+func (m *MemoryStore) Put(record *ClientRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.records[string(record.CredentialIdentifier)]; ok {
+		return ErrRecordExists
+	}
+
+	m.records[string(record.CredentialIdentifier)] = record
+
+	return nil
+}
+
+// Replace implements RecordStore.
+func (m *MemoryStore) Replace(record *ClientRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.records[string(record.CredentialIdentifier)] = record
+
+	return nil
+}
+
+// Authenticator drives the server side of the registration and login flows, looking up and storing records in a
+// RecordStore. It is a convenience layer for the common case, and the Server can still be used directly.
+type Authenticator struct {
+	conf           *Configuration
+	store          RecordStore
+	serverIdentity []byte
+	keys           *ServerKeys
+}
+
+// NewAuthenticator returns an Authenticator using the store, and the server identity and keys for all clients. If
+// serverIdentity is nil, the server public key is used. The configuration is copied.
+func NewAuthenticator(conf *Configuration, store RecordStore, serverIdentity []byte, keys *ServerKeys) *Authenticator {
+	if conf == nil {
+		conf = DefaultConfiguration()
+	}
+
+	return &Authenticator{
+		conf:           conf.Clone(),
+		store:          store,
+		serverIdentity: serverIdentity,
+		keys:           keys,
+	}
+}
+
+// RegistrationResponse returns the response to the client's registration request for the credential identifier.
+func (a *Authenticator) RegistrationResponse(credentialIdentifier []byte,
+	req *message.RegistrationRequest) (*message.RegistrationResponse, error) {
+	return a.conf.Server().RegistrationResponse(req, a.keys.PublicKey, credentialIdentifier, a.keys.OprfSeed)
+}
+
+// Register builds the record from the client's serialized RegistrationUpload, and stores it. It returns
+// ErrRecordExists if a record is already stored for the credential identifier.
+func (a *Authenticator) Register(credentialIdentifier, clientIdentity, upload []byte) error {
+	record, err := a.conf.Server().BuildRecord(upload, credentialIdentifier, clientIdentity)
+	if err != nil {
+		return err
+	}
+
+	return a.store.Put(record)
+}
+
+// Reregister is like Register, but replaces the record already stored for the credential identifier, if any, e.g. for
+// a password change.
+func (a *Authenticator) Reregister(credentialIdentifier, clientIdentity, upload []byte) error {
+	record, err := a.conf.Server().BuildRecord(upload, credentialIdentifier, clientIdentity)
+	if err != nil {
+		return err
+	}
+
+	return a.store.Replace(record)
+}
+
+// LoginInit looks up the record for the credential identifier and returns the KE2 response to ke1, and the server
+// state to give to LoginFinish. If no record is stored for the credential identifier, the login runs with a fake
+// record, so that the response doesn't reveal whether the client exists, and fails in the client and in LoginFinish.
+func (a *Authenticator) LoginInit(credentialIdentifier []byte, ke1 *message.KE1) (ke2 *message.KE2, state []byte,
+	err error) {
+	record, err := a.store.Get(credentialIdentifier)
+	if err != nil && !errors.Is(err, ErrRecordNotFound) {
+		return nil, nil, err
+	}
+
+	server := a.conf.Server()
+	record = server.RecordOrFake(record, credentialIdentifier, a.keys.OprfSeed)
+
+	ke2, err = server.Init(ke1, a.serverIdentity, a.keys.SecretKey, a.keys.PublicKey, a.keys.OprfSeed, record)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ke2, server.SerializeState(), nil
+}
+
+// LoginFinish authenticates the client's ke3 against the state returned by LoginInit, and returns the session key.
+func (a *Authenticator) LoginFinish(state []byte, ke3 *message.KE3) (sessionKey []byte, err error) {
+	server := a.conf.Server()
+
+	if err = server.SetAKEState(state); err != nil {
+		return nil, err
+	}
+
+	return server.FinishSession(ke3)
+}
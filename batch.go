@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bytemare/opaque/internal/ake"
+	"github.com/bytemare/opaque/internal/envelope"
+	"github.com/bytemare/opaque/message"
+)
+
+// ErrBatchLength indicates that the inputs of a batch operation don't have the same number of entries.
+var ErrBatchLength = errors.New("batch length mismatch")
+
+// BatchState holds the client state of a batch registration, pairing each blind with its password.
+type BatchState struct {
+	clients []*Client
+}
+
+// Len returns the number of registrations in the batch.
+func (b *BatchState) Len() int {
+	return len(b.clients)
+}
+
+// RegistrationInitBatch blinds all passwords, and returns the RegistrationRequest messages in the same order and the
+// state to be given to RegistrationFinalizeBatch. It returns ErrInputTooLong with the index of the entry if a password
+// exceeds the configuration's MaxInputLength.
+func (c *Client) RegistrationInitBatch(passwords [][]byte) ([]*message.RegistrationRequest, *BatchState, error) {
+	for i, password := range passwords {
+		if err := c.checkInputLength(password); err != nil {
+			return nil, nil, fmt.Errorf("batch entry %d: %w", i, err)
+		}
+	}
+
+	state := &BatchState{clients: make([]*Client, len(passwords))}
+	requests := make([]*message.RegistrationRequest, len(passwords))
+
+	for i, password := range passwords {
+		state.clients[i] = &Client{
+			Core:       envelope.New(c.OPRF, c.OPRFDomainSeparation),
+			Ake:        ake.NewClient(),
+			Parameters: c.Parameters,
+			mode:       c.mode,
+		}
+		requests[i] = state.clients[i].RegistrationInit(password)
+	}
+
+	return requests, state, nil
+}
+
+// RegistrationFinalizeBatch returns the RegistrationUpload messages and export keys for the responses to the requests
+// of RegistrationInitBatch, which must be in the same order. clientSecretKeys can be nil for the internal mode.
+func (c *Client) RegistrationFinalizeBatch(state *BatchState, clientSecretKeys [][]byte, creds []*Credentials,
+	responses []*message.RegistrationResponse) (uploads []*message.RegistrationUpload, exportKeys [][]byte, err error) {
+	n := state.Len()
+	if len(creds) != n || len(responses) != n || (clientSecretKeys != nil && len(clientSecretKeys) != n) {
+		return nil, nil, ErrBatchLength
+	}
+
+	uploads = make([]*message.RegistrationUpload, n)
+	exportKeys = make([][]byte, n)
+
+	for i, client := range state.clients {
+		var sk []byte
+		if clientSecretKeys != nil {
+			sk = clientSecretKeys[i]
+		}
+
+		uploads[i], exportKeys[i], err = client.RegistrationFinalize(sk, creds[i], responses[i])
+		if err != nil {
+			return nil, nil, fmt.Errorf("batch entry %d: %w", i, err)
+		}
+	}
+
+	return uploads, exportKeys, nil
+}
+
+// RegistrationResponseBatch returns the RegistrationResponse messages to the requests, in the same order, with the
+// credential identifiers and OPRF seeds at the same indexes. It stops at the first failure, and returns its error with
+// the index of the entry. Each entry costs as much as a call to RegistrationResponse, since its OPRF key is derived from
+// its own credential identifier: the batch only saves the caller the loop and the error bookkeeping.
+func (s *Server) RegistrationResponseBatch(requests []*message.RegistrationRequest, serverPublicKey []byte,
+	credentialIdentifiers, oprfSeeds [][]byte) ([]*message.RegistrationResponse, error) {
+	if s.verifier {
+		return nil, ErrVerifierOnly
+	}
+
+	if len(credentialIdentifiers) != len(requests) || len(oprfSeeds) != len(requests) {
+		return nil, ErrBatchLength
+	}
+
+	responses := make([]*message.RegistrationResponse, len(requests))
+
+	for i, req := range requests {
+		resp, err := s.RegistrationResponse(req, serverPublicKey, credentialIdentifiers[i], oprfSeeds[i])
+		if err != nil {
+			return nil, fmt.Errorf("batch entry %d: %w", i, err)
+		}
+
+		responses[i] = resp
+	}
+
+	return responses, nil
+}
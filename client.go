@@ -9,6 +9,7 @@
 package opaque
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 
@@ -27,6 +28,35 @@ var (
 
 	// errInvalidPKS happens when the server sends an invalid public key on registration.
 	errInvalidPKS = errors.New("invalid server public key")
+
+	// ErrOPRFProofInvalid indicates that, in the verifiable OPRF mode, the server's proof of the OPRF evaluation does
+	// not verify.
+	ErrOPRFProofInvalid = errors.New("invalid OPRF proof")
+
+	// ErrOPRFKeyNotPinned indicates that, in the verifiable OPRF mode, the client logs in without a pinned OPRF public
+	// key to verify the server's proof against.
+	ErrOPRFKeyNotPinned = errors.New("no pinned OPRF public key")
+
+	// ErrOPRFKeyMismatch indicates that, in the verifiable OPRF mode, the server's OPRF public key is not the pinned one.
+	ErrOPRFKeyMismatch = errors.New("OPRF public key doesn't match the pinned key")
+
+	// ErrDeterministicKeyMode indicates that a deterministic client key is requested in a mode other than external.
+	ErrDeterministicKeyMode = errors.New("deterministic client keys require the external mode")
+
+	// ErrAppContextNotBound indicates that credentials hold an AppContext, but the configuration doesn't bind it.
+	ErrAppContextNotBound = errors.New("application context requires Configuration.BindAppContext")
+
+	// ErrNoExportKey indicates that an application key is requested before a successful registration or login.
+	ErrNoExportKey = errors.New("no export key")
+
+	// ErrNoBlind indicates that the OPRF is finalized before Init or RegistrationInit blinded a password.
+	ErrNoBlind = errors.New("no OPRF blind: Init or RegistrationInit was not called")
+
+	// ErrInputTooLong indicates that a password is longer than the configuration's MaxInputLength.
+	ErrInputTooLong = errors.New("input exceeds the maximum length")
+
+	// errAppKeyLength happens when the requested application key length is out of the KDF's range.
+	errAppKeyLength = errors.New("invalid application key length")
 )
 
 // Client represents an OPAQUE Client, exposing its functions and holding its state.
@@ -35,56 +65,150 @@ type Client struct {
 	Ake  *ake.Client
 	Ke1  *message.KE1
 	*internal.Parameters
-	mode envelope.Mode
+	mode          envelope.Mode
+	exportKey     []byte
+	oprfPublicKey []byte
+	inputErr      error
 }
 
-// NewClient returns a new Client instantiation given the application Configuration.
+// NewClient returns a new Client instantiation given the application Configuration. The Client uses a snapshot of the
+// configuration, so later changes to it don't affect the Client, but it must not be modified concurrently.
 func NewClient(p *Configuration) *Client {
 	if p == nil {
 		p = DefaultConfiguration()
 	}
 
+	p = p.Clone()
 	ip := p.toInternal()
 
 	return &Client{
-		Core:       envelope.New(ip.OPRF),
+		Core:       envelope.New(ip.OPRF, ip.OPRFDomainSeparation),
 		Ake:        ake.NewClient(),
 		Parameters: ip,
 		mode:       envelope.Mode(p.Mode),
 	}
 }
 
+// NewClientErr is like NewClient, but returns an error naming the invalid field if the configuration doesn't pass
+// Validate().
+func NewClientErr(p *Configuration) (*Client, error) {
+	if p != nil {
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewClient(p), nil
+}
+
 // KeyGen returns a key pair in the AKE group. It can then be used for the external mode.
 func (c *Client) KeyGen() (secretKey, publicKey []byte) {
-	return ake.KeyGen(c.Group)
+	return ake.KeyGen(c.AKEGroup)
+}
+
+// checkInputLength returns ErrInputTooLong if the password exceeds the configuration's MaxInputLength.
+func (c *Client) checkInputLength(password []byte) error {
+	if c.MaxInputLength > 0 && len(password) > c.MaxInputLength {
+		return fmt.Errorf("%w: %d bytes, maximum is %d", ErrInputTooLong, len(password), c.MaxInputLength)
+	}
+
+	return nil
+}
+
+// blind blinds the password. If it exceeds the configuration's MaxInputLength, an empty password is blinded instead,
+// so that the message is well-formed without hashing the input, and the error is returned by the next finalization. If
+// the configuration sets a randomness source, a new blind is sampled from it.
+func (c *Client) blind(password []byte) []byte {
+	if c.inputErr = c.checkInputLength(password); c.inputErr != nil {
+		password = nil
+	}
+
+	if c.Rand != nil {
+		c.Core.Oprf.SetBlind(c.RandomScalar(c.OPRFGroup))
+	}
+
+	return c.Core.OprfStart(password)
 }
 
-// RegistrationInit returns a RegistrationRequest message blinding the given password.
+// RegistrationInit returns a RegistrationRequest message blinding the given password. If the password exceeds the
+// configuration's MaxInputLength, RegistrationFinalize returns ErrInputTooLong.
 func (c *Client) RegistrationInit(password []byte) *message.RegistrationRequest {
-	m := c.Core.OprfStart(password)
-	return &message.RegistrationRequest{Data: m}
+	return &message.RegistrationRequest{Data: c.blind(password)}
 }
 
 // RegistrationFinalize returns a RegistrationUpload message given the server's RegistrationResponse and credentials. If
 // the envelope mode is internal, then clientSecretKey is ignored and can be set to nil. For the external
-// mode, clientSecretKey must be the client's private key for the AKE.
+// modes, clientSecretKey must be the client's private key for the AKE.
 func (c *Client) RegistrationFinalize(clientSecretKey []byte, creds *Credentials,
 	resp *message.RegistrationResponse) (upload *message.RegistrationUpload, exportKey []byte, err error) {
-	creds2 := &envelope.Credentials{
-		Idc:           creds.Client,
-		Ids:           creds.Server,
-		EnvelopeNonce: creds.TestEnvNonce,
-		MaskingNonce:  creds.TestMaskNonce,
+	return c.registrationFinalize(nil, clientSecretKey, creds, resp, false)
+}
+
+// RegistrationFinalizeDeterministic is like RegistrationFinalize in the external mode, but derives the client's AKE
+// key pair from the randomized password (i.e. the OPRF output), so that the caller doesn't manage a separate secret key.
+// Registering the same password with the same server OPRF key yields the same client public key. It returns
+// ErrDeterministicKeyMode if the configuration doesn't use the external mode.
+func (c *Client) RegistrationFinalizeDeterministic(creds *Credentials,
+	resp *message.RegistrationResponse) (upload *message.RegistrationUpload, exportKey []byte, err error) {
+	if c.mode != envelope.External {
+		return nil, nil, ErrDeterministicKeyMode
 	}
 
-	// this check is very important: it verifies the server's public key validity in the group.
-	if _, err = c.Group.NewElement().Decode(resp.Pks); err != nil {
-		return nil, nil, fmt.Errorf("%s : %w", errInvalidPKS, err)
+	return c.registrationFinalize(nil, nil, creds, resp, true)
+}
+
+// registrationFinalize finalizes the OPRF, hardens its output, and builds the envelope. If deterministic is set, the
+// client secret key is derived from the randomized password.
+func (c *Client) registrationFinalize(i interrupt, clientSecretKey []byte, creds *Credentials,
+	resp *message.RegistrationResponse, deterministic bool) (upload *message.RegistrationUpload, exportKey []byte,
+	err error) {
+	if c.inputErr != nil {
+		return nil, nil, c.inputErr
+	}
+
+	creds2, err := c.checkRegistrationResponse(creds, resp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = i.check(); err != nil {
+		return nil, nil, err
 	}
 
-	envU, clientPublicKey, maskingKey, exportKey, err := c.Core.BuildEnvelope(c.Parameters, c.mode, resp.Data, resp.Pks, clientSecretKey, creds2)
+	unblinded, err := c.Core.OprfFinalize(resp.Data)
 	if err != nil {
-		return nil, nil, fmt.Errorf("building envelope: %w", err)
+		return nil, nil, stageError(StageOPRF, "building envelope: finalizing OPRF ", err)
+	}
+
+	if err = i.check(); err != nil {
+		c.Wipe(unblinded)
+		return nil, nil, err
+	}
+
+	randomizedPwd := envelope.BuildPRK(c.Parameters, unblinded)
+	c.Wipe(unblinded)
+
+	if err = i.check(); err != nil {
+		c.Wipe(randomizedPwd)
+		return nil, nil, err
+	}
+
+	c.WipeScalar(c.Core.Oprf.GetBlind())
+
+	if deterministic {
+		clientSecretKey = envelope.DeriveClientSecretKey(c.Parameters, randomizedPwd)
+	}
+
+	envU, clientPublicKey, maskingKey, exportKey, err := envelope.BuildEnvelope(c.Parameters, c.mode, randomizedPwd,
+		resp.Pks, clientSecretKey, creds2)
+	if err != nil {
+		return nil, nil, stageError(StageEnvelope, "building envelope", err)
+	}
+
+	c.exportKey = exportKey
+
+	if c.VerifiableOPRF && c.oprfPublicKey == nil {
+		c.oprfPublicKey = resp.OprfPublicKey
 	}
 
 	return &message.RegistrationUpload{
@@ -94,29 +218,123 @@ func (c *Client) RegistrationFinalize(clientSecretKey []byte, creds *Credentials
 	}, exportKey, nil
 }
 
+// checkRegistrationResponse validates the credentials and the server's RegistrationResponse, and returns the
+// credentials for the envelope.
+func (c *Client) checkRegistrationResponse(creds *Credentials,
+	resp *message.RegistrationResponse) (*envelope.Credentials, error) {
+	ids := creds.Server
+	if ids == nil {
+		ids = c.ServerIdentity
+	}
+
+	if c.RequireExplicitIdentities && (creds.Client == nil || ids == nil) {
+		return nil, ErrMissingIdentity
+	}
+
+	if creds.AppContext != nil && !c.BindAppContext {
+		return nil, ErrAppContextNotBound
+	}
+
+	// this check is very important: it verifies the server's public key validity in the group.
+	if _, err := encoding.DecodePoint(c.AKEGroup, resp.Pks); err != nil {
+		return nil, fmt.Errorf("%s : %w", errInvalidPKS, err)
+	}
+
+	if err := c.verifyOPRF(resp.OprfPublicKey, resp.Data, resp.Proof, false); err != nil {
+		return nil, err
+	}
+
+	return &envelope.Credentials{
+		Idc:           creds.Client,
+		Ids:           ids,
+		AppContext:    creds.AppContext,
+		EnvelopeNonce: creds.TestEnvNonce,
+		MaskingNonce:  creds.TestMaskNonce,
+	}, nil
+}
+
+// verifyOPRF verifies the server's proof of OPRF evaluation in the verifiable mode against the pinned OPRF public key,
+// and is a no-op otherwise. If no key is pinned, the login fails, and the registration verifies the proof against the
+// server's key, which it pins once it succeeds.
+func (c *Client) verifyOPRF(oprfPublicKey, evaluated, proof []byte, login bool) error {
+	if !c.VerifiableOPRF {
+		return nil
+	}
+
+	pinned := c.oprfPublicKey
+	if pinned == nil {
+		if login {
+			return ErrOPRFKeyNotPinned
+		}
+
+		pinned = oprfPublicKey
+	}
+
+	if !bytes.Equal(oprfPublicKey, pinned) {
+		return ErrOPRFKeyMismatch
+	}
+
+	if err := c.Core.Oprf.VerifyProof(pinned, evaluated, proof); err != nil {
+		return ErrOPRFProofInvalid
+	}
+
+	return nil
+}
+
+// SetOPRFPublicKey pins the OPRF public key the server committed to for this client, e.g. as returned by
+// OPRFPublicKey after the registration, or distributed out of band. In the verifiable OPRF mode, the proofs of the
+// server are verified against it, a server using another key is rejected with ErrOPRFKeyMismatch, and the login fails
+// with ErrOPRFKeyNotPinned if no key is pinned. A registration without a pinned key pins the server's key.
+func (c *Client) SetOPRFPublicKey(key []byte) {
+	c.oprfPublicKey = cloneBytes(key)
+}
+
+// OPRFPublicKey returns the pinned OPRF public key, i.e. the one set with SetOPRFPublicKey or pinned by the
+// registration, or nil if none is. It must be stored with the client's credentials to be pinned for the logins.
+func (c *Client) OPRFPublicKey() []byte {
+	return c.oprfPublicKey
+}
+
 // Init initiates the authentication process, returning a KE1 message blinding the given password.
-// clientInfo is optional client information sent in clear, and only authenticated in KE3.
+// clientInfo is optional client information sent in clear, and only authenticated in KE3. If the password exceeds the
+// configuration's MaxInputLength, Finish returns ErrInputTooLong.
 func (c *Client) Init(password []byte) *message.KE1 {
-	m := c.Core.OprfStart(password)
-	credReq := &cred.CredentialRequest{Data: encoding.PadPoint(m, c.Group)}
-	c.Ke1 = c.Ake.Start(c.Group)
+	credReq := &cred.CredentialRequest{Data: encoding.PadPoint(c.blind(password), c.OPRFGroup)}
+	c.Ke1 = c.Ake.Start(c.Parameters)
 	c.Ke1.CredentialRequest = credReq
 
 	return c.Ke1
 }
 
+// OprfFinalize unblinds the server's evaluation of the password blinded by the last call to Init or RegistrationInit,
+// and returns the OPRF output, i.e. the input to the password hardening. It is meant for applications driving the OPRF
+// step on their own, e.g. over a custom transport, and returns ErrNoBlind if no password was blinded yet. It doesn't
+// verify the server's proof in the verifiable mode, nor change the state of the client.
+func (c *Client) OprfFinalize(evaluated []byte) ([]byte, error) {
+	if c.Core.Oprf.GetBlind() == nil {
+		return nil, ErrNoBlind
+	}
+
+	if c.inputErr != nil {
+		return nil, c.inputErr
+	}
+
+	output, err := c.Core.OprfFinalize(evaluated)
+	if err != nil {
+		return nil, stageError(StageOPRF, "finalizing OPRF ", err)
+	}
+
+	return output, nil
+}
+
 // unmask assumes that maskedResponse has been checked to be of length pointLength + envelope size.
 func (c *Client) unmask(maskingNonce, maskingKey, maskedResponse []byte) ([]byte, *envelope.Envelope) {
 	clear := c.MaskResponse(maskingKey, maskingNonce, maskedResponse)
-	serverPublicKey := clear[:encoding.PointLength[c.Group]]
-	e := clear[encoding.PointLength[c.Group]:]
+	serverPublicKey := clear[:c.AkePointLength]
+	e := clear[c.AkePointLength:]
 
 	// Deserialize
-	innerLen := 0
-
-	if c.mode == envelope.External {
-		innerLen = encoding.ScalarLength[c.Group]
-	}
+	innerLen := c.EnvelopeSize - c.NonceLen - c.MAC.Size()
 
 	env := &envelope.Envelope{
 		Nonce:         e[:c.NonceLen],
@@ -128,28 +346,95 @@ func (c *Client) unmask(maskingNonce, maskingKey, maskedResponse []byte) ([]byte
 }
 
 // Finish returns a KE3 message given the server's KE2 response message and the identities. If the idc
-// or ids parameters are nil, the client and server's public keys are taken as identities for both.
-func (c *Client) Finish(idc, ids []byte, ke2 *message.KE2) (ke3 *message.KE3, exportKey []byte, err error) {
+// or ids parameters are nil, the client and server's public keys are taken as identities for both, unless the
+// configuration requires explicit identities. A nil ids defaults to the configuration's ServerIdentity, if set.
+//
+// If aad is given, the KE3's MAC is bound to it, e.g. to a hash of the application request carrying the KE3, and the
+// server must give the same aad, in the same order, to Server.Finish.
+func (c *Client) Finish(idc, ids []byte, ke2 *message.KE2,
+	aad ...[]byte) (ke3 *message.KE3, exportKey []byte, err error) {
+	return c.finish(nil, idc, ids, nil, ke2, aad)
+}
+
+// FinishWithCredentials is the same as Finish, but takes the identities and the application context from creds, which
+// must hold the same AppContext as in the registration.
+func (c *Client) FinishWithCredentials(creds *Credentials,
+	ke2 *message.KE2) (ke3 *message.KE3, exportKey []byte, err error) {
+	if creds.AppContext != nil && !c.BindAppContext {
+		return nil, nil, ErrAppContextNotBound
+	}
+
+	return c.finish(nil, creds.Client, creds.Server, creds.AppContext, ke2, nil)
+}
+
+// finish recovers the envelope and finalizes the AKE, binding the KE3's MAC to the additional authenticated data if any.
+func (c *Client) finish(i interrupt, idc, ids, appContext []byte, ke2 *message.KE2,
+	aad [][]byte) (ke3 *message.KE3, exportKey []byte, err error) {
+	if c.inputErr != nil {
+		return nil, nil, c.inputErr
+	}
+
+	if ids == nil {
+		ids = c.ServerIdentity
+	}
+
+	if c.RequireExplicitIdentities && (idc == nil || ids == nil) {
+		return nil, nil, ErrMissingIdentity
+	}
+
+	if err = c.verifyOPRF(ke2.OprfPublicKey, ke2.Data, ke2.Proof, true); err != nil {
+		return nil, nil, err
+	}
+
+	if err = i.check(); err != nil {
+		return nil, nil, err
+	}
+
 	unblinded, err := c.Core.OprfFinalize(ke2.Data)
 	if err != nil {
-		return nil, nil, fmt.Errorf("finalizing OPRF : %w", err)
+		return nil, nil, stageError(StageOPRF, "finalizing OPRF ", err)
 	}
 
 	// This test is very important as it avoids buffer overflows in subsequent parsing.
-	if len(ke2.MaskedResponse) != encoding.PointLength[c.Group]+c.EnvelopeSize {
+	if len(ke2.MaskedResponse) != c.AkePointLength+c.EnvelopeSize {
 		return nil, nil, errInvalidMaskedLength
 	}
 
+	if err = i.check(); err != nil {
+		c.Wipe(unblinded)
+		return nil, nil, err
+	}
+
 	randomizedPwd := envelope.BuildPRK(c.Parameters, unblinded)
+	c.Wipe(unblinded)
+
+	if err = i.check(); err != nil {
+		c.Wipe(randomizedPwd)
+		return nil, nil, err
+	}
+
 	maskingKey := c.KDF.Expand(randomizedPwd, []byte(tag.MaskingKey), c.Hash.Size())
 
 	serverPublicKey, env := c.unmask(ke2.MaskingNonce, maskingKey, ke2.MaskedResponse)
 
 	m := &envelope.Mailer{Parameters: c.Parameters}
 
-	clientSecretKey, clientPublicKey, exportKey, err := m.RecoverEnvelope(c.mode, randomizedPwd, serverPublicKey, idc, ids, env)
+	clientSecretKey, clientPublicKey, exportKey, err := m.RecoverEnvelope(c.mode, randomizedPwd, serverPublicKey, idc, ids, appContext,
+		env)
+	c.Wipe(randomizedPwd, maskingKey)
+
+	if err == nil {
+		// This is the last check: the AKE then changes the state of the client.
+		if err = i.check(); err != nil {
+			c.WipeScalar(clientSecretKey)
+			return nil, nil, err
+		}
+	}
+
+	c.WipeScalar(c.Core.Oprf.GetBlind())
+
 	if err != nil {
-		return nil, nil, fmt.Errorf("recover envelope: %w", err)
+		return nil, nil, stageError(StageEnvelope, "recover envelope", err)
 	}
 
 	if idc == nil {
@@ -161,16 +446,124 @@ func (c *Client) Finish(idc, ids []byte, ke2 *message.KE2) (ke3 *message.KE3, ex
 	}
 
 	ke3, err = c.Ake.Finalize(c.Parameters, idc, clientSecretKey, ids, serverPublicKey, c.Ke1, ke2)
+	c.WipeScalar(clientSecretKey)
+
 	if err != nil {
-		return nil, nil, fmt.Errorf(" AKE finalization: %w", err)
+		return nil, nil, stageError(StageAKE, " AKE finalization", err)
 	}
 
+	ke3.Mac = ake.BindAAD(c.Parameters, ke3.Mac, aad)
+	c.exportKey = exportKey
+
 	return ke3, exportKey, nil
 }
 
-// SessionKey returns the session key if the previous call to Finish() was successful.
+// clientNonceLength is the length of the client nonce in KE1.
+const clientNonceLength = 32
+
+// InitWithState is like Init, but also returns the client state, so that Finish can run on another Client instance
+// with FinishWithState. The state holds the OPRF blind and the AKE ephemeral secret key, which are as sensitive as the
+// password: it must be kept secret, and discarded after use. It returns ErrInputTooLong if the password exceeds the
+// configuration's MaxInputLength.
+func (c *Client) InitWithState(password []byte) (ke1 *message.KE1, state []byte, err error) {
+	if err = c.checkInputLength(password); err != nil {
+		return nil, nil, err
+	}
+
+	ke1 = c.Init(password)
+	state = encoding.Concat3(
+		encoding.SerializeScalar(c.Core.Oprf.GetBlind(), c.OPRFGroup),
+		encoding.SerializeScalar(c.Ake.EphemeralSecretKey(), c.AKEGroup),
+		c.Ake.NonceU)
+
+	return ke1, state, nil
+}
+
+// FinishWithState restores the client state returned by InitWithState for the same password, and then returns the
+// result of Finish, binding the KE3 to the additional authenticated data if any. It returns ErrInvalidState if the
+// state is malformed.
+func (c *Client) FinishWithState(state, password, idc, ids []byte, ke2 *message.KE2,
+	aad ...[]byte) (ke3 *message.KE3, exportKey []byte, err error) {
+	if err = c.setState(state, password); err != nil {
+		return nil, nil, err
+	}
+
+	return c.Finish(idc, ids, ke2, aad...)
+}
+
+func (c *Client) setState(state, password []byte) error {
+	blindLength := encoding.ScalarLength[c.OPRFGroup]
+	eskLength := encoding.ScalarLength[c.AKEGroup]
+
+	if len(state) != blindLength+eskLength+clientNonceLength {
+		return ErrInvalidState
+	}
+
+	if c.inputErr = c.checkInputLength(password); c.inputErr != nil {
+		return c.inputErr
+	}
+
+	blind, err := c.OPRFGroup.NewScalar().Decode(state[:blindLength])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+
+	esk, err := c.AKEGroup.NewScalar().Decode(state[blindLength : blindLength+eskLength])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+
+	c.Core.Oprf.SetBlind(blind)
+	m := c.Core.OprfStart(password)
+
+	c.Ake.SetValues(c.AKEGroup, esk, nil, clientNonceLength)
+	c.Ake.NonceU = state[blindLength+eskLength:]
+	c.Ke1 = c.Ake.Start(c.Parameters)
+	c.Ke1.CredentialRequest = &cred.CredentialRequest{Data: encoding.PadPoint(m, c.OPRFGroup)}
+
+	return nil
+}
+
+// ExportKey returns the export key computed by the last successful call to RegistrationFinalize() or Finish(), or nil
+// if there was none.
+func (c *Client) ExportKey() []byte {
+	return c.exportKey
+}
+
+// DeriveAppKey returns a key of length bytes expanded from the export key with the configured KDF and bound to label,
+// so that an application can derive several independent keys, e.g. one for file encryption and one for backups.
+// Labels are length-prefixed, so distinct labels never collide. It returns ErrNoExportKey if there was no successful
+// call to RegistrationFinalize() or Finish(), and an error if length is not between 1 and 255 times the KDF's output
+// size.
+func (c *Client) DeriveAppKey(label []byte, length int) ([]byte, error) {
+	if c.exportKey == nil {
+		return nil, ErrNoExportKey
+	}
+
+	if length <= 0 || length > 255*c.KDF.Size() {
+		return nil, fmt.Errorf("%w %d", errAppKeyLength, length)
+	}
+
+	info := encoding.Concat([]byte(tag.AppKey), encoding.EncodeVector(label))
+
+	return c.KDF.Expand(c.exportKey, info, length), nil
+}
+
+// SessionKey returns a copy of the session key if the previous call to Finish() was successful, and nil otherwise.
 func (c *Client) SessionKey() []byte {
-	return c.Ake.SessionKey()
+	return append([]byte(nil), c.Ake.SessionKey()...)
+}
+
+// SessionKeyFor returns a key derived from the session key and bound to purpose, so that independent subsystems
+// don't share the same key. The server derives the same key for the same purpose. It returns nil if the previous call
+// to Finish() was not successful.
+func (c *Client) SessionKeyFor(purpose []byte) []byte {
+	return ake.PurposeKey(c.KDF, c.Ake.SessionKey(), purpose)
+}
+
+// TranscriptInputs returns the components of the AKE transcript if the previous call to Finish() was successful.
+func (c *Client) TranscriptInputs() *message.TranscriptInputs {
+	return c.Ake.Transcript()
 }
 
 // DeserializeKE1 takes a serialized KE1 message and returns a deserialized KE1 structure.
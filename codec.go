@@ -0,0 +1,30 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import "github.com/bytemare/opaque/internal"
+
+// The Client and the Server write and read the messages with the configuration's Codec using their Encode and Decode
+// functions, e.g. EncodeKE1 and DecodeKE1. The Decode functions validate the messages as the Deserialize functions do.
+
+// ErrInvalidCBOR indicates that a message decoded with CBORCodec isn't a CBOR map of the expected fields.
+var ErrInvalidCBOR = internal.ErrInvalidCBOR
+
+// Codec encodes and decodes the protocol messages for a transport, as their ordered fields.
+type Codec = internal.Codec
+
+// MessageField is a field of a protocol message given to a Codec, named after its JSON key.
+type MessageField = internal.MessageField
+
+// RawCodec is the default Codec, which writes the same bytes as Serialize, and reads exactly the length of the message
+// in the configuration.
+type RawCodec = internal.RawCodec
+
+// CBORCodec is a Codec encoding a message as a CBOR map from its field names to byte strings.
+type CBORCodec = internal.CBORCodec
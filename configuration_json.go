@@ -0,0 +1,168 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/bytemare/cryptotools/hash"
+	"github.com/bytemare/cryptotools/mhf"
+)
+
+var errUnknownName = errors.New("unknown")
+
+// These names are part of the JSON encoding of a Configuration, and must not change.
+var (
+	groupNames = map[byte]string{
+		byte(RistrettoSha512):    "RistrettoSha512",
+		byte(P256Sha256):         "P256Sha256",
+		byte(P384Sha512):         "P384Sha512",
+		byte(P521Sha512):         "P521Sha512",
+		byte(Curve25519Sha512):   "Curve25519Sha512",
+		byte(Edwards25519Sha512): "Edwards25519Sha512",
+	}
+
+	hashNames = map[byte]string{
+		byte(hash.SHA256):   "SHA256",
+		byte(hash.SHA512):   "SHA512",
+		byte(hash.SHA3_256): "SHA3-256",
+		byte(hash.SHA3_512): "SHA3-512",
+	}
+
+	mhfNames = map[byte]string{
+		byte(mhf.Argon2id):     "argon2id",
+		byte(mhf.Scrypt):       "scrypt",
+		byte(mhf.PBKDF2Sha512): "pbkdf2-sha512",
+		byte(mhf.Bcrypt):       "bcrypt",
+	}
+
+	modeNames = map[byte]string{
+		byte(Internal):     "internal",
+		byte(External):     "external",
+		byte(ExternalAEAD): "external-aead",
+	}
+)
+
+func nameOf(kind string, names map[byte]string, value byte) (string, error) {
+	name, ok := names[value]
+	if !ok {
+		return "", fmt.Errorf("%w %s %d", errUnknownName, kind, value)
+	}
+
+	return name, nil
+}
+
+func valueOf(kind string, names map[byte]string, name string) (byte, error) {
+	for value, n := range names {
+		if n == name {
+			return value, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w %s %q", errUnknownName, kind, name)
+}
+
+// String returns the name of the group.
+func (g Group) String() string {
+	if name, ok := groupNames[byte(g)]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Group(%d)", byte(g))
+}
+
+// String returns the name of the mode.
+func (m Mode) String() string {
+	if name, ok := modeNames[byte(m)]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Mode(%d)", byte(m))
+}
+
+type configuration Configuration
+
+// configurationJSON shadows the enum fields of Configuration with their names.
+type configurationJSON struct {
+	*configuration
+	OPRFGroup string `json:"oprf"`
+	AKEGroup  string `json:"ake"`
+	KDF       string `json:"kdf"`
+	MAC       string `json:"mac"`
+	Hash      string `json:"hash"`
+	MHF       string `json:"mhf"`
+	Mode      string `json:"mode"`
+}
+
+// MarshalJSON encodes the Configuration to JSON, with names instead of numbers for the group, hash functions, MHF,
+// and mode.
+func (c *Configuration) MarshalJSON() ([]byte, error) {
+	aux := &configurationJSON{configuration: (*configuration)(c)}
+	fields := []struct {
+		kind  string
+		names map[byte]string
+		value byte
+		name  *string
+	}{
+		{"OPRF group", groupNames, byte(c.OPRFGroup), &aux.OPRFGroup},
+		{"AKE group", groupNames, byte(c.AKEGroup), &aux.AKEGroup},
+		{"KDF", hashNames, byte(c.KDF), &aux.KDF},
+		{"MAC", hashNames, byte(c.MAC), &aux.MAC},
+		{"Hash", hashNames, byte(c.Hash), &aux.Hash},
+		{"MHF", mhfNames, byte(c.MHF), &aux.MHF},
+		{"mode", modeNames, byte(c.Mode), &aux.Mode},
+	}
+
+	for _, f := range fields {
+		name, err := nameOf(f.kind, f.names, f.value)
+		if err != nil {
+			return nil, err
+		}
+
+		*f.name = name
+	}
+
+	return json.Marshal(aux)
+}
+
+// UnmarshalJSON decodes a Configuration encoded with MarshalJSON, and returns an error on unknown names.
+func (c *Configuration) UnmarshalJSON(data []byte) error {
+	aux := &configurationJSON{configuration: (*configuration)(c)}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+
+	fields := []struct {
+		kind  string
+		names map[byte]string
+		name  string
+		value *byte
+	}{
+		{"OPRF group", groupNames, aux.OPRFGroup, (*byte)(&c.OPRFGroup)},
+		{"AKE group", groupNames, aux.AKEGroup, (*byte)(&c.AKEGroup)},
+		{"KDF", hashNames, aux.KDF, (*byte)(&c.KDF)},
+		{"MAC", hashNames, aux.MAC, (*byte)(&c.MAC)},
+		{"Hash", hashNames, aux.Hash, (*byte)(&c.Hash)},
+		{"MHF", mhfNames, aux.MHF, (*byte)(&c.MHF)},
+		{"mode", modeNames, aux.Mode, (*byte)(&c.Mode)},
+	}
+
+	for _, f := range fields {
+		value, err := valueOf(f.kind, f.names, f.name)
+		if err != nil {
+			return err
+		}
+
+		*f.value = value
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import (
+	"context"
+
+	"github.com/bytemare/opaque/message"
+)
+
+// interrupt is called between the stages of the registration and login, to stop them early with its error. The last
+// call precedes any change to the state of the client or the server, so that an interrupted call leaves them as they
+// were. It is nil outside of the Context variants.
+type interrupt func() error
+
+func (i interrupt) check() error {
+	if i == nil {
+		return nil
+	}
+
+	return i()
+}
+
+// The password hardening can't be interrupted once started, so the following variants check ctx between the stages,
+// i.e. before and after the OPRF and the password hardening, and return ctx.Err() if it is done. A call returning
+// ctx.Err() doesn't change the state of the client or the server, and can be retried.
+
+// RegistrationFinalizeContext is the same as RegistrationFinalize, but returns ctx.Err() if ctx is done.
+func (c *Client) RegistrationFinalizeContext(ctx context.Context, clientSecretKey []byte, creds *Credentials,
+	resp *message.RegistrationResponse) (upload *message.RegistrationUpload, exportKey []byte, err error) {
+	return c.registrationFinalize(ctx.Err, clientSecretKey, creds, resp, false)
+}
+
+// FinishContext is the same as Finish, but returns ctx.Err() if ctx is done.
+func (c *Client) FinishContext(ctx context.Context, idc, ids []byte, ke2 *message.KE2,
+	aad ...[]byte) (ke3 *message.KE3, exportKey []byte, err error) {
+	return c.finish(ctx.Err, idc, ids, nil, ke2, aad)
+}
+
+// InitContext is the same as Init, but returns ctx.Err() if ctx is done.
+func (s *Server) InitContext(ctx context.Context, ke1 *message.KE1, serverIdentity, serverSecretKey, serverPublicKey,
+	oprfSeed []byte, record *ClientRecord) (*message.KE2, error) {
+	return s.decodeAndInit(ctx.Err, ke1, serverIdentity, serverSecretKey, serverPublicKey, oprfSeed, record)
+}
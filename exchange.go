@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import (
+	"fmt"
+
+	"github.com/bytemare/opaque/internal/envelope"
+	"github.com/bytemare/opaque/message"
+)
+
+// Login runs the client side of a login for synchronous transports: it calls exchange with the KE1 message to send to
+// the server, which returns the server's KE2 response, and finishes the login on the same Client. It returns the KE3
+// message that must still be sent to the server, which only authenticates the client once it verified it, and the
+// session and export keys. creds holds the identities and application context as in FinishWithCredentials, and can be
+// nil to use the public keys as identities.
+func (c *Client) Login(password []byte, creds *Credentials,
+	exchange func(ke1 *message.KE1) (*message.KE2, error)) (ke3 *message.KE3, sessionKey, exportKey []byte, err error) {
+	if creds == nil {
+		creds = &Credentials{}
+	}
+
+	if err = c.checkInputLength(password); err != nil {
+		return nil, nil, nil, err
+	}
+
+	ke2, err := exchange(c.Init(password))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("login exchange: %w", err)
+	}
+
+	ke3, exportKey, err = c.FinishWithCredentials(creds, ke2)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return ke3, c.SessionKey(), exportKey, nil
+}
+
+type registerOptions struct {
+	clientSecretKey []byte
+}
+
+// RegisterOption configures Register.
+type RegisterOption func(*registerOptions)
+
+// WithClientSecretKey sets the client secret key to register in the external mode, instead of a generated one.
+func WithClientSecretKey(clientSecretKey []byte) RegisterOption {
+	return func(o *registerOptions) {
+		o.clientSecretKey = clientSecretKey
+	}
+}
+
+// Register runs the client side of a registration for synchronous transports: it calls exchange with the
+// RegistrationRequest to send to the server, which returns the server's RegistrationResponse, and finalizes the
+// registration on the same Client. It returns the RegistrationUpload to send to the server, and the export key. In the
+// external modes, a client key pair is generated unless a secret key is given with WithClientSecretKey, and it's
+// recovered from the envelope at login. creds can be nil to use the public keys as identities.
+func (c *Client) Register(password []byte, creds *Credentials,
+	exchange func(req *message.RegistrationRequest) (*message.RegistrationResponse, error),
+	options ...RegisterOption) (upload *message.RegistrationUpload, exportKey []byte, err error) {
+	o := &registerOptions{}
+	for _, option := range options {
+		option(o)
+	}
+
+	if creds == nil {
+		creds = &Credentials{}
+	}
+
+	if c.mode != envelope.Internal && o.clientSecretKey == nil {
+		o.clientSecretKey, _ = c.KeyGen()
+	}
+
+	if err = c.checkInputLength(password); err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := exchange(c.RegistrationInit(password))
+	if err != nil {
+		return nil, nil, fmt.Errorf("registration exchange: %w", err)
+	}
+
+	return c.RegistrationFinalize(o.clientSecretKey, creds, resp)
+}
@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bytemare/opaque/internal/encoding"
+)
+
+var (
+	// ErrUnknownForeignLayout indicates that the foreign record layout is not supported.
+	ErrUnknownForeignLayout = errors.New("unknown foreign record layout")
+
+	errForeignTrailingBytes = errors.New("trailing bytes after foreign record")
+)
+
+// ForeignLayout identifies the storage layout of a record created by another OPAQUE implementation.
+type ForeignLayout byte
+
+const (
+	// ForeignLayoutRFC is the record layout of the specification, client_public_key || masking_key || envelope, as
+	// stored by implementations that persist the registration upload as-is. The credential identifier and client
+	// identity are not part of it, and must be set on the returned record.
+	ForeignLayoutRFC ForeignLayout = iota + 1
+
+	// ForeignLayoutLengthPrefixed is the sequence of credential_identifier, client_identity, client_public_key,
+	// masking_key, and envelope, each prefixed with its 2-byte big-endian length.
+	ForeignLayoutLengthPrefixed
+)
+
+// ImportForeignRecord maps a record serialized by another OPAQUE implementation into a ClientRecord. The record must
+// have been created with the same configuration as the Server's, as the bytes are only re-framed and not converted.
+func (s *Server) ImportForeignRecord(layout ForeignLayout, data []byte) (*ClientRecord, error) {
+	switch layout {
+	case ForeignLayoutRFC:
+		return s.BuildRecord(data, nil, nil)
+	case ForeignLayoutLengthPrefixed:
+		return s.importLengthPrefixed(data)
+	default:
+		return nil, ErrUnknownForeignLayout
+	}
+}
+
+func (s *Server) importLengthPrefixed(data []byte) (*ClientRecord, error) {
+	fields := make([][]byte, 5)
+
+	for i := range fields {
+		field, n, err := encoding.DecodeVector(data)
+		if err != nil {
+			return nil, fmt.Errorf("foreign record field %d: %w", i, err)
+		}
+
+		fields[i] = field
+		data = data[n:]
+	}
+
+	if len(data) != 0 {
+		return nil, errForeignTrailingBytes
+	}
+
+	upload := encoding.Concatenate(fields[2], fields[3], fields[4])
+
+	return s.BuildRecord(upload, fields[0], fields[1])
+}
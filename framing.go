@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import (
+	"io"
+
+	"github.com/bytemare/opaque/internal"
+	"github.com/bytemare/opaque/internal/encoding"
+	"github.com/bytemare/opaque/message"
+)
+
+// The following functions read and write messages framed with a 2-byte big-endian length prefix, for stream
+// transports. The Read functions check the declared length against the expected length of the message in the
+// configuration before reading the message, and return a *MessageLengthError if they differ. A stream ending before
+// the end of a frame returns io.ErrUnexpectedEOF, and io.EOF is only returned if it ends before a frame starts.
+
+// frameHeaderLength is the length of the frame length prefix.
+const frameHeaderLength = 2
+
+func readFrame(r io.Reader, expected int) ([]byte, error) {
+	header := make([]byte, frameHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if length := encoding.OS2IP(header); length != expected {
+		return nil, &MessageLengthError{Expected: expected, Actual: length}
+	}
+
+	frame := make([]byte, expected)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+func writeFrame(w io.Writer, m []byte) error {
+	_, err := w.Write(encoding.Concat(encoding.I2OSP(len(m), frameHeaderLength), m))
+	return err
+}
+
+func framingParameters(conf *Configuration) *internal.Parameters {
+	if conf == nil {
+		conf = DefaultConfiguration()
+	}
+
+	return conf.toInternal()
+}
+
+// ReadRegistrationRequest reads a framed RegistrationRequest from r.
+func ReadRegistrationRequest(r io.Reader, conf *Configuration) (*message.RegistrationRequest, error) {
+	p := framingParameters(conf)
+
+	frame, err := readFrame(r, p.RegistrationRequestLength())
+	if err != nil {
+		return nil, err
+	}
+
+	return p.DeserializeRegistrationRequest(frame)
+}
+
+// WriteRegistrationRequest writes the framed RegistrationRequest to w.
+func WriteRegistrationRequest(w io.Writer, m *message.RegistrationRequest) error {
+	return writeFrame(w, m.Serialize())
+}
+
+// ReadRegistrationResponse reads a framed RegistrationResponse from r.
+func ReadRegistrationResponse(r io.Reader, conf *Configuration) (*message.RegistrationResponse, error) {
+	p := framingParameters(conf)
+
+	frame, err := readFrame(r, p.RegistrationResponseLength())
+	if err != nil {
+		return nil, err
+	}
+
+	return p.DeserializeRegistrationResponse(frame)
+}
+
+// WriteRegistrationResponse writes the framed RegistrationResponse to w.
+func WriteRegistrationResponse(w io.Writer, m *message.RegistrationResponse) error {
+	return writeFrame(w, m.Serialize())
+}
+
+// ReadRegistrationUpload reads a framed RegistrationUpload from r.
+func ReadRegistrationUpload(r io.Reader, conf *Configuration) (*message.RegistrationUpload, error) {
+	p := framingParameters(conf)
+
+	frame, err := readFrame(r, p.RegistrationUploadLength())
+	if err != nil {
+		return nil, err
+	}
+
+	return p.DeserializeRegistrationUpload(frame)
+}
+
+// WriteRegistrationUpload writes the framed RegistrationUpload to w.
+func WriteRegistrationUpload(w io.Writer, m *message.RegistrationUpload) error {
+	return writeFrame(w, m.Serialize())
+}
+
+// ReadKE1 reads a framed KE1 from r.
+func ReadKE1(r io.Reader, conf *Configuration) (*message.KE1, error) {
+	p := framingParameters(conf)
+
+	frame, err := readFrame(r, p.KE1Length())
+	if err != nil {
+		return nil, err
+	}
+
+	return p.DeserializeKE1(frame)
+}
+
+// WriteKE1 writes the framed KE1 to w.
+func WriteKE1(w io.Writer, m *message.KE1) error {
+	return writeFrame(w, m.Serialize())
+}
+
+// ReadKE2 reads a framed KE2 from r.
+func ReadKE2(r io.Reader, conf *Configuration) (*message.KE2, error) {
+	p := framingParameters(conf)
+
+	frame, err := readFrame(r, p.KE2Length())
+	if err != nil {
+		return nil, err
+	}
+
+	return p.DeserializeKE2(frame)
+}
+
+// WriteKE2 writes the framed KE2 to w.
+func WriteKE2(w io.Writer, m *message.KE2) error {
+	return writeFrame(w, m.Serialize())
+}
+
+// ReadKE3 reads a framed KE3 from r.
+func ReadKE3(r io.Reader, conf *Configuration) (*message.KE3, error) {
+	p := framingParameters(conf)
+
+	frame, err := readFrame(r, p.KE3Length())
+	if err != nil {
+		return nil, err
+	}
+
+	return p.DeserializeKE3(frame)
+}
+
+// WriteKE3 writes the framed KE3 to w.
+func WriteKE3(w io.Writer, m *message.KE3) error {
+	return writeFrame(w, m.Serialize())
+}
@@ -30,23 +30,29 @@ const (
 
 // KeyGen returns private and public keys in the group.
 func KeyGen(id ciphersuite.Identifier) (sk, pk []byte) {
-	scalar := id.NewScalar().Random()
-	publicKey := id.Base().Mult(scalar)
-
+	scalar, publicKey := KeyGenTyped(id)
 	return encoding.SerializeScalar(scalar, id), encoding.SerializePoint(publicKey, id)
 }
 
+// KeyGenTyped returns private and public keys in the group, without encoding.
+func KeyGenTyped(id ciphersuite.Identifier) (sk group.Scalar, pk group.Element) {
+	sk = id.NewScalar().Random()
+	return sk, id.Base().Mult(sk)
+}
+
 // setValues - testing: integrated to support testing, to force values.
-// There's no effect if esk, epk, and nonce have already been set in a previous call.
-func setValues(g group.Group, scalar group.Scalar, nonce []byte, nonceLen int) (s group.Scalar, n []byte) {
+// There's no effect if esk, epk, and nonce have already been set in a previous call. Missing values are sampled from
+// the randomness source of p, which can be nil.
+func setValues(p *internal.Parameters, g ciphersuite.Identifier, scalar group.Scalar, nonce []byte,
+	nonceLen int) (s group.Scalar, n []byte) {
 	if scalar != nil {
 		s = scalar
 	} else {
-		s = g.NewScalar().Random()
+		s = p.RandomScalar(g)
 	}
 
 	if len(nonce) == 0 {
-		nonce = internal.RandomBytes(nonceLen)
+		nonce = p.Random(nonceLen)
 	}
 
 	return s, nonce
@@ -72,40 +78,152 @@ func deriveSecret(h *internal.KDF, secret, label, context []byte) []byte {
 	return expandLabel(h, secret, label, context)
 }
 
-func initTranscript(p *internal.Parameters, idc, ids []byte, ke1 *message.KE1, ke2 *message.KE2) {
-	sidc := encoding.EncodeVector(idc)
-	sids := encoding.EncodeVector(ids)
-	p.Hash.Write(encoding.Concatenate([]byte(tag.VersionTag), encoding.EncodeVector(p.Context),
-		sidc, ke1.Serialize(),
-		sids, ke2.CredentialResponse.Serialize(), ke2.NonceS, ke2.EpkS))
+// newTranscriptInputs returns the transcript inputs of the messages, using their encodings on the wire if they were
+// received with uncompressed points, so that both peers hash the same bytes.
+func newTranscriptInputs(p *internal.Parameters, idc, ids []byte, ke1 *message.KE1,
+	ke2 *message.KE2) *message.TranscriptInputs {
+	t := &message.TranscriptInputs{
+		ProtocolVersion:    []byte(p.ProtocolVersion),
+		Context:            p.Context,
+		ApplicationID:      p.ApplicationID,
+		ClientIdentity:     idc,
+		KE1:                ke1.Received,
+		ServerIdentity:     ids,
+		CredentialResponse: ke2.CredentialResponse.Serialize(),
+		NonceS:             ke2.NonceS,
+		EpkS:               ke2.EpkS,
+	}
+
+	if t.KE1 == nil {
+		t.KE1 = ke1.Serialize()
+	}
+
+	if ke2.Received != nil {
+		if cresp, nonceS, epkS := p.ReceivedKE2Transcript(ke2.Received); cresp != nil {
+			t.CredentialResponse, t.NonceS, t.EpkS = cresp, nonceS, epkS
+		}
+	}
+
+	return t
+}
+
+// transcriptWriter is where the transcript is written, i.e. the hash, or a buffer for the transcript observer.
+type transcriptWriter interface {
+	Write(p []byte)
+}
+
+type transcriptBuffer []byte
+
+func (b *transcriptBuffer) Write(p []byte) {
+	*b = append(*b, p...)
+}
+
+// writeVector writes the 2-byte length-prefixed encoding of v to w, without copying v.
+func writeVector(w transcriptWriter, v []byte) {
+	w.Write(encoding.I2OSP(len(v), 2))
+	w.Write(v)
+}
+
+// writeTranscript writes the transcript inputs to w. A nil and an empty context are both encoded as an empty vector,
+// and therefore result in the same transcript. The inputs are written one by one, so that a large context isn't
+// copied. The protocol version and the application ID are only written if set, with a label, so that the transcript
+// is unchanged without.
+func writeTranscript(w transcriptWriter, t *message.TranscriptInputs) {
+	w.Write([]byte(tag.VersionTag))
+
+	if len(t.ProtocolVersion) != 0 {
+		w.Write([]byte(tag.Version))
+		writeVector(w, t.ProtocolVersion)
+	}
+
+	writeVector(w, t.Context)
+
+	if len(t.ApplicationID) != 0 {
+		w.Write([]byte(tag.AppID))
+		writeVector(w, t.ApplicationID)
+	}
+
+	writeVector(w, t.ClientIdentity)
+	w.Write(t.KE1)
+	writeVector(w, t.ServerIdentity)
+	w.Write(t.CredentialResponse)
+	w.Write(t.NonceS)
+	w.Write(t.EpkS)
+}
+
+// initTranscript writes the transcript inputs to the hash, and gives a copy of the serialized transcript to the
+// transcript observer if one is set.
+func initTranscript(p *internal.Parameters, t *message.TranscriptInputs) {
+	writeTranscript(p.Hash, t)
+
+	if p.TranscriptObserver != nil {
+		var b transcriptBuffer
+		writeTranscript(&b, t)
+		p.TranscriptObserver(b)
+	}
+}
+
+// PurposeKey derives a subkey bound to purpose from the session secret. It returns nil if there's no session secret.
+func PurposeKey(h *internal.KDF, sessionSecret, purpose []byte) []byte {
+	if len(sessionSecret) == 0 {
+		return nil
+	}
+
+	return h.Expand(sessionSecret, encoding.Concat([]byte(tag.PurposeKey), encoding.EncodeVector(purpose)), h.Size())
+}
+
+// BindAAD returns the client MAC bound to the additional authenticated data, i.e. the MAC of the AAD keyed with the
+// client MAC, or the client MAC itself if there's no AAD. The client MAC then never leaves the parties and can't be
+// reused for other AAD.
+func BindAAD(p *internal.Parameters, clientMac []byte, aad [][]byte) []byte {
+	if len(aad) == 0 {
+		return clientMac
+	}
+
+	input := []byte(tag.KE3AAD)
+	for _, a := range aad {
+		input = append(input, encoding.EncodeVector(a)...)
+	}
+
+	return p.MAC.MAC(clientMac, input)
 }
 
 type macKeys struct {
 	serverMacKey, clientMacKey []byte
 }
 
-func deriveKeys(h *internal.KDF, ikm, context []byte) (k *macKeys, sessionSecret []byte) {
-	prk := h.Extract(nil, ikm)
+func deriveKeys(p *internal.Parameters, ikm, context []byte) (k *macKeys, sessionSecret []byte) {
+	h := p.KDF
+	prk := h.Extract(p.KDFSalt, ikm)
 	k = &macKeys{}
 	handshakeSecret := deriveSecret(h, prk, []byte(tag.Handshake), context)
 	sessionSecret = deriveSecret(h, prk, []byte(tag.Session), context)
 	k.serverMacKey = expandLabel(h, handshakeSecret, []byte(tag.MacServer), nil)
 	k.clientMacKey = expandLabel(h, handshakeSecret, []byte(tag.MacClient), nil)
+	p.Wipe(prk, handshakeSecret)
 
 	return k, sessionSecret
 }
 
-func decodeKeys(g group.Group, peerEpk, peerPk []byte) (epk, pk group.Element, err error) {
-	epk, err = g.NewElement().Decode(peerEpk)
+func decodeKeys(g ciphersuite.Identifier, peerEpk, peerPk []byte) (epk, pk group.Element, err error) {
+	epk, err = encoding.DecodePoint(g, peerEpk)
 	if err != nil {
 		return nil, nil, fmt.Errorf("decoding peer ephemeral public key: %w", err)
 	}
 
-	pk, err = g.NewElement().Decode(peerPk)
+	if epk.IsIdentity() {
+		return nil, nil, fmt.Errorf("decoding peer ephemeral public key: %w", internal.ErrIdentityElementKey)
+	}
+
+	pk, err = encoding.DecodePoint(g, peerPk)
 	if err != nil {
 		return nil, nil, fmt.Errorf("decoding peer public key: %w", err)
 	}
 
+	if pk.IsIdentity() {
+		return nil, nil, fmt.Errorf("decoding peer public key: %w", internal.ErrIdentityElementKey)
+	}
+
 	return epk, pk, nil
 }
 
@@ -117,7 +235,7 @@ func k3dh(p1 group.Element, s1 group.Scalar, p2 group.Element, s2 group.Scalar,
 	return encoding.Concat3(e1.Bytes(), e2.Bytes(), e3.Bytes())
 }
 
-func ikm(s selector, g group.Group, esk, secretKey group.Scalar, peerEpk, peerPublicKey []byte) ([]byte, error) {
+func ikm(s selector, g ciphersuite.Identifier, esk, secretKey group.Scalar, peerEpk, peerPublicKey []byte) ([]byte, error) {
 	epk, gpk, err := decodeKeys(g, peerEpk, peerPublicKey)
 	if err != nil {
 		return nil, err
@@ -140,21 +258,22 @@ type coreKeys struct {
 	peerEpk, peerPublicKey []byte
 }
 
-func core3DH(s selector, p *internal.Parameters, k *coreKeys, idu, ids []byte,
-	ke1 *message.KE1, ke2 *message.KE2) (*macs, []byte, error) {
-	ikm, err := ikm(s, p.Group, k.esk, k.secretKey, k.peerEpk, k.peerPublicKey)
+func core3DH(s selector, p *internal.Parameters, k *coreKeys, t *message.TranscriptInputs) (*macs, []byte, error) {
+	ikm, err := ikm(s, p.AKEGroup, k.esk, k.secretKey, k.peerEpk, k.peerPublicKey)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	initTranscript(p, idu, ids, ke1, ke2)
-	keys, sessionSecret := deriveKeys(p.KDF, ikm, p.Hash.Sum()) // preamble
+	initTranscript(p, t)
+	keys, sessionSecret := deriveKeys(p, ikm, p.Hash.Sum()) // preamble
 	m := &macs{
 		serverMac: p.MAC.MAC(keys.serverMacKey, p.Hash.Sum()), // transcript2
 	}
 	p.Hash.Write(m.serverMac)
 	transcript3 := p.Hash.Sum()
 	m.clientMac = p.MAC.MAC(keys.clientMacKey, transcript3)
+	p.Wipe(ikm, keys.serverMacKey, keys.clientMacKey)
+	p.WipeScalar(k.esk)
 
 	return m, sessionSecret, nil
 }
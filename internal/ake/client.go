@@ -26,6 +26,7 @@ var errAkeInvalidServerMac = errors.New("invalid server mac")
 type Client struct {
 	esk           group.Scalar
 	sessionSecret []byte
+	transcript    *message.TranscriptInputs
 	NonceU        []byte // testing: integrated to support testing, to force values.
 }
 
@@ -36,7 +37,12 @@ func NewClient() *Client {
 // SetValues - testing: integrated to support testing, to force values.
 // There's no effect if esk, epk, and nonce have already been set in a previous call.
 func (c *Client) SetValues(id ciphersuite.Identifier, esk group.Scalar, nonce []byte, nonceLen int) group.Element {
-	s, nonce := setValues(id, esk, nonce, nonceLen)
+	return c.setValues(nil, id, esk, nonce, nonceLen)
+}
+
+func (c *Client) setValues(p *internal.Parameters, id ciphersuite.Identifier, esk group.Scalar, nonce []byte,
+	nonceLen int) group.Element {
+	s, nonce := setValues(p, id, esk, nonce, nonceLen)
 	if c.esk == nil || (esk != nil && c.esk != s) {
 		c.esk = s
 	}
@@ -48,13 +54,19 @@ func (c *Client) SetValues(id ciphersuite.Identifier, esk group.Scalar, nonce []
 	return id.Base().Mult(c.esk)
 }
 
+// EphemeralSecretKey returns the client's ephemeral secret key, or nil if Start was not called.
+func (c *Client) EphemeralSecretKey() group.Scalar {
+	return c.esk
+}
+
 // Start initiates the 3DH protocol, and returns a KE1 message with clientInfo.
-func (c *Client) Start(cs ciphersuite.Identifier) *message.KE1 {
-	epk := c.SetValues(cs, nil, nil, 32)
+func (c *Client) Start(p *internal.Parameters) *message.KE1 {
+	epk := c.setValues(p, p.AKEGroup, nil, nil, 32)
 
 	return &message.KE1{
-		NonceU: c.NonceU,
-		EpkU:   encoding.PadPoint(epk.Bytes(), cs),
+		NonceU:  c.NonceU,
+		EpkU:    encoding.PadPoint(epk.Bytes(), p.AKEGroup),
+		Version: p.VersionID(),
 	}
 }
 
@@ -64,16 +76,20 @@ func (c *Client) Finalize(p *internal.Parameters, clientIdentity []byte, clientS
 	ke1 *message.KE1, ke2 *message.KE2) (*message.KE3, error) {
 	k := &coreKeys{c.esk, clientSecretKey, ke2.EpkS, serverPublicKey}
 
-	macs, sessionSecret, err := core3DH(client, p, k, clientIdentity, serverIdentity, ke1, ke2)
+	transcript := newTranscriptInputs(p, clientIdentity, serverIdentity, ke1, ke2)
+
+	macs, sessionSecret, err := core3DH(client, p, k, transcript)
 	if err != nil {
 		return nil, err
 	}
 
 	if !p.MAC.Equal(macs.serverMac, ke2.Mac) {
+		p.ObserveMACFailure(internal.StageAKE)
 		return nil, errAkeInvalidServerMac
 	}
 
 	c.sessionSecret = sessionSecret
+	c.transcript = transcript
 
 	return &message.KE3{Mac: macs.clientMac}, nil
 }
@@ -82,3 +98,8 @@ func (c *Client) Finalize(p *internal.Parameters, clientIdentity []byte, clientS
 func (c *Client) SessionKey() []byte {
 	return c.sessionSecret
 }
+
+// Transcript returns the inputs of the AKE transcript if a previous call to Finalize() was successful.
+func (c *Client) Transcript() *message.TranscriptInputs {
+	return c.transcript
+}
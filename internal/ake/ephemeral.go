@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package ake
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/bytemare/cryptotools/group"
+
+	"github.com/bytemare/opaque/internal"
+)
+
+// ephemeral is a server ephemeral key pair shared by the responses to a client within the reuse window.
+type ephemeral struct {
+	esk     group.Scalar
+	epk     group.Element
+	created time.Time
+}
+
+// ephemerals caches the server ephemeral key pairs by AKE group, server static key, and client identity. It is
+// process-wide, since a new Server is used for each login, but servers with different static keys never share an
+// ephemeral key pair.
+var ephemerals = struct {
+	sync.Mutex
+	keys map[string]*ephemeral
+}{keys: make(map[string]*ephemeral)}
+
+// reusableEphemeral returns a copy of the cached ephemeral key pair for the server static key and the client identity
+// if it was created less than p.EphemeralReuseWindow ago, and a new one otherwise. Expired entries are removed when a
+// new one is created. The cache is keyed by a hash of the static secret key, so that it doesn't hold the key itself.
+func reusableEphemeral(p *internal.Parameters, serverSecretKey group.Scalar,
+	clientIdentity []byte) (group.Scalar, group.Element) {
+	fingerprint := sha256.Sum256(serverSecretKey.Bytes())
+	key := string(append(append([]byte{byte(p.AKEGroup)}, fingerprint[:]...), clientIdentity...))
+	now := time.Now()
+
+	ephemerals.Lock()
+	defer ephemerals.Unlock()
+
+	e, ok := ephemerals.keys[key]
+	if !ok || now.Sub(e.created) >= p.EphemeralReuseWindow {
+		for k, old := range ephemerals.keys {
+			if now.Sub(old.created) >= p.EphemeralReuseWindow {
+				delete(ephemerals.keys, k)
+			}
+		}
+
+		esk := p.RandomScalar(p.AKEGroup)
+		e = &ephemeral{esk: esk, epk: p.AKEGroup.Base().Mult(esk), created: now}
+		ephemerals.keys[key] = e
+	}
+
+	return e.esk.Copy(), e.epk.Copy()
+}
+
+// ephemeral sets and returns the server's ephemeral public key, reusing a cached key pair for the static key and the
+// client identity if p.EphemeralReuseWindow is set and no ephemeral secret key was forced. The nonce is always fresh.
+func (s *Server) ephemeral(p *internal.Parameters, serverSecretKey group.Scalar, clientIdentity []byte) group.Element {
+	if s.esk != nil || p.EphemeralReuseWindow <= 0 {
+		return s.setValues(p, p.AKEGroup, nil, nil, p.NonceLen)
+	}
+
+	var epk group.Element
+	s.esk, epk = reusableEphemeral(p, serverSecretKey, clientIdentity)
+
+	if s.nonceS == nil {
+		s.nonceS = p.Random(p.NonceLen)
+	}
+
+	return epk
+}
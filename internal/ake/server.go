@@ -21,12 +21,24 @@ import (
 	"github.com/bytemare/opaque/message"
 )
 
-var errStateNotEmpty = errors.New("existing state is not empty")
+var (
+	errStateNotEmpty = errors.New("existing state is not empty")
+
+	// ErrNoState indicates that there is no expected client MAC to verify against.
+	ErrNoState = errors.New("no AKE state")
+
+	// ErrInvalidMacLength indicates that the client MAC doesn't have the expected length.
+	ErrInvalidMacLength = errors.New("invalid client mac length")
+
+	// ErrInvalidMac indicates that the client MAC doesn't match the expected value.
+	ErrInvalidMac = errors.New("invalid client mac")
+)
 
 // Server exposes the server's AKE functions and holds its state.
 type Server struct {
 	clientMac     []byte
 	sessionSecret []byte
+	transcript    *message.TranscriptInputs
 
 	// testing: integrated to support testing, to force values.
 	esk    group.Scalar
@@ -40,7 +52,12 @@ func NewServer() *Server {
 // SetValues - testing: integrated to support testing, to force values.
 // There's no effect if esk, epk, and nonce have already been set in a previous call.
 func (s *Server) SetValues(id ciphersuite.Identifier, esk group.Scalar, nonce []byte, nonceLen int) group.Element {
-	es, nonce := setValues(id, esk, nonce, nonceLen)
+	return s.setValues(nil, id, esk, nonce, nonceLen)
+}
+
+func (s *Server) setValues(p *internal.Parameters, id ciphersuite.Identifier, esk group.Scalar, nonce []byte,
+	nonceLen int) group.Element {
+	es, nonce := setValues(p, id, esk, nonce, nonceLen)
 	if s.esk == nil || (esk != nil && s.esk != es) {
 		s.esk = es
 	}
@@ -55,23 +72,26 @@ func (s *Server) SetValues(id ciphersuite.Identifier, esk group.Scalar, nonce []
 // Response produces a 3DH server response message.
 func (s *Server) Response(p *internal.Parameters, serverIdentity []byte, serverSecretKey group.Scalar, clientIdentity, clientPublicKey []byte,
 	ke1 *message.KE1, response *cred.CredentialResponse) (*message.KE2, error) {
-	epk := s.SetValues(p.Group, nil, nil, p.NonceLen)
+	epk := s.ephemeral(p, serverSecretKey, clientIdentity)
 	nonce := s.nonceS
 	k := &coreKeys{s.esk, serverSecretKey, ke1.EpkU, clientPublicKey}
 
 	ke2 := &message.KE2{
 		CredentialResponse: response,
 		NonceS:             nonce,
-		EpkS:               encoding.PadPoint(epk.Bytes(), p.Group),
+		EpkS:               encoding.PadPoint(epk.Bytes(), p.AKEGroup),
 	}
 
-	macs, sessionSecret, err := core3DH(server, p, k, clientIdentity, serverIdentity, ke1, ke2)
+	transcript := newTranscriptInputs(p, clientIdentity, serverIdentity, ke1, ke2)
+
+	macs, sessionSecret, err := core3DH(server, p, k, transcript)
 	if err != nil {
 		return nil, err
 	}
 
 	s.sessionSecret = sessionSecret
 	s.clientMac = macs.clientMac
+	s.transcript = transcript
 	ke2.Mac = macs.serverMac
 
 	return ke2, nil
@@ -99,9 +119,22 @@ func (s *Server) SetState(clientMac, sessionSecret []byte) error {
 	return nil
 }
 
-// Finalize verifies the authentication tag contained in ke3.
-func (s *Server) Finalize(p *internal.Parameters, ke3 *message.KE3) bool {
-	return p.MAC.Equal(s.clientMac, ke3.Mac)
+// Finalize verifies the authentication tag contained in ke3, bound to the additional authenticated data if any, and
+// returns an error describing why it failed.
+func (s *Server) Finalize(p *internal.Parameters, ke3 *message.KE3, aad [][]byte) error {
+	if len(s.clientMac) == 0 {
+		return ErrNoState
+	}
+
+	if len(ke3.Mac) != len(s.clientMac) {
+		return ErrInvalidMacLength
+	}
+
+	if !p.MAC.Equal(BindAAD(p, s.clientMac, aad), ke3.Mac) {
+		return ErrInvalidMac
+	}
+
+	return nil
 }
 
 // SessionKey returns the secret shared session key if a previous call to Response() was successful.
@@ -113,3 +146,8 @@ func (s *Server) SessionKey() []byte {
 func (s *Server) ExpectedMAC() []byte {
 	return s.clientMac
 }
+
+// Transcript returns the inputs of the AKE transcript if a previous call to Response() was successful.
+func (s *Server) Transcript() *message.TranscriptInputs {
+	return s.transcript
+}
@@ -0,0 +1,178 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The CBOR major types used by CBORCodec (RFC 8949).
+const (
+	cborByteString = 2
+	cborTextString = 3
+	cborMap        = 5
+)
+
+// ErrInvalidCBOR happens when decoding a CBOR message that isn't a map of the expected fields.
+var ErrInvalidCBOR = errors.New("invalid CBOR message")
+
+// CBORCodec is a Codec encoding a message as a CBOR map from the field names to byte strings, in the order of the
+// fields, omitting the absent optional fields. Decoding only accepts definite-length maps holding exactly the expected
+// fields with their expected lengths, in any order.
+type CBORCodec struct{}
+
+func cborHeader(major byte, length int) []byte {
+	switch {
+	case length < 24:
+		return []byte{major<<5 | byte(length)}
+	case length <= 0xff:
+		return []byte{major<<5 | 24, byte(length)}
+	default:
+		return []byte{major<<5 | 25, byte(length >> 8), byte(length)}
+	}
+}
+
+func readCBORHeader(r io.Reader, major byte) (int, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+
+	if b[0]>>5 != major {
+		return 0, fmt.Errorf("%w: unexpected major type %d", ErrInvalidCBOR, b[0]>>5)
+	}
+
+	var size int
+
+	switch info := b[0] & 0x1f; {
+	case info < 24:
+		return int(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	default:
+		// Longer lengths are never needed by the protocol messages.
+		return 0, fmt.Errorf("%w: unsupported length encoding %d", ErrInvalidCBOR, info)
+	}
+
+	l := make([]byte, size)
+	if _, err := io.ReadFull(r, l); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+
+	length := 0
+	for _, v := range l {
+		length = length<<8 | int(v)
+	}
+
+	return length, nil
+}
+
+func readCBORString(r io.Reader, major byte, maxLength int) ([]byte, error) {
+	length, err := readCBORHeader(r, major)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	if length > maxLength {
+		return nil, fmt.Errorf("%w: string of %d bytes", ErrInvalidCBOR, length)
+	}
+
+	s := make([]byte, length)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	return s, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// Encode implements Codec.
+func (CBORCodec) Encode(w io.Writer, fields []MessageField) error {
+	var (
+		body    []byte
+		entries int
+	)
+
+	for _, f := range fields {
+		if f.Length == 0 && len(f.Value) == 0 {
+			continue
+		}
+
+		body = append(body, cborHeader(cborTextString, len(f.Name))...)
+		body = append(body, f.Name...)
+		body = append(body, cborHeader(cborByteString, len(f.Value))...)
+		body = append(body, f.Value...)
+		entries++
+	}
+
+	_, err := w.Write(append(cborHeader(cborMap, entries), body...))
+
+	return err
+}
+
+// Decode implements Codec.
+func (CBORCodec) Decode(r io.Reader, fields []MessageField) error {
+	index := make(map[string]int, len(fields))
+	maxName := 0
+
+	for i, f := range fields {
+		if f.Length != 0 {
+			index[f.Name] = i
+		}
+
+		if len(f.Name) > maxName {
+			maxName = len(f.Name)
+		}
+	}
+
+	entries, err := readCBORHeader(r, cborMap)
+	if err != nil {
+		return err
+	}
+
+	if entries != len(index) {
+		return fmt.Errorf("%w: expected %d fields, got %d", ErrInvalidCBOR, len(index), entries)
+	}
+
+	for i := 0; i < entries; i++ {
+		name, err := readCBORString(r, cborTextString, maxName)
+		if err != nil {
+			return err
+		}
+
+		j, ok := index[string(name)]
+		if !ok {
+			return fmt.Errorf("%w: unexpected or duplicate field %q", ErrInvalidCBOR, name)
+		}
+
+		delete(index, string(name))
+
+		if fields[j].Value, err = readCBORString(r, cborByteString, fields[j].Length); err != nil {
+			return err
+		}
+
+		if len(fields[j].Value) != fields[j].Length {
+			return fmt.Errorf("%w: field %q of %d bytes, expected %d", ErrInvalidCBOR, name, len(fields[j].Value),
+				fields[j].Length)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,249 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package internal
+
+import (
+	"io"
+
+	"github.com/bytemare/opaque/internal/encoding"
+	"github.com/bytemare/opaque/message"
+)
+
+// MessageField is a field of a protocol message, named after its JSON key. Its Length is the length of the field in
+// the configuration, and is 0 for optional fields that are absent in the configuration, e.g. the OPRF proof.
+type MessageField struct {
+	Name   string
+	Length int
+	Value  []byte
+}
+
+// Codec encodes and decodes the protocol messages for a transport, as their ordered fields.
+type Codec interface {
+	// Encode writes the fields of a message to w.
+	Encode(w io.Writer, fields []MessageField) error
+
+	// Decode reads a message from r, and sets the Value of the fields, which hold the names and lengths of the fields
+	// of the expected message. It must not read beyond the message.
+	Decode(r io.Reader, fields []MessageField) error
+}
+
+// RawCodec is the default Codec, which writes the fields back to back, i.e. the same bytes as Serialize, and reads
+// exactly the length of the message in the configuration.
+type RawCodec struct{}
+
+// Encode implements Codec.
+func (RawCodec) Encode(w io.Writer, fields []MessageField) error {
+	var raw []byte
+	for _, f := range fields {
+		raw = append(raw, f.Value...)
+	}
+
+	_, err := w.Write(raw)
+
+	return err
+}
+
+// Decode implements Codec.
+func (RawCodec) Decode(r io.Reader, fields []MessageField) error {
+	length := 0
+	for _, f := range fields {
+		length += f.Length
+	}
+
+	raw := make([]byte, length)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return err
+	}
+
+	for i := range fields {
+		fields[i].Value, raw = raw[:fields[i].Length], raw[fields[i].Length:]
+	}
+
+	return nil
+}
+
+func (p *Parameters) codec() Codec {
+	if p.Codec == nil {
+		return RawCodec{}
+	}
+
+	return p.Codec
+}
+
+// proofFields returns the fields of the OPRF public key and proof, which are only present in the verifiable mode.
+func (p *Parameters) proofFields(opk, proof []byte) []MessageField {
+	f := []MessageField{{Name: "opk", Value: opk}, {Name: "proof", Value: proof}}
+	if p.VerifiableOPRF {
+		f[0].Length = p.OPRFPointLength
+		f[1].Length = 2 * encoding.ScalarLength[p.OPRFGroup]
+	}
+
+	return f
+}
+
+func (p *Parameters) registrationRequestFields(m *message.RegistrationRequest) []MessageField {
+	return []MessageField{{Name: "data", Length: p.OPRFPointLength, Value: m.Data}}
+}
+
+func (p *Parameters) registrationResponseFields(m *message.RegistrationResponse) []MessageField {
+	return append([]MessageField{
+		{Name: "data", Length: p.OPRFPointLength, Value: m.Data},
+		{Name: "pks", Length: p.AkePointLength, Value: m.Pks},
+	}, p.proofFields(m.OprfPublicKey, m.Proof)...)
+}
+
+func (p *Parameters) registrationUploadFields(m *message.RegistrationUpload) []MessageField {
+	return []MessageField{
+		{Name: "pku", Length: p.AkePointLength, Value: m.PublicKey},
+		{Name: "msk", Length: p.Hash.Size(), Value: m.MaskingKey},
+		{Name: "env", Length: p.EnvelopeSize, Value: m.Envelope},
+	}
+}
+
+func (p *Parameters) ke1Fields(m *message.KE1) []MessageField {
+	var data []byte
+	if m.CredentialRequest != nil {
+		data = m.Data
+	}
+
+	return []MessageField{
+		{Name: "data", Length: p.OPRFPointLength, Value: data},
+		{Name: "n", Length: p.NonceLen, Value: m.NonceU},
+		{Name: "e", Length: p.AkePointLength, Value: m.EpkU},
+		{Name: "v", Length: len(p.VersionID()), Value: m.Version},
+	}
+}
+
+func (p *Parameters) ke2Fields(m *message.KE2) []MessageField {
+	var data, maskingNonce, maskedResponse, opk, proof []byte
+	if m.CredentialResponse != nil {
+		data, maskingNonce, maskedResponse = m.Data, m.MaskingNonce, m.MaskedResponse
+		opk, proof = m.OprfPublicKey, m.Proof
+	}
+
+	return append([]MessageField{
+		{Name: "data", Length: p.OPRFPointLength, Value: data},
+		{Name: "mn", Length: p.NonceLen, Value: maskingNonce},
+		{Name: "mr", Length: p.AkePointLength + p.EnvelopeSize, Value: maskedResponse},
+		{Name: "n", Length: p.NonceLen, Value: m.NonceS},
+		{Name: "e", Length: p.AkePointLength, Value: m.EpkS},
+		{Name: "m", Length: p.MAC.Size(), Value: m.Mac},
+	}, p.proofFields(opk, proof)...)
+}
+
+func (p *Parameters) ke3Fields(m *message.KE3) []MessageField {
+	return []MessageField{{Name: "m", Length: p.MAC.Size(), Value: m.Mac}}
+}
+
+// decode reads the fields with the codec, and returns their concatenation, to be given to the Deserialize functions.
+func (p *Parameters) decode(r io.Reader, fields []MessageField) ([]byte, error) {
+	if err := p.codec().Decode(r, fields); err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	for _, f := range fields {
+		raw = append(raw, f.Value...)
+	}
+
+	return raw, nil
+}
+
+// The following functions write and read the messages with the configuration's Codec. The Decode functions validate
+// the messages as the Deserialize functions do.
+
+// EncodeRegistrationRequest writes m to w with the configuration's Codec.
+func (p *Parameters) EncodeRegistrationRequest(w io.Writer, m *message.RegistrationRequest) error {
+	return p.codec().Encode(w, p.registrationRequestFields(m))
+}
+
+// DecodeRegistrationRequest reads a RegistrationRequest from r with the configuration's Codec.
+func (p *Parameters) DecodeRegistrationRequest(r io.Reader) (*message.RegistrationRequest, error) {
+	raw, err := p.decode(r, p.registrationRequestFields(&message.RegistrationRequest{}))
+	if err != nil {
+		return nil, err
+	}
+
+	return p.DeserializeRegistrationRequest(raw)
+}
+
+// EncodeRegistrationResponse writes m to w with the configuration's Codec.
+func (p *Parameters) EncodeRegistrationResponse(w io.Writer, m *message.RegistrationResponse) error {
+	return p.codec().Encode(w, p.registrationResponseFields(m))
+}
+
+// DecodeRegistrationResponse reads a RegistrationResponse from r with the configuration's Codec.
+func (p *Parameters) DecodeRegistrationResponse(r io.Reader) (*message.RegistrationResponse, error) {
+	raw, err := p.decode(r, p.registrationResponseFields(&message.RegistrationResponse{}))
+	if err != nil {
+		return nil, err
+	}
+
+	return p.DeserializeRegistrationResponse(raw)
+}
+
+// EncodeRegistrationUpload writes m to w with the configuration's Codec.
+func (p *Parameters) EncodeRegistrationUpload(w io.Writer, m *message.RegistrationUpload) error {
+	return p.codec().Encode(w, p.registrationUploadFields(m))
+}
+
+// DecodeRegistrationUpload reads a RegistrationUpload from r with the configuration's Codec.
+func (p *Parameters) DecodeRegistrationUpload(r io.Reader) (*message.RegistrationUpload, error) {
+	raw, err := p.decode(r, p.registrationUploadFields(&message.RegistrationUpload{}))
+	if err != nil {
+		return nil, err
+	}
+
+	return p.DeserializeRegistrationUpload(raw)
+}
+
+// EncodeKE1 writes m to w with the configuration's Codec.
+func (p *Parameters) EncodeKE1(w io.Writer, m *message.KE1) error {
+	return p.codec().Encode(w, p.ke1Fields(m))
+}
+
+// DecodeKE1 reads a KE1 from r with the configuration's Codec.
+func (p *Parameters) DecodeKE1(r io.Reader) (*message.KE1, error) {
+	raw, err := p.decode(r, p.ke1Fields(&message.KE1{}))
+	if err != nil {
+		return nil, err
+	}
+
+	return p.DeserializeKE1(raw)
+}
+
+// EncodeKE2 writes m to w with the configuration's Codec.
+func (p *Parameters) EncodeKE2(w io.Writer, m *message.KE2) error {
+	return p.codec().Encode(w, p.ke2Fields(m))
+}
+
+// DecodeKE2 reads a KE2 from r with the configuration's Codec.
+func (p *Parameters) DecodeKE2(r io.Reader) (*message.KE2, error) {
+	raw, err := p.decode(r, p.ke2Fields(&message.KE2{}))
+	if err != nil {
+		return nil, err
+	}
+
+	return p.DeserializeKE2(raw)
+}
+
+// EncodeKE3 writes m to w with the configuration's Codec.
+func (p *Parameters) EncodeKE3(w io.Writer, m *message.KE3) error {
+	return p.codec().Encode(w, p.ke3Fields(m))
+}
+
+// DecodeKE3 reads a KE3 from r with the configuration's Codec.
+func (p *Parameters) DecodeKE3(r io.Reader) (*message.KE3, error) {
+	raw, err := p.decode(r, p.ke3Fields(&message.KE3{}))
+	if err != nil {
+		return nil, err
+	}
+
+	return p.DeserializeKE3(raw)
+}
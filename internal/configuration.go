@@ -10,10 +10,14 @@
 package internal
 
 import (
+	"bytes"
 	cryptorand "crypto/rand"
-	"errors"
+	"crypto/sha256"
 	"fmt"
+	"io"
+	"time"
 
+	"github.com/bytemare/cryptotools/group"
 	"github.com/bytemare/cryptotools/group/ciphersuite"
 
 	"github.com/bytemare/opaque/internal/encoding"
@@ -23,8 +27,6 @@ import (
 	"github.com/bytemare/opaque/message"
 )
 
-var errInvalidMessageLength = errors.New("invalid message length")
-
 // RandomBytes returns random bytes of length len (wrapper for crypto/rand).
 func RandomBytes(length int) []byte {
 	r := make([]byte, length)
@@ -45,36 +47,232 @@ type Parameters struct {
 	EnvelopeSize    int
 	OPRFPointLength int
 	AkePointLength  int
-	Group           ciphersuite.Identifier
+	OPRFGroup       ciphersuite.Identifier
+	AKEGroup        ciphersuite.Identifier
 	OPRF            oprf.Ciphersuite
+	OPRFEvaluator   OPRFEvaluator
 	Context         []byte
+	ApplicationID   []byte
+	ServerIdentity  []byte
+	KDFSalt         []byte
+	Rand            io.Reader
+
+	EphemeralReuseWindow time.Duration
+	TranscriptObserver   func(transcript []byte)
+	OPRFDomainSeparation []byte
+	Observer             Observer
+	ProtocolVersion      string
+	MaxInputLength       int
+	Codec                Codec
+
+	RequireExplicitIdentities bool
+	VerifiableOPRF            bool
+	StrictMode                bool
+	ZeroizeSecrets            bool
+	BindAppContext            bool
+	AcceptUncompressedPoints  bool
+}
+
+// Wipe overwrites b with zeros.
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Wipe zeroes the buffers if p.ZeroizeSecrets is set. It must not be given buffers returned to the caller.
+func (p *Parameters) Wipe(buffers ...[]byte) {
+	if p == nil || !p.ZeroizeSecrets {
+		return
+	}
+
+	for _, b := range buffers {
+		Wipe(b)
+	}
+}
+
+// WipeScalar overwrites s with a random value if p.ZeroizeSecrets is set, since scalars can't be set to zero in place.
+func (p *Parameters) WipeScalar(s group.Scalar) {
+	if p == nil || !p.ZeroizeSecrets || s == nil {
+		return
+	}
+
+	s.Random()
+}
+
+// Random returns length bytes read from p.Rand, or from crypto/rand if p or p.Rand is nil.
+func (p *Parameters) Random(length int) []byte {
+	if p == nil || p.Rand == nil {
+		return RandomBytes(length)
+	}
+
+	r := make([]byte, length)
+	if _, err := io.ReadFull(p.Rand, r); err != nil {
+		panic(fmt.Errorf("unexpected error in generating random bytes : %w", err))
+	}
+
+	return r
+}
+
+// RandomScalar returns a random scalar in g. If p.Rand is set, the scalar is derived from 64 bytes read from it, and
+// otherwise sampled with crypto/rand.
+func (p *Parameters) RandomScalar(g ciphersuite.Identifier) group.Scalar {
+	if p == nil || p.Rand == nil {
+		return g.NewScalar().Random()
+	}
+
+	return g.HashToScalar(p.Random(randomScalarInputLength), []byte(tag.RandomScalarDST))
+}
+
+// randomScalarInputLength is the number of random bytes hashed to a scalar, large enough to avoid bias in all groups.
+const randomScalarInputLength = 64
+
+// OPRFKeySeed returns the seed of the OPRF key of the client with the credential identifier.
+func (p *Parameters) OPRFKeySeed(oprfSeed, credentialIdentifier []byte) []byte {
+	return p.KDF.Expand(oprfSeed, encoding.SuffixString(credentialIdentifier, tag.OprfKey),
+		encoding.ScalarLength[p.OPRFGroup])
+}
+
+// RegistrationRequestLength returns the byte length of a serialized RegistrationRequest.
+func (p *Parameters) RegistrationRequestLength() int {
+	return p.OPRFPointLength
+}
+
+// oprfProofLength returns the byte length of the OPRF public key and proof appended to the responses in the verifiable
+// OPRF mode, and 0 otherwise.
+func (p *Parameters) oprfProofLength() int {
+	if !p.VerifiableOPRF {
+		return 0
+	}
+
+	return p.OPRFPointLength + 2*encoding.ScalarLength[p.OPRFGroup]
+}
+
+// splitOPRFProof returns the OPRF public key and proof in input, which must be oprfProofLength() long.
+func (p *Parameters) splitOPRFProof(input []byte) (publicKey, proof []byte) {
+	if !p.VerifiableOPRF {
+		return nil, nil
+	}
+
+	return input[:p.OPRFPointLength], input[p.OPRFPointLength:]
+}
+
+// RegistrationResponseLength returns the byte length of a serialized RegistrationResponse.
+func (p *Parameters) RegistrationResponseLength() int {
+	return p.OPRFPointLength + p.AkePointLength + p.oprfProofLength()
+}
+
+// RegistrationUploadLength returns the byte length of a serialized RegistrationUpload.
+func (p *Parameters) RegistrationUploadLength() int {
+	return p.AkePointLength + p.Hash.Size() + p.EnvelopeSize
+}
+
+// versionIDLength is the length of the identifier of a pinned protocol version in KE1.
+const versionIDLength = 4
+
+// VersionID returns the identifier of the pinned protocol version carried in KE1, i.e. the beginning of its SHA-256
+// hash, or nil if no version is pinned.
+func (p *Parameters) VersionID() []byte {
+	if p.ProtocolVersion == "" {
+		return nil
+	}
+
+	h := sha256.Sum256([]byte(p.ProtocolVersion))
+
+	return h[:versionIDLength]
+}
+
+// KE1Length returns the byte length of a serialized KE1.
+func (p *Parameters) KE1Length() int {
+	return p.OPRFPointLength + p.NonceLen + p.AkePointLength + len(p.VersionID())
+}
+
+// KE2Length returns the byte length of a serialized KE2.
+func (p *Parameters) KE2Length() int {
+	return p.OPRFPointLength + 2*p.NonceLen + 2*p.AkePointLength + p.EnvelopeSize + p.MAC.Size() + p.oprfProofLength()
+}
+
+// KE3Length returns the byte length of a serialized KE3.
+func (p *Parameters) KE3Length() int {
+	return p.MAC.Size()
 }
 
 func (p *Parameters) DeserializeRegistrationRequest(input []byte) (*message.RegistrationRequest, error) {
-	if len(input) != p.OPRFPointLength {
-		return nil, errInvalidMessageLength
+	input, err := p.compressPoints(input, p.registrationRequestLayout(), p.RegistrationRequestLength())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(input) != p.RegistrationRequestLength() {
+		return nil, lengthError(p.RegistrationRequestLength(), len(input))
 	}
 
 	return &message.RegistrationRequest{Data: input}, nil
 }
 
 func (p *Parameters) DeserializeRegistrationResponse(input []byte) (*message.RegistrationResponse, error) {
-	if len(input) != p.OPRFPointLength+p.AkePointLength {
-		return nil, errInvalidMessageLength
+	input, err := p.compressPoints(input, p.registrationResponseLayout(), p.RegistrationResponseLength())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(input) != p.RegistrationResponseLength() {
+		return nil, lengthError(p.RegistrationResponseLength(), len(input))
 	}
 
+	offset := p.OPRFPointLength + p.AkePointLength
+	opk, proof := p.splitOPRFProof(input[offset:])
+
 	return &message.RegistrationResponse{
-		Data: input[:p.OPRFPointLength],
-		Pks:  input[p.OPRFPointLength:],
+		Data:          input[:p.OPRFPointLength],
+		Pks:           input[p.OPRFPointLength:offset],
+		OprfPublicKey: opk,
+		Proof:         proof,
 	}, nil
 }
 
+// DecodeScalar decodes a scalar of g, and returns ErrInvalidScalar if it doesn't have the group's scalar length or
+// isn't below the group order. The length is checked first, so that oversized inputs, e.g. to P-521, are rejected
+// before being parsed.
+func DecodeScalar(g ciphersuite.Identifier, scalar []byte) (group.Scalar, error) {
+	if len(scalar) != encoding.ScalarLength[g] {
+		return nil, fmt.Errorf("%w: expected %d bytes, got %d", ErrInvalidScalar, encoding.ScalarLength[g], len(scalar))
+	}
+
+	s, err := g.NewScalar().Decode(scalar)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidScalar, err)
+	}
+
+	return s, nil
+}
+
+// canonicalPoint returns ErrNonCanonicalPoint for the named field if point doesn't decode to an element of g, or isn't
+// its canonical encoding.
+func canonicalPoint(g ciphersuite.Identifier, field string, point []byte) error {
+	e, err := encoding.DecodePoint(g, point)
+	if err != nil || !bytes.Equal(encoding.SerializePoint(e, g), point) {
+		return fmt.Errorf("%s: %w", field, ErrNonCanonicalPoint)
+	}
+
+	return nil
+}
+
 func (p *Parameters) DeserializeRegistrationUpload(input []byte) (*message.RegistrationUpload, error) {
-	if len(input) != p.AkePointLength+p.Hash.Size()+p.EnvelopeSize {
-		return nil, errInvalidMessageLength
+	input, err := p.compressPoints(input, p.registrationUploadLayout(), p.RegistrationUploadLength())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(input) != p.RegistrationUploadLength() {
+		return nil, lengthError(p.RegistrationUploadLength(), len(input))
 	}
 
 	pku := input[:p.AkePointLength]
+	if err = canonicalPoint(p.AKEGroup, "client public key", pku); err != nil {
+		return nil, err
+	}
+
 	maskingKey := input[p.AkePointLength : p.AkePointLength+p.Hash.Size()]
 	env := input[p.AkePointLength+p.Hash.Size():]
 
@@ -98,25 +296,58 @@ func (p *Parameters) deserializeCredentialResponse(input []byte, maxResponseLeng
 }
 
 func (p *Parameters) DeserializeKE1(input []byte) (*message.KE1, error) {
-	if len(input) != p.OPRFPointLength+p.NonceLen+p.AkePointLength {
-		return nil, errInvalidMessageLength
+	received := input
+
+	// A missing, unexpected, or different version identifier is reported as such, rather than as an invalid length.
+	if version, ok := p.receivedKE1Version(input); ok && (len(version) == 0 || len(version) == versionIDLength) &&
+		!bytes.Equal(version, p.VersionID()) {
+		return nil, ErrVersionMismatch
+	}
+
+	input, err := p.compressPoints(input, p.ke1Layout(), p.KE1Length())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(input) != p.KE1Length() {
+		return nil, lengthError(p.KE1Length(), len(input))
 	}
 
 	creq := p.deserializeCredentialRequest(input[:p.OPRFPointLength])
 	nonceU := input[p.OPRFPointLength : p.OPRFPointLength+p.NonceLen]
+	epkU := input[p.OPRFPointLength+p.NonceLen : p.OPRFPointLength+p.NonceLen+p.AkePointLength]
 
-	return &message.KE1{
+	var version []byte
+	if p.ProtocolVersion != "" {
+		version = input[p.OPRFPointLength+p.NonceLen+p.AkePointLength:]
+	}
+
+	ke1 := &message.KE1{
 		CredentialRequest: creq,
 		NonceU:            nonceU,
-		EpkU:              input[p.OPRFPointLength+p.NonceLen:],
-	}, nil
+		EpkU:              epkU,
+		Version:           version,
+	}
+
+	if len(received) != len(input) {
+		ke1.Received = received
+	}
+
+	return ke1, nil
 }
 
 func (p *Parameters) DeserializeKE2(input []byte) (*message.KE2, error) {
+	received := input
+
+	input, err := p.compressPoints(input, p.ke2Layout(), p.KE2Length())
+	if err != nil {
+		return nil, err
+	}
+
 	maxResponseLength := p.OPRFPointLength + p.NonceLen + p.AkePointLength + p.EnvelopeSize
 
-	if len(input) != maxResponseLength+p.NonceLen+p.AkePointLength+p.MAC.Size() {
-		return nil, errInvalidMessageLength
+	if len(input) != p.KE2Length() {
+		return nil, lengthError(p.KE2Length(), len(input))
 	}
 
 	cresp := p.deserializeCredentialResponse(input, maxResponseLength)
@@ -124,27 +355,196 @@ func (p *Parameters) DeserializeKE2(input []byte) (*message.KE2, error) {
 	nonceS := input[maxResponseLength : maxResponseLength+p.NonceLen]
 	offset := maxResponseLength + p.NonceLen
 	epks := input[offset : offset+p.AkePointLength]
+
+	if err := canonicalPoint(p.AKEGroup, "server ephemeral public key", epks); err != nil {
+		return nil, err
+	}
+
 	offset += p.AkePointLength
-	mac := input[offset:]
+	mac := input[offset : offset+p.MAC.Size()]
+	cresp.OprfPublicKey, cresp.Proof = p.splitOPRFProof(input[offset+p.MAC.Size():])
 
-	return &message.KE2{
+	ke2 := &message.KE2{
 		CredentialResponse: cresp,
 		NonceS:             nonceS,
 		EpkS:               epks,
 		Mac:                mac,
-	}, nil
+	}
+
+	if len(received) != len(input) {
+		ke2.Received = received
+	}
+
+	return ke2, nil
 }
 
 func (p *Parameters) DeserializeKE3(input []byte) (*message.KE3, error) {
-	if len(input) != p.MAC.Size() {
-		return nil, errInvalidMessageLength
+	if len(input) != p.KE3Length() {
+		return nil, lengthError(p.KE3Length(), len(input))
 	}
 
 	return &message.KE3{Mac: input}, nil
 }
 
+// decodePoint decodes the point of the named field, and rejects the identity element.
+func decodePoint(g ciphersuite.Identifier, field string, point []byte) error {
+	e, err := encoding.DecodePoint(g, point)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", field, err)
+	}
+
+	if e.IsIdentity() {
+		return fmt.Errorf("invalid %s: %w", field, errIdentityPoint)
+	}
+
+	return nil
+}
+
+// DeserializeKE1Strict deserializes a KE1 like DeserializeKE1, and additionally decodes its points to reject invalid
+// encodings early.
+func (p *Parameters) DeserializeKE1Strict(input []byte) (*message.KE1, error) {
+	ke1, err := p.DeserializeKE1(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = decodePoint(p.OPRFGroup, "KE1 blinded element", ke1.Data); err != nil {
+		return nil, err
+	}
+
+	if err = decodePoint(p.AKEGroup, "KE1 ephemeral public key", ke1.EpkU); err != nil {
+		return nil, err
+	}
+
+	return ke1, nil
+}
+
+// DeserializeKE2Strict deserializes a KE2 like DeserializeKE2, and additionally decodes its points to reject invalid
+// encodings early. The masked response is encrypted, and can only be checked by the client in Finish.
+func (p *Parameters) DeserializeKE2Strict(input []byte) (*message.KE2, error) {
+	ke2, err := p.DeserializeKE2(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = decodePoint(p.OPRFGroup, "KE2 evaluated element", ke2.Data); err != nil {
+		return nil, err
+	}
+
+	if err = decodePoint(p.AKEGroup, "KE2 ephemeral public key", ke2.EpkS); err != nil {
+		return nil, err
+	}
+
+	return ke2, nil
+}
+
+// prefix returns the first length bytes of input, or a MessageLengthError if it's too short.
+func prefix(input []byte, length int) ([]byte, error) {
+	if len(input) < length {
+		return nil, lengthError(length, len(input))
+	}
+
+	return input[:length], nil
+}
+
+// DeserializeRegistrationRequestPrefix deserializes the RegistrationRequest at the start of input, and returns the number of bytes it
+// consumed, allowing to read concatenated messages.
+func (p *Parameters) DeserializeRegistrationRequestPrefix(input []byte) (*message.RegistrationRequest, int, error) {
+	in, err := prefix(input, p.RegistrationRequestLength())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	m, err := p.DeserializeRegistrationRequest(in)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return m, len(in), nil
+}
+
+// DeserializeRegistrationResponsePrefix deserializes the RegistrationResponse at the start of input, and returns the number of bytes it
+// consumed, allowing to read concatenated messages.
+func (p *Parameters) DeserializeRegistrationResponsePrefix(input []byte) (*message.RegistrationResponse, int, error) {
+	in, err := prefix(input, p.RegistrationResponseLength())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	m, err := p.DeserializeRegistrationResponse(in)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return m, len(in), nil
+}
+
+// DeserializeRegistrationUploadPrefix deserializes the RegistrationUpload at the start of input, and returns the number of bytes it
+// consumed, allowing to read concatenated messages.
+func (p *Parameters) DeserializeRegistrationUploadPrefix(input []byte) (*message.RegistrationUpload, int, error) {
+	in, err := prefix(input, p.RegistrationUploadLength())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	m, err := p.DeserializeRegistrationUpload(in)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return m, len(in), nil
+}
+
+// DeserializeKE1Prefix deserializes the KE1 at the start of input, and returns the number of bytes it
+// consumed, allowing to read concatenated messages.
+func (p *Parameters) DeserializeKE1Prefix(input []byte) (*message.KE1, int, error) {
+	in, err := prefix(input, p.KE1Length())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	m, err := p.DeserializeKE1(in)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return m, len(in), nil
+}
+
+// DeserializeKE2Prefix deserializes the KE2 at the start of input, and returns the number of bytes it
+// consumed, allowing to read concatenated messages.
+func (p *Parameters) DeserializeKE2Prefix(input []byte) (*message.KE2, int, error) {
+	in, err := prefix(input, p.KE2Length())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	m, err := p.DeserializeKE2(in)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return m, len(in), nil
+}
+
+// DeserializeKE3Prefix deserializes the KE3 at the start of input, and returns the number of bytes it
+// consumed, allowing to read concatenated messages.
+func (p *Parameters) DeserializeKE3Prefix(input []byte) (*message.KE3, int, error) {
+	in, err := prefix(input, p.KE3Length())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	m, err := p.DeserializeKE3(in)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return m, len(in), nil
+}
+
 // MaskResponse is used to encrypt and decrypt the response in KE2.
 func (p *Parameters) MaskResponse(key, nonce, in []byte) []byte {
-	pad := p.KDF.Expand(key, encoding.SuffixString(nonce, tag.CredentialResponsePad), encoding.PointLength[p.Group]+p.EnvelopeSize)
+	pad := p.KDF.Expand(key, encoding.SuffixString(nonce, tag.CredentialResponsePad), p.AkePointLength+p.EnvelopeSize)
 	return Xor(pad, in)
 }
@@ -15,7 +15,12 @@ import (
 	"github.com/bytemare/cryptotools/encoding"
 )
 
-var ErrI2OSPLength = errors.New("requested size is too big")
+var (
+	ErrI2OSPLength = errors.New("requested size is too big")
+
+	// ErrDecodeVector happens when the input is too short for the vector length it announces.
+	ErrDecodeVector = errors.New("insufficient input for vector decoding")
+)
 
 func OS2IP(in []byte) int {
 	return encoding.OS2IP(in)
@@ -39,3 +44,17 @@ func EncodeVectorLen(in []byte, length int) []byte {
 func EncodeVector(in []byte) []byte {
 	return EncodeVectorLen(in, 2)
 }
+
+// DecodeVector returns the 2-byte length-prefixed vector at the start of in, and the number of bytes read.
+func DecodeVector(in []byte) ([]byte, int, error) {
+	if len(in) < 2 {
+		return nil, 0, ErrDecodeVector
+	}
+
+	end := 2 + OS2IP(in[:2])
+	if len(in) < end {
+		return nil, 0, ErrDecodeVector
+	}
+
+	return in[2:end], end, nil
+}
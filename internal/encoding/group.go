@@ -10,6 +10,8 @@
 package encoding
 
 import (
+	"errors"
+
 	"github.com/bytemare/cryptotools/group"
 	"github.com/bytemare/cryptotools/group/ciphersuite"
 )
@@ -23,22 +25,42 @@ const (
 	p384ScalarLength      = 48
 	p521PointLength       = 67
 	p521ScalarLength      = 66
+	curve25519PointLength = 33
+	ed25519PointLength    = 32
+	x25519ScalarLength    = 32
+
+	// cofactor25519 is the cofactor of Curve25519 and Edwards25519.
+	cofactor25519 = 8
 )
 
+// ErrSmallOrderComponent happens when decoding a point of Curve25519 or Edwards25519 that is not in the prime-order
+// subgroup.
+var ErrSmallOrderComponent = errors.New("point has a small-order component")
+
 var ScalarLength = map[ciphersuite.Identifier]int{
 	ciphersuite.Ristretto255Sha512: ristrettoPointLength,
 	// ciphersuite.Decaf448Shake256: 56,
-	ciphersuite.P256Sha256: p256ScalarLength,
-	ciphersuite.P384Sha512: p384ScalarLength,
-	ciphersuite.P521Sha512: p521ScalarLength,
+	ciphersuite.P256Sha256:         p256ScalarLength,
+	ciphersuite.P384Sha512:         p384ScalarLength,
+	ciphersuite.P521Sha512:         p521ScalarLength,
+	ciphersuite.Curve25519Sha512:   x25519ScalarLength,
+	ciphersuite.Edwards25519Sha512: x25519ScalarLength,
 }
 
 var PointLength = map[ciphersuite.Identifier]int{
 	ciphersuite.Ristretto255Sha512: ristrettoScalarLength,
 	// ciphersuite.Decaf448Shake256: 56,
-	ciphersuite.P256Sha256: p256PointLength,
-	ciphersuite.P384Sha512: p384PointLength,
-	ciphersuite.P521Sha512: p521PointLength,
+	ciphersuite.P256Sha256:         p256PointLength,
+	ciphersuite.P384Sha512:         p384PointLength,
+	ciphersuite.P521Sha512:         p521PointLength,
+	ciphersuite.Curve25519Sha512:   curve25519PointLength,
+	ciphersuite.Edwards25519Sha512: ed25519PointLength,
+}
+
+// cofactors holds the cofactor of the groups that have one.
+var cofactors = map[ciphersuite.Identifier]int{
+	ciphersuite.Curve25519Sha512:   cofactor25519,
+	ciphersuite.Edwards25519Sha512: cofactor25519,
 }
 
 func SerializeScalar(s group.Scalar, c ciphersuite.Identifier) []byte {
@@ -57,6 +79,34 @@ func SerializePoint(e group.Element, c ciphersuite.Identifier) []byte {
 	return PadPoint(e.Bytes(), c)
 }
 
+// DecodePoint decodes a point of the group c. It decodes a copy of point, since the Edwards25519 decoder modifies its
+// input, and rejects the points of the groups with a cofactor that are not in the prime-order subgroup.
+func DecodePoint(c ciphersuite.Identifier, point []byte) (group.Element, error) {
+	e, err := c.NewElement().Decode(append([]byte(nil), point...))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := cofactors[c]; ok && !inPrimeOrderSubgroup(c, e) {
+		return nil, ErrSmallOrderComponent
+	}
+
+	return e, nil
+}
+
+// inPrimeOrderSubgroup returns whether l·e is the identity, with l the order of the prime-order subgroup, computed as
+// (l-1)·e + e since scalars are reduced modulo l.
+func inPrimeOrderSubgroup(c ciphersuite.Identifier, e group.Element) bool {
+	one, err := c.NewScalar().Decode([]byte{1})
+	if err != nil {
+		panic(err)
+	}
+
+	minusOne := c.NewScalar().Sub(one)
+
+	return e.Copy().Mult(minusOne).Add(e).IsIdentity()
+}
+
 func PadPoint(point []byte, c ciphersuite.Identifier) []byte {
 	length := PointLength[c]
 
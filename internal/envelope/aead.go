@@ -0,0 +1,83 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+
+	"github.com/bytemare/cryptotools/group"
+	"github.com/bytemare/cryptotools/group/ciphersuite"
+
+	"github.com/bytemare/opaque/internal"
+	"github.com/bytemare/opaque/internal/encoding"
+	"github.com/bytemare/opaque/internal/tag"
+)
+
+// AEADOverhead is the length of the authentication tag appended to the client secret key in the AEAD mode.
+const AEADOverhead = 16
+
+const aeadKeyLength = 32
+
+var errRecoverInvalidCiphertext = errors.New("can't recover envelope: invalid secret key ciphertext")
+
+// aeadMode is the external mode with the client secret key encrypted with AES-256-GCM instead of a pad.
+type aeadMode struct {
+	ciphersuite.Identifier
+	*internal.KDF
+}
+
+// aead returns AES-256-GCM with a key expanded from the randomized password and the envelope nonce. The key is unique
+// to each envelope, so a fixed GCM nonce never repeats under the same key.
+func (a *aeadMode) aead(randomizedPwd, nonce []byte) (cipher.AEAD, []byte) {
+	key := a.Expand(randomizedPwd, encoding.SuffixString(nonce, tag.AEADKey), aeadKeyLength)
+	defer internal.Wipe(key)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+
+	return gcm, make([]byte, gcm.NonceSize())
+}
+
+func (a *aeadMode) buildInnerEnvelope(randomizedPwd, nonce, clientSecretKey []byte) (innerEnvelope, pk []byte, err error) {
+	scalar, err := a.NewScalar().Decode(clientSecretKey)
+	if err != nil {
+		return nil, nil, errBuildInvalidSK
+	}
+
+	clientPublicKey := a.Base().Mult(scalar)
+	gcm, iv := a.aead(randomizedPwd, nonce)
+
+	return gcm.Seal(nil, iv, clientSecretKey, nil), encoding.SerializePoint(clientPublicKey, a.Identifier), nil
+}
+
+func (a *aeadMode) recoverKeys(randomizedPwd, nonce, innerEnvelope []byte) (sk group.Scalar, clientPublicKey group.Element, err error) {
+	gcm, iv := a.aead(randomizedPwd, nonce)
+
+	clientSecretKey, err := gcm.Open(nil, iv, innerEnvelope, nil)
+	if err != nil {
+		return nil, nil, errRecoverInvalidCiphertext
+	}
+	defer internal.Wipe(clientSecretKey)
+
+	sk, err = a.NewScalar().Decode(clientSecretKey)
+	if err != nil {
+		return nil, nil, errRecoverInvalidSK
+	}
+
+	return sk, a.Base().Mult(sk), nil
+}
@@ -9,9 +9,8 @@
 package envelope
 
 import (
-	"fmt"
-
 	"github.com/bytemare/opaque/internal"
+	"github.com/bytemare/opaque/internal/encoding"
 	"github.com/bytemare/opaque/internal/oprf"
 	"github.com/bytemare/opaque/internal/tag"
 )
@@ -22,10 +21,10 @@ type Core struct {
 	Oprf *oprf.Client
 }
 
-// New returns a pointer to an instantiated Core structure.
-func New(id oprf.Ciphersuite) *Core {
+// New returns a pointer to an instantiated Core structure, with the OPRF's DSTs separated with domain.
+func New(id oprf.Ciphersuite, domain []byte) *Core {
 	return &Core{
-		Oprf: id.Client(),
+		Oprf: id.ClientWithDomain(domain),
 	}
 }
 
@@ -39,16 +38,22 @@ func (c *Core) OprfFinalize(data []byte) ([]byte, error) {
 	return c.Oprf.Finalize(data)
 }
 
-// BuildEnvelope returns the client's Envelope, the masking key for the registration, and the additional export key.
-func (c *Core) BuildEnvelope(p *internal.Parameters, mode Mode, evaluation, serverPublicKey, clientSecretKey []byte,
-	creds *Credentials) (env *Envelope, clientPublicKey, maskingKey, exportKey []byte, err error) {
-	unblinded, err := c.OprfFinalize(evaluation)
-	if err != nil {
-		return nil, nil, nil, nil, fmt.Errorf("finalizing OPRF : %w", err)
-	}
+// DeriveClientSecretKey derives the client's secret key from the randomized password, by expanding it with the
+// "DeterministicClientKey" label and hashing the result to a scalar of the AKE group.
+func DeriveClientSecretKey(p *internal.Parameters, randomizedPwd []byte) []byte {
+	seed := p.KDF.Expand(randomizedPwd, []byte(tag.DeterministicClientKey), encoding.ScalarLength[p.AKEGroup])
+	sk := p.AKEGroup.HashToScalar(seed, []byte(tag.H2sDST))
+	p.Wipe(seed)
 
-	randomizedPwd := BuildPRK(p, unblinded)
+	return encoding.SerializeScalar(sk, p.AKEGroup)
+}
+
+// BuildEnvelope returns the client's Envelope, the masking key for the registration, and the additional export key,
+// given the randomized password, which it wipes.
+func BuildEnvelope(p *internal.Parameters, mode Mode, randomizedPwd, serverPublicKey, clientSecretKey []byte,
+	creds *Credentials) (env *Envelope, clientPublicKey, maskingKey, exportKey []byte, err error) {
 	m := &Mailer{Parameters: p}
+	defer p.Wipe(randomizedPwd)
 
 	env, clientPublicKey, exportKey, err = m.CreateEnvelope(mode, randomizedPwd, serverPublicKey, clientSecretKey, creds)
 	if err != nil {
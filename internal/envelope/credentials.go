@@ -12,9 +12,10 @@ package envelope
 import "github.com/bytemare/opaque/internal/encoding"
 
 type CleartextCredentials struct {
-	Pks []byte
-	Idc []byte
-	Ids []byte
+	Pks        []byte
+	Idc        []byte
+	Ids        []byte
+	AppContext []byte
 }
 
 func (c *CleartextCredentials) Serialize() []byte {
@@ -27,6 +28,10 @@ func (c *CleartextCredentials) Serialize() []byte {
 		s = encoding.EncodeVector(c.Ids)
 	}
 
+	if c.AppContext != nil {
+		return encoding.Concat(encoding.Concat3(c.Pks, s, u), encoding.EncodeVector(c.AppContext))
+	}
+
 	return encoding.Concat3(c.Pks, s, u)
 }
 
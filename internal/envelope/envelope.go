@@ -27,15 +27,17 @@ var (
 
 type Credentials struct {
 	Idc, Ids                    []byte
+	AppContext                  []byte
 	EnvelopeNonce, MaskingNonce []byte // testing: integrated to support testing
 }
 
 type Mode byte
 
-// Internal and External define the Envelope modes.
+// Internal, External, and ExternalAEAD define the Envelope modes.
 const (
 	Internal Mode = iota + 1
 	External
+	ExternalAEAD
 )
 
 type Envelope struct {
@@ -54,8 +56,14 @@ type innerEnvelope interface {
 }
 
 func BuildPRK(p *internal.Parameters, unblinded []byte) []byte {
-	// testing: commented out to support testing. hardened := p.Harden(unblinded, nil)
-	hardened := unblinded
+	if !p.MHF.Enabled() {
+		return p.KDF.Extract(nil, unblinded)
+	}
+
+	start := p.ObserveStart()
+	hardened := p.MHF.Harden(unblinded, len(unblinded))
+	p.ObserveMHF(start)
+
 	return p.KDF.Extract(nil, hardened)
 }
 
@@ -68,9 +76,11 @@ func (m *Mailer) inner(mode Mode) innerEnvelope {
 
 	switch mode {
 	case Internal:
-		inner = &internalMode{m.Group, m.KDF}
+		inner = &internalMode{m.AKEGroup, m.KDF}
 	case External:
-		inner = &externalMode{m.Group, m.KDF}
+		inner = &externalMode{m.AKEGroup, m.KDF}
+	case ExternalAEAD:
+		inner = &aeadMode{m.AKEGroup, m.KDF}
 	default:
 		panic("invalid mode")
 	}
@@ -89,22 +99,35 @@ func (m *Mailer) authTag(authKey, nonce, inner, ctc []byte) []byte {
 	return m.MAC.MAC(authKey, encoding.Concat3(nonce, inner, ctc))
 }
 
+// cleartextCredentials returns the cleartext credentials, with the application context if it's bound to the envelope.
+func (m *Mailer) cleartextCredentials(clientPublicKey, serverPublicKey, idc, ids,
+	appContext []byte) *CleartextCredentials {
+	ctc := CreateCleartextCredentials(clientPublicKey, serverPublicKey, idc, ids)
+	if m.BindAppContext {
+		// never nil, so that an empty context is still encoded
+		ctc.AppContext = append([]byte{}, appContext...)
+	}
+
+	return ctc
+}
+
 func (m *Mailer) CreateEnvelope(mode Mode, randomizedPwd, serverPublicKey, clientSecretKey []byte,
 	creds *Credentials) (envelope *Envelope, publicKey, exportKey []byte, err error) {
 	// testing: integrated to support testing with set nonce
 	nonce := creds.EnvelopeNonce
 	if nonce == nil {
-		nonce = internal.RandomBytes(m.NonceLen)
+		nonce = m.Random(m.NonceLen)
 	}
 
 	authKey, exportKey := m.buildKeys(randomizedPwd, nonce)
+	defer m.Wipe(authKey)
 
 	inner, clientPublicKey, err := m.inner(mode).buildInnerEnvelope(randomizedPwd, nonce, clientSecretKey)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	ctc := CreateCleartextCredentials(clientPublicKey, serverPublicKey, creds.Idc, creds.Ids)
+	ctc := m.cleartextCredentials(clientPublicKey, serverPublicKey, creds.Idc, creds.Ids, creds.AppContext)
 	authTag := m.authTag(authKey, nonce, inner, ctc.Serialize())
 
 	envelope = &Envelope{
@@ -117,19 +140,21 @@ func (m *Mailer) CreateEnvelope(mode Mode, randomizedPwd, serverPublicKey, clien
 }
 
 // RecoverEnvelope assumes that the envelope's inner envelope has been previously checked to be of correct size.
-func (m *Mailer) RecoverEnvelope(mode Mode, randomizedPwd, serverPublicKey, idc, ids []byte,
+func (m *Mailer) RecoverEnvelope(mode Mode, randomizedPwd, serverPublicKey, idc, ids, appContext []byte,
 	envelope *Envelope) (clientSecretKey group.Scalar, clientPublicKey group.Element, exportKey []byte, err error) {
 	authKey, exportKey := m.buildKeys(randomizedPwd, envelope.Nonce)
+	defer m.Wipe(authKey)
 
 	clientSecretKey, clientPublicKey, err = m.inner(mode).recoverKeys(randomizedPwd, envelope.Nonce, envelope.InnerEnvelope)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	ctc := CreateCleartextCredentials(clientPublicKey.Bytes(), serverPublicKey, idc, ids)
+	ctc := m.cleartextCredentials(clientPublicKey.Bytes(), serverPublicKey, idc, ids, appContext)
 
 	expectedTag := m.authTag(authKey, envelope.Nonce, envelope.InnerEnvelope, ctc.Serialize())
 	if !m.MAC.Equal(expectedTag, envelope.AuthTag) {
+		m.ObserveMACFailure(internal.StageEnvelope)
 		return nil, nil, nil, errEnvelopeInvalidTag
 	}
 
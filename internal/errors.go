@@ -11,5 +11,46 @@ package internal
 
 import "errors"
 
-// ErrConfigurationInvalidLength happens when deserializing a configuration of invalid length.
-var ErrConfigurationInvalidLength = errors.New("invalid encoded configuration length")
+var (
+	// ErrConfigurationInvalidLength happens when deserializing a configuration of invalid length.
+	ErrConfigurationInvalidLength = errors.New("invalid encoded configuration length")
+
+	// ErrInvalidMessageLength happens when deserializing a message of invalid length.
+	ErrInvalidMessageLength = errors.New("invalid message length")
+
+	// ErrNonCanonicalPoint happens when deserializing a point that is not the canonical encoding of a group element.
+	ErrNonCanonicalPoint = errors.New("invalid or non-canonical point encoding")
+
+	// ErrIdentityElementKey happens when a public key is the identity element of its group.
+	ErrIdentityElementKey = errors.New("public key is the identity element")
+
+	// ErrInvalidScalar happens when decoding a scalar that doesn't have the group's scalar length, or isn't reduced
+	// modulo the group order.
+	ErrInvalidScalar = errors.New("invalid scalar encoding")
+
+	// ErrVersionMismatch happens when a KE1 doesn't carry the protocol version pinned in the configuration, or carries
+	// one while none is pinned.
+	ErrVersionMismatch = errors.New("protocol version mismatch")
+
+	errIdentityPoint = errors.New("point is the identity element")
+)
+
+// MessageLengthError is returned when deserializing a message of invalid length, and carries the expected and actual
+// lengths for diagnostics. It reads and unwraps as ErrInvalidMessageLength.
+type MessageLengthError struct {
+	Expected, Actual int
+}
+
+// Error implements the error interface.
+func (e *MessageLengthError) Error() string {
+	return ErrInvalidMessageLength.Error()
+}
+
+// Unwrap returns ErrInvalidMessageLength.
+func (e *MessageLengthError) Unwrap() error {
+	return ErrInvalidMessageLength
+}
+
+func lengthError(expected, actual int) error {
+	return &MessageLengthError{Expected: expected, Actual: actual}
+}
@@ -0,0 +1,51 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package internal
+
+import (
+	"github.com/bytemare/opaque/internal/encoding"
+	"github.com/bytemare/opaque/internal/tag"
+)
+
+// OPRFEvaluator runs the server side of the OPRF. It allows the OPRF keys to be held outside of the process, e.g. in
+// an HSM or across the key holders of a threshold OPRF.
+type OPRFEvaluator interface {
+	// DeriveKey returns a reference to the OPRF key of the client with the credential identifier, derived from an OPRF
+	// seed held by the evaluator. The reference is only given back to Evaluate, and can be the key itself or a handle
+	// to it.
+	DeriveKey(credentialIdentifier []byte) ([]byte, error)
+
+	// Evaluate returns the evaluated element for the blinded element, with the OPRF key referenced by key.
+	Evaluate(key, blindedElement []byte) ([]byte, error)
+}
+
+type evaluator struct {
+	*Parameters
+	oprfSeed []byte
+}
+
+// NewOPRFEvaluator returns the built-in OPRFEvaluator for the parameters and the OPRF seed, whose key references are
+// the encoded keys.
+func NewOPRFEvaluator(p *Parameters, oprfSeed []byte) OPRFEvaluator {
+	return &evaluator{p, oprfSeed}
+}
+
+func (e *evaluator) DeriveKey(credentialIdentifier []byte) ([]byte, error) {
+	ku := e.OPRF.DeriveKey(e.OPRFKeySeed(e.oprfSeed, credentialIdentifier), []byte(tag.DeriveKeyPair))
+	return encoding.SerializeScalar(ku, e.OPRFGroup), nil
+}
+
+func (e *evaluator) Evaluate(key, blindedElement []byte) ([]byte, error) {
+	ku, err := e.OPRFGroup.NewScalar().Decode(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.OPRF.Server(ku).Evaluate(blindedElement)
+}
@@ -67,3 +67,17 @@ func (h *Hash) Write(p []byte) {
 type MHF struct {
 	*mhf.MHF
 }
+
+// Enabled returns whether an MHF is set, which is not the case in the test vectors.
+func (m *MHF) Enabled() bool {
+	return m != nil && m.MHF != nil
+}
+
+// Harden returns the password hardened to length bytes, or the password itself if no MHF is set.
+func (m *MHF) Harden(password []byte, length int) []byte {
+	if !m.Enabled() {
+		return password
+	}
+
+	return m.MHF.Harden(password, nil, length)
+}
@@ -24,6 +24,10 @@ type CredentialResponse struct {
 	Data           []byte `json:"data"`
 	MaskingNonce   []byte `json:"mn"`
 	MaskedResponse []byte `json:"mr"`
+
+	// OprfPublicKey and Proof are only set in the verifiable OPRF mode.
+	OprfPublicKey []byte `json:"opk,omitempty"`
+	Proof         []byte `json:"proof,omitempty"`
 }
 
 // Serialize returns the byte encoding of CredentialResponse.
@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package internal
+
+import "time"
+
+// These are the protocol stages, as reported by errors and to an Observer.
+const (
+	StageOPRF     = "OPRF"
+	StageEnvelope = "envelope"
+	StageAKE      = "AKE"
+)
+
+// Observer receives the events of the protocol stages, e.g. for metrics. Its methods are called synchronously, and
+// must return quickly.
+type Observer interface {
+	// OnOPRFEvaluate is called by the server after each OPRF evaluation, with its duration.
+	OnOPRFEvaluate(d time.Duration)
+
+	// OnAKEResponse is called by the server after computing each KE2's AKE response, with its duration.
+	OnAKEResponse(d time.Duration)
+
+	// OnMACFailure is called when a MAC doesn't verify, with the stage that checked it: the envelope's authentication
+	// tag on the client, or the server's or client's MAC in the AKE.
+	OnMACFailure(stage string)
+
+	// OnMHF is called by the client after hardening the OPRF output when building or recovering the envelope, with the
+	// duration of the MHF. It's not called if no MHF is set.
+	OnMHF(d time.Duration)
+}
+
+// ObserveStart returns the current time if an Observer is set, to time a step, and the zero time otherwise.
+func (p *Parameters) ObserveStart() time.Time {
+	if p.Observer == nil {
+		return time.Time{}
+	}
+
+	return time.Now()
+}
+
+// ObserveOPRF reports the OPRF evaluation started at start, if an Observer is set.
+func (p *Parameters) ObserveOPRF(start time.Time) {
+	if p.Observer != nil {
+		p.Observer.OnOPRFEvaluate(time.Since(start))
+	}
+}
+
+// ObserveAKEResponse reports the AKE response started at start, if an Observer is set.
+func (p *Parameters) ObserveAKEResponse(start time.Time) {
+	if p.Observer != nil {
+		p.Observer.OnAKEResponse(time.Since(start))
+	}
+}
+
+// ObserveMHF reports the MHF started at start, if an Observer is set.
+func (p *Parameters) ObserveMHF(start time.Time) {
+	if p.Observer != nil {
+		p.Observer.OnMHF(time.Since(start))
+	}
+}
+
+// ObserveMACFailure reports a MAC failure in the stage, if an Observer is set.
+func (p *Parameters) ObserveMACFailure(stage string) {
+	if p.Observer != nil {
+		p.Observer.OnMACFailure(stage)
+	}
+}
@@ -21,14 +21,20 @@ const dstFinalizePrefix = "Finalize-"
 
 type Client struct {
 	*oprf
-	input []byte
-	blind group.Scalar
+	input   []byte
+	blind   group.Scalar
+	blinded group.Element
 }
 
 func (c *Client) SetBlind(blind group.Scalar) {
 	c.blind = blind
 }
 
+// GetBlind returns the blind, or nil if none is set.
+func (c *Client) GetBlind() group.Scalar {
+	return c.blind
+}
+
 func (c *Client) Blind(input []byte) []byte {
 	if c.blind == nil {
 		c.blind = c.group.NewScalar().Random()
@@ -36,8 +42,9 @@ func (c *Client) Blind(input []byte) []byte {
 
 	p := c.group.HashToGroup(input, c.dst(hash2groupDSTPrefix))
 	c.input = input
+	c.blinded = p.Mult(c.blind)
 
-	return p.Mult(c.blind).Bytes()
+	return c.blinded.Bytes()
 }
 
 func (o *oprf) hashTranscript(input, unblinded []byte) []byte {
@@ -54,6 +54,12 @@ func (c Ciphersuite) register(h hash.Hashing) {
 	suiteToHash[c] = h
 }
 
+// Available returns whether the cipher suite is registered for the OPRF.
+func (c Ciphersuite) Available() bool {
+	_, ok := suiteToHash[c]
+	return ok
+}
+
 func (c Ciphersuite) Group() ciphersuite.Identifier {
 	return ciphersuite.Identifier(c)
 }
@@ -62,12 +68,14 @@ func (c Ciphersuite) hash() hash.Hashing {
 	return suiteToHash[c]
 }
 
-func contextString(id Ciphersuite) []byte {
+// contextString returns the context string of the ciphersuite, suffixed with the application's domain separation.
+func contextString(id Ciphersuite, domain []byte) []byte {
 	v := []byte(version)
-	ctx := make([]byte, 0, len(v)+1+2)
+	ctx := make([]byte, 0, len(v)+1+2+len(domain))
 	ctx = append(ctx, v...)
 	ctx = append(ctx, encoding.I2OSP(int(base), 1)...)
 	ctx = append(ctx, encoding.I2OSP(int(id), 2)...)
+	ctx = append(ctx, domain...)
 
 	return ctx
 }
@@ -93,29 +101,34 @@ func (c Ciphersuite) DeriveKey(input, dst []byte) group.Scalar {
 	return c.Group().HashToScalar(input, dst)
 }
 
+func (c Ciphersuite) new(domain []byte) *oprf {
+	return &oprf{
+		id:            c,
+		group:         c.Group(),
+		hash:          c.hash().Get(),
+		contextString: contextString(c, domain),
+	}
+}
+
 // Client returns an OPRF client.
 func (c Ciphersuite) Client() *Client {
-	client := &Client{
-		oprf: &oprf{
-			id:            c,
-			group:         c.Group(),
-			hash:          c.hash().Get(),
-			contextString: contextString(c),
-		},
-	}
+	return c.ClientWithDomain(nil)
+}
 
-	return client
+// ClientWithDomain returns an OPRF client whose DSTs are separated with domain.
+func (c Ciphersuite) ClientWithDomain(domain []byte) *Client {
+	return &Client{oprf: c.new(domain)}
 }
 
 // Server returns an OPRF server.
 func (c Ciphersuite) Server(privateKey group.Scalar) *Server {
+	return c.ServerWithDomain(privateKey, nil)
+}
+
+// ServerWithDomain returns an OPRF server whose DSTs are separated with domain.
+func (c Ciphersuite) ServerWithDomain(privateKey group.Scalar, domain []byte) *Server {
 	return &Server{
-		oprf: &oprf{
-			id:            c,
-			group:         c.Group(),
-			hash:          c.hash().Get(),
-			contextString: contextString(c),
-		},
+		oprf:       c.new(domain),
 		privateKey: privateKey,
 	}
 }
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+// Package oprf implements the Elliptic Curve Oblivious Pseudorandom Function (EC-OPRF) from https://tools.ietf.org/html/draft-irtf-cfrg-voprf.
+package oprf
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"github.com/bytemare/cryptotools/group"
+
+	"github.com/bytemare/opaque/internal/encoding"
+)
+
+const dstChallengePrefix = "Challenge-"
+
+// ErrInvalidProof indicates that the DLEQ proof does not verify.
+var ErrInvalidProof = errors.New("invalid OPRF proof")
+
+// challenge returns the Fiat-Shamir challenge scalar of the DLEQ proof that log_G(pk) == log_M(Z).
+func (o *oprf) challenge(pk, blinded, evaluated, t2, t3 group.Element) group.Scalar {
+	input := encoding.Concatenate(
+		encoding.EncodeVector(o.group.Base().Bytes()),
+		encoding.EncodeVector(pk.Bytes()),
+		encoding.EncodeVector(blinded.Bytes()),
+		encoding.EncodeVector(evaluated.Bytes()),
+		encoding.EncodeVector(t2.Bytes()),
+		encoding.EncodeVector(t3.Bytes()))
+
+	return o.group.HashToScalar(input, o.dst(dstChallengePrefix))
+}
+
+// PublicKey returns the public commitment to the server's OPRF private key.
+func (s *Server) PublicKey() []byte {
+	return encoding.SerializePoint(s.group.Base().Mult(s.privateKey), s.id.Group())
+}
+
+// EvaluateWithProof returns the evaluation of the blinded element, the public commitment to the OPRF key, and a
+// DLEQ proof that the evaluation was done with the committed key.
+func (s *Server) EvaluateWithProof(blindedElement []byte) (evaluated, publicKey, proof []byte, err error) {
+	evaluated, err = s.Evaluate(blindedElement)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// These have already been successfully decoded or computed.
+	m, _ := s.group.NewElement().Decode(blindedElement)
+	z, _ := s.group.NewElement().Decode(evaluated)
+	pk := s.group.Base().Mult(s.privateKey)
+
+	r := s.group.NewScalar().Random()
+	t2 := s.group.Base().Mult(r)
+	t3 := m.Mult(r)
+	c := s.challenge(pk, m, z, t2, t3)
+	sc := r.Sub(c.Mult(s.privateKey))
+
+	proof = encoding.Concat(encoding.SerializeScalar(c, s.id.Group()), encoding.SerializeScalar(sc, s.id.Group()))
+
+	return evaluated, encoding.SerializePoint(pk, s.id.Group()), proof, nil
+}
+
+// VerifyProof verifies the DLEQ proof that the evaluated element is the product of the client's blinded element with
+// the private key committed to in publicKey.
+func (c *Client) VerifyProof(publicKey, evaluated, proof []byte) error {
+	scalarLength := encoding.ScalarLength[c.id.Group()]
+	if c.blinded == nil || len(proof) != 2*scalarLength {
+		return ErrInvalidProof
+	}
+
+	pk, err := c.group.NewElement().Decode(publicKey)
+	if err != nil {
+		return ErrInvalidProof
+	}
+
+	z, err := c.group.NewElement().Decode(evaluated)
+	if err != nil {
+		return ErrInvalidProof
+	}
+
+	ch, err := c.group.NewScalar().Decode(proof[:scalarLength])
+	if err != nil {
+		return ErrInvalidProof
+	}
+
+	sc, err := c.group.NewScalar().Decode(proof[scalarLength:])
+	if err != nil {
+		return ErrInvalidProof
+	}
+
+	t2 := c.group.Base().Mult(sc).Add(pk.Mult(ch))
+	t3 := c.blinded.Mult(sc).Add(z.Mult(ch))
+	expected := encoding.SerializeScalar(c.challenge(pk, c.blinded, z, t2, t3), c.id.Group())
+
+	if subtle.ConstantTimeCompare(expected, proof[:scalarLength]) != 1 {
+		return ErrInvalidProof
+	}
+
+	return nil
+}
@@ -10,11 +10,14 @@
 package oprf
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/bytemare/cryptotools/group"
 )
 
+var errIdentityElement = errors.New("invalid blinded element: identity element")
+
 type Server struct {
 	*oprf
 	privateKey group.Scalar
@@ -26,5 +29,10 @@ func (s *Server) Evaluate(blindedElement []byte) ([]byte, error) {
 		return nil, fmt.Errorf("can't evaluate input : %w", err)
 	}
 
+	// The groups are of prime order, so the identity is the only low-order element.
+	if b.IsIdentity() {
+		return nil, fmt.Errorf("can't evaluate input : %w", errIdentityElement)
+	}
+
 	return b.Mult(s.privateKey).Bytes(), nil
 }
@@ -24,23 +24,40 @@ const (
 
 	// External Mode tags.
 
-	Pad = "Pad"
+	Pad                    = "Pad"
+	DeterministicClientKey = "DeterministicClientKey"
+
+	// AEAD Mode tags.
+
+	AEADKey = "AEADKey"
 
 	// 3DH tags.
 
 	VersionTag  = "RFCXXXX"
+	Version     = "ProtocolVersion"
 	LabelPrefix = "OPAQUE-"
 	Handshake   = "HandshakeSecret"
 	Session     = "SessionKey"
 	MacServer   = "ServerMAC"
 	MacClient   = "ClientMAC"
+	PurposeKey  = "PurposeKey"
+	KE3AAD      = "KE3AAD"
+	AppID       = "ApplicationID"
 
 	// Client tags.
 
 	CredentialResponsePad = "CredentialResponsePad"
+	RandomScalarDST       = "OPAQUE-RandomScalar"
+	AppKey                = "AppKey"
 
 	// Server tags.
 
-	OprfKey       = "OprfKey"
-	DeriveKeyPair = "OPAQUE-DeriveKeyPair"
+	OprfKey        = "OprfKey"
+	OprfSeed       = "OprfSeed"
+	FakeRecord     = "FakeRecord"
+	FakePublicKey  = "FakePublicKey"
+	FakeMaskingKey = "FakeMaskingKey"
+	PremaskNonce   = "PremaskNonce"
+	DeriveKeyPair  = "OPAQUE-DeriveKeyPair"
+	ServerKeyPair  = "ServerKeyPair"
 )
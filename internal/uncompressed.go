@@ -0,0 +1,164 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package internal
+
+import (
+	"crypto/elliptic"
+
+	"github.com/bytemare/cryptotools/group/ciphersuite"
+
+	"github.com/bytemare/opaque/internal/encoding"
+)
+
+// uncompressedTag is the first byte of an uncompressed SEC1 point encoding.
+const uncompressedTag = 0x04
+
+var nistCurves = map[ciphersuite.Identifier]elliptic.Curve{
+	ciphersuite.P256Sha256: elliptic.P256(),
+	ciphersuite.P384Sha512: elliptic.P384(),
+	ciphersuite.P521Sha512: elliptic.P521(),
+}
+
+// field is a component of a serialized message: a point of group if it's set, and otherwise length bytes.
+type field struct {
+	group  ciphersuite.Identifier
+	length int
+}
+
+func (p *Parameters) registrationRequestLayout() []field {
+	return []field{{group: p.OPRFGroup}}
+}
+
+func (p *Parameters) registrationResponseLayout() []field {
+	return p.withProof([]field{{group: p.OPRFGroup}, {group: p.AKEGroup}})
+}
+
+func (p *Parameters) registrationUploadLayout() []field {
+	return []field{{group: p.AKEGroup}, {length: p.Hash.Size() + p.EnvelopeSize}}
+}
+
+func (p *Parameters) ke1Layout() []field {
+	return []field{{group: p.OPRFGroup}, {length: p.NonceLen}, {group: p.AKEGroup}, {length: len(p.VersionID())}}
+}
+
+// ke2Layout doesn't include the server public key in the masked response, which must be compressed.
+func (p *Parameters) ke2Layout() []field {
+	return p.withProof([]field{
+		{group: p.OPRFGroup},
+		{length: 2*p.NonceLen + p.AkePointLength + p.EnvelopeSize},
+		{group: p.AKEGroup},
+		{length: p.MAC.Size()},
+	})
+}
+
+func (p *Parameters) withProof(fields []field) []field {
+	if !p.VerifiableOPRF {
+		return fields
+	}
+
+	return append(fields, field{group: p.OPRFGroup}, field{length: 2 * encoding.ScalarLength[p.OPRFGroup]})
+}
+
+// fieldEnds returns the offsets in input of the ends of the fields of the layout, whose NIST points can be
+// uncompressed if p.AcceptUncompressedPoints is set. expected is the length of the message with compressed points.
+func (p *Parameters) fieldEnds(input []byte, layout []field, expected int) ([]int, error) {
+	ends := make([]int, len(layout))
+	offset := 0
+
+	for i, f := range layout {
+		offset += p.fieldLength(input, offset, f)
+		if offset > len(input) {
+			return nil, lengthError(expected, len(input))
+		}
+
+		ends[i] = offset
+	}
+
+	if offset != len(input) {
+		return nil, lengthError(expected, len(input))
+	}
+
+	return ends, nil
+}
+
+// fieldLength returns the length of the field starting at offset in input.
+func (p *Parameters) fieldLength(input []byte, offset int, f field) int {
+	if f.group == 0 {
+		return f.length
+	}
+
+	if _, isNist := nistCurves[f.group]; isNist && p.AcceptUncompressedPoints && offset < len(input) &&
+		input[offset] == uncompressedTag {
+		return 1 + 2*(encoding.PointLength[f.group]-1)
+	}
+
+	return encoding.PointLength[f.group]
+}
+
+// receivedKE1Version returns the bytes following the ephemeral public key of the KE1 received as input, where the
+// version identifier is, and false if input is too short to hold them.
+func (p *Parameters) receivedKE1Version(input []byte) ([]byte, bool) {
+	offset := 0
+
+	for _, f := range p.ke1Layout()[:3] {
+		offset += p.fieldLength(input, offset, f)
+	}
+
+	if offset > len(input) {
+		return nil, false
+	}
+
+	return input[offset:], true
+}
+
+// compressPoints returns input with the uncompressed points of the NIST groups in the layout replaced by their
+// compressed encoding, if p.AcceptUncompressedPoints is set, and input otherwise. expected is the length of the
+// message with compressed points.
+func (p *Parameters) compressPoints(input []byte, layout []field, expected int) ([]byte, error) {
+	if !p.AcceptUncompressedPoints {
+		return input, nil
+	}
+
+	ends, err := p.fieldEnds(input, layout, expected)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, expected)
+	start := 0
+
+	for i, f := range layout {
+		in := input[start:ends[i]]
+		start = ends[i]
+
+		if f.group != 0 && len(in) != encoding.PointLength[f.group] {
+			x, y := elliptic.Unmarshal(nistCurves[f.group], in)
+			if x == nil {
+				return nil, ErrNonCanonicalPoint
+			}
+
+			in = elliptic.MarshalCompressed(nistCurves[f.group], x, y)
+		}
+
+		out = append(out, in...)
+	}
+
+	return out, nil
+}
+
+// ReceivedKE2Transcript returns the credential response, server nonce, and server ephemeral public key of the KE2
+// received as input, as they were encoded on the wire.
+func (p *Parameters) ReceivedKE2Transcript(input []byte) (credentialResponse, nonceS, epkS []byte) {
+	ends, err := p.fieldEnds(input, p.ke2Layout(), p.KE2Length())
+	if err != nil {
+		return nil, nil, nil
+	}
+
+	return input[:ends[1]-p.NonceLen], input[ends[1]-p.NonceLen : ends[1]], input[ends[1]:ends[2]]
+}
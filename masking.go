@@ -0,0 +1,44 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import "github.com/bytemare/opaque/internal"
+
+// The masked response in KE2 is the concatenation of the server public key and the client's envelope, XORed with a
+// pad derived from the record's masking key and the masking nonce. The following functions allow computing it outside
+// of the login flow, e.g. to store pre-masked responses. Masking and unmasking are the same operation, and the masking
+// nonce must never be reused with the same masking key for different inputs.
+
+func maskResponse(p *internal.Parameters, maskingKey, nonce, input []byte) ([]byte, error) {
+	if len(input) != p.AkePointLength+p.EnvelopeSize {
+		return nil, errInvalidMaskedLength
+	}
+
+	return p.MaskResponse(maskingKey, nonce, input), nil
+}
+
+// Mask returns the masked response of the plaintext, the concatenation of the server public key and the envelope.
+func (s *Server) Mask(maskingKey, nonce, plaintext []byte) ([]byte, error) {
+	return maskResponse(s.Parameters, maskingKey, nonce, plaintext)
+}
+
+// Unmask returns the concatenation of the server public key and the envelope in the masked response.
+func (s *Server) Unmask(maskingKey, nonce, masked []byte) ([]byte, error) {
+	return maskResponse(s.Parameters, maskingKey, nonce, masked)
+}
+
+// Mask returns the masked response of the plaintext, the concatenation of the server public key and the envelope.
+func (c *Client) Mask(maskingKey, nonce, plaintext []byte) ([]byte, error) {
+	return maskResponse(c.Parameters, maskingKey, nonce, plaintext)
+}
+
+// Unmask returns the concatenation of the server public key and the envelope in the masked response.
+func (c *Client) Unmask(maskingKey, nonce, masked []byte) ([]byte, error) {
+	return maskResponse(c.Parameters, maskingKey, nonce, masked)
+}
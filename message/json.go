@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The messages are encoded to JSON as objects of their fields, named after their JSON tags, and holding base64
+// strings. Their UnmarshalJSON methods reject unknown, missing, and trailing data, but the lengths of the fields depend
+// on the configuration: a decoded message must be validated with the Deserialize functions of a Client or Server, e.g.
+// with server.DeserializeKE1(ke1.Serialize()), before being used.
+
+var (
+	// ErrMissingField happens when decoding a message from JSON that lacks one of its mandatory fields.
+	ErrMissingField = errors.New("missing message field")
+
+	errTrailingJSON = errors.New("trailing data after JSON message")
+)
+
+// The following types have the fields of the messages, but not their methods, to be decoded without recursion.
+type (
+	registrationRequest  RegistrationRequest
+	registrationResponse RegistrationResponse
+	registrationUpload   RegistrationUpload
+	ke1                  KE1
+	ke2                  KE2
+	ke3                  KE3
+)
+
+// decodeJSON decodes data into v, rejecting unknown fields and trailing data.
+func decodeJSON(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+
+	if _, err := d.Token(); err != io.EOF {
+		return errTrailingJSON
+	}
+
+	return nil
+}
+
+// requireFields returns ErrMissingField naming the first of the fields that is empty.
+func requireFields(names []string, fields ...[]byte) error {
+	for i, f := range fields {
+		if len(f) == 0 {
+			return fmt.Errorf("%w %q", ErrMissingField, names[i])
+		}
+	}
+
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *RegistrationRequest) UnmarshalJSON(data []byte) error {
+	if err := decodeJSON(data, (*registrationRequest)(r)); err != nil {
+		return err
+	}
+
+	return requireFields([]string{"data"}, r.Data)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *RegistrationResponse) UnmarshalJSON(data []byte) error {
+	if err := decodeJSON(data, (*registrationResponse)(r)); err != nil {
+		return err
+	}
+
+	return requireFields([]string{"data", "pks"}, r.Data, r.Pks)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *RegistrationUpload) UnmarshalJSON(data []byte) error {
+	if err := decodeJSON(data, (*registrationUpload)(r)); err != nil {
+		return err
+	}
+
+	return requireFields([]string{"pku", "msk", "env"}, r.PublicKey, r.MaskingKey, r.Envelope)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (m *KE1) UnmarshalJSON(data []byte) error {
+	if err := decodeJSON(data, (*ke1)(m)); err != nil {
+		return err
+	}
+
+	if m.CredentialRequest == nil {
+		return fmt.Errorf("%w %q", ErrMissingField, "data")
+	}
+
+	return requireFields([]string{"data", "n", "e"}, m.Data, m.NonceU, m.EpkU)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (m *KE2) UnmarshalJSON(data []byte) error {
+	if err := decodeJSON(data, (*ke2)(m)); err != nil {
+		return err
+	}
+
+	if m.CredentialResponse == nil {
+		return fmt.Errorf("%w %q", ErrMissingField, "data")
+	}
+
+	return requireFields([]string{"data", "mn", "mr", "n", "e", "m"}, m.Data, m.MaskingNonce, m.MaskedResponse,
+		m.NonceS, m.EpkS, m.Mac)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (k *KE3) UnmarshalJSON(data []byte) error {
+	if err := decodeJSON(data, (*ke3)(k)); err != nil {
+		return err
+	}
+
+	return requireFields([]string{"m"}, k.Mac)
+}
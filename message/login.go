@@ -19,11 +19,19 @@ type KE1 struct {
 	*message.CredentialRequest
 	NonceU []byte `json:"n"`
 	EpkU   []byte `json:"e"`
+
+	// Version identifies the client's protocol version if the configuration pins one, and is nil otherwise.
+	Version []byte `json:"v,omitempty"`
+
+	// Received, if set, is the encoding of the message on the wire when it differs from Serialize, e.g. with
+	// uncompressed points, and is hashed in the AKE transcript instead.
+	Received []byte `json:"-"`
 }
 
-// Serialize returns the byte encoding of KE1.
+// Serialize returns the byte encoding of KE1. If the configuration pins a protocol version, its identifier is
+// appended.
 func (m *KE1) Serialize() []byte {
-	return encoding.Concat3(m.CredentialRequest.Serialize(), m.NonceU, m.EpkU)
+	return encoding.Concatenate(m.CredentialRequest.Serialize(), m.NonceU, m.EpkU, m.Version)
 }
 
 // KE2 is the second message of the login flow, created by the server and sent to the client.
@@ -32,11 +40,16 @@ type KE2 struct {
 	NonceS []byte `json:"n"`
 	EpkS   []byte `json:"e"`
 	Mac    []byte `json:"m"`
+
+	// Received, if set, is the encoding of the message on the wire when it differs from Serialize, e.g. with
+	// uncompressed points, and its credential response and server key share are hashed in the AKE transcript instead.
+	Received []byte `json:"-"`
 }
 
-// Serialize returns the byte encoding of KE2.
+// Serialize returns the byte encoding of KE2. In the verifiable OPRF mode, the OPRF public key and the proof are
+// appended, outside of the credential response that is part of the AKE transcript.
 func (m *KE2) Serialize() []byte {
-	return encoding.Concat(m.CredentialResponse.Serialize(), encoding.Concat3(m.NonceS, m.EpkS, m.Mac))
+	return encoding.Concatenate(m.CredentialResponse.Serialize(), m.NonceS, m.EpkS, m.Mac, m.OprfPublicKey, m.Proof)
 }
 
 // KE3 is the third and last message of the login flow, created by the client and sent to the server.
@@ -48,3 +61,17 @@ type KE3 struct {
 func (k KE3) Serialize() []byte {
 	return k.Mac
 }
+
+// TranscriptInputs holds the components of the AKE transcript, in the order they are hashed. It allows applications to
+// recompute or bind to the transcript, e.g. for channel binding.
+type TranscriptInputs struct {
+	ProtocolVersion    []byte `json:"version,omitempty"`
+	Context            []byte `json:"ctx"`
+	ApplicationID      []byte `json:"appid,omitempty"`
+	ClientIdentity     []byte `json:"idc"`
+	KE1                []byte `json:"ke1"`
+	ServerIdentity     []byte `json:"ids"`
+	CredentialResponse []byte `json:"cr"`
+	NonceS             []byte `json:"n"`
+	EpkS               []byte `json:"e"`
+}
@@ -25,11 +25,16 @@ func (r *RegistrationRequest) Serialize() []byte {
 type RegistrationResponse struct {
 	Data []byte `json:"data"`
 	Pks  []byte `json:"pks"`
+
+	// OprfPublicKey and Proof are only set in the verifiable OPRF mode.
+	OprfPublicKey []byte `json:"opk,omitempty"`
+	Proof         []byte `json:"proof,omitempty"`
 }
 
-// Serialize returns the byte encoding of RegistrationResponse.
+// Serialize returns the byte encoding of RegistrationResponse. In the verifiable OPRF mode, the OPRF public key and
+// the proof are appended.
 func (r *RegistrationResponse) Serialize() []byte {
-	return encoding.Concat(r.Data, r.Pks)
+	return encoding.Concatenate(r.Data, r.Pks, r.OprfPublicKey, r.Proof)
 }
 
 // RegistrationUpload represents the client record sent as the last registration message by the client to the server.
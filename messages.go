@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import (
+	"errors"
+
+	"github.com/bytemare/opaque/internal"
+	"github.com/bytemare/opaque/internal/encoding"
+)
+
+var (
+	// ErrUnknownMessageType indicates that the length of a serialized message matches no message of the configuration.
+	ErrUnknownMessageType = errors.New("unknown message type")
+
+	// ErrAmbiguousMessageType indicates that the length of a serialized message matches more than one message type.
+	ErrAmbiguousMessageType = errors.New("ambiguous message type")
+
+	// ErrInvalidMessageLength indicates that a message to deserialize doesn't have the expected length. The Deserialize*
+	// methods return a *MessageLengthError wrapping it.
+	ErrInvalidMessageLength = internal.ErrInvalidMessageLength
+
+	// ErrNonCanonicalPoint indicates that a deserialized RegistrationUpload or KE2 holds a public key that is not the
+	// canonical encoding of a group element, e.g. a non-canonical Ristretto encoding.
+	ErrNonCanonicalPoint = internal.ErrNonCanonicalPoint
+
+	// ErrInvalidScalar indicates that a secret key doesn't have the scalar length of its group, or isn't below the
+	// group order.
+	ErrInvalidScalar = internal.ErrInvalidScalar
+
+	// ErrSmallOrderComponent indicates that a point of Curve25519Sha512 or Edwards25519Sha512 is not in the prime-order
+	// subgroup.
+	ErrSmallOrderComponent = encoding.ErrSmallOrderComponent
+)
+
+// MessageLengthError is returned when deserializing a message of invalid length, and carries the expected and actual
+// lengths for diagnostics. It reads and unwraps as ErrInvalidMessageLength.
+type MessageLengthError = internal.MessageLengthError
+
+// MessageType identifies the OPAQUE protocol messages.
+type MessageType byte
+
+const (
+	// RegistrationRequestType identifies the RegistrationRequest message.
+	RegistrationRequestType MessageType = iota + 1
+
+	// RegistrationResponseType identifies the RegistrationResponse message.
+	RegistrationResponseType
+
+	// RegistrationUploadType identifies the RegistrationUpload message.
+	RegistrationUploadType
+
+	// KE1Type identifies the KE1 message.
+	KE1Type
+
+	// KE2Type identifies the KE2 message.
+	KE2Type
+
+	// KE3Type identifies the KE3 message.
+	KE3Type
+)
+
+func messageLengths(p *internal.Parameters) map[MessageType]int {
+	return map[MessageType]int{
+		RegistrationRequestType:  p.RegistrationRequestLength(),
+		RegistrationResponseType: p.RegistrationResponseLength(),
+		RegistrationUploadType:   p.RegistrationUploadLength(),
+		KE1Type:                  p.KE1Length(),
+		KE2Type:                  p.KE2Length(),
+		KE3Type:                  p.KE3Length(),
+	}
+}
+
+// The following methods return the byte length of the serialized messages for a valid configuration, e.g. for framing.
+
+// RegistrationRequestLength returns the byte length of a serialized RegistrationRequest in the configuration.
+func (c *Configuration) RegistrationRequestLength() int {
+	return c.toInternal().RegistrationRequestLength()
+}
+
+// RegistrationResponseLength returns the byte length of a serialized RegistrationResponse in the configuration.
+func (c *Configuration) RegistrationResponseLength() int {
+	return c.toInternal().RegistrationResponseLength()
+}
+
+// RegistrationUploadLength returns the byte length of a serialized RegistrationUpload in the configuration.
+func (c *Configuration) RegistrationUploadLength() int {
+	return c.toInternal().RegistrationUploadLength()
+}
+
+// KE1Length returns the byte length of a serialized KE1 in the configuration.
+func (c *Configuration) KE1Length() int {
+	return c.toInternal().KE1Length()
+}
+
+// KE2Length returns the byte length of a serialized KE2 in the configuration.
+func (c *Configuration) KE2Length() int {
+	return c.toInternal().KE2Length()
+}
+
+// KE3Length returns the byte length of a serialized KE3 in the configuration.
+func (c *Configuration) KE3Length() int {
+	return c.toInternal().KE3Length()
+}
+
+// PeekMessageType classifies the serialized message by its length against the configuration, without deserializing
+// it. ErrAmbiguousMessageType is returned if multiple messages have the same length in the configuration (e.g. KE3 and
+// RegistrationResponse with Ristretto255 and SHA-512), and ErrUnknownMessageType if none matches.
+func PeekMessageType(data []byte, conf *Configuration) (MessageType, error) {
+	if conf == nil {
+		conf = DefaultConfiguration()
+	}
+
+	var (
+		found   MessageType
+		matches int
+	)
+
+	for t, length := range messageLengths(conf.toInternal()) {
+		if len(data) == length {
+			found = t
+			matches++
+		}
+	}
+
+	switch matches {
+	case 0:
+		return 0, ErrUnknownMessageType
+	case 1:
+		return found, nil
+	default:
+		return 0, ErrAmbiguousMessageType
+	}
+}
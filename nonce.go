@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrReplayedNonce indicates that the client nonce of a KE1 was already seen by the server's nonce cache.
+var ErrReplayedNonce = errors.New("replayed client nonce")
+
+// defaultNonceWindow is the default time a MemoryNonceCache remembers the nonces for.
+const defaultNonceWindow = time.Minute
+
+// NonceCache records the client nonces of the KE1 messages answered by a server, to reject replays. A cache shared by
+// several server instances, e.g. in Redis, must record and check the nonce atomically.
+type NonceCache interface {
+	// NonceSeen records the nonce, and reports whether it was already recorded within the cache's window.
+	NonceSeen(nonce []byte) bool
+}
+
+// MemoryNonceCache is an in-memory NonceCache, safe for concurrent use. It remembers the nonces for at least its
+// window, and at most twice as long, so it holds up to the nonces of the logins of two windows: the window bounds its
+// memory use for a given login rate.
+type MemoryNonceCache struct {
+	mu       sync.Mutex
+	window   time.Duration
+	rotated  time.Time
+	current  map[string]struct{}
+	previous map[string]struct{}
+}
+
+// NewMemoryNonceCache returns an empty MemoryNonceCache remembering the nonces for the window, or for a minute if the
+// window is not positive.
+func NewMemoryNonceCache(window time.Duration) *MemoryNonceCache {
+	if window <= 0 {
+		window = defaultNonceWindow
+	}
+
+	return &MemoryNonceCache{
+		window:   window,
+		rotated:  time.Now(),
+		current:  make(map[string]struct{}),
+		previous: make(map[string]struct{}),
+	}
+}
+
+// NonceSeen implements NonceCache.
+func (m *MemoryNonceCache) NonceSeen(nonce []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch now := time.Now(); {
+	case now.Sub(m.rotated) >= 2*m.window:
+		m.previous, m.current = make(map[string]struct{}), make(map[string]struct{})
+		m.rotated = now
+	case now.Sub(m.rotated) >= m.window:
+		m.previous, m.current = m.current, make(map[string]struct{})
+		m.rotated = now
+	}
+
+	key := string(nonce)
+
+	_, inCurrent := m.current[key]
+	_, inPrevious := m.previous[key]
+
+	m.current[key] = struct{}{}
+
+	return inCurrent || inPrevious
+}
+
+// SetNonceCache sets the cache consulted by Init, which then returns ErrReplayedNonce if the client nonce of the KE1
+// was already seen. It is nil by default, and the server then answers replayed KE1 messages.
+func (s *Server) SetNonceCache(cache NonceCache) {
+	s.nonceCache = cache
+}
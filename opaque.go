@@ -12,20 +12,52 @@
 //
 // This package implements the official OPAQUE definition. For protocol details, please refer to the IETF protocol
 // document at https://datatracker.ietf.org/doc/draft-irtf-cfrg-opaque.
-//
 package opaque
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+
 	"github.com/bytemare/cryptotools/group/ciphersuite"
 	"github.com/bytemare/cryptotools/hash"
 	"github.com/bytemare/cryptotools/mhf"
 
 	"github.com/bytemare/opaque/internal"
 	"github.com/bytemare/opaque/internal/encoding"
+	"github.com/bytemare/opaque/internal/envelope"
 	"github.com/bytemare/opaque/internal/oprf"
 	"github.com/bytemare/opaque/message"
 )
 
+var (
+	// ErrMissingIdentity indicates that a client or server identity is nil while the configuration requires explicit
+	// identities.
+	ErrMissingIdentity = errors.New("missing identity: explicit identities are required")
+
+	// ErrUnknownRecordMode indicates that the envelope length of a record matches no mode of the configuration.
+	ErrUnknownRecordMode = errors.New("record envelope length matches no mode")
+
+	errInvalidGroup = errors.New("unsupported group")
+	errInvalidKDF   = errors.New("unsupported KDF hashing")
+	errInvalidMAC   = errors.New("unsupported MAC hashing")
+	errInvalidHash  = errors.New("unsupported Hash hashing")
+	errInvalidMHF   = errors.New("unsupported MHF")
+	errInvalidMode  = errors.New("unsupported envelope mode")
+	errNonceLength  = errors.New("nonce length too short")
+	errMHFParams    = errors.New("invalid MHF parameters")
+	errShortNonce   = errors.New("nonce length too short for the expected number of registrations")
+
+	errEvaluatorVerifiable = errors.New("custom OPRF evaluators don't support the verifiable OPRF mode")
+	errAppIDLength         = errors.New("application ID too long")
+	errEphemeralWindow     = errors.New("invalid ephemeral reuse window")
+	errKDFSaltLength       = errors.New("KDF salt too long")
+	errOPRFDomainLength    = errors.New("OPRF domain separation too long")
+	errMaxInputLength      = errors.New("negative maximum input length")
+)
+
 // Mode designates OPAQUE's envelope mode.
 type Mode byte
 
@@ -35,6 +67,11 @@ const (
 
 	// External designates the external mode.
 	External
+
+	// ExternalAEAD designates the external mode with the client secret key encrypted with AES-256-GCM, keyed from the
+	// randomized password, instead of masked with a pad. The key material is then authenticated on its own, and not
+	// only by the envelope's authentication tag.
+	ExternalAEAD
 )
 
 // Group identifies the prime-order group with hash-to-curve capability to use in OPRF and AKE.
@@ -56,20 +93,48 @@ const (
 	// P521Sha512 identifies the NIST P-512 group and SHA-512.
 	P521Sha512 = Group(oprf.P521Sha512)
 
-	confLength = 7
+	// Curve25519Sha512 identifies the Curve25519 group, the group of X25519, and SHA-512. It can only be used as the
+	// AKE group. Its points are encoded as the x-coordinate prefixed with the sign of y, like the NIST groups, and not
+	// as in X25519.
+	Curve25519Sha512 = Group(ciphersuite.Curve25519Sha512)
+
+	// Edwards25519Sha512 identifies the Edwards25519 group, the group of Ed25519, and SHA-512. It can only be used as
+	// the AKE group.
+	Edwards25519Sha512 = Group(ciphersuite.Edwards25519Sha512)
+
+	confLength       = 8
+	legacyConfLength = 7
 )
 
+// PointLength returns the length of an encoded element of the group, e.g. to size buffers for framing, or 0 if the
+// group is unknown.
+func PointLength(g Group) int {
+	return encoding.PointLength[ciphersuite.Identifier(g)]
+}
+
+// ScalarLength returns the length of an encoded scalar of the group, or 0 if the group is unknown.
+func ScalarLength(g Group) int {
+	return encoding.ScalarLength[ciphersuite.Identifier(g)]
+}
+
 // Credentials holds the client and server ids (will certainly disappear in next versions°.
 type Credentials struct {
 	Client, Server              []byte
 	TestEnvNonce, TestMaskNonce []byte
+
+	// AppContext is additional application data bound to the envelope, e.g. a device identifier, which must be given
+	// again at login with FinishWithCredentials. It requires Configuration.BindAppContext.
+	AppContext []byte
 }
 
-// Configuration represents an OPAQUE configuration. Note that OprfGroup and AKEGroup are recommended to be the same,
+// Configuration represents an OPAQUE configuration. Note that OPRFGroup and AKEGroup are recommended to be the same,
 // as well as KDF, MAC, Hash should be the same.
 type Configuration struct {
-	// Group identifies the group and ciphersuite to use for the OPRF and AKE.
-	Group Group `json:"oprf"`
+	// OPRFGroup identifies the group and ciphersuite to use for the OPRF.
+	OPRFGroup Group `json:"oprf"`
+
+	// AKEGroup identifies the group to use for the AKE and the client and server keys.
+	AKEGroup Group `json:"ake"`
 
 	// KDF identifies the hash function to be used for key derivation (e.g. HKDF).
 	// Identifiers are defined in github.com/bytemare/cryptotools/hash.
@@ -86,58 +151,409 @@ type Configuration struct {
 	// defined in github.com/bytemare/cryptotools/mhf.
 	MHF mhf.Identifier `json:"mhf"`
 
+	// MHFParameters optionally sets the cost parameters of the MHF, in the order of
+	// github.com/bytemare/cryptotools/mhf: time, memory in KiB, and threads for Argon2id, N, r, and p for scrypt, and
+	// the iterations or cost for PBKDF2 and bcrypt. The MHF's defaults are used if nil.
+	MHFParameters []int `json:"mhfp,omitempty"`
+
 	// Mode identifies the envelope mode to be used.
 	Mode Mode `json:"mode"`
 
 	// Context is optional shared information to include in the AKE transcript.
 	Context []byte
 
+	// ApplicationID optionally identifies the application, to separate the sessions of applications sharing the same
+	// parameters. It is included in the AKE transcript apart from Context, such that a mismatch between client and
+	// server fails the MAC checks, and is part of the encoding of the configuration.
+	ApplicationID []byte `json:"appid,omitempty"`
+
+	// KDFSalt is an optional, non-secret salt for the HKDF-Extract step of the AKE key schedule, e.g. bound to the
+	// deployment for domain separation. It must be the same on client and server, or the MACs won't verify, and is
+	// part of the encoding of the configuration.
+	KDFSalt []byte `json:"kdfsalt,omitempty"`
+
+	// OPRFDomainSeparation is optionally appended to the OPRF's context string, and hence to the DSTs of hashing the
+	// password to the group and of the OPRF output, to separate the application from other OPRF users of the same
+	// group. Client and server must use the same value, or the passwords won't match, and it is part of the encoding
+	// of the configuration. It can't exceed 200 bytes.
+	OPRFDomainSeparation []byte `json:"oprfdst,omitempty"`
+
+	// ServerIdentity, if set, is the server identity used by the client and the server when none is given in the
+	// credentials or as an argument, so that a stable, human-readable identity can live with the server's long-term
+	// configuration. The server public key is used if neither is set. Client and server must use the same setting.
+	ServerIdentity []byte `json:"ids,omitempty"`
+
+	// TranscriptObserver, if set, is called by the client and the server with the serialized AKE transcript, i.e. the
+	// exact bytes hashed into the key schedule and the MACs, on each login. It is meant for auditing and debugging
+	// MAC mismatches between implementations, and should not be set in production. The slice is not reused. It is
+	// nil by default, in which case the transcript is not copied, and is not part of the encoding of the
+	// configuration.
+	TranscriptObserver func(transcript []byte) `json:"-"`
+
+	// Observer, if set, receives the events of the protocol stages on the client and the server, e.g. for metrics: the
+	// durations of the OPRF evaluations, AKE responses, and MHF, and the MAC failures. It is nil by default, in which
+	// case nothing is timed, and is not part of the encoding of the configuration.
+	Observer Observer `json:"-"`
+
+	// ProtocolVersion optionally pins the version of the application's protocol. If set, it is bound to the AKE
+	// transcript, and a short identifier of it is appended to KE1, so that the server rejects clients of another
+	// version with ErrVersionMismatch before evaluating their request. Client and server must use the same value. It
+	// is empty by default, in which case the transcript and KE1 are unchanged.
+	ProtocolVersion string `json:"version,omitempty"`
+
+	// Rand is the source of the nonces and of the ephemeral scalars (the OPRF blind and the AKE ephemeral keys), which
+	// defaults to crypto/rand if nil. It is meant for reproducible tests with a deterministic reader, and must not be
+	// set otherwise. It's not part of the encoding of the configuration.
+	Rand io.Reader `json:"-"`
+
 	// NonceLen identifies the length to use for nonces. 32 is the recommended value.
 	NonceLen int `json:"nn"`
+
+	// RequireExplicitIdentities, if set, rejects nil client or server identities instead of defaulting them to the
+	// public keys. Client and server must use the same policy.
+	RequireExplicitIdentities bool `json:"eid"`
+
+	// VerifiableOPRF enables the verifiable OPRF mode, in which the server proves that it evaluated the client's input
+	// with the OPRF key it commits to, and the client verifies that proof against the key pinned at registration (see
+	// Client.SetOPRFPublicKey). This prevents a server from using different OPRF keys to fingerprint clients. Client
+	// and server must use the same setting.
+	VerifiableOPRF bool `json:"voprf"`
+
+	// StrictMode enables heuristic integrity checks that are not required by the protocol specification, e.g. rejecting
+	// a blinded element equal to the group's base point, which indicates a broken or malicious client.
+	StrictMode bool `json:"strict"`
+
+	// ZeroizeSecrets, if set, overwrites the ephemeral secrets and derived key material (e.g. the randomized password,
+	// the masking and authentication keys, and the AKE key schedule) once they're no longer needed. The export and
+	// session keys are returned to the caller and are left untouched. Go's garbage collector may still have copied
+	// these values, so this is a best-effort mitigation.
+	ZeroizeSecrets bool `json:"zeroize"`
+
+	// BindAppContext, if set, adds the AppContext of the Credentials to the cleartext credentials authenticated by the
+	// envelope. This changes the envelope's authentication tag, so records registered with and without it are not
+	// compatible, and a login must provide the same AppContext.
+	BindAppContext bool `json:"appctx"`
+
+	// AcceptUncompressedPoints, if set, makes the deserialization of messages accept uncompressed SEC1 encodings of
+	// the points of the NIST groups, in addition to the compressed ones, and normalizes them to the compressed
+	// encoding. Messages are always serialized with compressed points. The server public key in the masked response
+	// of a KE2 is authenticated as is and must be compressed, and the *Prefix deserializers and the framing functions
+	// only work with compressed points.
+	AcceptUncompressedPoints bool `json:"uncompressed"`
+
+	// EphemeralReuseWindow, if positive, lets the server reuse its ephemeral AKE key pair for the logins of the same
+	// client identity within that duration, to save the key generation when a client logs in many times in a burst.
+	// This trades forward secrecy for throughput: the compromise of a reused ephemeral secret key exposes all the
+	// sessions using it, and its logins are linkable. It is 0 by default, which generates a fresh ephemeral for each
+	// login, and is capped at one minute. It only affects the server and is not part of the serialized configuration.
+	EphemeralReuseWindow time.Duration `json:"ephreuse,omitempty"`
+
+	// MaxInputLength, if positive, is the maximum length of the passwords blinded by the client, above which Finish
+	// and RegistrationFinalize return ErrInputTooLong, so that bogus or huge inputs are rejected before being hashed to
+	// the group. It is 0 by default, for no limit. It only affects the client and is not part of the serialized
+	// configuration.
+	MaxInputLength int `json:"maxinput,omitempty"`
+
+	// Codec, if set, is used by the Encode and Decode functions of the Client and the Server to write and read the
+	// messages, e.g. CBORCodec. It defaults to RawCodec, which uses the same bytes as Serialize. Both peers must use
+	// the same codec. It is not part of the encoding of the configuration.
+	Codec Codec `json:"-"`
+
+	// OPRFEvaluator, if set, replaces the built-in server side of the OPRF, e.g. to keep the OPRF seed and keys in an
+	// HSM or to run a threshold OPRF. The OPRF seeds given to the Server are then ignored. It doesn't support the
+	// verifiable OPRF mode, and is not part of the encoding of the configuration.
+	OPRFEvaluator OPRFEvaluator `json:"-"`
 }
 
+// Observer receives the events of the protocol stages, e.g. for metrics. Its methods are called synchronously, and
+// must return quickly.
+type Observer = internal.Observer
+
+// OPRFEvaluator runs the server side of the OPRF. DeriveKey returns a reference to the OPRF key of the client with a
+// credential identifier, derived from an OPRF seed the evaluator holds, which is only given back to Evaluate, and
+// Evaluate returns the evaluation of a blinded element with that key.
+type OPRFEvaluator = internal.OPRFEvaluator
+
 func envelopeSize(mode Mode, p *internal.Parameters) int {
 	innerSize := 0
-	if mode == External {
-		innerSize = encoding.ScalarLength[p.Group]
+
+	switch mode {
+	case External:
+		innerSize = encoding.ScalarLength[p.AKEGroup]
+	case ExternalAEAD:
+		innerSize = encoding.ScalarLength[p.AKEGroup] + envelope.AEADOverhead
 	}
 
 	return p.NonceLen + p.MAC.Size() + innerSize
 }
 
+// mhfParameterCount is the number of cost parameters of each MHF.
+var mhfParameterCount = map[mhf.Identifier]int{
+	mhf.Argon2id:     3,
+	mhf.Scrypt:       3,
+	mhf.PBKDF2Sha512: 1,
+	mhf.Bcrypt:       1,
+}
+
+// maxMHFParameter is the upper bound of an MHF parameter, which is encoded on 4 bytes. It is compared as an int64, to
+// build on 32-bit platforms.
+const maxMHFParameter int64 = 1<<32 - 1
+
+func (c *Configuration) newMHF() *mhf.MHF {
+	m := c.MHF.Get()
+	if m != nil && len(c.MHFParameters) != 0 && len(c.MHFParameters) == mhfParameterCount[c.MHF] {
+		m.Parameterize(c.MHFParameters...)
+	}
+
+	return m
+}
+
 func (c *Configuration) toInternal() *internal.Parameters {
-	g := ciphersuite.Identifier(c.Group)
+	og := ciphersuite.Identifier(c.OPRFGroup)
+	ag := ciphersuite.Identifier(c.AKEGroup)
 	ip := &internal.Parameters{
 		KDF:             &internal.KDF{H: c.KDF.Get()},
 		MAC:             &internal.Mac{H: c.MAC.Get()},
 		Hash:            &internal.Hash{H: c.Hash.Get()},
-		MHF:             &internal.MHF{MHF: c.MHF.Get()},
+		MHF:             &internal.MHF{MHF: c.newMHF()},
 		NonceLen:        c.NonceLen,
-		OPRFPointLength: encoding.PointLength[g],
-		AkePointLength:  encoding.PointLength[g],
-		Group:           g,
-		OPRF:            oprf.Ciphersuite(g),
+		OPRFPointLength: encoding.PointLength[og],
+		AkePointLength:  encoding.PointLength[ag],
+		OPRFGroup:       og,
+		AKEGroup:        ag,
+		OPRF:            oprf.Ciphersuite(og),
+		OPRFEvaluator:   c.OPRFEvaluator,
 		Context:         c.Context,
+		ApplicationID:   c.ApplicationID,
+		ServerIdentity:  c.ServerIdentity,
+		KDFSalt:         c.KDFSalt,
+		Rand:            c.Rand,
+
+		RequireExplicitIdentities: c.RequireExplicitIdentities,
+		VerifiableOPRF:            c.VerifiableOPRF,
+		StrictMode:                c.StrictMode,
+		ZeroizeSecrets:            c.ZeroizeSecrets,
+		BindAppContext:            c.BindAppContext,
+		AcceptUncompressedPoints:  c.AcceptUncompressedPoints,
+		EphemeralReuseWindow:      c.EphemeralReuseWindow,
+		TranscriptObserver:        c.TranscriptObserver,
+		OPRFDomainSeparation:      c.OPRFDomainSeparation,
+		Observer:                  c.Observer,
+		ProtocolVersion:           c.ProtocolVersion,
+		MaxInputLength:            c.MaxInputLength,
+		Codec:                     c.Codec,
 	}
 	ip.EnvelopeSize = envelopeSize(c.Mode, ip)
 
 	return ip
 }
 
-// Serialize returns the byte encoding of the Configuration structure.
+// minNonceLen is the minimum length, in bytes, of the nonces.
+const minNonceLen = 16
+
+// maxEphemeralReuseWindow bounds the duration for which a server ephemeral key pair can be reused.
+const maxEphemeralReuseWindow = time.Minute
+
+// maxOPRFDomainLength keeps the OPRF's DSTs, with their prefixes and the ciphersuite's context string, under the 255
+// bytes of hash-to-curve.
+const maxOPRFDomainLength = 200
+
+// maxApplicationIDLength is the maximum length of the application ID and of the KDF salt, whose lengths are encoded
+// on 2 bytes.
+const maxApplicationIDLength = 1<<16 - 1
+
+// Validate returns an error naming the first invalid field if the configuration holds an unsupported group, hashing
+// function, MHF or MHF parameters, or envelope mode, if the nonce length is below 16 bytes, if a custom OPRF
+// evaluator is set in the verifiable mode, if the application ID or the KDF salt is longer than 65535 bytes, or if the
+// ephemeral reuse window is negative or above one minute. Client() and Server() don't validate the configuration, so
+// it should be called on configurations that are not built from DefaultConfiguration() or DeserializeConfiguration().
+func (c *Configuration) Validate() error {
+	if !oprf.Ciphersuite(c.OPRFGroup).Available() {
+		return fmt.Errorf("%w %d", errInvalidGroup, c.OPRFGroup)
+	}
+
+	if _, ok := encoding.PointLength[ciphersuite.Identifier(c.AKEGroup)]; !ok {
+		return fmt.Errorf("%w %d", errInvalidGroup, c.AKEGroup)
+	}
+
+	if !c.KDF.Available() {
+		return fmt.Errorf("%w %d", errInvalidKDF, c.KDF)
+	}
+
+	if !c.MAC.Available() {
+		return fmt.Errorf("%w %d", errInvalidMAC, c.MAC)
+	}
+
+	if !c.Hash.Available() {
+		return fmt.Errorf("%w %d", errInvalidHash, c.Hash)
+	}
+
+	if !c.MHF.Available() {
+		return fmt.Errorf("%w %d", errInvalidMHF, c.MHF)
+	}
+
+	if err := c.validateMHFParameters(); err != nil {
+		return err
+	}
+
+	if c.Mode != Internal && c.Mode != External && c.Mode != ExternalAEAD {
+		return fmt.Errorf("%w %d", errInvalidMode, c.Mode)
+	}
+
+	if c.NonceLen < minNonceLen {
+		return fmt.Errorf("%w %d", errNonceLength, c.NonceLen)
+	}
+
+	if c.OPRFEvaluator != nil && c.VerifiableOPRF {
+		return errEvaluatorVerifiable
+	}
+
+	if len(c.ApplicationID) > maxApplicationIDLength {
+		return fmt.Errorf("%w %d", errAppIDLength, len(c.ApplicationID))
+	}
+
+	if len(c.KDFSalt) > maxApplicationIDLength {
+		return fmt.Errorf("%w %d", errKDFSaltLength, len(c.KDFSalt))
+	}
+
+	if len(c.OPRFDomainSeparation) > maxOPRFDomainLength {
+		return fmt.Errorf("%w %d", errOPRFDomainLength, len(c.OPRFDomainSeparation))
+	}
+
+	if c.EphemeralReuseWindow < 0 || c.EphemeralReuseWindow > maxEphemeralReuseWindow {
+		return fmt.Errorf("%w %s", errEphemeralWindow, c.EphemeralReuseWindow)
+	}
+
+	if c.MaxInputLength < 0 {
+		return fmt.Errorf("%w %d", errMaxInputLength, c.MaxInputLength)
+	}
+
+	return nil
+}
+
+func (c *Configuration) validateMHFParameters() error {
+	if len(c.MHFParameters) == 0 {
+		return nil
+	}
+
+	if len(c.MHFParameters) != mhfParameterCount[c.MHF] {
+		return fmt.Errorf("%w: expected %d, got %d", errMHFParams, mhfParameterCount[c.MHF], len(c.MHFParameters))
+	}
+
+	for _, v := range c.MHFParameters {
+		if v <= 0 || int64(v) > maxMHFParameter {
+			return fmt.Errorf("%w: %d out of range", errMHFParams, v)
+		}
+	}
+
+	return nil
+}
+
+// nonceCollisionMargin is the minimum security margin, in bits, against envelope nonce collisions.
+const nonceCollisionMargin = 32
+
+// ValidateRegistrations validates the configuration like Validate, and additionally checks that the randomly
+// generated envelope nonces are long enough for the expected number of registrations, such that the probability of a
+// collision (given by the birthday bound) stays below 2^-32.
+func (c *Configuration) ValidateRegistrations(expected uint64) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	if 8*c.NonceLen < 2*bits.Len64(expected)+nonceCollisionMargin {
+		return fmt.Errorf("%w: %d bytes for %d registrations", errShortNonce, c.NonceLen, expected)
+	}
+
+	return nil
+}
+
+// Serialize returns the byte encoding of the Configuration structure. The AKE group is appended after the bytes of the
+// legacy encoding, followed, if set, by the number of MHF parameters and their 4-byte encodings, then by the 2-byte
+// length-prefixed application ID, and then by the 2-byte length-prefixed KDF salt. The number of MHF parameters is 0
+// if only the application ID or the KDF salt is set, and the application ID is empty if only the KDF salt is set.
 func (c *Configuration) Serialize() []byte {
-	b := make([]byte, confLength)
-	b[0] = byte(c.Group)
+	extensions := [][]byte{c.ApplicationID, c.KDFSalt, c.OPRFDomainSeparation}
+
+	// last is the index of the last non-empty extension, and the ones before it are encoded even if empty.
+	last := -1
+	size := confLength + 1 + 4*len(c.MHFParameters)
+
+	for i, e := range extensions {
+		if len(e) != 0 {
+			last = i
+		}
+
+		size += 2 + len(e)
+	}
+
+	b := make([]byte, confLength, size)
+	b[0] = byte(c.OPRFGroup)
 	b[1] = byte(c.KDF)
 	b[2] = byte(c.MAC)
 	b[3] = byte(c.Hash)
 	b[4] = byte(c.MHF)
 	b[5] = byte(c.Mode)
 	b[6] = encoding.I2OSP(c.NonceLen, 1)[0]
+	b[7] = byte(c.AKEGroup)
+
+	if len(c.MHFParameters) != 0 || last >= 0 {
+		b = append(b, encoding.I2OSP(len(c.MHFParameters), 1)...)
+		for _, v := range c.MHFParameters {
+			b = append(b, encoding.I2OSP(v, 4)...)
+		}
+	}
+
+	for _, e := range extensions[:last+1] {
+		b = append(b, encoding.EncodeVector(e)...)
+	}
 
 	return b
 }
 
+// decodeExtensions decodes the MHF parameters, the application ID, the KDF salt, and the OPRF domain separation
+// following the fixed-length encoding into c. The encoding must be canonical, i.e. not end with an empty extension.
+func (c *Configuration) decodeExtensions(encoded []byte) error {
+	n := int(encoded[0])
+	if len(encoded) < 1+4*n {
+		return internal.ErrConfigurationInvalidLength
+	}
+
+	if n != 0 {
+		c.MHFParameters = make([]int, n)
+		for i := range c.MHFParameters {
+			c.MHFParameters[i] = encoding.OS2IP(encoded[1+4*i : 5+4*i])
+		}
+	}
+
+	extensions := []*[]byte{&c.ApplicationID, &c.KDFSalt, &c.OPRFDomainSeparation}
+	rest := encoded[1+4*n:]
+	last := -1
+
+	for i := 0; i < len(extensions) && len(rest) != 0; i++ {
+		e, offset, err := encoding.DecodeVector(rest)
+		if err != nil {
+			return internal.ErrConfigurationInvalidLength
+		}
+
+		if len(e) != 0 {
+			*extensions[i] = e
+		}
+
+		rest = rest[offset:]
+		last = i
+	}
+
+	if len(rest) != 0 {
+		return internal.ErrConfigurationInvalidLength
+	}
+
+	if last < 0 && n == 0 || last >= 0 && *extensions[last] == nil {
+		return internal.ErrConfigurationInvalidLength
+	}
+
+	return nil
+}
+
 // Client returns a newly instantiated Client from the Configuration.
 func (c *Configuration) Client() *Client {
 	return NewClient(c)
@@ -148,34 +564,100 @@ func (c *Configuration) Server() *Server {
 	return NewServer(c)
 }
 
+// Clone returns a deep copy of the Configuration, such that modifying one doesn't affect the other. The functions and
+// interfaces it holds (e.g. Rand, TranscriptObserver, Observer, and OPRFEvaluator) are shared.
+func (c *Configuration) Clone() *Configuration {
+	clone := *c
+	clone.MHFParameters = cloneInts(c.MHFParameters)
+	clone.Context = cloneBytes(c.Context)
+	clone.ApplicationID = cloneBytes(c.ApplicationID)
+	clone.KDFSalt = cloneBytes(c.KDFSalt)
+	clone.OPRFDomainSeparation = cloneBytes(c.OPRFDomainSeparation)
+	clone.ServerIdentity = cloneBytes(c.ServerIdentity)
+
+	return &clone
+}
+
+// cloneBytes returns a copy of b, preserving the difference between nil and empty.
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	return append([]byte{}, b...)
+}
+
+func cloneInts(i []int) []int {
+	if i == nil {
+		return nil
+	}
+
+	return append([]int{}, i...)
+}
+
 // DeserializeConfiguration decodes the input and returns a Parameter structure. This assumes that the encoded parameters
-// are valid, and will not be checked.
+// are valid, and will not be checked, except for the MHF which must be known so that password hardening is never
+// silently skipped. A legacy encoding without the AKE group uses the OPRF group for both.
 func DeserializeConfiguration(encoded []byte) (*Configuration, error) {
-	if len(encoded) != confLength {
+	if len(encoded) < legacyConfLength {
 		return nil, internal.ErrConfigurationInvalidLength
 	}
 
-	return &Configuration{
-		Group:    Group(encoded[0]),
-		KDF:      hash.Hashing(encoded[1]),
-		MAC:      hash.Hashing(encoded[2]),
-		Hash:     hash.Hashing(encoded[3]),
-		MHF:      mhf.Identifier(encoded[4]),
-		Mode:     Mode(encoded[5]),
-		NonceLen: encoding.OS2IP(encoded[6:]),
-	}, nil
+	ake := encoded[0]
+	if len(encoded) >= confLength {
+		ake = encoded[7]
+	}
+
+	c := &Configuration{
+		OPRFGroup: Group(encoded[0]),
+		AKEGroup:  Group(ake),
+		KDF:       hash.Hashing(encoded[1]),
+		MAC:       hash.Hashing(encoded[2]),
+		Hash:      hash.Hashing(encoded[3]),
+		MHF:       mhf.Identifier(encoded[4]),
+		Mode:      Mode(encoded[5]),
+		NonceLen:  encoding.OS2IP(encoded[6:7]),
+	}
+
+	if len(encoded) > confLength {
+		if err := c.decodeExtensions(encoded[confLength:]); err != nil {
+			return nil, err
+		}
+	}
+
+	if !c.MHF.Available() {
+		return nil, fmt.Errorf("%w %d", errInvalidMHF, c.MHF)
+	}
+
+	return c, nil
 }
 
 // DefaultConfiguration returns a default configuration with strong parameters.
 func DefaultConfiguration() *Configuration {
 	return &Configuration{
-		Group:    RistrettoSha512,
-		KDF:      hash.SHA512,
-		MAC:      hash.SHA512,
-		Hash:     hash.SHA512,
-		MHF:      mhf.Scrypt,
-		Mode:     Internal,
-		NonceLen: 32,
+		OPRFGroup: RistrettoSha512,
+		AKEGroup:  RistrettoSha512,
+		KDF:       hash.SHA512,
+		MAC:       hash.SHA512,
+		Hash:      hash.SHA512,
+		MHF:       mhf.Argon2id,
+		Mode:      Internal,
+		NonceLen:  32,
+	}
+}
+
+// FIPSConfiguration returns a configuration using only FIPS-approved primitives: the NIST P-384 group, SHA-512 for
+// key derivation, MAC, and hashing, and PBKDF2 with SHA-512 as the password hashing function.
+func FIPSConfiguration() *Configuration {
+	return &Configuration{
+		OPRFGroup: P384Sha512,
+		AKEGroup:  P384Sha512,
+		KDF:       hash.SHA512,
+		MAC:       hash.SHA512,
+		Hash:      hash.SHA512,
+		MHF:       mhf.PBKDF2Sha512,
+		Mode:      Internal,
+		NonceLen:  32,
 	}
 }
 
@@ -185,10 +667,43 @@ type ClientRecord struct {
 	ClientIdentity       []byte
 	*message.RegistrationUpload
 
+	// OPRFKeyTweak is set by Server.ReencryptRecord, and maps the OPRF key derived from the current OPRF seed to the
+	// one the record was registered with.
+	OPRFKeyTweak []byte
+
+	// MaskingNonce and MaskedResponse are set by Server.PremaskRecord, and are sent in the KE2 instead of masking the
+	// response with a fresh nonce at each login.
+	MaskingNonce, MaskedResponse []byte
+
+	// Fake is set by Server.FakeRecord. It doesn't change the login flow, and only triggers the hook set with
+	// Server.SetFakeRecordHook. It's kept by the JSON encoding, but not by SerializeRecord.
+	Fake bool
+
 	// testing
 	TestMaskNonce []byte
 }
 
+// Mode infers the envelope mode the record was registered with from its envelope length in the configuration, and
+// returns ErrUnknownRecordMode if it matches neither mode.
+func (r *ClientRecord) Mode(conf *Configuration) (Mode, error) {
+	if conf == nil {
+		conf = DefaultConfiguration()
+	}
+
+	p := conf.toInternal()
+
+	switch len(r.Envelope) {
+	case envelopeSize(Internal, p):
+		return Internal, nil
+	case envelopeSize(External, p):
+		return External, nil
+	case envelopeSize(ExternalAEAD, p):
+		return ExternalAEAD, nil
+	default:
+		return 0, ErrUnknownRecordMode
+	}
+}
+
 // GetFakeEnvelope returns a byte array filled with 0s the length of a legitimate envelope size in the configuration's mode.
 // This fake envelope byte array is used in the client enumeration mitigation scheme.
 func GetFakeEnvelope(c *Configuration) []byte {
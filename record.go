@@ -0,0 +1,169 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/bytemare/opaque/internal/encoding"
+	"github.com/bytemare/opaque/message"
+)
+
+var (
+	// ErrRecordVersion indicates that a serialized client record has an unknown version.
+	ErrRecordVersion = errors.New("unsupported client record version")
+
+	errRecordTrailingBytes = errors.New("trailing bytes after client record")
+	errRecordTweak         = errors.New("invalid client record OPRF key tweak")
+)
+
+// recordVersion is the first byte of a serialized client record, and identifies its layout.
+const recordVersion byte = 1
+
+// recordFields is the number of length-prefixed fields following the version byte of a serialized client record.
+const recordFields = 4
+
+// SerializeRecord returns the record in a versioned layout suitable for storage: a version byte followed by the
+// credential identifier, the client identity, the serialized registration upload, and the OPRF key tweak, each
+// prefixed with its 2-byte big-endian length. The premasked response and the TestMaskNonce field are not serialized.
+// Serialize, from the embedded RegistrationUpload, still returns the upload alone.
+func (r *ClientRecord) SerializeRecord() []byte {
+	return encoding.Concatenate(
+		[]byte{recordVersion},
+		encoding.EncodeVector(r.CredentialIdentifier),
+		encoding.EncodeVector(r.ClientIdentity),
+		encoding.EncodeVector(r.RegistrationUpload.Serialize()),
+		encoding.EncodeVector(r.OPRFKeyTweak),
+	)
+}
+
+// DeserializeClientRecord decodes a record serialized with SerializeRecord, and validates the registration upload and the
+// OPRF key tweak against the configuration, so that corrupted records are caught at load time. It returns
+// ErrRecordVersion if the layout version is unknown. Empty client identities and tweaks are restored as nil.
+func DeserializeClientRecord(conf *Configuration, encoded []byte) (*ClientRecord, error) {
+	if conf == nil {
+		conf = DefaultConfiguration()
+	}
+
+	if len(encoded) == 0 || encoded[0] != recordVersion {
+		return nil, ErrRecordVersion
+	}
+
+	fields := make([][]byte, recordFields)
+	data := encoded[1:]
+
+	for i := range fields {
+		field, n, err := encoding.DecodeVector(data)
+		if err != nil {
+			return nil, fmt.Errorf("client record field %d: %w", i, err)
+		}
+
+		if len(field) != 0 {
+			fields[i] = field
+		}
+
+		data = data[n:]
+	}
+
+	if len(data) != 0 {
+		return nil, errRecordTrailingBytes
+	}
+
+	p := conf.toInternal()
+
+	upload, err := p.DeserializeRegistrationUpload(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("client record upload: %w", err)
+	}
+
+	if fields[3] != nil {
+		if _, err := p.OPRFGroup.NewScalar().Decode(fields[3]); err != nil {
+			return nil, fmt.Errorf("%w: %v", errRecordTweak, err)
+		}
+	}
+
+	return &ClientRecord{
+		CredentialIdentifier: fields[0],
+		ClientIdentity:       fields[1],
+		RegistrationUpload:   upload,
+		OPRFKeyTweak:         fields[3],
+	}, nil
+}
+
+// recordJSON holds the fields of a ClientRecord for its JSON encoding, with the upload fields named as in the
+// RegistrationUpload's encoding.
+type recordJSON struct {
+	CredentialIdentifier []byte `json:"cid"`
+	ClientIdentity       []byte `json:"idc,omitempty"`
+	PublicKey            []byte `json:"pku"`
+	MaskingKey           []byte `json:"msk"`
+	Envelope             []byte `json:"env"`
+	OPRFKeyTweak         []byte `json:"tweak,omitempty"`
+	MaskingNonce         []byte `json:"mn,omitempty"`
+	MaskedResponse       []byte `json:"mr,omitempty"`
+	Fake                 bool   `json:"fake,omitempty"`
+}
+
+// MarshalJSON encodes all the fields of the record but TestMaskNonce, as base64 strings. It is needed since the
+// record would otherwise be encoded with the methods of the embedded RegistrationUpload, which only hold the upload.
+func (r *ClientRecord) MarshalJSON() ([]byte, error) {
+	aux := &recordJSON{
+		CredentialIdentifier: r.CredentialIdentifier,
+		ClientIdentity:       r.ClientIdentity,
+		OPRFKeyTweak:         r.OPRFKeyTweak,
+		MaskingNonce:         r.MaskingNonce,
+		MaskedResponse:       r.MaskedResponse,
+		Fake:                 r.Fake,
+	}
+
+	if r.RegistrationUpload != nil {
+		aux.PublicKey, aux.MaskingKey, aux.Envelope = r.PublicKey, r.MaskingKey, r.Envelope
+	}
+
+	return json.Marshal(aux)
+}
+
+// UnmarshalJSON decodes a record encoded with MarshalJSON, and rejects unknown and missing fields. As for the messages,
+// the lengths of the fields depend on the configuration, and can be validated with
+// DeserializeClientRecord(conf, record.SerializeRecord()).
+func (r *ClientRecord) UnmarshalJSON(data []byte) error {
+	aux := new(recordJSON)
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+
+	if err := d.Decode(aux); err != nil {
+		return err
+	}
+
+	names := []string{"cid", "pku", "msk", "env"}
+	for i, field := range [][]byte{aux.CredentialIdentifier, aux.PublicKey, aux.MaskingKey, aux.Envelope} {
+		if len(field) == 0 {
+			return fmt.Errorf("%w %q", message.ErrMissingField, names[i])
+		}
+	}
+
+	*r = ClientRecord{
+		CredentialIdentifier: aux.CredentialIdentifier,
+		ClientIdentity:       aux.ClientIdentity,
+		RegistrationUpload: &message.RegistrationUpload{
+			PublicKey:  aux.PublicKey,
+			MaskingKey: aux.MaskingKey,
+			Envelope:   aux.Envelope,
+		},
+		OPRFKeyTweak:   aux.OPRFKeyTweak,
+		MaskingNonce:   aux.MaskingNonce,
+		MaskedResponse: aux.MaskedResponse,
+		Fake:           aux.Fake,
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/bytemare/opaque/internal"
+	"github.com/bytemare/opaque/internal/ake"
+)
+
+var (
+	errSessionKeys        = errors.New("session keys differ")
+	errSelfTestExportKeys = errors.New("self-test: export keys differ")
+)
+
+// ServerKeys holds the server secrets of a self-hosted registration, which must be stored alongside the ClientRecord.
+type ServerKeys struct {
+	SecretKey, PublicKey, OprfSeed []byte
+}
+
+// local runs both the client and server sides in memory.
+type local struct {
+	*Configuration
+	password, credentialIdentifier, oprfSeed []byte
+	serverSecretKey, serverPublicKey         []byte
+	clientIdentity, serverIdentity           []byte
+}
+
+func newLocal(c *Configuration, password []byte, keys *ServerKeys) *local {
+	return &local{
+		Configuration:        c,
+		password:             password,
+		credentialIdentifier: internal.RandomBytes(32),
+		oprfSeed:             keys.OprfSeed,
+		serverSecretKey:      keys.SecretKey,
+		serverPublicKey:      keys.PublicKey,
+	}
+}
+
+func newServerKeys(c *Configuration) *ServerKeys {
+	sk, pk := ake.KeyGen(c.toInternal().AKEGroup)
+
+	return &ServerKeys{
+		SecretKey: sk,
+		PublicKey: pk,
+		OprfSeed:  internal.RandomBytes(c.Hash.Size()),
+	}
+}
+
+func (t *local) registration() (*ClientRecord, []byte, error) {
+	client := t.Client()
+	server := t.Server()
+
+	req, err := server.DeserializeRegistrationRequest(client.RegistrationInit(t.password).Serialize())
+	if err != nil {
+		return nil, nil, fmt.Errorf("registration request: %w", err)
+	}
+
+	resp, err := server.RegistrationResponse(req, t.serverPublicKey, t.credentialIdentifier, t.oprfSeed)
+	if err != nil {
+		return nil, nil, fmt.Errorf("registration response: %w", err)
+	}
+
+	resp, err = client.DeserializeRegistrationResponse(resp.Serialize())
+	if err != nil {
+		return nil, nil, fmt.Errorf("registration response: %w", err)
+	}
+
+	var clientSecretKey []byte
+	if t.Mode != Internal {
+		clientSecretKey, _ = client.KeyGen()
+	}
+
+	creds := &Credentials{Client: t.clientIdentity, Server: t.serverIdentity}
+
+	upload, exportKey, err := client.RegistrationFinalize(clientSecretKey, creds, resp)
+	if err != nil {
+		return nil, nil, fmt.Errorf("registration finalize: %w", err)
+	}
+
+	upload, err = server.DeserializeRegistrationUpload(upload.Serialize())
+	if err != nil {
+		return nil, nil, fmt.Errorf("registration upload: %w", err)
+	}
+
+	return &ClientRecord{
+		CredentialIdentifier: t.credentialIdentifier,
+		ClientIdentity:       t.clientIdentity,
+		RegistrationUpload:   upload,
+	}, exportKey, nil
+}
+
+func (t *local) login(record *ClientRecord) (sessionKey, exportKey []byte, err error) {
+	client := t.Client()
+	server := t.Server()
+
+	ke1, err := server.DeserializeKE1(client.Init(t.password).Serialize())
+	if err != nil {
+		return nil, nil, fmt.Errorf("KE1: %w", err)
+	}
+
+	ke2, err := server.Init(ke1, t.serverIdentity, t.serverSecretKey, t.serverPublicKey, t.oprfSeed, record)
+	if err != nil {
+		return nil, nil, fmt.Errorf("server init: %w", err)
+	}
+
+	ke2, err = client.DeserializeKE2(ke2.Serialize())
+	if err != nil {
+		return nil, nil, fmt.Errorf("KE2: %w", err)
+	}
+
+	ke3, exportKey, err := client.Finish(t.clientIdentity, t.serverIdentity, ke2)
+	if err != nil {
+		return nil, nil, fmt.Errorf("client finish: %w", err)
+	}
+
+	ke3, err = server.DeserializeKE3(ke3.Serialize())
+	if err != nil {
+		return nil, nil, fmt.Errorf("KE3: %w", err)
+	}
+
+	if err := server.Finish(ke3); err != nil {
+		return nil, nil, fmt.Errorf("server finish: %w", err)
+	}
+
+	if !bytes.Equal(client.SessionKey(), server.SessionKey()) {
+		return nil, nil, errSessionKeys
+	}
+
+	return client.SessionKey(), exportKey, nil
+}
+
+// SelfTest runs a full registration and login in memory with random inputs, and returns an error naming the first
+// step that failed. It verifies that the configuration produces consistent message sizes, and matching session and
+// export keys on both sides. It is meant to be called at startup to fail fast on a broken configuration.
+func (c *Configuration) SelfTest() error {
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("self-test configuration: %w", err)
+	}
+
+	t := newLocal(c, internal.RandomBytes(32), newServerKeys(c))
+	t.clientIdentity = []byte("client")
+	t.serverIdentity = []byte("server")
+
+	record, exportKeyReg, err := t.registration()
+	if err != nil {
+		return fmt.Errorf("self-test %w", err)
+	}
+
+	_, exportKeyLogin, err := t.login(record)
+	if err != nil {
+		return fmt.Errorf("self-test %w", err)
+	}
+
+	if !bytes.Equal(exportKeyReg, exportKeyLogin) {
+		return errSelfTestExportKeys
+	}
+
+	return nil
+}
+
+// SelfTest runs conf.SelfTest(), using the default configuration if conf is nil, so that the check can be called at
+// process start as a single function.
+func SelfTest(conf *Configuration) error {
+	if conf == nil {
+		conf = DefaultConfiguration()
+	}
+
+	return conf.SelfTest()
+}
+
+// SelfRegister runs a registration for the password with both roles on the local device and freshly generated server
+// keys, e.g. for single-user, self-hosted applications. The record and server keys must be stored to later call
+// SelfAuthenticate, and the export key can be used to encrypt local data. The public keys are used as identities.
+func SelfRegister(conf *Configuration,
+	password []byte) (record *ClientRecord, keys *ServerKeys, exportKey []byte, err error) {
+	if conf == nil {
+		conf = DefaultConfiguration()
+	}
+
+	keys = newServerKeys(conf)
+
+	record, exportKey, err = newLocal(conf, password, keys).registration()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return record, keys, exportKey, nil
+}
+
+// SelfAuthenticate runs a login for the password against the record and server keys returned by SelfRegister, with
+// both roles on the local device. It returns the session key and the same export key as in the registration, or an
+// error if the password is wrong.
+func SelfAuthenticate(conf *Configuration, record *ClientRecord, keys *ServerKeys,
+	password []byte) (sessionKey, exportKey []byte, err error) {
+	if conf == nil {
+		conf = DefaultConfiguration()
+	}
+
+	t := newLocal(conf, password, keys)
+	t.credentialIdentifier = record.CredentialIdentifier
+
+	return t.login(record)
+}
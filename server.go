@@ -9,8 +9,15 @@
 package opaque
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"time"
+
+	"github.com/bytemare/cryptotools/group"
 
 	"github.com/bytemare/opaque/internal"
 	"github.com/bytemare/opaque/internal/ake"
@@ -26,96 +33,709 @@ var (
 
 	// ErrInvalidState indicates that the given state is not valid due to a wrong length.
 	ErrInvalidState = errors.New("invalid state length")
+
+	// ErrSuspiciousBlindedElement indicates, in strict mode, that the client's blinded element is the group's base
+	// point, which happens with a blind of 1 or a malformed client.
+	ErrSuspiciousBlindedElement = errors.New("suspicious blinded element: base point")
+
+	// ErrCorruptedOPRFSeed indicates that a wrapped OPRF seed does not match its checksum.
+	ErrCorruptedOPRFSeed = errors.New("corrupted OPRF seed: invalid checksum")
+
+	// ErrNoActiveSession indicates that Finish was called on a server without AKE state, e.g. because Init was never
+	// called or because a KE3 was routed to another instance than its KE1 without state transfer.
+	ErrNoActiveSession = errors.New("no active session: Init was not called or its state was not set")
+
+	// ErrVerifierOnly indicates that a registration function was called on a verifier-only Server.
+	ErrVerifierOnly = errors.New("operation not permitted on a verifier-only server")
+
+	// ErrNoMasterKey indicates that RegisterClient was called on a Server without master key.
+	ErrNoMasterKey = errors.New("no master key set")
+
+	// ErrStateExpired indicates that the AKE state is older than the maximum age set with SetStateMaxAge.
+	ErrStateExpired = errors.New("AKE state expired")
+
+	// ErrStateMismatch indicates that the AKE state was serialized with another state version or configuration.
+	ErrStateMismatch = errors.New("AKE state version or configuration mismatch")
+
+	// ErrIdentityElementKey indicates that the server's public key, the client's public key in the record, or an
+	// ephemeral public key is the identity element of the AKE group, which would void its contribution to the 3DH.
+	ErrIdentityElementKey = internal.ErrIdentityElementKey
+
+	// ErrEnvelopeLengthMismatch indicates that the envelope of a record doesn't have the length of the configuration's
+	// mode, e.g. because the record was registered in another mode.
+	ErrEnvelopeLengthMismatch = errors.New("record envelope length doesn't match the configuration")
+
+	// ErrInvalidUpload indicates that a field of a registration upload doesn't have the length of the configuration.
+	ErrInvalidUpload = errors.New("invalid registration upload")
+
+	// ErrEmptyCredentialIdentifier indicates that the credential identifier is empty, which would give all the clients
+	// without one the same OPRF key.
+	ErrEmptyCredentialIdentifier = errors.New("empty credential identifier")
+
+	// ErrVersionMismatch indicates that the protocol version in KE1 is not the one pinned in the server's configuration.
+	ErrVersionMismatch = internal.ErrVersionMismatch
+
+	errStateTimestamp = errors.New("invalid AKE state timestamp")
+	errShortMasterKey = errors.New("master key is too short")
+	errKeyMismatch    = errors.New("server public key does not match the secret key")
+	errMissingKey     = errors.New("missing server key")
+	errInvalidTweak   = errors.New("invalid OPRF key tweak")
 )
 
+// FailureReason is a machine-readable reason for a client authentication failure. It is server-local metadata meant
+// for security logging, and must not be sent to the client.
+type FailureReason byte
+
+const (
+	// ReasonInvalidMacLength indicates that the client MAC in KE3 has an invalid length.
+	ReasonInvalidMacLength FailureReason = iota + 1
+
+	// ReasonInvalidMac indicates that the client MAC in KE3 has the right length but an invalid value, e.g. because of
+	// a wrong password or a tampered message.
+	ReasonInvalidMac
+
+	// ReasonNoState indicates that the server has no active session state to verify the client MAC against.
+	ReasonNoState
+)
+
+// String returns the name of the failure reason.
+func (r FailureReason) String() string {
+	switch r {
+	case ReasonInvalidMacLength:
+		return "invalid mac length"
+	case ReasonInvalidMac:
+		return "invalid mac value"
+	case ReasonNoState:
+		return "no active state"
+	default:
+		return "unknown"
+	}
+}
+
+// AuthenticationError is returned by Finish when the client could not be authenticated, and carries a Reason for
+// server-side logging. It reads and unwraps as ErrNoActiveSession for ReasonNoState, and as ErrAkeInvalidClientMac
+// otherwise.
+type AuthenticationError struct {
+	Reason FailureReason
+}
+
+// Error implements the error interface, and doesn't expose the reason of a MAC failure.
+func (e *AuthenticationError) Error() string {
+	return e.Unwrap().Error()
+}
+
+// Unwrap returns ErrNoActiveSession for ReasonNoState, and ErrAkeInvalidClientMac otherwise.
+func (e *AuthenticationError) Unwrap() error {
+	if e.Reason == ReasonNoState {
+		return ErrNoActiveSession
+	}
+
+	return ErrAkeInvalidClientMac
+}
+
+const seedChecksumLength = 8
+
+func seedChecksum(seed []byte) []byte {
+	sum := sha256.Sum256(seed)
+	return sum[:seedChecksumLength]
+}
+
+// WrapOPRFSeed returns the seed appended with a checksum, allowing UnwrapOPRFSeed to detect corruption of stored seeds.
+func WrapOPRFSeed(seed []byte) []byte {
+	return encoding.Concat(seed, seedChecksum(seed))
+}
+
+// UnwrapOPRFSeed returns the OPRF seed contained in the output of WrapOPRFSeed, or ErrCorruptedOPRFSeed if the
+// checksum doesn't match.
+func UnwrapOPRFSeed(wrapped []byte) ([]byte, error) {
+	if len(wrapped) <= seedChecksumLength {
+		return nil, ErrCorruptedOPRFSeed
+	}
+
+	offset := len(wrapped) - seedChecksumLength
+	seed := wrapped[:offset]
+
+	if subtle.ConstantTimeCompare(seedChecksum(seed), wrapped[offset:]) != 1 {
+		return nil, ErrCorruptedOPRFSeed
+	}
+
+	return seed, nil
+}
+
 // Server represents an OPAQUE Server, exposing its functions and holding its state.
 type Server struct {
 	*internal.Parameters
-	Ake *ake.Server
+	Ake       *ake.Server
+	conf      *Configuration
+	masterKey []byte
+	verifier  bool
+
+	staticSecretKey group.Scalar
+	staticPublicKey []byte
+
+	stateMaxAge  time.Duration
+	stateCreated time.Time
+
+	nonceCache NonceCache
+
+	fakeRecordHook func(credentialIdentifier []byte)
 }
 
-// NewServer returns a Server instantiation given the application Configuration.
+// NewServer returns a Server instantiation given the application Configuration. The Server uses a snapshot of the
+// configuration, so later changes to it don't affect the Server, but it must not be modified concurrently.
 func NewServer(p *Configuration) *Server {
 	if p == nil {
 		p = DefaultConfiguration()
 	}
 
+	p = p.Clone()
 	ip := p.toInternal()
 
+	if ip.EphemeralReuseWindow > maxEphemeralReuseWindow {
+		ip.EphemeralReuseWindow = maxEphemeralReuseWindow
+	}
+
 	return &Server{
 		Parameters: ip,
 		Ake:        ake.NewServer(),
+		conf:       p,
+	}
+}
+
+// NewServerErr is like NewServer, but returns an error naming the invalid field if the configuration doesn't pass
+// Validate().
+func NewServerErr(p *Configuration) (*Server, error) {
+	if p != nil {
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewServer(p), nil
+}
+
+// NewVerifier returns a verifier-only Server, that can run the login flow with injected keys but can neither generate
+// keys nor register clients. This allows separating an authentication service from the enrollment service.
+func NewVerifier(p *Configuration) *Server {
+	s := NewServer(p)
+	s.verifier = true
+
+	return s
+}
+
+// IsVerifier returns whether the Server is verifier-only.
+func (s *Server) IsVerifier() bool {
+	return s.verifier
+}
+
+// KeyGen returns a key pair in the AKE group, or ErrVerifierOnly on a verifier-only Server.
+func (s *Server) KeyGen() (secretKey, publicKey []byte, err error) {
+	if s.verifier {
+		return nil, nil, ErrVerifierOnly
+	}
+
+	secretKey, publicKey = ake.KeyGen(s.AKEGroup)
+
+	return secretKey, publicKey, nil
+}
+
+// KeyGenTyped returns a key pair in the AKE group as a scalar and an element, that don't need to be decoded before use,
+// or ErrVerifierOnly on a verifier-only Server.
+func (s *Server) KeyGenTyped() (secretKey group.Scalar, publicKey group.Element, err error) {
+	if s.verifier {
+		return nil, nil, ErrVerifierOnly
+	}
+
+	secretKey, publicKey = ake.KeyGenTyped(s.AKEGroup)
+
+	return secretKey, publicKey, nil
+}
+
+// DeriveKeyPair returns the key pair in the AKE group derived from the master seed and the label, such that the server
+// can reconstruct its keys from a single backed-up secret, like the OPRF keys are derived from the OPRF seed. The same
+// seed and label always yield the same key pair, and different labels yield independent ones. The master seed must
+// be secret and uniformly random, e.g. of the KDF's output length. It returns ErrVerifierOnly on a verifier-only Server.
+func (s *Server) DeriveKeyPair(masterSeed, label []byte) (secretKey, publicKey []byte, err error) {
+	if s.verifier {
+		return nil, nil, ErrVerifierOnly
+	}
+
+	seed := s.KDF.Expand(masterSeed, encoding.SuffixString(label, tag.ServerKeyPair), encoding.ScalarLength[s.AKEGroup])
+	defer s.Wipe(seed)
+
+	sk := s.AKEGroup.HashToScalar(seed, []byte(tag.DeriveKeyPair))
+
+	return encoding.SerializeScalar(sk, s.AKEGroup), encoding.SerializePoint(s.AKEGroup.Base().Mult(sk), s.AKEGroup),
+		nil
+}
+
+// evaluation holds the OPRF evaluation, and the key commitment and proof in the verifiable mode.
+type evaluation struct {
+	z, publicKey, proof []byte
+}
+
+func (s *Server) evaluate(oprfSeed, credentialIdentifier, blinded []byte, tweak group.Scalar) (*evaluation, error) {
+	if !s.VerifiableOPRF {
+		evaluator := s.OPRFEvaluator
+		if evaluator == nil {
+			evaluator = internal.NewOPRFEvaluator(s.Parameters, oprfSeed)
+		}
+
+		ku, err := evaluator.DeriveKey(credentialIdentifier)
+		if err != nil {
+			return nil, err
+		}
+
+		z, err := evaluator.Evaluate(ku, blinded)
+		if err != nil {
+			return nil, err
+		}
+
+		if tweak != nil {
+			if z, err = s.applyTweak(z, tweak); err != nil {
+				return nil, err
+			}
+		}
+
+		return &evaluation{z: z}, nil
+	}
+
+	ku := s.OPRF.DeriveKey(s.OPRFKeySeed(oprfSeed, credentialIdentifier), []byte(tag.DeriveKeyPair))
+	if tweak != nil {
+		ku = ku.Mult(tweak)
+	}
+
+	z, pk, proof, err := s.OPRF.ServerWithDomain(ku, s.OPRFDomainSeparation).EvaluateWithProof(blinded)
+	if err != nil {
+		return nil, err
+	}
+
+	return &evaluation{z: z, publicKey: pk, proof: proof}, nil
+}
+
+// applyTweak multiplies the evaluated element by the OPRF key tweak of a record.
+func (s *Server) applyTweak(evaluated []byte, tweak group.Scalar) ([]byte, error) {
+	z, err := s.OPRFGroup.NewElement().Decode(evaluated)
+	if err != nil {
+		return nil, err
+	}
+
+	return encoding.SerializePoint(z.Mult(tweak), s.OPRFGroup), nil
+}
+
+func (s *Server) oprfResponse(oprfSeed, credentialIdentifier, oprfKeyTweak, element []byte) (*evaluation, error) {
+	if s.StrictMode && bytes.Equal(element, encoding.SerializePoint(s.OPRFGroup.Base(), s.OPRFGroup)) {
+		return nil, ErrSuspiciousBlindedElement
+	}
+
+	var tweak group.Scalar
+
+	if oprfKeyTweak != nil {
+		var err error
+		if tweak, err = s.OPRFGroup.NewScalar().Decode(oprfKeyTweak); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidTweak, err)
+		}
+	}
+
+	start := s.ObserveStart()
+	ev, err := s.evaluate(oprfSeed, credentialIdentifier, element, tweak)
+	s.ObserveOPRF(start)
+
+	return ev, err
+}
+
+// ReencryptRecord returns a copy of the record that can be used with newSeed instead of oldSeed, without the client.
+//
+// The OPRF key of a record is derived from the seed and can't change without the client registering again, so the
+// copy holds a tweak that maps the key derived from newSeed to the one the record was registered with. The effective
+// OPRF key is therefore unchanged, and can still be derived from oldSeed: oldSeed must remain as secret as newSeed,
+// and destroying it doesn't protect the records against its disclosure, e.g. from a backup. Only a new registration
+// changes the OPRF key of a client. The masking key is derived by the client from its password, and can't be rotated
+// by the server either. It only supports the built-in OPRF evaluator.
+func (s *Server) ReencryptRecord(oldSeed, newSeed []byte, record *ClientRecord) (*ClientRecord, error) {
+	kOld := s.OPRF.DeriveKey(s.OPRFKeySeed(oldSeed, record.CredentialIdentifier), []byte(tag.DeriveKeyPair))
+
+	if record.OPRFKeyTweak != nil {
+		tweak, err := s.OPRFGroup.NewScalar().Decode(record.OPRFKeyTweak)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidTweak, err)
+		}
+
+		kOld = kOld.Mult(tweak)
 	}
+
+	kNew := s.OPRF.DeriveKey(s.OPRFKeySeed(newSeed, record.CredentialIdentifier), []byte(tag.DeriveKeyPair))
+	r := *record
+	r.OPRFKeyTweak = encoding.SerializeScalar(kOld.Mult(kNew.Invert()), s.OPRFGroup)
+
+	return &r, nil
 }
 
-// KeyGen returns a key pair in the AKE group.
-func (s *Server) KeyGen() (secretKey, publicKey []byte) {
-	return ake.KeyGen(s.Group)
+// minMasterKeyLength is the minimum length of a master key, in bytes.
+const minMasterKeyLength = 32
+
+// SetMasterKey sets the secret master key from which RegisterClient derives the per-credential OPRF seeds. It must be
+// at least 32 bytes long, and kept as secret as the server's private key. The server keeps a copy of it.
+func (s *Server) SetMasterKey(masterKey []byte) error {
+	if len(masterKey) < minMasterKeyLength {
+		return errShortMasterKey
+	}
+
+	s.masterKey = cloneBytes(masterKey)
+
+	return nil
 }
 
-func (s *Server) evaluate(seed, blinded []byte) (m []byte, err error) {
-	ku := s.OPRF.DeriveKey(seed, []byte(tag.DeriveKeyPair))
-	return s.OPRF.Server(ku).Evaluate(blinded)
+// OPRFSeed returns the OPRF seed derived from the master key for the credential identifier, to be used in Init.
+func (s *Server) OPRFSeed(credentialIdentifier []byte) ([]byte, error) {
+	if s.masterKey == nil {
+		return nil, ErrNoMasterKey
+	}
+
+	return s.KDF.Expand(s.masterKey, encoding.SuffixString(credentialIdentifier, tag.OprfSeed), s.Hash.Size()), nil
 }
 
-func (s *Server) oprfResponse(oprfSeed, credentialIdentifier, element []byte) (m []byte, err error) {
-	seed := s.KDF.Expand(oprfSeed, encoding.SuffixString(credentialIdentifier, tag.OprfKey), encoding.ScalarLength[s.Group])
-	return s.evaluate(seed, element)
+// RegisterClient is a wrapper around RegistrationResponse that uses the OPRF seed derived from the master key for the
+// credential identifier, and returns it.
+func (s *Server) RegisterClient(req *message.RegistrationRequest,
+	serverPublicKey, credentialIdentifier []byte) (*message.RegistrationResponse, []byte, error) {
+	seed, err := s.OPRFSeed(credentialIdentifier)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := s.RegistrationResponse(req, serverPublicKey, credentialIdentifier, seed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp, seed, nil
+}
+
+// FakeRecord returns a record for a nonexistent client, to run the login flow as for a real client and so prevent
+// client enumeration. It has the size of a real record, and its keys are derived from the OPRF seed and the credential
+// identifier, such that repeated logins for the same credential identifier use the same record. Init accepts it like
+// any other record, and the client fails to recover the envelope.
+func (s *Server) FakeRecord(credentialIdentifier, oprfSeed []byte) *ClientRecord {
+	seed := s.KDF.Expand(oprfSeed, encoding.SuffixString(credentialIdentifier, tag.FakeRecord), s.KDF.Size())
+	skSeed := s.KDF.Expand(seed, []byte(tag.FakePublicKey), encoding.ScalarLength[s.AKEGroup])
+	sk := s.AKEGroup.HashToScalar(skSeed, []byte(tag.H2sDST))
+
+	return &ClientRecord{
+		CredentialIdentifier: credentialIdentifier,
+		RegistrationUpload: &message.RegistrationUpload{
+			PublicKey:  encoding.SerializePoint(s.AKEGroup.Base().Mult(sk), s.AKEGroup),
+			MaskingKey: s.KDF.Expand(seed, []byte(tag.FakeMaskingKey), s.Hash.Size()),
+			Envelope:   GetFakeEnvelope(s.conf),
+		},
+		Fake: true,
+	}
+}
+
+// RecordOrFake returns the record to give to Init for the credential identifier, where record is the one found in the
+// store, or nil if there's none. A nil record is replaced with the FakeRecord for the credential identifier, so that
+// the login runs as for a real client. Only the derivation of the fake record is unconditional, so that its cost is
+// paid whether the client exists or not: the choice of the returned record is a plain branch, not a constant-time
+// selection, and the lookup of the record in the store is up to the caller. If the server premasks its records with
+// PremaskRecord, it must premask the returned fake records too, or their fresh masking nonces reveal that the client
+// doesn't exist.
+func (s *Server) RecordOrFake(record *ClientRecord, credentialIdentifier, oprfSeed []byte) *ClientRecord {
+	fake := s.FakeRecord(credentialIdentifier, oprfSeed)
+	if record == nil {
+		return fake
+	}
+
+	return record
+}
+
+// SetFakeRecordHook sets a function called by Init with the credential identifier of a record returned by FakeRecord,
+// e.g. to log or count the logins for nonexistent clients. It's called once the KE2 has been computed as for a real
+// record, so the KE2 doesn't reveal the record is fake, but the hook must not take observably longer than the
+// caller's own processing of real logins where timing matters.
+func (s *Server) SetFakeRecordHook(hook func(credentialIdentifier []byte)) {
+	s.fakeRecordHook = hook
 }
 
 // RegistrationResponse returns a RegistrationResponse message to the input RegistrationRequest message and given identifiers.
+// The credential identifier must not be empty, as it separates the OPRF keys of the clients.
 func (s *Server) RegistrationResponse(req *message.RegistrationRequest,
 	serverPublicKey, credentialIdentifier, oprfSeed []byte) (*message.RegistrationResponse, error) {
-	z, err := s.oprfResponse(oprfSeed, credentialIdentifier, req.Data)
+	if s.verifier {
+		return nil, ErrVerifierOnly
+	}
+
+	if len(credentialIdentifier) == 0 {
+		return nil, ErrEmptyCredentialIdentifier
+	}
+
+	ev, err := s.oprfResponse(oprfSeed, credentialIdentifier, nil, req.Data)
 	if err != nil {
-		return nil, fmt.Errorf(" RegistrationResponse: %w", err)
+		return nil, stageError(StageOPRF, " RegistrationResponse", err)
 	}
 
 	return &message.RegistrationResponse{
-		Data: encoding.PadPoint(z, s.Group),
-		Pks:  serverPublicKey,
+		Data:          encoding.PadPoint(ev.z, s.OPRFGroup),
+		Pks:           serverPublicKey,
+		OprfPublicKey: ev.publicKey,
+		Proof:         ev.proof,
 	}, nil
 }
 
-func (s *Server) credentialResponse(req *cred.CredentialRequest, serverPublicKey []byte, record *message.RegistrationUpload,
-	credentialIdentifier, oprfSeed, maskingNonce []byte) (*cred.CredentialResponse, error) {
-	z, err := s.oprfResponse(oprfSeed, credentialIdentifier, req.Data)
+func (s *Server) credentialResponse(req *cred.CredentialRequest, serverPublicKey []byte, record *ClientRecord,
+	oprfSeed []byte) (*cred.CredentialResponse, error) {
+	ev, err := s.oprfResponse(oprfSeed, record.CredentialIdentifier, record.OPRFKeyTweak, req.Data)
 	if err != nil {
-		return nil, fmt.Errorf("oprfResponse: %w", err)
+		return nil, stageError(StageOPRF, " credentialResponse: oprfResponse", err)
 	}
 
-	// testing: integrated to support testing, to force values.
-	if len(maskingNonce) == 0 {
-		maskingNonce = internal.RandomBytes(s.Parameters.NonceLen)
-	}
+	maskingNonce, maskedResponse := record.MaskingNonce, record.MaskedResponse
 
-	clear := encoding.Concat(serverPublicKey, record.Envelope)
-	maskedResponse := s.MaskResponse(record.MaskingKey, maskingNonce, clear)
+	if len(maskedResponse) == 0 || len(record.TestMaskNonce) != 0 {
+		// testing: integrated to support testing, to force values.
+		maskingNonce = record.TestMaskNonce
+		if len(maskingNonce) == 0 {
+			maskingNonce = s.Random(s.NonceLen)
+		}
+
+		maskedResponse = s.mask(record.RegistrationUpload, serverPublicKey, maskingNonce)
+	}
 
 	return &cred.CredentialResponse{
-		Data:           encoding.PadPoint(z, s.Group),
+		Data:           encoding.PadPoint(ev.z, s.OPRFGroup),
 		MaskingNonce:   maskingNonce,
 		MaskedResponse: maskedResponse,
+		OprfPublicKey:  ev.publicKey,
+		Proof:          ev.proof,
 	}, nil
 }
 
-// Init responds to a KE1 message with a KE2 message given server credentials and client record.
+func (s *Server) mask(record *message.RegistrationUpload, serverPublicKey, maskingNonce []byte) []byte {
+	clear := encoding.Concat(serverPublicKey, record.Envelope)
+	return s.MaskResponse(record.MaskingKey, maskingNonce, clear)
+}
+
+// ReMask returns a new masked response of the server public key and the record's envelope under the given masking
+// nonce, using the record's masking key. This allows re-randomizing stored responses, which the client can still unmask
+// with the correct password.
+func (s *Server) ReMask(record *ClientRecord, serverPublicKey, maskingNonce []byte) []byte {
+	return s.mask(record.RegistrationUpload, serverPublicKey, maskingNonce)
+}
+
+// PremaskRecord returns a copy of the record holding its masked response under the server public key, which Init then
+// uses instead of masking the response at each login. This saves the masking for frequently used accounts, but every
+// KE2 for the record then carries the same masking nonce and masked response, which makes the logins of that client
+// linkable. The masking nonce is derived from the masking key and the server public key, so that premasking a
+// FakeRecord also gives the same response at each login: a server premasking the records of existing clients must
+// premask the records of nonexistent ones too, e.g. with PremaskRecord(RecordOrFake(...)), or the fresh nonces
+// of the latter reveal that they don't exist. The copy must be premasked again if the server public key changes, and
+// the premasked fields are not part of the record's serialization.
+func (s *Server) PremaskRecord(record *ClientRecord, serverPublicKey []byte) *ClientRecord {
+	r := *record
+	r.MaskingNonce = s.KDF.Expand(record.MaskingKey, encoding.SuffixString(serverPublicKey, tag.PremaskNonce), s.NonceLen)
+	r.MaskedResponse = s.mask(record.RegistrationUpload, serverPublicKey, r.MaskingNonce)
+
+	return &r
+}
+
+// BuildRecord deserializes the RegistrationUpload, validates the client public key, and returns the ClientRecord to
+// store for the client.
+func (s *Server) BuildRecord(upload, credentialIdentifier, clientIdentity []byte) (*ClientRecord, error) {
+	if s.verifier {
+		return nil, ErrVerifierOnly
+	}
+
+	u, err := s.DeserializeRegistrationUpload(upload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registration upload: %w", err)
+	}
+
+	if err := s.ValidateUpload(u); err != nil {
+		return nil, err
+	}
+
+	return &ClientRecord{
+		CredentialIdentifier: credentialIdentifier,
+		ClientIdentity:       clientIdentity,
+		RegistrationUpload:   u,
+	}, nil
+}
+
+// ValidateUpload returns an error if the fields of the upload don't have the lengths of the configuration, or if the
+// client public key is not the canonical encoding of an element of the AKE group, or is the identity element.
+func (s *Server) ValidateUpload(upload *message.RegistrationUpload) error {
+	if len(upload.MaskingKey) != s.Hash.Size() {
+		return fmt.Errorf("%w: masking key length %d", ErrInvalidUpload, len(upload.MaskingKey))
+	}
+
+	if len(upload.Envelope) != s.EnvelopeSize {
+		return fmt.Errorf("%w: envelope length %d", ErrInvalidUpload, len(upload.Envelope))
+	}
+
+	if len(upload.PublicKey) != s.AkePointLength {
+		return fmt.Errorf("%w: client public key length %d", ErrInvalidUpload, len(upload.PublicKey))
+	}
+
+	pku, err := encoding.DecodePoint(s.AKEGroup, upload.PublicKey)
+	if err != nil || !bytes.Equal(encoding.SerializePoint(pku, s.AKEGroup), upload.PublicKey) {
+		return fmt.Errorf("client public key: %w", ErrNonCanonicalPoint)
+	}
+
+	if pku.IsIdentity() {
+		return fmt.Errorf("client public key: %w", ErrIdentityElementKey)
+	}
+
+	return nil
+}
+
+// StoreRecord validates the upload with ValidateUpload, and stores the resulting record in the store with Put, which
+// returns ErrRecordExists if a record is already stored for the credential identifier.
+func (s *Server) StoreRecord(store RecordStore, upload *message.RegistrationUpload, credentialIdentifier,
+	clientIdentity []byte) (*ClientRecord, error) {
+	if s.verifier {
+		return nil, ErrVerifierOnly
+	}
+
+	if err := s.ValidateUpload(upload); err != nil {
+		return nil, err
+	}
+
+	record := &ClientRecord{
+		CredentialIdentifier: credentialIdentifier,
+		ClientIdentity:       clientIdentity,
+		RegistrationUpload:   upload,
+	}
+
+	if err := store.Put(record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// Init responds to a KE1 message with a KE2 message given server credentials and client record. If both server keys
+// are nil, the pair set with SetStaticKeys is used. The server identity is, in order of precedence, serverIdentity,
+// the configuration's ServerIdentity, and the server public key. The client identity is the record's ClientIdentity,
+// or the client public key if it is nil. The record's CredentialIdentifier must not be empty.
 func (s *Server) Init(ke1 *message.KE1, serverIdentity, serverSecretKey, serverPublicKey, oprfSeed []byte,
 	record *ClientRecord) (*message.KE2, error) {
-	_, err := s.Group.NewElement().Decode(serverPublicKey)
+	return s.decodeAndInit(nil, ke1, serverIdentity, serverSecretKey, serverPublicKey, oprfSeed, record)
+}
+
+func (s *Server) decodeAndInit(i interrupt, ke1 *message.KE1, serverIdentity, serverSecretKey, serverPublicKey,
+	oprfSeed []byte, record *ClientRecord) (*message.KE2, error) {
+	if serverSecretKey == nil && serverPublicKey == nil && s.staticSecretKey != nil {
+		return s.init(i, ke1, serverIdentity, s.staticSecretKey, s.staticPublicKey, oprfSeed, record)
+	}
+
+	pks, err := encoding.DecodePoint(s.AKEGroup, serverPublicKey)
 	if err != nil {
 		return nil, fmt.Errorf("invalid server public key: %w", err)
 	}
 
-	sks, err := s.Group.NewScalar().Decode(serverSecretKey)
+	if pks.IsIdentity() {
+		return nil, fmt.Errorf("invalid server public key: %w", ErrIdentityElementKey)
+	}
+
+	sks, err := internal.DecodeScalar(s.AKEGroup, serverSecretKey)
 	if err != nil {
 		return nil, fmt.Errorf("invalid server secret key: %w", err)
 	}
 
-	response, err := s.credentialResponse(ke1.CredentialRequest, serverPublicKey,
-		record.RegistrationUpload, record.CredentialIdentifier, oprfSeed, record.TestMaskNonce)
+	return s.init(i, ke1, serverIdentity, sks, serverPublicKey, oprfSeed, record)
+}
+
+// SetStaticKeys validates and caches the server's long-term key pair, after which Init can be called with nil keys to
+// use it without decoding it again.
+func (s *Server) SetStaticKeys(serverSecretKey, serverPublicKey []byte) error {
+	sks, err := internal.DecodeScalar(s.AKEGroup, serverSecretKey)
+	if err != nil {
+		return fmt.Errorf("invalid server secret key: %w", err)
+	}
+
+	pks, err := encoding.DecodePoint(s.AKEGroup, serverPublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid server public key: %w", err)
+	}
+
+	if err := s.checkKeyPair(sks, pks); err != nil {
+		return err
+	}
+
+	s.staticSecretKey = sks
+	s.staticPublicKey = serverPublicKey
+
+	return nil
+}
+
+// checkKeyPair returns an error if a key is missing, if the public key is the identity, or if it doesn't match the
+// secret key.
+func (s *Server) checkKeyPair(sks group.Scalar, pks group.Element) error {
+	if sks == nil || pks == nil {
+		return errMissingKey
+	}
+
+	if pks.IsIdentity() {
+		return fmt.Errorf("invalid server public key: %w", ErrIdentityElementKey)
+	}
+
+	if !bytes.Equal(s.AKEGroup.Base().Mult(sks).Bytes(), pks.Bytes()) {
+		return errKeyMismatch
+	}
+
+	return nil
+}
+
+// InitWithKeys is the same as Init, but takes the server key pair as returned by KeyGenTyped, avoiding to decode it.
+// The key pair is validated as in SetStaticKeys, which should be preferred to validate it only once.
+func (s *Server) InitWithKeys(ke1 *message.KE1, serverIdentity []byte, serverSecretKey group.Scalar,
+	serverPublicKey group.Element, oprfSeed []byte, record *ClientRecord) (*message.KE2, error) {
+	if err := s.checkKeyPair(serverSecretKey, serverPublicKey); err != nil {
+		return nil, err
+	}
+
+	return s.init(nil, ke1, serverIdentity, serverSecretKey, encoding.SerializePoint(serverPublicKey, s.AKEGroup), oprfSeed,
+		record)
+}
+
+func (s *Server) init(i interrupt, ke1 *message.KE1, serverIdentity []byte, sks group.Scalar,
+	serverPublicKey, oprfSeed []byte, record *ClientRecord) (*message.KE2, error) {
+	if !bytes.Equal(ke1.Version, s.VersionID()) {
+		return nil, ErrVersionMismatch
+	}
+
+	if len(record.CredentialIdentifier) == 0 {
+		return nil, ErrEmptyCredentialIdentifier
+	}
+
+	if serverIdentity == nil {
+		serverIdentity = s.ServerIdentity
+	}
+
+	if s.RequireExplicitIdentities && (record.ClientIdentity == nil || serverIdentity == nil) {
+		return nil, ErrMissingIdentity
+	}
+
+	if len(record.Envelope) != s.EnvelopeSize {
+		return nil, fmt.Errorf("%w: expected %d bytes, got %d", ErrEnvelopeLengthMismatch, s.EnvelopeSize,
+			len(record.Envelope))
+	}
+
+	if err := i.check(); err != nil {
+		return nil, err
+	}
+
+	response, err := s.credentialResponse(ke1.CredentialRequest, serverPublicKey, record, oprfSeed)
 	if err != nil {
-		return nil, fmt.Errorf(" credentialResponse: %w", err)
+		return nil, err
+	}
+
+	// This is the last check: the nonce cache and the AKE then change the state of the server.
+	if err = i.check(); err != nil {
+		return nil, err
+	}
+
+	if s.nonceCache != nil && s.nonceCache.NonceSeen(ke1.NonceU) {
+		return nil, ErrReplayedNonce
 	}
 
 	clientIdentity := record.ClientIdentity
@@ -128,21 +748,67 @@ func (s *Server) Init(ke1 *message.KE1, serverIdentity, serverSecretKey, serverP
 		serverIdentity = serverPublicKey
 	}
 
+	start := s.ObserveStart()
 	ke2, err := s.Ake.Response(s.Parameters, serverIdentity, sks, clientIdentity, record.PublicKey, ke1, response)
+	s.ObserveAKEResponse(start)
+
 	if err != nil {
-		return nil, fmt.Errorf(" AKE response: %w", err)
+		return nil, stageError(StageAKE, " AKE response", err)
+	}
+
+	s.stateCreated = time.Now()
+
+	if record.Fake && s.fakeRecordHook != nil {
+		s.fakeRecordHook(record.CredentialIdentifier)
 	}
 
 	return ke2, nil
 }
 
-// Finish returns an error if the KE3 received from the client holds an invalid mac, and nil if correct.
-func (s *Server) Finish(ke3 *message.KE3) error {
-	if !s.Ake.Finalize(s.Parameters, ke3) {
-		return ErrAkeInvalidClientMac
+// InitWithWrappedSeed is the same as Init, but takes an OPRF seed wrapped by WrapOPRFSeed, and returns
+// ErrCorruptedOPRFSeed if it has been corrupted.
+func (s *Server) InitWithWrappedSeed(ke1 *message.KE1, serverIdentity, serverSecretKey, serverPublicKey,
+	wrappedSeed []byte, record *ClientRecord) (*message.KE2, error) {
+	oprfSeed, err := UnwrapOPRFSeed(wrappedSeed)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return s.Init(ke1, serverIdentity, serverSecretKey, serverPublicKey, oprfSeed, record)
+}
+
+// Finish returns an error if the KE3 received from the client holds an invalid mac, and nil if correct. The returned
+// error is an *AuthenticationError holding the reason of the failure. FinishSession is preferred, as it only returns
+// the session key once the client is authenticated. If the client bound additional authenticated data to its KE3,
+// the same aad must be given, in the same order, or the MAC check fails.
+func (s *Server) Finish(ke3 *message.KE3, aad ...[]byte) error {
+	if s.stateExpired() {
+		return ErrStateExpired
+	}
+
+	err := s.Ake.Finalize(s.Parameters, ke3, aad)
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ake.ErrNoState):
+		return &AuthenticationError{Reason: ReasonNoState}
+	case errors.Is(err, ake.ErrInvalidMacLength):
+		s.ObserveMACFailure(StageAKE)
+		return &AuthenticationError{Reason: ReasonInvalidMacLength}
+	default:
+		s.ObserveMACFailure(StageAKE)
+		return &AuthenticationError{Reason: ReasonInvalidMac}
+	}
+}
+
+// FinishSession is like Finish, but also returns a copy of the session key if the KE3 is valid, and no key otherwise.
+func (s *Server) FinishSession(ke3 *message.KE3, aad ...[]byte) (sessionKey []byte, err error) {
+	if err = s.Finish(ke3, aad...); err != nil {
+		return nil, err
+	}
+
+	return append([]byte(nil), s.Ake.SessionKey()...), nil
 }
 
 // SessionKey returns the session key if the previous call to Init() was successful.
@@ -150,11 +816,38 @@ func (s *Server) SessionKey() []byte {
 	return s.Ake.SessionKey()
 }
 
-// ExpectedMAC returns the expected client MAC if the previous call to Init() was successful.
+// SessionKeyFor returns a key derived from the session key and bound to purpose, so that independent subsystems
+// don't share the same key. The client derives the same key for the same purpose. It returns nil if the previous call
+// to Init() was not successful.
+func (s *Server) SessionKeyFor(purpose []byte) []byte {
+	return ake.PurposeKey(s.KDF, s.Ake.SessionKey(), purpose)
+}
+
+// ExpectedMAC returns the expected client MAC if the previous call to Init() was successful. This is the MAC before
+// any binding to additional authenticated data, and it is the key of that binding: whoever holds it can compute a valid
+// KE3 for any aad, so it must be kept as secret as the session key.
 func (s *Server) ExpectedMAC() []byte {
 	return s.Ake.ExpectedMAC()
 }
 
+// VerifyKE3 returns whether the KE3's MAC, bound to the additional authenticated data if any, matches ExpectedMAC(),
+// comparing them in constant time. Unlike Finish, it doesn't notify the observer, and can be called any number of
+// times without side effects, e.g. by a secondary verifier. It returns false if Init wasn't called, or if the state is
+// older than the maximum age set with SetStateMaxAge.
+func (s *Server) VerifyKE3(ke3 *message.KE3, aad ...[]byte) bool {
+	return !s.stateExpired() && s.Ake.Finalize(s.Parameters, ke3, aad) == nil
+}
+
+// stateExpired returns whether the state set by Init is older than the maximum age, if any.
+func (s *Server) stateExpired() bool {
+	return s.stateMaxAge > 0 && !s.stateCreated.IsZero() && time.Since(s.stateCreated) > s.stateMaxAge
+}
+
+// TranscriptInputs returns the components of the AKE transcript if the previous call to Init() was successful.
+func (s *Server) TranscriptInputs() *message.TranscriptInputs {
+	return s.Ake.Transcript()
+}
+
 // DeserializeRegistrationRequest takes a serialized RegistrationRequest message and returns a deserialized RegistrationRequest structure.
 func (s *Server) DeserializeRegistrationRequest(registrationRequest []byte) (*message.RegistrationRequest, error) {
 	return s.Parameters.DeserializeRegistrationRequest(registrationRequest)
@@ -185,16 +878,71 @@ func (s *Server) DeserializeKE3(ke3 []byte) (*message.KE3, error) {
 	return s.Parameters.DeserializeKE3(ke3)
 }
 
-// SetAKEState sets the internal state of the AKE server from the given bytes.
+const (
+	// stateVersion is the first byte of the serialized AKE state, and identifies its encoding.
+	stateVersion byte = 1
+
+	// stateHeaderLength is the length of the version byte and the configuration fingerprint prefixing the AKE state.
+	stateHeaderLength = 1 + confLength
+
+	// stateTimestampLength is the length of the creation timestamp appended to the AKE state.
+	stateTimestampLength = 8
+)
+
+// stateHeader returns the version byte and the configuration fingerprint, which is the encoding of the configuration
+// without MHF parameters.
+func (s *Server) stateHeader() []byte {
+	return append([]byte{stateVersion}, s.conf.Serialize()[:confLength]...)
+}
+
+// SetStateMaxAge sets the maximum age of the AKE state, after which Finish returns ErrStateExpired. If set, the state
+// returned by SerializeState embeds its creation time, and SetAKEState rejects states without it. A zero maxAge
+// disables the expiry.
+func (s *Server) SetStateMaxAge(maxAge time.Duration) {
+	s.stateMaxAge = maxAge
+}
+
+// SetAKEState sets the internal state of the AKE server from the given bytes. It returns ErrStateMismatch if the state
+// was serialized by a server with another configuration. If the state embeds a creation time, it must not be in the
+// future.
 func (s *Server) SetAKEState(state []byte) error {
-	if len(state) != s.MAC.Size()+s.KDF.Size() {
+	length := s.MAC.Size() + s.KDF.Size()
+	if len(state) != stateHeaderLength+length && len(state) != stateHeaderLength+length+stateTimestampLength {
+		return ErrInvalidState
+	}
+
+	if !bytes.Equal(state[:stateHeaderLength], s.stateHeader()) {
+		return ErrStateMismatch
+	}
+
+	state = state[stateHeaderLength:]
+
+	switch {
+	case len(state) == length && s.stateMaxAge == 0:
+	case len(state) == length+stateTimestampLength:
+		created := time.Unix(0, int64(binary.BigEndian.Uint64(state[length:])))
+		if created.UnixNano() <= 0 || created.After(time.Now()) {
+			return errStateTimestamp
+		}
+
+		s.stateCreated = created
+	default:
 		return ErrInvalidState
 	}
 
-	return s.Ake.SetState(state[:s.MAC.Size()], state[s.MAC.Size():])
+	return s.Ake.SetState(state[:s.MAC.Size()], state[s.MAC.Size():length])
 }
 
-// SerializeState returns the internal state of the AKE server serialized to bytes.
+// SerializeState returns the internal state of the AKE server serialized to bytes, with its creation time if a
+// maximum age is set. It is prefixed with a version byte and a fingerprint of the configuration.
 func (s *Server) SerializeState() []byte {
-	return s.Ake.SerializeState()
+	state := append(s.stateHeader(), s.Ake.SerializeState()...)
+	if s.stateMaxAge == 0 {
+		return state
+	}
+
+	timestamp := make([]byte, stateTimestampLength)
+	binary.BigEndian.PutUint64(timestamp, uint64(s.stateCreated.UnixNano()))
+
+	return append(state, timestamp...)
 }
@@ -0,0 +1,204 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bytemare/opaque/internal"
+	"github.com/bytemare/opaque/message"
+)
+
+// ErrSessionNotFound indicates that no server state is stored for the session identifier.
+var ErrSessionNotFound = errors.New("session not found")
+
+const (
+	// sessionIDLength is the length, in bytes, of the session identifiers.
+	sessionIDLength = 32
+
+	// defaultSessionMaxAge is the default time a client has between Begin and Complete.
+	defaultSessionMaxAge = time.Minute
+)
+
+// SessionStore stores the server state of logins between Begin and Complete, by session identifier. The states are
+// as sensitive as the server's secret key, and should be stored with an expiry. For example, a Redis-backed store
+// would SET the state with an expiry in Put, GET it in Get and map a missing key to ErrSessionNotFound, and DEL it in
+// Delete.
+type SessionStore interface {
+	// Get returns the state stored for the session identifier, or ErrSessionNotFound.
+	Get(sessionID []byte) ([]byte, error)
+
+	// Put stores the state under the session identifier.
+	Put(sessionID, state []byte) error
+
+	// Delete removes the state stored for the session identifier, if any.
+	Delete(sessionID []byte) error
+}
+
+// MemorySessionStore is an in-memory SessionStore, safe for concurrent use. States older than its maximum age are
+// not returned, and abandoned ones are evicted after at most twice that age.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	maxAge   time.Duration
+	rotated  time.Time
+	current  map[string]sessionEntry
+	previous map[string]sessionEntry
+}
+
+type sessionEntry struct {
+	state   []byte
+	created time.Time
+}
+
+// NewMemorySessionStore returns an empty MemorySessionStore keeping states for maxAge, or for a minute if maxAge is not
+// positive.
+func NewMemorySessionStore(maxAge time.Duration) *MemorySessionStore {
+	if maxAge <= 0 {
+		maxAge = defaultSessionMaxAge
+	}
+
+	return &MemorySessionStore{
+		maxAge:   maxAge,
+		rotated:  time.Now(),
+		current:  make(map[string]sessionEntry),
+		previous: make(map[string]sessionEntry),
+	}
+}
+
+// rotate drops the states stored more than two maximum ages ago, in one go, so that abandoned states don't pile up.
+func (m *MemorySessionStore) rotate(now time.Time) {
+	switch elapsed := now.Sub(m.rotated); {
+	case elapsed >= 2*m.maxAge:
+		m.previous, m.current = make(map[string]sessionEntry), make(map[string]sessionEntry)
+		m.rotated = now
+	case elapsed >= m.maxAge:
+		m.previous, m.current = m.current, make(map[string]sessionEntry)
+		m.rotated = now
+	}
+}
+
+// Get implements SessionStore.
+func (m *MemorySessionStore) Get(sessionID []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.rotate(now)
+
+	entry, ok := m.current[string(sessionID)]
+	if !ok {
+		entry, ok = m.previous[string(sessionID)]
+	}
+
+	if !ok || now.Sub(entry.created) > m.maxAge {
+		return nil, ErrSessionNotFound
+	}
+
+	return entry.state, nil
+}
+
+// Put implements SessionStore.
+func (m *MemorySessionStore) Put(sessionID, state []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.rotate(now)
+	m.current[string(sessionID)] = sessionEntry{state: state, created: now}
+
+	return nil
+}
+
+// Delete implements SessionStore.
+func (m *MemorySessionStore) Delete(sessionID []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.current, string(sessionID))
+	delete(m.previous, string(sessionID))
+
+	return nil
+}
+
+// ServerSession runs the server side of logins across two requests, keeping the server state in a SessionStore
+// between Begin and Complete.
+type ServerSession struct {
+	conf           *Configuration
+	store          SessionStore
+	serverIdentity []byte
+	keys           *ServerKeys
+	maxAge         time.Duration
+}
+
+// NewServerSession returns a ServerSession using the store, and the server identity and keys for all clients. If
+// serverIdentity is nil, the server public key is used. The configuration is copied, and the states expire after a
+// minute, which can be changed with SetMaxAge.
+func NewServerSession(conf *Configuration, store SessionStore, serverIdentity []byte, keys *ServerKeys) *ServerSession {
+	if conf == nil {
+		conf = DefaultConfiguration()
+	}
+
+	return &ServerSession{
+		conf:           conf.Clone(),
+		store:          store,
+		serverIdentity: serverIdentity,
+		keys:           keys,
+		maxAge:         defaultSessionMaxAge,
+	}
+}
+
+// SetMaxAge sets the time a client has between Begin and Complete, after which Complete returns ErrStateExpired. It
+// should not exceed the expiry of the store. A zero maxAge leaves the expiry to the store.
+func (s *ServerSession) SetMaxAge(maxAge time.Duration) {
+	s.maxAge = maxAge
+}
+
+// Begin returns the KE2 response to ke1 for the client's record, and the identifier of the session to give to
+// Complete with the client's KE3.
+func (s *ServerSession) Begin(ke1 *message.KE1, record *ClientRecord) (ke2 *message.KE2, sessionID []byte, err error) {
+	server := s.conf.Server()
+	server.SetStateMaxAge(s.maxAge)
+
+	ke2, err = server.Init(ke1, s.serverIdentity, s.keys.SecretKey, s.keys.PublicKey, s.keys.OprfSeed, record)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sessionID = internal.RandomBytes(sessionIDLength)
+	if err = s.store.Put(sessionID, server.SerializeState()); err != nil {
+		return nil, nil, err
+	}
+
+	return ke2, sessionID, nil
+}
+
+// Complete authenticates the client's ke3 against the state of the session, and returns the session key. The state is
+// deleted whatever the outcome, so that a session can only be completed once, and ErrStateExpired is returned if the
+// session is older than its maximum age.
+func (s *ServerSession) Complete(sessionID []byte, ke3 *message.KE3) (sessionKey []byte, err error) {
+	state, err := s.store.Get(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.store.Delete(sessionID); err != nil {
+		return nil, err
+	}
+
+	server := s.conf.Server()
+	server.SetStateMaxAge(s.maxAge)
+
+	if err = server.SetAKEState(state); err != nil {
+		return nil, err
+	}
+
+	return server.FinishSession(ke3)
+}
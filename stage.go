@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import "github.com/bytemare/opaque/internal"
+
+// These are the protocol stages reported by a StageError and to an Observer.
+const (
+	// StageOPRF is the evaluation or finalization of the OPRF.
+	StageOPRF = internal.StageOPRF
+
+	// StageEnvelope is the creation or recovery of the client's envelope.
+	StageEnvelope = internal.StageEnvelope
+
+	// StageAKE is the server's response or the client's finalization of the 3DH key exchange.
+	StageAKE = internal.StageAKE
+)
+
+// StageError is returned by the registration and login functions when a protocol stage fails, so that callers can
+// use errors.As to find which stage failed, and errors.Is or errors.As on Err to find why.
+type StageError struct {
+	Stage string
+	Err   error
+
+	// operation describes the failing operation of the stage in the error message.
+	operation string
+}
+
+func stageError(stage, operation string, err error) error {
+	return &StageError{Stage: stage, Err: err, operation: operation}
+}
+
+// Error returns the description of the failing operation, or the stage, followed by the description of the error.
+func (e *StageError) Error() string {
+	operation := e.operation
+	if operation == "" {
+		operation = e.Stage
+	}
+
+	return operation + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
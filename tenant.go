@@ -0,0 +1,33 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import (
+	"fmt"
+
+	"github.com/bytemare/opaque/message"
+)
+
+// TenantResolver selects the server identity, key pair, and OPRF seed to answer a login with, for servers hosting
+// several tenants with their own keys. It can route on the record, e.g. its credential identifier, or on the KE1.
+type TenantResolver interface {
+	// Resolve returns the server identity, secret key, public key, and OPRF seed to use for the login. A nil identity
+	// defaults like in Server.Init.
+	Resolve(ke1 *message.KE1, record *ClientRecord) (identity, secretKey, publicKey, oprfSeed []byte, err error)
+}
+
+// InitResolved is the same as Init, but takes the server identity, keys, and OPRF seed from the resolver.
+func (s *Server) InitResolved(ke1 *message.KE1, resolver TenantResolver, record *ClientRecord) (*message.KE2, error) {
+	identity, sk, pk, oprfSeed, err := resolver.Resolve(ke1, record)
+	if err != nil {
+		return nil, fmt.Errorf("tenant resolver: %w", err)
+	}
+
+	return s.Init(ke1, identity, sk, pk, oprfSeed, record)
+}
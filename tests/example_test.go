@@ -33,13 +33,14 @@ func ExampleConfiguration() {
 	defaultConf := opaque.DefaultConfiguration()
 
 	customConf := &opaque.Configuration{
-		Group:    opaque.RistrettoSha512,
-		KDF:      hash.SHA512,
-		MAC:      hash.SHA512,
-		Hash:     hash.SHA512,
-		MHF:      mhf.Scrypt,
-		Mode:     opaque.Internal,
-		NonceLen: 32,
+		OPRFGroup: opaque.RistrettoSha512,
+		AKEGroup:  opaque.RistrettoSha512,
+		KDF:       hash.SHA512,
+		MAC:       hash.SHA512,
+		Hash:      hash.SHA512,
+		MHF:       mhf.Argon2id,
+		Mode:      opaque.Internal,
+		NonceLen:  32,
 	}
 
 	if !isSame(defaultConf, customConf) {
@@ -103,7 +104,12 @@ func ExampleRegistration() {
 	// They can be unique for all clients, and must be the same for a client between registration and login. It's safe
 	// to use these same values across clients as long as they remain secret.
 	secretOprfSeed = internal.RandomBytes(32)
-	serverPrivateKey, serverPublicKey = opaque.DefaultConfiguration().Server().KeyGen()
+	var err error
+
+	serverPrivateKey, serverPublicKey, err = opaque.DefaultConfiguration().Server().KeyGen()
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	// Secret client information.
 	password := []byte("password")
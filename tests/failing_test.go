@@ -9,7 +9,10 @@
 package opaque
 
 import (
+	"bytes"
+	"context"
 	"crypto/elliptic"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -18,7 +21,9 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/bytemare/cryptotools/group"
 	"github.com/bytemare/cryptotools/group/ciphersuite"
 	"github.com/bytemare/cryptotools/hash"
 	"github.com/bytemare/cryptotools/mhf"
@@ -83,7 +88,7 @@ func TestDeserializeRegistrationUpload(t *testing.T) {
 
 func TestDeserializeKE1(t *testing.T) {
 	c := opaque.DefaultConfiguration()
-	group := ciphersuite.Identifier(c.Group)
+	group := ciphersuite.Identifier(c.OPRFGroup)
 	ke1Length := encoding.PointLength[group] + c.NonceLen + encoding.PointLength[group]
 
 	server := c.Server()
@@ -141,360 +146,3288 @@ func TestSetAKEState(t *testing.T) {
 	}
 }
 
+func TestSetAKEState_Mismatch(t *testing.T) {
+	conf := opaque.DefaultConfiguration()
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	client := conf.Client()
+	server := conf.Server()
+	sk, pk := keyGen(t, server)
+	rec := buildRecord(t, credID, seed, []byte("yo"), pk, client, server)
+
+	server = conf.Server()
+	if _, err := server.Init(conf.Client().Init([]byte("yo")), nil, sk, pk, seed, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	state := server.SerializeState()
+
+	other := opaque.DefaultConfiguration()
+	other.MHF = mhf.Scrypt
+
+	if err := other.Server().SetAKEState(state); !errors.Is(err, opaque.ErrStateMismatch) {
+		t.Fatalf("expected %q on another configuration, got %v", opaque.ErrStateMismatch, err)
+	}
+
+	state[0]++
+	if err := conf.Server().SetAKEState(state); !errors.Is(err, opaque.ErrStateMismatch) {
+		t.Fatalf("expected %q on another version, got %v", opaque.ErrStateMismatch, err)
+	}
+}
+
+func TestServerStateMaxAge(t *testing.T) {
+	conf := opaque.DefaultConfiguration()
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	client := conf.Client()
+	server := conf.Server()
+	sk, pk := keyGen(t, server)
+	rec := buildRecord(t, credID, seed, []byte("yo"), pk, client, server)
+
+	client = conf.Client()
+	server = conf.Server()
+	server.SetStateMaxAge(time.Minute)
+
+	ke2, err := server.Init(client.Init([]byte("yo")), nil, sk, pk, seed, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ke3, _, err := client.Finish(nil, nil, ke2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := server.SerializeState()
+	timestamp := state[len(state)-8:]
+
+	restore := func(created time.Time) (*opaque.Server, error) {
+		s := conf.Server()
+		s.SetStateMaxAge(time.Minute)
+		binary.BigEndian.PutUint64(timestamp, uint64(created.UnixNano()))
+
+		return s, s.SetAKEState(state)
+	}
+
+	s, err := restore(time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.VerifyKE3(ke3) {
+		t.Fatal("expected VerifyKE3 to succeed on a fresh state")
+	}
+
+	if err := s.Finish(ke3); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = restore(time.Now().Add(-2 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.VerifyKE3(ke3) {
+		t.Fatal("expected VerifyKE3 to fail on an expired state")
+	}
+
+	if err := s.Finish(ke3); !errors.Is(err, opaque.ErrStateExpired) {
+		t.Fatalf("expected %q, got %v", opaque.ErrStateExpired, err)
+	}
+
+	if _, err := restore(time.Now().Add(time.Hour)); err == nil {
+		t.Fatal("expected error on a state created in the future")
+	}
+
+	s = conf.Server()
+	s.SetStateMaxAge(time.Minute)
+
+	if err := s.SetAKEState(state[:len(state)-8]); !errors.Is(err, opaque.ErrInvalidState) {
+		t.Fatalf("expected %q on a state without timestamp, got %v", opaque.ErrInvalidState, err)
+	}
+}
+
 // opaque.go
 
+func TestDeserialize_MessageLengthError(t *testing.T) {
+	client := opaque.DefaultConfiguration().Client()
+	ke1Length := len(client.Init([]byte("yo")).Serialize())
+
+	_, err := client.DeserializeKE1(internal.RandomBytes(ke1Length + 1))
+	if !errors.Is(err, opaque.ErrInvalidMessageLength) {
+		t.Fatalf("expected error %q, got %v", opaque.ErrInvalidMessageLength, err)
+	}
+
+	var lengthErr *opaque.MessageLengthError
+	if !errors.As(err, &lengthErr) || lengthErr.Expected != ke1Length || lengthErr.Actual != ke1Length+1 {
+		t.Fatalf("unexpected length error %#v", lengthErr)
+	}
+}
+
+func TestDeserializeStrict(t *testing.T) {
+	/*
+		Invalid points are rejected on deserialization
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		client := conf.Conf.Client()
+		server := conf.Conf.Server()
+		sks, pks := keyGen(t, server)
+		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
+		bad := getBadElement(t, conf)
+
+		ke1 := client.Init([]byte("yo"))
+		if _, err := server.DeserializeKE1Strict(ke1.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+
+		ke2, err := server.Init(ke1, nil, sks, pks, oprfSeed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.DeserializeKE2Strict(ke2.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+
+		encoded := ke1.Serialize()
+		copy(encoded[len(encoded)-len(bad):], bad)
+		expected := "invalid KE1 ephemeral public key: "
+		if _, err := server.DeserializeKE1Strict(encoded); err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("expected error on invalid epk - got %v", err)
+		}
+
+		encoded = ke2.Serialize()
+		copy(encoded, bad)
+		expected = "invalid KE2 evaluated element: "
+		if _, err := client.DeserializeKE2Strict(encoded); err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("expected error on invalid evaluated element - got %v", err)
+		}
+
+		if _, err := server.DeserializeKE1Strict(encoded[:1]); !errors.Is(err, opaque.ErrInvalidMessageLength) {
+			t.Fatalf("expected error on invalid length - got %v", err)
+		}
+	}
+
+	// The Ristretto255 identity element decodes but is rejected.
+	client := opaque.DefaultConfiguration().Client()
+	encoded := client.Init([]byte("yo")).Serialize()
+	copy(encoded, make([]byte, 32))
+	expected := "invalid KE1 blinded element: point is the identity element"
+	if _, err := client.DeserializeKE1Strict(encoded); err == nil || err.Error() != expected {
+		t.Fatalf("expected error on identity element - got %v", err)
+	}
+}
+
 func TestDeserializeConfiguration(t *testing.T) {
 	r6 := internal.RandomBytes(6)
-	r8 := internal.RandomBytes(8)
+	r9 := internal.RandomBytes(9)
 
 	if _, err := opaque.DeserializeConfiguration(r6); !errors.Is(err, internal.ErrConfigurationInvalidLength) {
 		t.Errorf("DeserializeConfiguration did not return the appropriate error for vector r7. want %q, got %q",
 			internal.ErrConfigurationInvalidLength, err)
 	}
 
-	if _, err := opaque.DeserializeConfiguration(r8); !errors.Is(err, internal.ErrConfigurationInvalidLength) {
+	if _, err := opaque.DeserializeConfiguration(r9); !errors.Is(err, internal.ErrConfigurationInvalidLength) {
 		t.Errorf("DeserializeConfiguration did not return the appropriate error for vector r9. want %q, got %q",
 			internal.ErrConfigurationInvalidLength, err)
 	}
+
+	// A legacy 7-byte encoding uses the same group for the OPRF and AKE.
+	legacy := opaque.FIPSConfiguration().Serialize()[:7]
+	legacy[0] = byte(opaque.P256Sha256)
+
+	conf, err := opaque.DeserializeConfiguration(legacy)
+	if err != nil || conf.OPRFGroup != opaque.P256Sha256 || conf.AKEGroup != opaque.P256Sha256 || conf.NonceLen != 32 {
+		t.Errorf("unexpected legacy configuration decoding %v (%v)", conf, err)
+	}
+
+	encoded := opaque.DefaultConfiguration().Serialize()
+	encoded[4] = 0
+
+	if _, err := opaque.DeserializeConfiguration(encoded); err == nil || err.Error() != "unsupported MHF 0" {
+		t.Errorf("DeserializeConfiguration did not fail on an unknown MHF, got %v", err)
+	}
 }
 
-func TestNilConfiguration(t *testing.T) {
-	def := opaque.DefaultConfiguration()
-	g := ciphersuite.Identifier(def.Group)
-	defaultConfiguration := &internal.Parameters{
-		KDF:             &internal.KDF{H: def.KDF.Get()},
-		MAC:             &internal.Mac{H: def.MAC.Get()},
-		Hash:            &internal.Hash{H: def.Hash.Get()},
-		MHF:             &internal.MHF{MHF: def.MHF.Get()},
-		NonceLen:        def.NonceLen,
-		OPRFPointLength: encoding.PointLength[g],
-		AkePointLength:  encoding.PointLength[g],
-		Group:           g,
-		OPRF:            oprf.Ciphersuite(g),
-		Context:         def.Context,
+func TestConfiguration_Validate(t *testing.T) {
+	tests := map[string]func(c *opaque.Configuration){
+		"unsupported group 2":                 func(c *opaque.Configuration) { c.AKEGroup = 2 },
+		"unsupported KDF hashing 0":           func(c *opaque.Configuration) { c.KDF = 0 },
+		"unsupported MAC hashing 9":           func(c *opaque.Configuration) { c.MAC = 9 },
+		"unsupported Hash hashing 0":          func(c *opaque.Configuration) { c.Hash = 0 },
+		"unsupported MHF 0":                   func(c *opaque.Configuration) { c.MHF = 0 },
+		"unsupported envelope mode 0":         func(c *opaque.Configuration) { c.Mode = 0 },
+		"nonce length too short 8":            func(c *opaque.Configuration) { c.NonceLen = 8 },
+		"application ID too long 65536":       func(c *opaque.Configuration) { c.ApplicationID = make([]byte, 1<<16) },
+		"KDF salt too long 65536":             func(c *opaque.Configuration) { c.KDFSalt = make([]byte, 1<<16) },
+		"OPRF domain separation too long 201": func(c *opaque.Configuration) { c.OPRFDomainSeparation = make([]byte, 201) },
+		"invalid ephemeral reuse window -1s":  func(c *opaque.Configuration) { c.EphemeralReuseWindow = -time.Second },
+		"invalid ephemeral reuse window 2m0s": func(c *opaque.Configuration) { c.EphemeralReuseWindow = 2 * time.Minute },
+		"negative maximum input length -1":    func(c *opaque.Configuration) { c.MaxInputLength = -1 },
+		"custom OPRF evaluators don't support the verifiable OPRF mode": func(c *opaque.Configuration) {
+			c.OPRFEvaluator = internal.NewOPRFEvaluator(c.Server().Parameters, nil)
+			c.VerifiableOPRF = true
+		},
 	}
 
-	s := opaque.NewServer(nil)
-	if reflect.DeepEqual(s.Parameters, defaultConfiguration) {
-		t.Errorf("server did not default to correct configuration")
+	for expected, tamper := range tests {
+		c := opaque.DefaultConfiguration()
+		tamper(c)
+
+		if err := c.Validate(); err == nil || err.Error() != expected {
+			t.Errorf("expected error %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestConfiguration_MHFParameters(t *testing.T) {
+	c := opaque.DefaultConfiguration()
+	c.MHFParameters = []int{2, 32 * 1024, 1}
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
 	}
 
-	c := opaque.NewClient(nil)
-	if reflect.DeepEqual(c.Parameters, defaultConfiguration) {
-		t.Errorf("client did not default to correct configuration")
+	if m := c.Client().MHF.String(); m != "Argon2id(2-32768-1)" {
+		t.Fatalf("MHF parameters not applied, got %s", m)
+	}
+
+	encoded := c.Serialize()
+
+	decoded, err := opaque.DeserializeConfiguration(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded.MHFParameters, c.MHFParameters) {
+		t.Fatalf("MHF parameters don't round-trip, got %v", decoded.MHFParameters)
+	}
+
+	if _, err := opaque.DeserializeConfiguration(encoded[:len(encoded)-1]); !errors.Is(err, internal.ErrConfigurationInvalidLength) {
+		t.Fatalf("expected %q, got %v", internal.ErrConfigurationInvalidLength, err)
+	}
+
+	if len(opaque.DefaultConfiguration().Serialize()) != 8 {
+		t.Fatal("unexpected encoding length without MHF parameters")
 	}
 }
 
-// helper functions
+func TestConfiguration_ApplicationID(t *testing.T) {
+	/*
+		The application ID is part of the encoding, and a mismatch fails the login
+	*/
+	for _, params := range [][]int{nil, {2, 32 * 1024, 1}} {
+		c := opaque.DefaultConfiguration()
+		c.MHFParameters = params
+		c.ApplicationID = []byte("mobile-app")
 
-type configuration struct {
-	Conf  *opaque.Configuration
-	Curve elliptic.Curve
+		decoded, err := opaque.DeserializeConfiguration(c.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(decoded.MHFParameters, params) || !bytes.Equal(decoded.ApplicationID, c.ApplicationID) {
+			t.Fatalf("configuration doesn't round-trip: %v %q", decoded.MHFParameters, decoded.ApplicationID)
+		}
+	}
+
+	base := opaque.DefaultConfiguration().Serialize()
+	for name, extension := range map[string][]byte{
+		"no parameters nor application ID": {0},
+		"empty application ID":             {0, 0, 0},
+		"truncated application ID":         {0, 0, 3, 'a', 'b'},
+		"trailing bytes":                   {0, 0, 1, 'a', 'b'},
+	} {
+		if _, err := opaque.DeserializeConfiguration(append(append([]byte{}, base...), extension...)); !errors.Is(err, internal.ErrConfigurationInvalidLength) {
+			t.Errorf("%s: expected %q, got %v", name, internal.ErrConfigurationInvalidLength, err)
+		}
+	}
+
+	// Login with different application IDs.
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	web := opaque.DefaultConfiguration()
+	web.ApplicationID = []byte("web-app")
+	mobile := opaque.DefaultConfiguration()
+	mobile.ApplicationID = []byte("mobile-app")
+
+	server := web.Server()
+	sk, pk := keyGen(t, server)
+	rec := buildRecord(t, credID, seed, []byte("yo"), pk, web.Client(), server)
+
+	for _, conf := range []*opaque.Configuration{web, mobile} {
+		client := conf.Client()
+
+		ke2, err := web.Server().Init(client.Init([]byte("yo")), nil, sk, pk, seed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = client.Finish(nil, nil, ke2)
+		if conf == web && err != nil {
+			t.Fatal(err)
+		}
+
+		if conf == mobile && err == nil {
+			t.Fatal("expected error with a different application ID")
+		}
+	}
 }
 
-var confs = []configuration{
-	{
-		Conf:  opaque.DefaultConfiguration(),
-		Curve: nil,
-	},
-	{
-		Conf: &opaque.Configuration{
-			Group:    opaque.P256Sha256,
-			KDF:      hash.SHA256,
-			MAC:      hash.SHA256,
-			Hash:     hash.SHA256,
-			MHF:      mhf.Scrypt,
-			Mode:     opaque.Internal,
-			NonceLen: 32,
-		},
-		Curve: elliptic.P256(),
-	},
-	{
-		Conf: &opaque.Configuration{
-			Group:    opaque.P384Sha512,
-			KDF:      hash.SHA512,
-			MAC:      hash.SHA512,
-			Hash:     hash.SHA512,
-			MHF:      mhf.Scrypt,
-			Mode:     opaque.Internal,
-			NonceLen: 32,
-		},
-		Curve: elliptic.P384(),
-	},
-	{
-		Conf: &opaque.Configuration{
-			Group:    opaque.P521Sha512,
-			KDF:      hash.SHA512,
-			MAC:      hash.SHA512,
-			Hash:     hash.SHA512,
-			MHF:      mhf.Scrypt,
-			Mode:     opaque.Internal,
-			NonceLen: 32,
-		},
-		Curve: elliptic.P521(),
-	},
+func TestConfiguration_KDFSalt(t *testing.T) {
+	/*
+		The KDF salt is part of the encoding, changes the session key, and a mismatch fails the login
+	*/
+	for _, appID := range [][]byte{nil, []byte("mobile-app")} {
+		for _, params := range [][]int{nil, {2, 32 * 1024, 1}} {
+			c := opaque.DefaultConfiguration()
+			c.MHFParameters = params
+			c.ApplicationID = appID
+			c.KDFSalt = []byte("deployment")
+
+			decoded, err := opaque.DeserializeConfiguration(c.Serialize())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(decoded.MHFParameters, params) || !bytes.Equal(decoded.ApplicationID, appID) ||
+				decoded.ApplicationID == nil != (appID == nil) || !bytes.Equal(decoded.KDFSalt, c.KDFSalt) {
+				t.Fatalf("configuration doesn't round-trip: %v %q %q", decoded.MHFParameters, decoded.ApplicationID,
+					decoded.KDFSalt)
+			}
+		}
+	}
+
+	base := opaque.DefaultConfiguration().Serialize()
+	if _, err := opaque.DeserializeConfiguration(append(base, 0, 0, 0, 0, 0)); !errors.Is(err, internal.ErrConfigurationInvalidLength) {
+		t.Errorf("empty KDF salt: expected %q, got %v", internal.ErrConfigurationInvalidLength, err)
+	}
+
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	salted := opaque.DefaultConfiguration()
+	salted.KDFSalt = []byte("deployment")
+	other := opaque.DefaultConfiguration()
+	other.KDFSalt = []byte("other deployment")
+
+	server := salted.Server()
+	sk, pk := keyGen(t, server)
+	rec := buildRecord(t, credID, seed, []byte("yo"), pk, salted.Client(), server)
+	sessionKeys := make([][]byte, 0, 2)
+
+	for _, conf := range []*opaque.Configuration{salted, opaque.DefaultConfiguration(), other} {
+		client := conf.Client()
+		server := salted.Server()
+
+		ke2, err := server.Init(client.Init([]byte("yo")), nil, sk, pk, seed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ke3, _, err := client.Finish(nil, nil, ke2)
+		if conf != salted {
+			if err == nil {
+				t.Fatal("expected error with a different KDF salt")
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := server.Finish(ke3); err != nil {
+			t.Fatal(err)
+		}
+
+		sessionKeys = append(sessionKeys, client.SessionKey(), server.SessionKey())
+	}
+
+	if !bytes.Equal(sessionKeys[0], sessionKeys[1]) {
+		t.Fatal("session keys differ")
+	}
+}
+
+func TestConfiguration_OPRFDomainSeparation(t *testing.T) {
+	/*
+		The OPRF domain separation is part of the encoding, changes the evaluation of the same input, and a mismatch
+		fails the login
+	*/
+	c := opaque.DefaultConfiguration()
+	c.OPRFDomainSeparation = []byte("my-app")
+
+	decoded, err := opaque.DeserializeConfiguration(c.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(decoded.OPRFDomainSeparation, c.OPRFDomainSeparation) || decoded.ApplicationID != nil ||
+		decoded.KDFSalt != nil {
+		t.Fatalf("configuration doesn't round-trip: %q %q %q", decoded.ApplicationID, decoded.KDFSalt,
+			decoded.OPRFDomainSeparation)
+	}
+
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	evaluation := func(c *opaque.Configuration) []byte {
+		c.Rand = bytes.NewReader(make([]byte, 64))
+		defer func() { c.Rand = nil }()
+
+		resp, err := c.Server().RegistrationResponse(c.Client().RegistrationInit([]byte("yo")), nil, credID, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Data
+	}
+
+	other := opaque.DefaultConfiguration()
+	other.OPRFDomainSeparation = []byte("other-app")
+
+	if bytes.Equal(evaluation(c), evaluation(other)) || bytes.Equal(evaluation(c), evaluation(opaque.DefaultConfiguration())) {
+		t.Fatal("expected different evaluations with different OPRF domain separations")
+	}
+
+	for _, verifiable := range []bool{false, true} {
+		c.VerifiableOPRF = verifiable
+		other.VerifiableOPRF = verifiable
+		server := c.Server()
+		sk, pk := keyGen(t, server)
+		registering := c.Client()
+		rec := buildRecord(t, credID, seed, []byte("yo"), pk, registering, server)
+
+		for _, conf := range []*opaque.Configuration{c, other} {
+			client := conf.Client()
+			client.SetOPRFPublicKey(registering.OPRFPublicKey())
+
+			ke2, err := c.Server().Init(client.Init([]byte("yo")), nil, sk, pk, seed, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err = client.Finish(nil, nil, ke2)
+			if conf == c && err != nil {
+				t.Fatal(err)
+			}
+
+			if conf == other && err == nil {
+				t.Fatal("expected error with a different OPRF domain separation")
+			}
+		}
+	}
+}
+
+func TestConfiguration_MaxInputLength(t *testing.T) {
+	/*
+		Passwords up to the maximum length are accepted, and longer ones fail the finalization without a panic
+	*/
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	long := make([]byte, 9)
+
+	for _, conf := range confs {
+		p := conf.Conf.Clone()
+		p.MaxInputLength = 8
+		server := p.Server()
+		sk, pk := keyGen(t, server)
+		client := p.Client()
+		rec := buildRecord(t, credID, seed, make([]byte, 8), pk, client, server)
+
+		resp, err := server.RegistrationResponse(client.RegistrationInit(long), pk, credID, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		skc, _ := client.KeyGen()
+
+		_, _, err = client.RegistrationFinalize(skc, &opaque.Credentials{}, resp)
+		if !errors.Is(err, opaque.ErrInputTooLong) {
+			t.Fatalf("expected ErrInputTooLong, got %v", err)
+		}
+
+		for _, password := range [][]byte{long, make([]byte, 8)} {
+			ke2, err := p.Server().Init(client.Init(password), nil, sk, pk, seed, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err = client.Finish(nil, nil, ke2)
+			if len(password) == len(long) && !errors.Is(err, opaque.ErrInputTooLong) {
+				t.Fatalf("expected ErrInputTooLong, got %v", err)
+			}
+
+			if len(password) != len(long) && err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, _, err := p.Client().InitWithState(long); !errors.Is(err, opaque.ErrInputTooLong) {
+			t.Fatalf("expected ErrInputTooLong, got %v", err)
+		}
+
+		if _, _, err := p.Client().RegistrationInitBatch([][]byte{{1}, long}); !errors.Is(err, opaque.ErrInputTooLong) {
+			t.Fatalf("expected ErrInputTooLong, got %v", err)
+		}
+
+		_, _, _, err = p.Client().Login(long, nil, func(*message.KE1) (*message.KE2, error) {
+			t.Fatal("unexpected exchange")
+			return nil, nil
+		})
+		if !errors.Is(err, opaque.ErrInputTooLong) {
+			t.Fatalf("expected ErrInputTooLong, got %v", err)
+		}
+	}
+}
+
+func TestGroupLengths(t *testing.T) {
+	for _, conf := range confs {
+		sk, pk := keyGen(t, conf.Conf.Server())
+
+		if l := opaque.PointLength(conf.Conf.AKEGroup); l != len(pk) {
+			t.Errorf("%s: point length %d, expected %d", conf.Conf.AKEGroup, l, len(pk))
+		}
+
+		if l := opaque.ScalarLength(conf.Conf.AKEGroup); l != len(sk) {
+			t.Errorf("%s: scalar length %d, expected %d", conf.Conf.AKEGroup, l, len(sk))
+		}
+	}
+
+	if opaque.PointLength(2) != 0 || opaque.ScalarLength(0) != 0 {
+		t.Error("expected 0 for unknown groups")
+	}
+}
+
+func TestNewErrConstructors(t *testing.T) {
+	if _, err := opaque.NewServerErr(nil); err != nil {
+		t.Fatalf("unexpected error on nil configuration: %v", err)
+	}
+
+	if _, err := opaque.NewClientErr(opaque.DefaultConfiguration()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c := opaque.DefaultConfiguration()
+	c.KDF = 0
+	expected := "unsupported KDF hashing 0"
+
+	if s, err := opaque.NewServerErr(c); s != nil || err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+
+	if cl, err := opaque.NewClientErr(c); cl != nil || err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestConfiguration_ValidateRegistrations(t *testing.T) {
+	c := opaque.DefaultConfiguration()
+	if err := c.ValidateRegistrations(1 << 62); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	c.NonceLen = 16
+	if err := c.ValidateRegistrations(1 << 40); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	expected := "nonce length too short for the expected number of registrations: 16 bytes for 281474976710656 registrations"
+	if err := c.ValidateRegistrations(1 << 48); err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+
+	c.OPRFGroup = 2
+	if err := c.ValidateRegistrations(1); err == nil {
+		t.Error("expected error on invalid configuration")
+	}
+}
+
+func TestNilConfiguration(t *testing.T) {
+	def := opaque.DefaultConfiguration()
+	g := ciphersuite.Identifier(def.OPRFGroup)
+	defaultConfiguration := &internal.Parameters{
+		KDF:             &internal.KDF{H: def.KDF.Get()},
+		MAC:             &internal.Mac{H: def.MAC.Get()},
+		Hash:            &internal.Hash{H: def.Hash.Get()},
+		MHF:             &internal.MHF{MHF: def.MHF.Get()},
+		NonceLen:        def.NonceLen,
+		OPRFPointLength: encoding.PointLength[g],
+		AkePointLength:  encoding.PointLength[g],
+		OPRFGroup:       g,
+		AKEGroup:        g,
+		OPRF:            oprf.Ciphersuite(g),
+		Context:         def.Context,
+	}
+
+	s := opaque.NewServer(nil)
+	if reflect.DeepEqual(s.Parameters, defaultConfiguration) {
+		t.Errorf("server did not default to correct configuration")
+	}
+
+	c := opaque.NewClient(nil)
+	if reflect.DeepEqual(c.Parameters, defaultConfiguration) {
+		t.Errorf("client did not default to correct configuration")
+	}
+}
+
+// helper functions
+
+type configuration struct {
+	Conf  *opaque.Configuration
+	Curve elliptic.Curve
+}
+
+var confs = []configuration{
+	{
+		Conf:  opaque.DefaultConfiguration(),
+		Curve: nil,
+	},
+	{
+		Conf: &opaque.Configuration{
+			OPRFGroup: opaque.P256Sha256,
+			AKEGroup:  opaque.P256Sha256,
+			KDF:       hash.SHA256,
+			MAC:       hash.SHA256,
+			Hash:      hash.SHA256,
+			MHF:       mhf.Scrypt,
+			Mode:      opaque.Internal,
+			NonceLen:  32,
+		},
+		Curve: elliptic.P256(),
+	},
+	{
+		Conf: &opaque.Configuration{
+			OPRFGroup: opaque.P384Sha512,
+			AKEGroup:  opaque.P384Sha512,
+			KDF:       hash.SHA512,
+			MAC:       hash.SHA512,
+			Hash:      hash.SHA512,
+			MHF:       mhf.Scrypt,
+			Mode:      opaque.Internal,
+			NonceLen:  32,
+		},
+		Curve: elliptic.P384(),
+	},
+	{
+		Conf: &opaque.Configuration{
+			OPRFGroup: opaque.P521Sha512,
+			AKEGroup:  opaque.P521Sha512,
+			KDF:       hash.SHA512,
+			MAC:       hash.SHA512,
+			Hash:      hash.SHA512,
+			MHF:       mhf.Scrypt,
+			Mode:      opaque.Internal,
+			NonceLen:  32,
+		},
+		Curve: elliptic.P521(),
+	},
+}
+
+func getBadRistrettoScalar() []byte {
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	decoded, _ := hex.DecodeString(a)
+
+	return decoded
+}
+
+func getBadRistrettoElement() []byte {
+	a := "2a292df7e32cababbd9de088d1d1abec9fc0440f637ed2fba145094dc14bea08"
+	decoded, _ := hex.DecodeString(a)
+
+	return decoded
+}
+
+func getBadNistScalar(t *testing.T, ci ciphersuite.Identifier, curve elliptic.Curve) []byte {
+	// Don't add to the curve's order in place, as that would corrupt the shared curve parameters.
+	exceeded := new(big.Int).Add(curve.Params().N, big.NewInt(2)).Bytes()
+
+	_, err := ci.NewScalar().Decode(exceeded)
+	if err == nil {
+		t.Errorf("Exceeding order did not yield an error for group %s", ci)
+	}
+
+	return exceeded
+}
+
+func getBadNistElement(t *testing.T, id ciphersuite.Identifier) []byte {
+	size := encoding.PointLength[id]
+	element := internal.RandomBytes(size)
+	// detag compression
+	element[0] = 4
+
+	_, err := id.NewElement().Decode(element)
+	if err == nil {
+		t.Errorf("detagged compressed point did not yield an error for group %s", id)
+	}
+
+	return element
+}
+
+func getBadElement(t *testing.T, c configuration) []byte {
+	if c.Conf.OPRFGroup == opaque.RistrettoSha512 {
+		return getBadRistrettoElement()
+	} else {
+		return getBadNistElement(t, oprf.Ciphersuite(c.Conf.OPRFGroup).Group())
+	}
+}
+
+func getBadScalar(t *testing.T, c configuration) []byte {
+	if c.Conf.OPRFGroup == opaque.RistrettoSha512 {
+		return getBadRistrettoScalar()
+	} else {
+		return getBadNistScalar(t, oprf.Ciphersuite(c.Conf.OPRFGroup).Group(), c.Curve)
+	}
+}
+
+func keyGen(t testing.TB, server *opaque.Server) (secretKey, publicKey []byte) {
+	secretKey, publicKey, err := server.KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return secretKey, publicKey
+}
+
+func buildRecord(t *testing.T, credID, oprfSeed, password, pks []byte, client *opaque.Client, server *opaque.Server) *opaque.ClientRecord {
+	r1 := client.RegistrationInit(password)
+	r2, err := server.RegistrationResponse(r1, pks, credID, oprfSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	skc, _ := client.KeyGen()
+	r3, _, err := client.RegistrationFinalize(skc, &opaque.Credentials{}, r2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &opaque.ClientRecord{
+		CredentialIdentifier: credID,
+		ClientIdentity:       nil,
+		RegistrationUpload:   r3,
+		TestMaskNonce:        nil,
+	}
+}
+
+func getEnvelope(mode envelope.Mode, client *opaque.Client, ke2 *message.KE2) (*envelope.Envelope, []byte, error) {
+	unblinded, err := client.OprfFinalize(ke2.Data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("finalizing OPRF : %w", err)
+	}
+
+	randomizedPwd := envelope.BuildPRK(client.Parameters, unblinded)
+	maskingKey := client.KDF.Expand(randomizedPwd, []byte(tag.MaskingKey), client.Hash.Size())
+
+	clear := client.MaskResponse(maskingKey, ke2.MaskingNonce, ke2.MaskedResponse)
+	e := clear[client.AkePointLength:]
+
+	// Deserialize
+	innerLen := client.EnvelopeSize - client.NonceLen - client.MAC.Size()
+
+	env := &envelope.Envelope{
+		Nonce:         e[:client.NonceLen],
+		InnerEnvelope: e[client.NonceLen : client.NonceLen+innerLen],
+		AuthTag:       e[client.NonceLen+innerLen:],
+	}
+
+	return env, randomizedPwd, nil
+}
+
+// server.go
+
+func TestServer_BadRegistrationRequest(t *testing.T) {
+	/*
+		Error in OPRF
+		- client blinded element invalid point encoding
+	*/
+	credId := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	terr := " RegistrationResponse: can't evaluate input : "
+
+	for i, e := range confs {
+		badRequest := &message.RegistrationRequest{Data: getBadElement(t, e)}
+		server := e.Conf.Server()
+		if _, err := server.RegistrationResponse(badRequest, nil, credId, seed); err == nil || !isStageError(err, opaque.StageOPRF, terr) {
+			log.Printf("#%d - expected error. Got %v", i, err)
+		}
+	}
+}
+
+func TestServer_LowOrderBlindedElement(t *testing.T) {
+	/*
+		The blinded element is the identity element, which is encoded as all zeros for Ristretto255 and can't be
+		encoded in compressed form for NIST groups.
+	*/
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	terr := "can't evaluate input : "
+
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		sk, pk := keyGen(t, server)
+		identity := make([]byte, server.OPRFPointLength)
+
+		badRequest := &message.RegistrationRequest{Data: identity}
+		if _, err := server.RegistrationResponse(badRequest, pk, credID, seed); err == nil || !strings.Contains(err.Error(), terr) {
+			t.Fatalf("expected error on identity blinded element - got %v", err)
+		}
+
+		rec := &opaque.ClientRecord{
+			CredentialIdentifier: credID,
+			RegistrationUpload: &message.RegistrationUpload{
+				MaskingKey: internal.RandomBytes(32),
+				Envelope:   opaque.GetFakeEnvelope(conf.Conf),
+			},
+		}
+		ke1 := conf.Conf.Client().Init([]byte("yo"))
+		ke1.CredentialRequest.Data = identity
+
+		if _, err := server.Init(ke1, nil, sk, pk, seed, rec); err == nil || !strings.Contains(err.Error(), terr) {
+			t.Fatalf("expected error on identity blinded element - got %v", err)
+		}
+	}
+}
+
+func TestServerBuildRecord(t *testing.T) {
+	/*
+		Invalid upload length and client public key encoding
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		client := conf.Conf.Client()
+		server := conf.Conf.Server()
+		_, pks := keyGen(t, server)
+		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
+		upload := rec.RegistrationUpload.Serialize()
+
+		built, err := server.BuildRecord(upload, credID, []byte("client"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(built.RegistrationUpload.Serialize(), upload) || !bytes.Equal(built.CredentialIdentifier, credID) ||
+			!bytes.Equal(built.ClientIdentity, []byte("client")) {
+			t.Fatal("built record does not match")
+		}
+
+		expected := "invalid registration upload: invalid message length"
+		if _, err := server.BuildRecord(upload[1:], credID, nil); err == nil || err.Error() != expected {
+			t.Fatalf("expected error on invalid upload length - got %v", err)
+		}
+
+		copy(upload, getBadElement(t, conf))
+		if _, err := server.BuildRecord(upload, credID, nil); !errors.Is(err, opaque.ErrNonCanonicalPoint) {
+			t.Fatalf("expected error on invalid client public key - got %v", err)
+		}
+	}
+}
+
+func isStageError(err error, stage, prefix string) bool {
+	var e *opaque.StageError
+	return errors.As(err, &e) && e.Stage == stage && strings.HasPrefix(err.Error(), prefix)
+}
+
+func TestDeserialize_NonCanonicalPoint(t *testing.T) {
+	/*
+		Invalid or non-canonical public keys in uploads and KE2 are rejected at deserialization
+	*/
+	for _, conf := range confs {
+		client := conf.Conf.Client()
+		server := conf.Conf.Server()
+		bad := getBadElement(t, conf)
+
+		upload := make([]byte, server.RegistrationUploadLength())
+		copy(upload, bad)
+
+		if _, err := server.DeserializeRegistrationUpload(upload); !errors.Is(err, opaque.ErrNonCanonicalPoint) {
+			t.Fatalf("expected error %q on upload, got %v", opaque.ErrNonCanonicalPoint, err)
+		}
+
+		ke2 := make([]byte, client.KE2Length())
+		offset := client.OPRFPointLength + 2*client.NonceLen + client.AkePointLength + client.EnvelopeSize
+		copy(ke2[offset:], bad)
+
+		if _, err := client.DeserializeKE2(ke2); !errors.Is(err, opaque.ErrNonCanonicalPoint) {
+			t.Fatalf("expected error %q on KE2, got %v", opaque.ErrNonCanonicalPoint, err)
+		}
+	}
+}
+
+func uncompress(t *testing.T, curve elliptic.Curve, point []byte) []byte {
+	x, y := elliptic.UnmarshalCompressed(curve, point)
+	if x == nil {
+		t.Fatal("invalid compressed point")
+	}
+
+	return elliptic.Marshal(curve, x, y)
+}
+
+func TestDeserialize_UncompressedPoints(t *testing.T) {
+	/*
+		Uncompressed NIST points are accepted and normalized only with AcceptUncompressedPoints
+	*/
+	for _, conf := range confs {
+		if conf.Curve == nil {
+			continue
+		}
+
+		accepting := *conf.Conf
+		accepting.AcceptUncompressedPoints = true
+		client := conf.Conf.Client()
+		server := accepting.Server()
+
+		ke1 := client.Init([]byte("yo"))
+		uncompressed := encoding.Concatenate(uncompress(t, conf.Curve, ke1.CredentialRequest.Data), ke1.NonceU,
+			uncompress(t, conf.Curve, ke1.EpkU))
+
+		decoded, err := server.DeserializeKE1(uncompressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(decoded.Serialize(), ke1.Serialize()) {
+			t.Fatal("expected the normalized KE1 to match")
+		}
+
+		if _, err := conf.Conf.Server().DeserializeKE1(uncompressed); err == nil {
+			t.Fatal("expected error on uncompressed points without AcceptUncompressedPoints")
+		}
+
+		if _, err := server.DeserializeKE1(uncompressed[:len(uncompressed)-1]); err == nil {
+			t.Fatal("expected error on truncated input")
+		}
+
+		_, pks := keyGen(t, server)
+		upload := buildRecord(t, internal.RandomBytes(32), internal.RandomBytes(32), []byte("yo"), pks,
+			conf.Conf.Client(), conf.Conf.Server()).RegistrationUpload
+		serialized := upload.Serialize()
+		uncompressed = append(uncompress(t, conf.Curve, upload.PublicKey), serialized[len(upload.PublicKey):]...)
+
+		decodedUpload, err := server.DeserializeRegistrationUpload(uncompressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(decodedUpload.Serialize(), serialized) {
+			t.Fatal("expected the normalized upload to match")
+		}
+
+		uncompressed[1] ^= 0xff
+		if _, err := server.DeserializeRegistrationUpload(uncompressed); !errors.Is(err, opaque.ErrNonCanonicalPoint) {
+			t.Fatalf("expected error %q on invalid point, got %v", opaque.ErrNonCanonicalPoint, err)
+		}
+	}
+}
+
+func TestLogin_UncompressedPeer(t *testing.T) {
+	/*
+		The AKE transcript hashes the messages as received, so that a peer sending uncompressed points can log in
+	*/
+	for _, conf := range confs {
+		if conf.Curve == nil {
+			continue
+		}
+
+		var transcript []byte
+		accepting := *conf.Conf
+		accepting.AcceptUncompressedPoints = true
+		accepting.TranscriptObserver = func(tr []byte) { transcript = tr }
+		credID, seed, password := internal.RandomBytes(32), internal.RandomBytes(32), []byte("yo")
+		server := accepting.Server()
+		sks, pks := keyGen(t, server)
+		rec := buildRecord(t, credID, seed, password, pks, conf.Conf.Client(), conf.Conf.Server())
+
+		// The client stands for a peer that sends, and hashes, uncompressed points.
+		client := conf.Conf.Client()
+		ke1 := client.Init(password)
+		ke1.Received = encoding.Concatenate(uncompress(t, conf.Curve, ke1.CredentialRequest.Data), ke1.NonceU,
+			uncompress(t, conf.Curve, ke1.EpkU))
+
+		decoded, err := server.DeserializeKE1(ke1.Received)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(decoded.Received, ke1.Received) {
+			t.Fatal("expected the received KE1 to be kept")
+		}
+
+		ke2, err := server.Init(decoded, nil, sks, pks, seed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Contains(transcript, ke1.Received) {
+			t.Fatal("expected the received KE1 in the transcript")
+		}
+
+		ke3, _, err := client.Finish(nil, nil, ke2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := server.Finish(ke3); err != nil {
+			t.Fatal(err)
+		}
+
+		// The client hashes the KE2 as received.
+		client = accepting.Client()
+		ke2, err = conf.Conf.Server().Init(client.Init(password), nil, sks, pks, seed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		epks := uncompress(t, conf.Curve, ke2.EpkS)
+		received := encoding.Concatenate(uncompress(t, conf.Curve, ke2.Data), ke2.MaskingNonce, ke2.MaskedResponse,
+			ke2.NonceS, epks, ke2.Mac)
+
+		decodedKE2, err := client.DeserializeKE2(received)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, _ = client.Finish(nil, nil, decodedKE2)
+
+		if !bytes.HasSuffix(transcript, encoding.Concatenate(ke2.NonceS, epks)) {
+			t.Fatal("expected the received server key share in the transcript")
+		}
+	}
+}
+
+func TestServerImportForeignRecord(t *testing.T) {
+	/*
+		Foreign layouts map to the same record, and malformed ones are rejected
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+	idc := []byte("client")
+
+	for _, conf := range confs {
+		client := conf.Conf.Client()
+		server := conf.Conf.Server()
+		_, pks := keyGen(t, server)
+		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
+		upload := rec.RegistrationUpload.Serialize()
+
+		imported, err := server.ImportForeignRecord(opaque.ForeignLayoutRFC, upload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(imported.RegistrationUpload.Serialize(), upload) {
+			t.Fatal("imported record does not match")
+		}
+
+		prefixed := encoding.Concatenate(encoding.EncodeVector(credID), encoding.EncodeVector(idc),
+			encoding.EncodeVector(rec.PublicKey), encoding.EncodeVector(rec.MaskingKey), encoding.EncodeVector(rec.Envelope))
+
+		imported, err = server.ImportForeignRecord(opaque.ForeignLayoutLengthPrefixed, prefixed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(imported.RegistrationUpload.Serialize(), upload) || !bytes.Equal(imported.CredentialIdentifier, credID) ||
+			!bytes.Equal(imported.ClientIdentity, idc) {
+			t.Fatal("imported record does not match")
+		}
+
+		if _, err := server.ImportForeignRecord(opaque.ForeignLayoutLengthPrefixed, prefixed[:len(prefixed)-1]); err == nil {
+			t.Fatal("expected error on truncated record")
+		}
+
+		if _, err := server.ImportForeignRecord(opaque.ForeignLayoutLengthPrefixed, append(prefixed, 0)); err == nil {
+			t.Fatal("expected error on trailing bytes")
+		}
+
+		if _, err := server.ImportForeignRecord(0, upload); !errors.Is(err, opaque.ErrUnknownForeignLayout) {
+			t.Fatalf("expected error %q - got %v", opaque.ErrUnknownForeignLayout, err)
+		}
+	}
+}
+
+func TestClientRecord_Mode(t *testing.T) {
+	/*
+		The mode is inferred from the envelope length
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		for _, mode := range []opaque.Mode{opaque.Internal, opaque.External, opaque.ExternalAEAD} {
+			c := *conf.Conf
+			c.Mode = mode
+			client := c.Client()
+			server := c.Server()
+			_, pks := keyGen(t, server)
+			rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
+
+			if m, err := rec.Mode(&c); err != nil || m != mode {
+				t.Fatalf("expected mode %v, got %v (%v)", mode, m, err)
+			}
+
+			rec.Envelope = rec.Envelope[1:]
+			if _, err := rec.Mode(&c); !errors.Is(err, opaque.ErrUnknownRecordMode) {
+				t.Fatalf("expected error %q, got %v", opaque.ErrUnknownRecordMode, err)
+			}
+		}
+	}
+}
+
+func TestServer_BasePointBlindedElement(t *testing.T) {
+	/*
+		In strict mode, the blinded element is the group's base point
+	*/
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		c := *conf.Conf
+		server := c.Server()
+		_, pk := keyGen(t, server)
+		req := &message.RegistrationRequest{Data: encoding.SerializePoint(server.OPRFGroup.Base(), server.OPRFGroup)}
+
+		if _, err := server.RegistrationResponse(req, pk, credID, seed); err != nil {
+			t.Fatalf("unexpected error outside of strict mode - got %v", err)
+		}
+
+		c.StrictMode = true
+		server = c.Server()
+
+		if _, err := server.RegistrationResponse(req, pk, credID, seed); !errors.Is(err, opaque.ErrSuspiciousBlindedElement) {
+			t.Fatalf("expected error on base point blinded element - got %v", err)
+		}
+	}
+}
+
+func TestServerInit_InvalidPublicKey(t *testing.T) {
+	/*
+		Nil and invalid server public key
+	*/
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		expected := "invalid server public key: "
+
+		if _, err := server.Init(nil, nil, nil, nil, nil, nil); err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("expected error on nil pubkey - got %s", err)
+		}
+
+		if _, err := server.Init(nil, nil, nil, getBadElement(t, conf), nil, nil); err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("expected error on bad secret key - got %s", err)
+		}
+	}
+}
+
+func TestServerInit_IdentityElementKey(t *testing.T) {
+	/*
+		The identity element is rejected as server public key and as client public key in the record. Only Ristretto
+		decodes the all-zero encoding to the identity, the NIST groups reject it as invalid encoding.
+	*/
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		sk, pk := keyGen(t, server)
+		identity := make([]byte, len(pk))
+		isIdentityErr := func(err error) bool {
+			if conf.Conf.AKEGroup == opaque.RistrettoSha512 {
+				return errors.Is(err, opaque.ErrIdentityElementKey)
+			}
+
+			return err != nil
+		}
+
+		if _, err := server.Init(nil, nil, sk, identity, nil, nil); !isIdentityErr(err) {
+			t.Fatalf("%s: expected error on identity server public key - got %v", conf.Conf.AKEGroup, err)
+		}
+
+		if err := server.SetStaticKeys(sk, identity); !isIdentityErr(err) {
+			t.Fatalf("%s: expected error on identity static public key - got %v", conf.Conf.AKEGroup, err)
+		}
+
+		credID := internal.RandomBytes(32)
+		seed := internal.RandomBytes(32)
+		rec := buildRecord(t, credID, seed, []byte("yo"), pk, conf.Conf.Client(), server)
+		rec.PublicKey = identity
+
+		if _, err := conf.Conf.Server().Init(conf.Conf.Client().Init([]byte("yo")), nil, sk, pk, seed,
+			rec); !isIdentityErr(err) {
+			t.Fatalf("%s: expected error on identity client public key - got %v", conf.Conf.AKEGroup, err)
+		}
+	}
+}
+
+func TestServerInit_NilSecretKey(t *testing.T) {
+	/*
+		Nil server secret key
+	*/
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		_, pk := keyGen(t, server)
+		expected := "invalid server secret key: "
+
+		if _, err := server.Init(nil, nil, nil, pk, nil, nil); err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("expected error on nil secret key - got %s", err)
+		}
+	}
+}
+
+func TestServerInit_InvalidData(t *testing.T) {
+	/*
+		Invalid OPRF data in KE1
+	*/
+	seed := internal.RandomBytes(32)
+	rec := &opaque.ClientRecord{
+		CredentialIdentifier: internal.RandomBytes(32),
+		ClientIdentity:       nil,
+		RegistrationUpload: &message.RegistrationUpload{
+			MaskingKey: internal.RandomBytes(32),
+		},
+		TestMaskNonce: nil,
+	}
+
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		sk, pk := keyGen(t, server)
+		client := conf.Conf.Client()
+		ke1 := client.Init([]byte("yo"))
+		ke1.CredentialRequest.Data = getBadElement(t, conf)
+		rec.Envelope = opaque.GetFakeEnvelope(conf.Conf)
+		expected := " credentialResponse: oprfResponse: can't evaluate input :"
+		if _, err := server.Init(ke1, nil, sk, pk, seed, rec); err == nil || !isStageError(err, opaque.StageOPRF, expected) {
+			t.Fatalf("expected error on bad oprf request - got %s", err)
+		}
+	}
+}
+
+func TestServerInit_EnvelopeLengthMismatch(t *testing.T) {
+	/*
+		A record registered in another envelope mode is rejected before answering the KE1
+	*/
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		other := *conf.Conf
+		other.Mode = opaque.Internal
+		if conf.Conf.Mode == opaque.Internal {
+			other.Mode = opaque.External
+		}
+
+		server := other.Server()
+		sk, pk := keyGen(t, server)
+		rec := buildRecord(t, credID, seed, []byte("yo"), pk, other.Client(), server)
+
+		_, err := conf.Conf.Server().Init(conf.Conf.Client().Init([]byte("yo")), nil, sk, pk, seed, rec)
+		if !errors.Is(err, opaque.ErrEnvelopeLengthMismatch) {
+			t.Fatalf("expected error %q, got %v", opaque.ErrEnvelopeLengthMismatch, err)
+		}
+	}
+}
+
+func TestServerStoreRecord(t *testing.T) {
+	/*
+		Uploads with invalid fields are rejected before reaching the store
+	*/
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		_, pk := keyGen(t, server)
+		rec := buildRecord(t, credID, seed, []byte("yo"), pk, conf.Conf.Client(), server)
+
+		tamper := []struct {
+			name   string
+			modify func(u *message.RegistrationUpload)
+			err    error
+		}{
+			{"masking key length", func(u *message.RegistrationUpload) { u.MaskingKey = u.MaskingKey[1:] }, opaque.ErrInvalidUpload},
+			{"envelope length", func(u *message.RegistrationUpload) { u.Envelope = append(u.Envelope, 0) }, opaque.ErrInvalidUpload},
+			{"public key length", func(u *message.RegistrationUpload) { u.PublicKey = u.PublicKey[1:] }, opaque.ErrInvalidUpload},
+			{"public key encoding", func(u *message.RegistrationUpload) { u.PublicKey = getBadElement(t, conf) }, opaque.ErrNonCanonicalPoint},
+		}
+
+		if conf.Curve == nil {
+			tamper = append(tamper, struct {
+				name   string
+				modify func(u *message.RegistrationUpload)
+				err    error
+			}{"identity public key", func(u *message.RegistrationUpload) { u.PublicKey = make([]byte, len(pk)) }, opaque.ErrIdentityElementKey})
+		}
+
+		for _, test := range tamper {
+			upload := *rec.RegistrationUpload
+			test.modify(&upload)
+
+			store := opaque.NewMemoryStore()
+			if _, err := conf.Conf.Server().StoreRecord(store, &upload, credID, nil); !errors.Is(err, test.err) {
+				t.Fatalf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+
+			if _, err := store.Get(credID); !errors.Is(err, opaque.ErrRecordNotFound) {
+				t.Fatalf("%s: invalid upload was stored", test.name)
+			}
+		}
+
+		store := opaque.NewMemoryStore()
+
+		stored, err := conf.Conf.Server().StoreRecord(store, rec.RegistrationUpload, credID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := store.Get(credID); err != nil || got != stored {
+			t.Fatalf("record not stored: %v", err)
+		}
+	}
+}
+
+func TestServerInit_InvalidEPKU(t *testing.T) {
+	/*
+		Invalid EPKU in KE1
+	*/
+	seed := internal.RandomBytes(32)
+	rec := &opaque.ClientRecord{
+		CredentialIdentifier: internal.RandomBytes(32),
+		ClientIdentity:       nil,
+		RegistrationUpload: &message.RegistrationUpload{
+			MaskingKey: internal.RandomBytes(32),
+		},
+		TestMaskNonce: nil,
+	}
+
+	for _, conf := range confs {
+		rec.Envelope = opaque.GetFakeEnvelope(conf.Conf)
+		server := conf.Conf.Server()
+		sk, pk := keyGen(t, server)
+		client := conf.Conf.Client()
+		ke1 := client.Init([]byte("yo"))
+		ke1.EpkU = getBadElement(t, conf)
+		expected := " AKE response: decoding peer ephemeral public key:"
+		if _, err := server.Init(ke1, nil, sk, pk, seed, rec); err == nil || !isStageError(err, opaque.StageAKE, expected) {
+			t.Fatalf("expected error on bad epku - got %s", err)
+		}
+	}
+}
+
+func TestServerInit_InvalidPKU(t *testing.T) {
+	/*
+		Invalid PKU in KE1
+	*/
+	seed := internal.RandomBytes(32)
+	rec := &opaque.ClientRecord{
+		CredentialIdentifier: internal.RandomBytes(32),
+		ClientIdentity:       nil,
+		RegistrationUpload: &message.RegistrationUpload{
+			MaskingKey: internal.RandomBytes(32),
+		},
+		TestMaskNonce: nil,
+	}
+
+	for _, conf := range confs {
+		rec.Envelope = opaque.GetFakeEnvelope(conf.Conf)
+		server := conf.Conf.Server()
+		sk, pk := keyGen(t, server)
+		client := conf.Conf.Client()
+		ke1 := client.Init([]byte("yo"))
+		rec.PublicKey = getBadElement(t, conf)
+		expected := " AKE response: decoding peer public key:"
+		if _, err := server.Init(ke1, nil, sk, pk, seed, rec); err == nil || !isStageError(err, opaque.StageAKE, expected) {
+			t.Fatalf("expected error on bad epku - got %s", err)
+		}
+	}
+}
+
+func TestServerFinish_InvalidKE3Mac(t *testing.T) {
+	/*
+		ke3 mac is invalid
+	*/
+	conf := opaque.DefaultConfiguration()
+	credId := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	client := conf.Client()
+	server := conf.Server()
+	sk, pk := keyGen(t, server)
+	rec := buildRecord(t, credId, seed, []byte("yo"), pk, client, server)
+	ke1 := client.Init([]byte("yo"))
+	ke2, _ := server.Init(ke1, nil, sk, pk, seed, rec)
+	ke3, _, _ := client.Finish(nil, nil, ke2)
+	ke3.Mac[0] = ^ke3.Mac[0]
+
+	expected := opaque.ErrAkeInvalidClientMac
+	if err := server.Finish(ke3); err == nil || err.Error() != expected.Error() {
+		t.Fatalf("expected error on invalid mac - got %v", err)
+	}
+}
+
+func TestServerFinish_NoActiveSession(t *testing.T) {
+	/*
+		KE3 received by a server that never ran Init
+	*/
+	conf := opaque.DefaultConfiguration()
+	credId := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	client := conf.Client()
+	server := conf.Server()
+	sk, pk := keyGen(t, server)
+	rec := buildRecord(t, credId, seed, []byte("yo"), pk, client, server)
+	ke1 := client.Init([]byte("yo"))
+	ke2, _ := server.Init(ke1, nil, sk, pk, seed, rec)
+	ke3, _, _ := client.Finish(nil, nil, ke2)
+
+	err := conf.Server().Finish(ke3)
+	if !errors.Is(err, opaque.ErrNoActiveSession) || errors.Is(err, opaque.ErrAkeInvalidClientMac) {
+		t.Fatalf("expected error %q - got %v", opaque.ErrNoActiveSession, err)
+	}
+
+	var authErr *opaque.AuthenticationError
+	if !errors.As(err, &authErr) || authErr.Reason != opaque.ReasonNoState || authErr.Reason.String() != "no active state" {
+		t.Fatalf("expected reason %q - got %v", opaque.ReasonNoState, err)
+	}
+}
+
+func TestRegistrationFinalizeDeterministic(t *testing.T) {
+	/*
+		The same password yields the same client public key, and the derived key authenticates
+	*/
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	password := []byte("yo")
+
+	conf := opaque.DefaultConfiguration()
+	conf.Mode = opaque.External
+	server := conf.Server()
+	sk, pk := keyGen(t, server)
+
+	register := func() *message.RegistrationUpload {
+		client := conf.Client()
+
+		resp, err := server.RegistrationResponse(client.RegistrationInit(password), pk, credID, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		upload, _, err := client.RegistrationFinalizeDeterministic(&opaque.Credentials{}, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return upload
+	}
+
+	upload := register()
+	if !bytes.Equal(upload.PublicKey, register().PublicKey) {
+		t.Fatal("expected the same client public key")
+	}
+
+	rec := &opaque.ClientRecord{CredentialIdentifier: credID, RegistrationUpload: upload}
+	client := conf.Client()
+
+	ke2, err := server.Init(client.Init(password), nil, sk, pk, seed, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := client.Finish(nil, nil, ke2); err != nil {
+		t.Fatal(err)
+	}
+
+	client = opaque.DefaultConfiguration().Client()
+	resp, _ := server.RegistrationResponse(client.RegistrationInit(password), pk, credID, seed)
+
+	if _, _, err := client.RegistrationFinalizeDeterministic(&opaque.Credentials{}, resp); !errors.Is(err, opaque.ErrDeterministicKeyMode) {
+		t.Fatalf("expected %q, got %v", opaque.ErrDeterministicKeyMode, err)
+	}
+}
+
+func TestServerPremaskRecord(t *testing.T) {
+	/*
+		A premasked record allows the login with a constant masking nonce, while the default path uses fresh nonces, and
+		fake records premask the same way
+	*/
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		sks, pks := keyGen(t, server)
+		rec := buildRecord(t, credID, seed, []byte("yo"), pks, conf.Conf.Client(), server)
+		premasked := server.PremaskRecord(rec, pks)
+
+		if rec.MaskedResponse != nil {
+			t.Fatal("expected the original record to be unchanged")
+		}
+
+		login := func(rec *opaque.ClientRecord, pks []byte) (*message.KE2, error) {
+			client := conf.Conf.Client()
+
+			ke2, err := conf.Conf.Server().Init(client.Init([]byte("yo")), nil, sks, pks, seed, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err = client.Finish(nil, nil, ke2)
+
+			return ke2, err
+		}
+
+		nonces := make([][]byte, 0, 4)
+
+		for _, r := range []*opaque.ClientRecord{rec, rec, premasked, premasked} {
+			ke2, err := login(r, pks)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			nonces = append(nonces, ke2.MaskingNonce)
+		}
+
+		if bytes.Equal(nonces[0], nonces[1]) {
+			t.Fatal("expected fresh masking nonces in the default path")
+		}
+
+		if !bytes.Equal(nonces[2], premasked.MaskingNonce) || !bytes.Equal(nonces[3], premasked.MaskingNonce) {
+			t.Fatal("expected the premasked nonce")
+		}
+
+		_, otherPks := keyGen(t, server)
+		if _, err := login(server.PremaskRecord(rec, otherPks), pks); err == nil {
+			t.Fatal("expected error on a response premasked with another server public key")
+		}
+
+		// Premasked fake records are as stable as premasked real ones.
+		if again := server.PremaskRecord(rec, pks); !bytes.Equal(again.MaskedResponse, premasked.MaskedResponse) {
+			t.Fatal("expected premasking to be deterministic")
+		}
+
+		unknown := internal.RandomBytes(32)
+		fake := server.PremaskRecord(server.RecordOrFake(nil, unknown, seed), pks)
+		fakeAgain := server.PremaskRecord(server.RecordOrFake(nil, unknown, seed), pks)
+
+		if !bytes.Equal(fake.MaskingNonce, fakeAgain.MaskingNonce) ||
+			!bytes.Equal(fake.MaskedResponse, fakeAgain.MaskedResponse) {
+			t.Fatal("expected the same premasked response for a nonexistent client")
+		}
+	}
+}
+
+func TestGetFakeEnvelope_Length(t *testing.T) {
+	/*
+		Fake envelopes have the length the deserializers expect in each mode, so fake records look like real ones
+	*/
+	for _, conf := range confs {
+		for _, mode := range []opaque.Mode{opaque.Internal, opaque.External, opaque.ExternalAEAD} {
+			c := *conf.Conf
+			c.Mode = mode
+			server := c.Server()
+			_, pk := keyGen(t, server)
+
+			fake := opaque.GetFakeEnvelope(&c)
+			if len(fake) != server.EnvelopeSize {
+				t.Fatalf("%s: fake envelope length %d, expected %d", mode, len(fake), server.EnvelopeSize)
+			}
+
+			// The Internal mode is the light envelope, holding only the nonce and the authentication tag.
+			if mode == opaque.Internal && len(fake) != server.NonceLen+server.MAC.Size() {
+				t.Fatalf("%s: fake envelope length %d, expected the nonce and tag lengths", mode, len(fake))
+			}
+
+			if !bytes.Equal(server.FakeRecord([]byte("id"), make([]byte, 32)).Envelope, fake) {
+				t.Fatalf("%s: expected the fake record to hold the fake envelope", mode)
+			}
+
+			upload := encoding.Concatenate(pk, make([]byte, server.Hash.Size()), fake)
+
+			decoded, err := server.DeserializeRegistrationUpload(upload)
+			if err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+
+			if m, err := (&opaque.ClientRecord{RegistrationUpload: decoded}).Mode(&c); err != nil || m != mode {
+				t.Fatalf("%s: unexpected record mode %s (%v)", mode, m, err)
+			}
+		}
+	}
+}
+
+func TestServerFakeRecord(t *testing.T) {
+	/*
+		A fake record is stable, has the size of a real one, and fails on the client
+	*/
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		sk, pk := keyGen(t, server)
+		real := buildRecord(t, credID, seed, []byte("yo"), pk, conf.Conf.Client(), server)
+		fake := server.FakeRecord([]byte("nobody"), seed)
+
+		if !reflect.DeepEqual(fake, server.FakeRecord([]byte("nobody"), seed)) {
+			t.Fatal("expected the same fake record for the same credential identifier")
+		}
+
+		if bytes.Equal(fake.MaskingKey, server.FakeRecord([]byte("other"), seed).MaskingKey) {
+			t.Fatal("expected different fake records for different credential identifiers")
+		}
+
+		if len(fake.Serialize()) != len(real.Serialize()) {
+			t.Fatalf("fake record length %d differs from %d", len(fake.Serialize()), len(real.Serialize()))
+		}
+
+		client := conf.Conf.Client()
+
+		ke2, err := conf.Conf.Server().Init(client.Init([]byte("yo")), nil, sk, pk, seed, fake)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := client.Finish(nil, nil, ke2); err == nil {
+			t.Fatal("expected the client to fail on a fake record")
+		}
+	}
+}
+
+func TestServerFakeRecordHook(t *testing.T) {
+	/*
+		The hook is only called for fake records, and the KE2 has the same shape whether the flag is set or not
+	*/
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		sk, pk := keyGen(t, server)
+		real := buildRecord(t, credID, seed, []byte("yo"), pk, conf.Conf.Client(), server)
+		fake := server.FakeRecord([]byte("nobody"), seed)
+		unflagged := *fake
+		unflagged.Fake = false
+
+		var called [][]byte
+		lengths := make([][]int, 0, 3)
+
+		for _, rec := range []*opaque.ClientRecord{real, fake, &unflagged} {
+			server := conf.Conf.Server()
+			server.SetFakeRecordHook(func(credentialIdentifier []byte) {
+				called = append(called, credentialIdentifier)
+			})
+
+			ke2, err := server.Init(conf.Conf.Client().Init([]byte("yo")), nil, sk, pk, seed, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lengths = append(lengths, []int{
+				len(ke2.Data), len(ke2.MaskingNonce), len(ke2.MaskedResponse), len(ke2.NonceS),
+				len(ke2.EpkS), len(ke2.Mac), len(ke2.Serialize()),
+			})
+		}
+
+		if len(called) != 1 || !bytes.Equal(called[0], []byte("nobody")) {
+			t.Fatalf("expected the hook to be called once for the fake record, got %q", called)
+		}
+
+		if !reflect.DeepEqual(lengths[0], lengths[1]) || !reflect.DeepEqual(lengths[1], lengths[2]) {
+			t.Fatalf("KE2 shapes differ: %v", lengths)
+		}
+	}
+}
+
+func TestServerRecordOrFake(t *testing.T) {
+	/*
+		The real record is returned when it exists, the fake one otherwise, and both give KE2s of the same shape
+	*/
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		sk, pk := keyGen(t, server)
+		real := buildRecord(t, credID, seed, []byte("yo"), pk, conf.Conf.Client(), server)
+
+		got := server.RecordOrFake(real, credID, seed)
+		if got != real {
+			t.Fatal("expected the real record")
+		}
+
+		fake := server.RecordOrFake(nil, []byte("nobody"), seed)
+		if !reflect.DeepEqual(fake, server.FakeRecord([]byte("nobody"), seed)) {
+			t.Fatal("expected the fake record")
+		}
+
+		short := *real
+		short.RegistrationUpload = &message.RegistrationUpload{PublicKey: real.PublicKey[1:]}
+		if server.RecordOrFake(&short, credID, seed) != &short {
+			t.Fatal("expected an invalid record to be returned as is")
+		}
+
+		lengths := make([]int, 0, 2)
+
+		for _, rec := range []*opaque.ClientRecord{got, fake} {
+			client := conf.Conf.Client()
+
+			ke2, err := conf.Conf.Server().Init(client.Init([]byte("yo")), nil, sk, pk, seed, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lengths = append(lengths, len(ke2.Serialize()))
+
+			_, _, err = client.Finish(nil, nil, ke2)
+			if (rec == got) != (err == nil) {
+				t.Fatalf("unexpected login result %v", err)
+			}
+		}
+
+		if lengths[0] != lengths[1] {
+			t.Fatalf("KE2 lengths differ: %v", lengths)
+		}
+	}
+}
+
+func TestClientFinishWithState(t *testing.T) {
+	/*
+		A client restored from the state of another one finishes the login, with additional authenticated data
+	*/
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		sk, pk := keyGen(t, server)
+		rec := buildRecord(t, credID, seed, []byte("yo"), pk, conf.Conf.Client(), server)
+
+		server = conf.Conf.Server()
+		ke1, state, err := conf.Conf.Client().InitWithState([]byte("yo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ke2, err := server.Init(ke1, nil, sk, pk, seed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := conf.Conf.Client().FinishWithState(state[1:], []byte("yo"), nil, nil, ke2); !errors.Is(err, opaque.ErrInvalidState) {
+			t.Fatalf("expected %q, got %v", opaque.ErrInvalidState, err)
+		}
+
+		client := conf.Conf.Client()
+
+		aad := []byte("request hash")
+
+		ke3, _, err := client.FinishWithState(state, []byte("yo"), nil, nil, ke2, aad)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if server.VerifyKE3(ke3) {
+			t.Fatal("expected the KE3 to be bound to the additional authenticated data")
+		}
+
+		if err := server.Finish(ke3, aad); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(client.SessionKey(), server.SessionKey()) {
+			t.Fatal("session keys differ")
+		}
+	}
+}
+
+func TestClientSessionKey(t *testing.T) {
+	/*
+		The session key is nil before Finish, and can't be modified through the returned slice
+	*/
+	conf := opaque.DefaultConfiguration()
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	server := conf.Server()
+	sk, pk := keyGen(t, server)
+	rec := buildRecord(t, credID, seed, []byte("yo"), pk, conf.Client(), server)
+
+	client := conf.Client()
+	if client.SessionKey() != nil {
+		t.Fatal("expected nil session key before Init")
+	}
+
+	ke2, err := server.Init(client.Init([]byte("yo")), nil, sk, pk, seed, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if client.SessionKey() != nil {
+		t.Fatal("expected nil session key before Finish")
+	}
+
+	if _, _, err := client.Finish(nil, nil, ke2); err != nil {
+		t.Fatal(err)
+	}
+
+	key := client.SessionKey()
+	key[0] ^= 0xff
+
+	if !bytes.Equal(client.SessionKey(), server.SessionKey()) {
+		t.Fatal("the session key was modified through the returned slice")
+	}
+}
+
+func TestMacEqual(t *testing.T) {
+	/*
+		The MAC comparison doesn't accept a prefix or a zero-padded value
+	*/
+	m := &internal.Mac{}
+	mac := internal.RandomBytes(64)
+	tests := map[string][]byte{
+		"truncated":   mac[:32],
+		"zero-padded": append(append([]byte{}, mac...), 0),
+		"empty":       nil,
+		"flipped":     append(append([]byte{}, mac[:63]...), mac[63]^1),
+	}
+
+	if !m.Equal(mac, append([]byte{}, mac...)) {
+		t.Fatal("expected equal MACs")
+	}
+
+	for name, other := range tests {
+		if m.Equal(mac, other) || m.Equal(other, mac) {
+			t.Errorf("%s: expected unequal MACs", name)
+		}
+	}
+
+	if !m.Equal(nil, []byte{}) {
+		t.Error("expected empty MACs to be equal")
+	}
+}
+
+func TestFinish_MacLengthMismatch(t *testing.T) {
+	/*
+		Truncated MACs are rejected on both sides
+	*/
+	conf := opaque.DefaultConfiguration()
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	client := conf.Client()
+	server := conf.Server()
+	sk, pk := keyGen(t, server)
+	rec := buildRecord(t, credID, seed, []byte("yo"), pk, client, server)
+
+	client = conf.Client()
+	ke1 := client.Init([]byte("yo"))
+
+	ke2, err := server.Init(ke1, nil, sk, pk, seed, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ke2.Mac = ke2.Mac[:len(ke2.Mac)-1]
+
+	if _, _, err := client.Finish(nil, nil, ke2); err == nil {
+		t.Fatal("expected error on truncated server MAC")
+	}
+
+	client = conf.Client()
+	server = conf.Server()
+
+	ke2, err = server.Init(client.Init([]byte("yo")), nil, sk, pk, seed, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ke3, _, err := client.Finish(nil, nil, ke2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ke3.Mac = ke3.Mac[:len(ke3.Mac)-1]
+	if err := server.Finish(ke3); err == nil {
+		t.Fatal("expected error on truncated client MAC")
+	}
+}
+
+func TestServerReMask(t *testing.T) {
+	/*
+		A re-masked response is unmasked by the client into the original envelope
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		client := conf.Conf.Client()
+		server := conf.Conf.Server()
+		sks, pks := keyGen(t, server)
+		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
+
+		ke1 := client.Init([]byte("yo"))
+		ke2, err := server.Init(ke1, nil, sks, pks, oprfSeed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nonce := internal.RandomBytes(server.NonceLen)
+		ke2.MaskingNonce = nonce
+		ke2.MaskedResponse = server.ReMask(rec, pks, nonce)
+
+		env, _, err := getEnvelope(envelope.Mode(conf.Conf.Mode), client, ke2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(env.Serialize(), rec.Envelope) {
+			t.Fatal("unmasked envelope does not match the record")
+		}
+	}
+}
+
+func TestMaskUnmask(t *testing.T) {
+	/*
+		Pre-masked responses are the same as in the login, and unmask to the server public key and envelope
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+	conf := opaque.DefaultConfiguration()
+	client := conf.Client()
+	server := conf.Server()
+	_, pks := keyGen(t, server)
+	rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
+
+	nonce := internal.RandomBytes(server.NonceLen)
+	clear := append(append([]byte{}, pks...), rec.Envelope...)
+
+	masked, err := server.Mask(rec.MaskingKey, nonce, clear)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(masked, server.ReMask(rec, pks, nonce)) {
+		t.Fatal("masked response differs from the login's")
+	}
+
+	for _, unmask := range []func(maskingKey, nonce, masked []byte) ([]byte, error){server.Unmask, client.Unmask} {
+		unmasked, err := unmask(rec.MaskingKey, nonce, masked)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(unmasked, clear) {
+			t.Fatal("unmasked response differs")
+		}
+	}
+
+	if _, err := client.Mask(rec.MaskingKey, nonce, clear[1:]); err == nil || err.Error() != "invalid masked response length" {
+		t.Fatalf("expected error on invalid length, got %v", err)
+	}
+}
+
+func TestServerReencryptRecord(t *testing.T) {
+	/*
+		A record migrated to a new OPRF seed, once or repeatedly, still allows the login with the new seed only
+	*/
+	credID := internal.RandomBytes(32)
+	seeds := [][]byte{internal.RandomBytes(32), internal.RandomBytes(32), internal.RandomBytes(32)}
+	verifiable := *opaque.DefaultConfiguration()
+	verifiable.VerifiableOPRF = true
+	configurations := []*opaque.Configuration{&verifiable}
+
+	for _, conf := range confs {
+		configurations = append(configurations, conf.Conf)
+	}
+
+	login := func(conf *opaque.Configuration, sks, pks, seed, oprfPublicKey []byte, rec *opaque.ClientRecord) error {
+		client := conf.Client()
+		client.SetOPRFPublicKey(oprfPublicKey)
+
+		ke2, err := conf.Server().Init(client.Init([]byte("yo")), nil, sks, pks, seed, rec)
+		if err != nil {
+			return err
+		}
+
+		_, _, err = client.Finish(nil, nil, ke2)
+
+		return err
+	}
+
+	for _, conf := range configurations {
+		server := conf.Server()
+		sks, pks := keyGen(t, server)
+		registering := conf.Client()
+		rec := buildRecord(t, credID, seeds[0], []byte("yo"), pks, registering, server)
+
+		for i := 1; i < len(seeds); i++ {
+			var err error
+			if rec, err = server.ReencryptRecord(seeds[i-1], seeds[i], rec); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := login(conf, sks, pks, seeds[i], registering.OPRFPublicKey(), rec); err != nil {
+				t.Fatalf("login after rotation %d: %v", i, err)
+			}
+
+			if err := login(conf, sks, pks, seeds[i-1], registering.OPRFPublicKey(), rec); err == nil {
+				t.Fatalf("expected error on login with the old seed after rotation %d", i)
+			}
+		}
+	}
+}
+
+func TestClientRecordSerialization(t *testing.T) {
+	/*
+		Records survive a serialization round trip, including the OPRF key tweak, and corruptions are rejected
+	*/
+	credID := internal.RandomBytes(32)
+	seed, newSeed := internal.RandomBytes(32), internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		sks, pks := keyGen(t, server)
+		rec := buildRecord(t, credID, seed, []byte("yo"), pks, conf.Conf.Client(), server)
+		rec.ClientIdentity = nil
+		rec.TestMaskNonce = internal.RandomBytes(32)
+
+		rec, err := server.ReencryptRecord(seed, newSeed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encoded := rec.SerializeRecord()
+
+		decoded, err := opaque.DeserializeClientRecord(conf.Conf, encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(decoded.SerializeRecord(), encoded) || decoded.ClientIdentity != nil || decoded.TestMaskNonce != nil ||
+			!bytes.Equal(decoded.OPRFKeyTweak, rec.OPRFKeyTweak) {
+			t.Fatal("expected the decoded record to match")
+		}
+
+		client := conf.Conf.Client()
+
+		ke2, err := conf.Conf.Server().Init(client.Init([]byte("yo")), nil, sks, pks, newSeed, decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := client.Finish(nil, nil, ke2); err != nil {
+			t.Fatal(err)
+		}
+
+		bad := append([]byte{2}, encoded[1:]...)
+		if _, err := opaque.DeserializeClientRecord(conf.Conf, bad); !errors.Is(err, opaque.ErrRecordVersion) {
+			t.Fatalf("expected error %q, got %v", opaque.ErrRecordVersion, err)
+		}
+
+		for _, bad := range [][]byte{encoded[:len(encoded)-1], append(encoded, 0)} {
+			if _, err := opaque.DeserializeClientRecord(conf.Conf, bad); err == nil {
+				t.Fatal("expected error on truncated or trailing input")
+			}
+		}
+
+		rec.Envelope = rec.Envelope[1:]
+		if _, err := opaque.DeserializeClientRecord(conf.Conf, rec.SerializeRecord()); err == nil {
+			t.Fatal("expected error on invalid upload length")
+		}
+	}
+}
+
+func TestTranscriptInputs(t *testing.T) {
+	/*
+		Both sides expose the same transcript inputs, built from the exchanged messages
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		client := conf.Conf.Client()
+		server := conf.Conf.Server()
+		sks, pks := keyGen(t, server)
+		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
+
+		if client.TranscriptInputs() != nil || server.TranscriptInputs() != nil {
+			t.Fatal("expected no transcript inputs before the handshake")
+		}
+
+		ke1 := client.Init([]byte("yo"))
+		ke2, err := server.Init(ke1, nil, sks, pks, oprfSeed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := client.Finish(nil, nil, ke2); err != nil {
+			t.Fatal(err)
+		}
+
+		ti := client.TranscriptInputs()
+		if !reflect.DeepEqual(ti, server.TranscriptInputs()) {
+			t.Fatal("transcript inputs differ")
+		}
+
+		// Identities default to the public keys.
+		if !bytes.Equal(ti.ClientIdentity, rec.PublicKey) || !bytes.Equal(ti.ServerIdentity, pks) ||
+			!bytes.Equal(ti.KE1, ke1.Serialize()) || !bytes.Equal(ti.EpkS, ke2.EpkS) {
+			t.Fatal("unexpected transcript inputs")
+		}
+	}
+}
+
+func TestTranscriptObserver(t *testing.T) {
+	/*
+		Both sides surface the same serialized transcript, built from the transcript inputs
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		var observed [][]byte
+
+		observing := *conf.Conf
+		observing.Context = []byte("context")
+		observing.TranscriptObserver = func(transcript []byte) {
+			observed = append(observed, transcript)
+		}
+
+		client := observing.Client()
+		server := observing.Server()
+		sks, pks := keyGen(t, server)
+		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
+
+		ke2, err := server.Init(client.Init([]byte("yo")), nil, sks, pks, oprfSeed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := client.Finish(nil, nil, ke2); err != nil {
+			t.Fatal(err)
+		}
+
+		ti := client.TranscriptInputs()
+		expected := encoding.Concatenate([]byte(tag.VersionTag), encoding.EncodeVector(ti.Context),
+			encoding.EncodeVector(ti.ClientIdentity), ti.KE1, encoding.EncodeVector(ti.ServerIdentity),
+			ti.CredentialResponse, ti.NonceS, ti.EpkS)
+
+		if len(observed) != 2 || !bytes.Equal(observed[0], expected) || !bytes.Equal(observed[1], expected) {
+			t.Fatal("unexpected observed transcripts")
+		}
+	}
+}
+
+func TestEphemeralReuseWindow(t *testing.T) {
+	/*
+		Within the window, the server reuses its ephemeral key for the same client identity, with fresh nonces
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		if conf.Conf.EphemeralReuseWindow != 0 {
+			t.Fatal("expected no ephemeral reuse by default")
+		}
+
+		reusing := *conf.Conf
+		reusing.EphemeralReuseWindow = time.Minute
+		sks, pks := keyGen(t, conf.Conf.Server())
+		alice := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, conf.Conf.Client(), conf.Conf.Server())
+		bob := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, conf.Conf.Client(), conf.Conf.Server())
+
+		login := func(c *opaque.Configuration, rec *opaque.ClientRecord) *message.KE2 {
+			client := c.Client()
+			server := c.Server()
+
+			ke2, err := server.Init(client.Init([]byte("yo")), nil, sks, pks, oprfSeed, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ke3, _, err := client.Finish(nil, nil, ke2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := server.Finish(ke3); err != nil {
+				t.Fatal(err)
+			}
+
+			return ke2
+		}
+
+		first := login(&reusing, alice)
+		second := login(&reusing, alice)
+
+		if !bytes.Equal(first.EpkS, second.EpkS) || bytes.Equal(first.NonceS, second.NonceS) {
+			t.Fatal("expected the same ephemeral key and fresh nonces within the window")
+		}
+
+		if bytes.Equal(first.EpkS, login(&reusing, bob).EpkS) {
+			t.Fatal("expected a different ephemeral key for another client")
+		}
+
+		// A server with another static key doesn't share the ephemeral key.
+		otherSks, otherPks := keyGen(t, conf.Conf.Server())
+
+		other, err := reusing.Server().Init(reusing.Client().Init([]byte("yo")), nil, otherSks, otherPks, oprfSeed, alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Equal(first.EpkS, other.EpkS) {
+			t.Fatal("expected a different ephemeral key for another static key")
+		}
+
+		if bytes.Equal(login(conf.Conf, alice).EpkS, login(conf.Conf, alice).EpkS) {
+			t.Fatal("expected fresh ephemeral keys without the window")
+		}
+	}
+
+	// The window is capped by the constructor, even without Validate.
+	long := opaque.DefaultConfiguration()
+	long.EphemeralReuseWindow = time.Hour
+
+	if w := long.Server().EphemeralReuseWindow; w != time.Minute {
+		t.Fatalf("expected the window to be capped at a minute, got %s", w)
+	}
+}
+
+func TestSessionKeyFor(t *testing.T) {
+	/*
+		Both sides derive the same purpose-bound keys, distinct across purposes
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		client := conf.Conf.Client()
+		server := conf.Conf.Server()
+		sks, pks := keyGen(t, server)
+		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
+
+		if client.SessionKeyFor([]byte("traffic")) != nil {
+			t.Fatal("expected no key before the handshake")
+		}
+
+		ke1 := client.Init([]byte("yo"))
+		ke2, err := server.Init(ke1, nil, sks, pks, oprfSeed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := client.Finish(nil, nil, ke2); err != nil {
+			t.Fatal(err)
+		}
+
+		traffic := client.SessionKeyFor([]byte("traffic"))
+		if !bytes.Equal(traffic, server.SessionKeyFor([]byte("traffic"))) {
+			t.Fatal("purpose keys differ")
+		}
+
+		if bytes.Equal(traffic, client.SessionKeyFor([]byte("resumption"))) ||
+			bytes.Equal(traffic, client.SessionKey()) {
+			t.Fatal("expected independent keys")
+		}
+	}
+}
+
+func TestClientDeriveAppKey(t *testing.T) {
+	/*
+		Application keys are the same after registration and login, distinct across labels, and need an export key
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		client := conf.Conf.Client()
+		server := conf.Conf.Server()
+
+		if _, err := client.DeriveAppKey([]byte("files"), 32); !errors.Is(err, opaque.ErrNoExportKey) {
+			t.Fatalf("expected error %q, got %v", opaque.ErrNoExportKey, err)
+		}
+
+		sks, pks := keyGen(t, server)
+		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
+
+		files, err := client.DeriveAppKey([]byte("files"), 48)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(files) != 48 {
+			t.Fatalf("expected a 48 byte key, got %d", len(files))
+		}
+
+		backup, err := client.DeriveAppKey([]byte("backup"), 48)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Equal(files, backup) || bytes.Equal(files[:32], client.ExportKey()[:32]) {
+			t.Fatal("expected independent keys")
+		}
+
+		for _, length := range []int{0, 255*client.KDF.Size() + 1} {
+			if _, err := client.DeriveAppKey([]byte("files"), length); err == nil {
+				t.Fatalf("expected error on length %d", length)
+			}
+		}
+
+		client = conf.Conf.Client()
+		server = conf.Conf.Server()
+		ke2, err := server.Init(client.Init([]byte("yo")), nil, sks, pks, oprfSeed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := client.Finish(nil, nil, ke2); err != nil {
+			t.Fatal(err)
+		}
+
+		login, err := client.DeriveAppKey([]byte("files"), 48)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(files, login) {
+			t.Fatal("expected the same key after login")
+		}
+	}
+}
+
+func TestClientExportKey(t *testing.T) {
+	/*
+		The export key is retained after registration and login, and is nil before
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		client := conf.Conf.Client()
+		server := conf.Conf.Server()
+		sks, pks := keyGen(t, server)
+
+		if client.ExportKey() != nil {
+			t.Fatal("expected no export key before registration")
+		}
+
+		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
+		registrationKey := client.ExportKey()
+
+		if registrationKey == nil {
+			t.Fatal("expected export key after registration")
+		}
+
+		client = conf.Conf.Client()
+		ke1 := client.Init([]byte("yo"))
+
+		ke2, err := server.Init(ke1, nil, sks, pks, oprfSeed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, exportKey, err := client.Finish(nil, nil, ke2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(exportKey, client.ExportKey()) || !bytes.Equal(registrationKey, client.ExportKey()) {
+			t.Fatal("unexpected export key")
+		}
+	}
+}
+
+func TestServerVerifierOnly(t *testing.T) {
+	/*
+		A verifier can't generate keys or register clients, but runs the login flow
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		client := conf.Conf.Client()
+		server := conf.Conf.Server()
+		sks, pks := keyGen(t, server)
+		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
+
+		verifier := opaque.NewVerifier(conf.Conf)
+		if !verifier.IsVerifier() || server.IsVerifier() {
+			t.Fatal("unexpected verifier flag")
+		}
+
+		if sk, pk, err := verifier.KeyGen(); sk != nil || pk != nil || !errors.Is(err, opaque.ErrVerifierOnly) {
+			t.Fatalf("expected no keys and ErrVerifierOnly from a verifier, got %v", err)
+		}
+
+		if sk, pk, err := verifier.DeriveKeyPair(oprfSeed, []byte("identity")); sk != nil || pk != nil ||
+			!errors.Is(err, opaque.ErrVerifierOnly) {
+			t.Fatalf("expected no keys and ErrVerifierOnly from a verifier, got %v", err)
+		}
+
+		req := conf.Conf.Client().RegistrationInit([]byte("yo"))
+		if _, err := verifier.RegistrationResponse(req, pks, credID, oprfSeed); !errors.Is(err, opaque.ErrVerifierOnly) {
+			t.Fatalf("expected error %q, got %v", opaque.ErrVerifierOnly, err)
+		}
+
+		if _, err := verifier.BuildRecord(rec.RegistrationUpload.Serialize(), credID, nil); !errors.Is(err, opaque.ErrVerifierOnly) {
+			t.Fatalf("expected error %q, got %v", opaque.ErrVerifierOnly, err)
+		}
+
+		ke1 := client.Init([]byte("yo"))
+		ke2, err := verifier.Init(ke1, nil, sks, pks, oprfSeed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ke3, _, err := client.Finish(nil, nil, ke2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := verifier.Finish(ke3); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNilAndEmptyContext(t *testing.T) {
+	/*
+		A nil context on one side and an empty context on the other are the same
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	clientConf := opaque.DefaultConfiguration()
+	clientConf.Context = nil
+	serverConf := opaque.DefaultConfiguration()
+	serverConf.Context = []byte{}
+
+	client := clientConf.Client()
+	server := serverConf.Server()
+	sks, pks := keyGen(t, server)
+	rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
+
+	ke1 := client.Init([]byte("yo"))
+	ke2, err := server.Init(ke1, nil, sks, pks, oprfSeed, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ke3, _, err := client.Finish(nil, nil, ke2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Finish(ke3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerInitWithKeys(t *testing.T) {
+	/*
+		A typed key pair is used without decoding
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		client := conf.Conf.Client()
+		server := conf.Conf.Server()
+		sks, pks, err := server.KeyGenTyped()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pk := encoding.SerializePoint(pks, server.AKEGroup)
+		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pk, client, server)
+
+		otherSks, otherPks, err := server.KeyGenTyped()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, keys := range []struct {
+			sks group.Scalar
+			pks group.Element
+		}{{nil, pks}, {sks, nil}, {sks, otherPks}, {otherSks, pks}, {sks, server.AKEGroup.Identity()}} {
+			if _, err := server.InitWithKeys(client.Init([]byte("yo")), nil, keys.sks, keys.pks, oprfSeed, rec); err == nil {
+				t.Fatal("expected error on missing or mismatching keys")
+			}
+		}
+
+		client = conf.Conf.Client()
+		ke1 := client.Init([]byte("yo"))
+		ke2, err := server.InitWithKeys(ke1, nil, sks, pks, oprfSeed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ke3, _, err := client.Finish(nil, nil, ke2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := server.Finish(ke3); err != nil {
+			t.Fatal(err)
+		}
+
+		if sk, pk, err := opaque.NewVerifier(conf.Conf).KeyGenTyped(); sk != nil || pk != nil ||
+			!errors.Is(err, opaque.ErrVerifierOnly) {
+			t.Fatalf("expected no keys and ErrVerifierOnly from a verifier, got %v", err)
+		}
+	}
+}
+
+func TestServerSetStaticKeys(t *testing.T) {
+	/*
+		Cached static keys are used when Init gets nil keys
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		client := conf.Conf.Client()
+		server := conf.Conf.Server()
+		sks, pks := keyGen(t, server)
+		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
+
+		_, otherPks := keyGen(t, server)
+		if err := server.SetStaticKeys(sks, otherPks); err == nil {
+			t.Fatal("expected error on mismatching keys")
+		}
+
+		if err := server.SetStaticKeys(sks, getBadElement(t, conf)); err == nil {
+			t.Fatal("expected error on invalid public key")
+		}
+
+		if err := server.SetStaticKeys(sks, pks); err != nil {
+			t.Fatal(err)
+		}
+
+		ke1 := client.Init([]byte("yo"))
+		ke2, err := server.Init(ke1, nil, nil, nil, oprfSeed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ke3, _, err := client.Finish(nil, nil, ke2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := server.Finish(ke3); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestServerDeriveKeyPair(t *testing.T) {
+	/*
+		The same seed and label yield the same, valid, key pair, and different ones yield different key pairs
+	*/
+	masterSeed := internal.RandomBytes(32)
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		sk, pk, err := server.DeriveKeyPair(masterSeed, []byte("identity"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sk2, pk2, _ := conf.Conf.Server().DeriveKeyPair(masterSeed, []byte("identity"))
+		if !bytes.Equal(sk, sk2) || !bytes.Equal(pk, pk2) {
+			t.Fatal("expected the same key pair for the same seed and label")
+		}
+
+		if _, pk3, _ := server.DeriveKeyPair(masterSeed, []byte("other")); bytes.Equal(pk, pk3) {
+			t.Fatal("expected different key pairs for different labels")
+		}
+
+		if _, pk3, _ := server.DeriveKeyPair(internal.RandomBytes(32), []byte("identity")); bytes.Equal(pk, pk3) {
+			t.Fatal("expected different key pairs for different seeds")
+		}
+
+		if len(sk) != opaque.ScalarLength(conf.Conf.AKEGroup) || len(pk) != opaque.PointLength(conf.Conf.AKEGroup) {
+			t.Fatalf("unexpected key lengths %d and %d", len(sk), len(pk))
+		}
+
+		client := conf.Conf.Client()
+		rec := buildRecord(t, credID, seed, []byte("yo"), pk, client, server)
+
+		ke2, err := conf.Conf.Server().Init(client.Init([]byte("yo")), nil, sk, pk, seed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := client.Finish(nil, nil, ke2); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestContextVariants(t *testing.T) {
+	/*
+		Context-aware variants succeed with a live context and fail with a cancelled one
+	*/
+	conf := opaque.DefaultConfiguration()
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	client := conf.Client()
+	server := conf.Server()
+	sk, pk := keyGen(t, server)
+	rec := buildRecord(t, credID, seed, []byte("yo"), pk, client, server)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	resp, err := server.RegistrationResponse(client.RegistrationInit([]byte("yo")), pk, credID, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := client.RegistrationFinalizeContext(cancelled, nil, &opaque.Credentials{}, resp); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+
+	if _, _, err := client.RegistrationFinalizeContext(context.Background(), nil, &opaque.Credentials{}, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	ke1 := client.Init([]byte("yo"))
+	if _, err := server.InitContext(cancelled, ke1, nil, sk, pk, seed, rec); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+
+	ke2, err := server.InitContext(context.Background(), ke1, nil, sk, pk, seed, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := client.FinishContext(cancelled, nil, nil, ke2); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+
+	aad := []byte("request hash")
+
+	ke3, _, err := client.FinishContext(context.Background(), nil, nil, ke2, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Finish(ke3, aad); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cancellingObserver cancels a context when the client hardens the password or the server evaluates the OPRF.
+type cancellingObserver struct {
+	cancel func()
+}
+
+func (o *cancellingObserver) OnOPRFEvaluate(time.Duration) { o.cancel() }
+func (o *cancellingObserver) OnAKEResponse(time.Duration)  {}
+func (o *cancellingObserver) OnMACFailure(string)          {}
+func (o *cancellingObserver) OnMHF(time.Duration)          { o.cancel() }
+
+func TestContextVariants_Interrupted(t *testing.T) {
+	/*
+		A context done between two stages interrupts the call, which leaves the client and the server unchanged
+	*/
+	conf := opaque.DefaultConfiguration()
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	registering := conf.Server()
+	sk, pk := keyGen(t, registering)
+	rec := buildRecord(t, credID, seed, []byte("yo"), pk, conf.Client(), registering)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	observed := conf.Clone()
+	observed.Observer = &cancellingObserver{cancel: cancel}
+
+	client := observed.Client()
+	resp, err := registering.RegistrationResponse(client.RegistrationInit([]byte("yo")), pk, credID, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := client.RegistrationFinalizeContext(ctx, nil, &opaque.Credentials{}, resp); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+
+	// The blind is kept, so the call can be retried.
+	if _, _, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	observed.Observer = &cancellingObserver{cancel: cancel}
+	server := observed.Server()
+	server.SetNonceCache(opaque.NewMemoryNonceCache(time.Minute))
+	client = conf.Client()
+	ke1 := client.Init([]byte("yo"))
+
+	if _, err := server.InitContext(ctx, ke1, nil, sk, pk, seed, rec); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+
+	// The nonce isn't recorded, so the call can be retried.
+	ke2, err := server.Init(ke1, nil, sk, pk, seed, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	observed.Observer = &cancellingObserver{cancel: cancel}
+	interrupted := observed.Client()
+	ke1 = interrupted.Init([]byte("yo"))
+
+	if ke2, err = conf.Server().Init(ke1, nil, sk, pk, seed, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := interrupted.FinishContext(ctx, nil, nil, ke2); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+
+	if _, _, err := interrupted.Finish(nil, nil, ke2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerInit_CorruptedSeed(t *testing.T) {
+	/*
+		A bit flip in the wrapped OPRF seed is detected
+	*/
+	conf := opaque.DefaultConfiguration()
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	client := conf.Client()
+	server := conf.Server()
+	sk, pk := keyGen(t, server)
+	rec := buildRecord(t, credID, seed, []byte("yo"), pk, client, server)
+	wrapped := opaque.WrapOPRFSeed(seed)
+
+	unwrapped, err := opaque.UnwrapOPRFSeed(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(seed, unwrapped) {
+		t.Fatal("unwrapped seed does not match")
+	}
+
+	ke1 := client.Init([]byte("yo"))
+	if _, err := server.InitWithWrappedSeed(ke1, nil, sk, pk, wrapped, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped[3] ^= 0x01
+	if _, err := opaque.UnwrapOPRFSeed(wrapped); !errors.Is(err, opaque.ErrCorruptedOPRFSeed) {
+		t.Fatalf("expected error on corrupted seed - got %v", err)
+	}
+
+	if _, err := server.InitWithWrappedSeed(ke1, nil, sk, pk, wrapped, rec); !errors.Is(err, opaque.ErrCorruptedOPRFSeed) {
+		t.Fatalf("expected error on corrupted seed - got %v", err)
+	}
+
+	if _, err := opaque.UnwrapOPRFSeed(wrapped[:4]); !errors.Is(err, opaque.ErrCorruptedOPRFSeed) {
+		t.Fatalf("expected error on short seed - got %v", err)
+	}
+}
+
+func TestServerInit_MissingIdentity(t *testing.T) {
+	/*
+		Explicit identities are required, but the server identity or the client identity in the record is nil
+	*/
+	conf := opaque.DefaultConfiguration()
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	client := conf.Client()
+	server := conf.Server()
+	sk, pk := keyGen(t, server)
+	rec := buildRecord(t, credID, seed, []byte("yo"), pk, client, server)
+
+	conf.RequireExplicitIdentities = true
+	server = conf.Server()
+	ke1 := conf.Client().Init([]byte("yo"))
+
+	if _, err := server.Init(ke1, nil, sk, pk, seed, rec); !errors.Is(err, opaque.ErrMissingIdentity) {
+		t.Fatalf("expected error on nil server identity - got %v", err)
+	}
+
+	if _, err := server.Init(ke1, []byte("server"), sk, pk, seed, rec); !errors.Is(err, opaque.ErrMissingIdentity) {
+		t.Fatalf("expected error on nil client identity - got %v", err)
+	}
+}
+
+func TestServerVerifyKE3(t *testing.T) {
+	/*
+		VerifyKE3 agrees with Finish on valid and tampered MACs, and has no side effects
+	*/
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		sk, pk := keyGen(t, server)
+		rec := buildRecord(t, credID, seed, []byte("yo"), pk, conf.Conf.Client(), server)
+
+		for _, tamper := range []bool{false, true} {
+			client := conf.Conf.Client()
+			server := conf.Conf.Server()
+
+			ke2, err := server.Init(client.Init([]byte("yo")), nil, sk, pk, seed, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ke3, _, err := client.Finish(nil, nil, ke2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tamper {
+				ke3.Mac[0] ^= 0xff
+			}
+
+			if server.VerifyKE3(ke3) != server.VerifyKE3(ke3) {
+				t.Fatal("expected VerifyKE3 to be repeatable")
+			}
+
+			if valid, err := server.VerifyKE3(ke3), server.Finish(ke3); valid != (err == nil) || valid == tamper {
+				t.Fatalf("VerifyKE3 returned %v, Finish returned %v", valid, err)
+			}
+		}
+
+		if conf.Conf.Server().VerifyKE3(&message.KE3{Mac: make([]byte, conf.Conf.MAC.Size())}) {
+			t.Fatal("expected VerifyKE3 to fail without state")
+		}
+	}
+}
+
+func TestServer_EmptyCredentialIdentifier(t *testing.T) {
+	/*
+		Registration and login reject an empty or nil credential identifier
+	*/
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		sk, pk := keyGen(t, server)
+		rec := buildRecord(t, credID, seed, []byte("yo"), pk, conf.Conf.Client(), server)
+
+		for _, empty := range [][]byte{nil, {}} {
+			req := conf.Conf.Client().RegistrationInit([]byte("yo"))
+			if _, err := server.RegistrationResponse(req, pk, empty, seed); !errors.Is(err, opaque.ErrEmptyCredentialIdentifier) {
+				t.Fatalf("expected ErrEmptyCredentialIdentifier on registration, got %v", err)
+			}
+
+			record := *rec
+			record.CredentialIdentifier = empty
+
+			ke1 := conf.Conf.Client().Init([]byte("yo"))
+			if _, err := conf.Conf.Server().Init(ke1, nil, sk, pk, seed, &record); !errors.Is(err, opaque.ErrEmptyCredentialIdentifier) {
+				t.Fatalf("expected ErrEmptyCredentialIdentifier on login, got %v", err)
+			}
+		}
+	}
 }
 
-func getBadRistrettoScalar() []byte {
-	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
-	decoded, _ := hex.DecodeString(a)
+func TestCodecs(t *testing.T) {
+	/*
+		Messages round-trip with the raw and CBOR codecs, and the raw codec writes the serialized messages
+	*/
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
 
-	return decoded
-}
+	for _, conf := range confs {
+		for _, codec := range []opaque.Codec{nil, opaque.RawCodec{}, opaque.CBORCodec{}} {
+			for _, verifiable := range []bool{false, true} {
+				p := conf.Conf.Clone()
+				p.Codec = codec
+				p.VerifiableOPRF = verifiable
+				p.ProtocolVersion = "v1"
+				client, server := p.Client(), p.Server()
+				sk, pk := keyGen(t, server)
+				var buf bytes.Buffer
 
-func getBadRistrettoElement() []byte {
-	a := "2a292df7e32cababbd9de088d1d1abec9fc0440f637ed2fba145094dc14bea08"
-	decoded, _ := hex.DecodeString(a)
+				check := func(m interface{ Serialize() []byte }, decoded interface{ Serialize() []byte }, err error) {
+					t.Helper()
 
-	return decoded
-}
+					if err != nil {
+						t.Fatal(err)
+					}
 
-func getBadNistScalar(t *testing.T, ci ciphersuite.Identifier, curve elliptic.Curve) []byte {
-	order := curve.Params().P
-	exceeded := order.Add(order, big.NewInt(2)).Bytes()
+					if !bytes.Equal(m.Serialize(), decoded.Serialize()) {
+						t.Fatalf("%T doesn't round-trip with %T", m, codec)
+					}
 
-	_, err := ci.NewScalar().Decode(exceeded)
-	if err == nil {
-		t.Errorf("Exceeding order did not yield an error for group %s", ci)
-	}
+					if buf.Len() != 0 {
+						t.Fatalf("%d trailing bytes after %T", buf.Len(), m)
+					}
+				}
 
-	return exceeded
-}
+				req := client.RegistrationInit([]byte("yo"))
+				if err := client.EncodeRegistrationRequest(&buf, req); err != nil {
+					t.Fatal(err)
+				}
 
-func getBadNistElement(t *testing.T, id ciphersuite.Identifier) []byte {
-	size := encoding.PointLength[id]
-	element := internal.RandomBytes(size)
-	// detag compression
-	element[0] = 4
+				if _, isCBOR := codec.(opaque.CBORCodec); !isCBOR && !bytes.Equal(buf.Bytes(), req.Serialize()) {
+					t.Fatal("expected the raw codec to write the serialized message")
+				}
 
-	_, err := id.NewElement().Decode(element)
-	if err == nil {
-		t.Errorf("detagged compressed point did not yield an error for group %s", id)
-	}
+				decodedReq, err := server.DecodeRegistrationRequest(&buf)
+				check(req, decodedReq, err)
 
-	return element
-}
+				resp, err := server.RegistrationResponse(decodedReq, pk, credID, seed)
+				if err != nil {
+					t.Fatal(err)
+				}
 
-func getBadElement(t *testing.T, c configuration) []byte {
-	if c.Conf.Group == opaque.RistrettoSha512 {
-		return getBadRistrettoElement()
-	} else {
-		return getBadNistElement(t, oprf.Ciphersuite(c.Conf.Group).Group())
-	}
-}
+				if err := server.EncodeRegistrationResponse(&buf, resp); err != nil {
+					t.Fatal(err)
+				}
 
-func getBadScalar(t *testing.T, c configuration) []byte {
-	if c.Conf.Group == opaque.RistrettoSha512 {
-		return getBadRistrettoScalar()
-	} else {
-		return getBadNistScalar(t, oprf.Ciphersuite(c.Conf.Group).Group(), c.Curve)
-	}
-}
+				decodedResp, err := client.DecodeRegistrationResponse(&buf)
+				check(resp, decodedResp, err)
 
-func buildRecord(t *testing.T, credID, oprfSeed, password, pks []byte, client *opaque.Client, server *opaque.Server) *opaque.ClientRecord {
-	r1 := client.RegistrationInit(password)
-	r2, err := server.RegistrationResponse(r1, pks, credID, oprfSeed)
-	if err != nil {
-		t.Fatal(err)
-	}
+				upload, _, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, decodedResp)
+				if err != nil {
+					t.Fatal(err)
+				}
 
-	skc, _ := client.KeyGen()
-	r3, _, err := client.RegistrationFinalize(skc, &opaque.Credentials{}, r2)
-	if err != nil {
-		t.Fatal(err)
-	}
+				if err := client.EncodeRegistrationUpload(&buf, upload); err != nil {
+					t.Fatal(err)
+				}
 
-	return &opaque.ClientRecord{
-		CredentialIdentifier: credID,
-		ClientIdentity:       nil,
-		RegistrationUpload:   r3,
-		TestMaskNonce:        nil,
-	}
-}
+				decodedUpload, err := server.DecodeRegistrationUpload(&buf)
+				check(upload, decodedUpload, err)
 
-func getEnvelope(mode envelope.Mode, client *opaque.Client, ke2 *message.KE2) (*envelope.Envelope, []byte, error) {
-	unblinded, err := client.Core.OprfFinalize(ke2.Data)
-	if err != nil {
-		return nil, nil, fmt.Errorf("finalizing OPRF : %w", err)
-	}
+				rec := &opaque.ClientRecord{CredentialIdentifier: credID, RegistrationUpload: decodedUpload}
+				oprfPublicKey := client.OPRFPublicKey()
+				client, server = p.Client(), p.Server()
+				client.SetOPRFPublicKey(oprfPublicKey)
 
-	randomizedPwd := envelope.BuildPRK(client.Parameters, unblinded)
-	maskingKey := client.KDF.Expand(randomizedPwd, []byte(tag.MaskingKey), client.Hash.Size())
+				ke1 := client.Init([]byte("yo"))
+				if err := client.EncodeKE1(&buf, ke1); err != nil {
+					t.Fatal(err)
+				}
 
-	clear := client.MaskResponse(maskingKey, ke2.MaskingNonce, ke2.MaskedResponse)
-	e := clear[encoding.PointLength[client.Group]:]
+				decodedKE1, err := server.DecodeKE1(&buf)
+				check(ke1, decodedKE1, err)
 
-	// Deserialize
-	innerLen := 0
+				ke2, err := server.Init(decodedKE1, nil, sk, pk, seed, rec)
+				if err != nil {
+					t.Fatal(err)
+				}
 
-	if mode == envelope.External {
-		innerLen = encoding.ScalarLength[client.Group]
-	}
+				if err := server.EncodeKE2(&buf, ke2); err != nil {
+					t.Fatal(err)
+				}
 
-	env := &envelope.Envelope{
-		Nonce:         e[:client.NonceLen],
-		InnerEnvelope: e[client.NonceLen : client.NonceLen+innerLen],
-		AuthTag:       e[client.NonceLen+innerLen:],
-	}
+				decodedKE2, err := client.DecodeKE2(&buf)
+				check(ke2, decodedKE2, err)
 
-	return env, randomizedPwd, nil
-}
+				ke3, _, err := client.Finish(nil, nil, decodedKE2)
+				if err != nil {
+					t.Fatal(err)
+				}
 
-// server.go
+				if err := client.EncodeKE3(&buf, ke3); err != nil {
+					t.Fatal(err)
+				}
 
-func TestServer_BadRegistrationRequest(t *testing.T) {
-	/*
-		Error in OPRF
-		- client blinded element invalid point encoding
-	*/
-	credId := internal.RandomBytes(32)
-	seed := internal.RandomBytes(32)
-	terr := " RegistrationResponse: can't evaluate input : "
+				decodedKE3, err := server.DecodeKE3(&buf)
+				check(ke3, decodedKE3, err)
 
-	for i, e := range confs {
-		badRequest := &message.RegistrationRequest{Data: getBadElement(t, e)}
-		server := e.Conf.Server()
-		if _, err := server.RegistrationResponse(badRequest, nil, credId, seed); err == nil || !strings.HasPrefix(err.Error(), terr) {
-			log.Printf("#%d - expected error. Got %v", i, err)
+				if err := server.Finish(decodedKE3); err != nil {
+					t.Fatal(err)
+				}
+			}
 		}
 	}
 }
 
-func TestServerInit_InvalidPublicKey(t *testing.T) {
+func TestCBORCodec_Invalid(t *testing.T) {
 	/*
-		Nil and invalid server public key
+		The CBOR codec rejects messages that aren't a map of the expected fields
 	*/
-	for _, conf := range confs {
-		server := conf.Conf.Server()
-		expected := "invalid server public key: "
+	p := opaque.DefaultConfiguration()
+	p.Codec = opaque.CBORCodec{}
+	client, server := p.Client(), p.Server()
 
-		if _, err := server.Init(nil, nil, nil, nil, nil, nil); err == nil || !strings.HasPrefix(err.Error(), expected) {
-			t.Fatalf("expected error on nil pubkey - got %s", err)
-		}
+	var buf bytes.Buffer
+	if err := client.EncodeKE3(&buf, &message.KE3{Mac: make([]byte, p.MAC.Size())}); err != nil {
+		t.Fatal(err)
+	}
 
-		if _, err := server.Init(nil, nil, nil, getBadElement(t, conf), nil, nil); err == nil || !strings.HasPrefix(err.Error(), expected) {
-			t.Fatalf("expected error on bad secret key - got %s", err)
+	valid := buf.Bytes()
+
+	for name, encoded := range map[string][]byte{
+		"not a map":      {0x41, 0x00},
+		"no field":       {0xa0},
+		"unknown field":  append([]byte{0xa1, 0x61, 'x'}, valid[3:]...),
+		"short field":    append(append([]byte{}, valid[:3]...), 0x41, 0x00),
+		"truncated":      valid[:len(valid)-1],
+		"two fields":     append([]byte{0xa2}, valid[1:]...),
+		"indefinite map": append([]byte{0xbf}, valid[1:]...),
+	} {
+		if _, err := server.DecodeKE3(bytes.NewReader(encoded)); err == nil {
+			t.Fatalf("expected an error for %s", name)
 		}
 	}
+
+	if _, err := server.DecodeKE3(bytes.NewReader(valid)); err != nil {
+		t.Fatal(err)
+	}
 }
 
-func TestServerInit_NilSecretKey(t *testing.T) {
+func TestServerFinish_FailureReason(t *testing.T) {
 	/*
-		Nil server secret key
+		The authentication error carries the reason of the failure
 	*/
-	for _, conf := range confs {
-		server := conf.Conf.Server()
-		_, pk := server.KeyGen()
-		expected := "invalid server secret key: "
+	conf := opaque.DefaultConfiguration()
+	credId := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	client := conf.Client()
+	server := conf.Server()
+	sk, pk := keyGen(t, server)
+	rec := buildRecord(t, credId, seed, []byte("yo"), pk, client, server)
 
-		if _, err := server.Init(nil, nil, nil, pk, nil, nil); err == nil || !strings.HasPrefix(err.Error(), expected) {
-			t.Fatalf("expected error on nil secret key - got %s", err)
+	reason := func(err error) opaque.FailureReason {
+		var authErr *opaque.AuthenticationError
+		if !errors.As(err, &authErr) || !errors.Is(err, opaque.ErrAkeInvalidClientMac) {
+			t.Fatalf("expected an authentication error - got %v", err)
 		}
+
+		return authErr.Reason
+	}
+
+	ke1 := client.Init([]byte("yo"))
+	ke2, _ := server.Init(ke1, nil, sk, pk, seed, rec)
+	ke3, _, _ := client.Finish(nil, nil, ke2)
+
+	if r := reason(server.Finish(&message.KE3{Mac: ke3.Mac[1:]})); r != opaque.ReasonInvalidMacLength {
+		t.Fatalf("expected reason %q, got %q", opaque.ReasonInvalidMacLength, r)
+	}
+
+	ke3.Mac[0] = ^ke3.Mac[0]
+	if r := reason(server.Finish(ke3)); r != opaque.ReasonInvalidMac {
+		t.Fatalf("expected reason %q, got %q", opaque.ReasonInvalidMac, r)
 	}
 }
 
-func TestServerInit_InvalidData(t *testing.T) {
+func TestServerFinishSession(t *testing.T) {
 	/*
-		Invalid OPRF data in KE1
+		The session key is returned only for a valid KE3, and equals the client's
 	*/
+	credID := internal.RandomBytes(32)
 	seed := internal.RandomBytes(32)
-	rec := &opaque.ClientRecord{
-		CredentialIdentifier: internal.RandomBytes(32),
-		ClientIdentity:       nil,
-		RegistrationUpload: &message.RegistrationUpload{
-			MaskingKey: internal.RandomBytes(32),
-		},
-		TestMaskNonce: nil,
-	}
 
 	for _, conf := range confs {
 		server := conf.Conf.Server()
-		sk, pk := server.KeyGen()
-		client := conf.Conf.Client()
-		ke1 := client.Init([]byte("yo"))
-		ke1.CredentialRequest.Data = getBadElement(t, conf)
-		expected := " credentialResponse: oprfResponse: can't evaluate input :"
-		if _, err := server.Init(ke1, nil, sk, pk, seed, rec); err == nil || !strings.HasPrefix(err.Error(), expected) {
-			t.Fatalf("expected error on bad oprf request - got %s", err)
+		sk, pk := keyGen(t, server)
+		rec := buildRecord(t, credID, seed, []byte("yo"), pk, conf.Conf.Client(), server)
+
+		for _, tamper := range []bool{true, false} {
+			client := conf.Conf.Client()
+			server := conf.Conf.Server()
+
+			ke2, err := server.Init(client.Init([]byte("yo")), nil, sk, pk, seed, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ke3, _, err := client.Finish(nil, nil, ke2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tamper {
+				ke3.Mac[0] ^= 0xff
+
+				if key, err := server.FinishSession(ke3); key != nil || !errors.Is(err, opaque.ErrAkeInvalidClientMac) {
+					t.Fatalf("expected no session key and an authentication error, got %v", err)
+				}
+
+				continue
+			}
+
+			key, err := server.FinishSession(ke3)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(key, client.SessionKey()) {
+				t.Fatal("session keys differ")
+			}
 		}
 	}
 }
 
-func TestServerInit_InvalidEPKU(t *testing.T) {
+func TestClientOprfFinalize(t *testing.T) {
 	/*
-		Invalid EPKU in KE1
+		The OPRF output is the same at registration and login, and can't be computed before blinding
 	*/
+	credID := internal.RandomBytes(32)
 	seed := internal.RandomBytes(32)
-	rec := &opaque.ClientRecord{
-		CredentialIdentifier: internal.RandomBytes(32),
-		ClientIdentity:       nil,
-		RegistrationUpload: &message.RegistrationUpload{
-			MaskingKey: internal.RandomBytes(32),
-		},
-		TestMaskNonce: nil,
-	}
 
 	for _, conf := range confs {
-		rec.Envelope = opaque.GetFakeEnvelope(conf.Conf)
+		if _, err := conf.Conf.Client().OprfFinalize(getBadElement(t, conf)); !errors.Is(err, opaque.ErrNoBlind) {
+			t.Fatalf("expected ErrNoBlind, got %v", err)
+		}
+
 		server := conf.Conf.Server()
-		sk, pk := server.KeyGen()
+		sk, pk := keyGen(t, server)
 		client := conf.Conf.Client()
-		ke1 := client.Init([]byte("yo"))
-		ke1.EpkU = getBadElement(t, conf)
-		expected := " AKE response: decoding peer ephemeral public key:"
-		if _, err := server.Init(ke1, nil, sk, pk, seed, rec); err == nil || !strings.HasPrefix(err.Error(), expected) {
-			t.Fatalf("expected error on bad epku - got %s", err)
+
+		resp, err := server.RegistrationResponse(client.RegistrationInit([]byte("yo")), pk, credID, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		registration, err := client.OprfFinalize(resp.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := buildRecord(t, credID, seed, []byte("yo"), pk, conf.Conf.Client(), server)
+		client = conf.Conf.Client()
+
+		ke2, err := conf.Conf.Server().Init(client.Init([]byte("yo")), nil, sk, pk, seed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		login, err := client.OprfFinalize(ke2.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(registration, login) {
+			t.Fatal("expected the same OPRF output at registration and login")
+		}
+
+		if _, _, err := client.Finish(nil, nil, ke2); err != nil {
+			t.Fatal(err)
 		}
 	}
 }
 
-func TestServerInit_InvalidPKU(t *testing.T) {
+func TestProtocolVersion(t *testing.T) {
 	/*
-		Invalid PKU in KE1
+		A pinned version travels in KE1 and the server rejects another one, or a missing or unexpected one
 	*/
+	credID := internal.RandomBytes(32)
 	seed := internal.RandomBytes(32)
-	rec := &opaque.ClientRecord{
-		CredentialIdentifier: internal.RandomBytes(32),
-		ClientIdentity:       nil,
-		RegistrationUpload: &message.RegistrationUpload{
-			MaskingKey: internal.RandomBytes(32),
-		},
-		TestMaskNonce: nil,
-	}
 
 	for _, conf := range confs {
-		rec.Envelope = opaque.GetFakeEnvelope(conf.Conf)
-		server := conf.Conf.Server()
-		sk, pk := server.KeyGen()
-		client := conf.Conf.Client()
-		ke1 := client.Init([]byte("yo"))
-		rec.PublicKey = getBadElement(t, conf)
-		expected := " AKE response: decoding peer public key:"
-		if _, err := server.Init(ke1, nil, sk, pk, seed, rec); err == nil || !strings.HasPrefix(err.Error(), expected) {
-			t.Fatalf("expected error on bad epku - got %s", err)
+		v1 := conf.Conf.Clone()
+		v1.ProtocolVersion = "v1"
+		v2 := conf.Conf.Clone()
+		v2.ProtocolVersion = "v2"
+
+		server := v1.Server()
+		sk, pk := keyGen(t, server)
+		rec := buildRecord(t, credID, seed, []byte("yo"), pk, v1.Client(), server)
+
+		ke1 := v2.Client().Init([]byte("yo"))
+		if _, err := v1.Server().Init(ke1, nil, sk, pk, seed, rec); !errors.Is(err, opaque.ErrVersionMismatch) {
+			t.Fatalf("expected ErrVersionMismatch, got %v", err)
+		}
+
+		for _, c := range []struct{ client, server *opaque.Configuration }{
+			{v2, v1},
+			{conf.Conf, v1},
+			{v1, conf.Conf},
+		} {
+			_, err := c.server.Server().DeserializeKE1(c.client.Client().Init([]byte("yo")).Serialize())
+			if !errors.Is(err, opaque.ErrVersionMismatch) {
+				t.Fatalf("expected ErrVersionMismatch for versions %q and %q, got %v", c.client.ProtocolVersion,
+					c.server.ProtocolVersion, err)
+			}
+		}
+
+		if _, err := v1.Server().DeserializeKE1(internal.RandomBytes(3)); errors.Is(err, opaque.ErrVersionMismatch) {
+			t.Fatal("expected a length error on a short KE1")
+		}
+
+		client := v1.Client()
+		server = v1.Server()
+
+		ke1, err := server.DeserializeKE1(client.Init([]byte("yo")).Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ke2, err := server.Init(ke1, nil, sk, pk, seed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ke3, _, err := client.Finish(nil, nil, ke2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := server.Finish(ke3); err != nil {
+			t.Fatal(err)
 		}
 	}
 }
 
-func TestServerFinish_InvalidKE3Mac(t *testing.T) {
+func TestFinish_AAD(t *testing.T) {
 	/*
-		ke3 mac is invalid
+		The KE3 is bound to the additional authenticated data, which must be the same on both sides
 	*/
-	conf := opaque.DefaultConfiguration()
-	credId := internal.RandomBytes(32)
+	credID := internal.RandomBytes(32)
 	seed := internal.RandomBytes(32)
-	client := conf.Client()
-	server := conf.Server()
-	sk, pk := server.KeyGen()
-	rec := buildRecord(t, credId, seed, []byte("yo"), pk, client, server)
-	ke1 := client.Init([]byte("yo"))
-	ke2, _ := server.Init(ke1, nil, sk, pk, seed, rec)
-	ke3, _, _ := client.Finish(nil, nil, ke2)
-	ke3.Mac[0] = ^ke3.Mac[0]
+	request := []byte("request hash")
 
-	expected := opaque.ErrAkeInvalidClientMac
-	if err := server.Finish(ke3); err == nil || err.Error() != expected.Error() {
-		t.Fatalf("expected error on invalid mac - got %v", err)
+	tests := []struct {
+		name           string
+		client, server [][]byte
+		valid          bool
+	}{
+		{"none", nil, nil, true},
+		{"same", [][]byte{request}, [][]byte{request}, true},
+		{"several", [][]byte{request, []byte("b")}, [][]byte{request, []byte("b")}, true},
+		{"different", [][]byte{request}, [][]byte{[]byte("other")}, false},
+		{"missing on the server", [][]byte{request}, nil, false},
+		{"missing on the client", nil, [][]byte{request}, false},
+		{"empty", [][]byte{{}}, nil, false},
+		{"concatenated", [][]byte{[]byte("ab")}, [][]byte{[]byte("a"), []byte("b")}, false},
+	}
+
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		sk, pk := keyGen(t, server)
+		rec := buildRecord(t, credID, seed, []byte("yo"), pk, conf.Conf.Client(), server)
+
+		for _, test := range tests {
+			client := conf.Conf.Client()
+			server := conf.Conf.Server()
+
+			ke2, err := server.Init(client.Init([]byte("yo")), nil, sk, pk, seed, rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ke3, _, err := client.Finish(nil, nil, ke2, test.client...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = server.Finish(ke3, test.server...)
+			if test.valid && err != nil {
+				t.Fatalf("%s: unexpected error %v", test.name, err)
+			}
+
+			if !test.valid && !errors.Is(err, opaque.ErrAkeInvalidClientMac) {
+				t.Fatalf("%s: expected error %q, got %v", test.name, opaque.ErrAkeInvalidClientMac, err)
+			}
+		}
 	}
 }
 
@@ -510,7 +3443,7 @@ func TestClientRegistrationFinalize_InvalidPks(t *testing.T) {
 	for _, conf := range confs {
 		client := conf.Conf.Client()
 		server := conf.Conf.Server()
-		_, pks := server.KeyGen()
+		_, pks := keyGen(t, server)
 		r1 := client.RegistrationInit([]byte("yo"))
 
 		r2, err := server.RegistrationResponse(r1, pks, credID, oprfSeed)
@@ -533,6 +3466,40 @@ func TestClientRegistrationFinalize_InvalidPks(t *testing.T) {
 	}
 }
 
+func TestClientRegistrationFinalize_SmallOrderPks(t *testing.T) {
+	/*
+		Server public key of order 2 in the groups with a cofactor
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	// (0, 0) on Curve25519, and (0, -1) on Edwards25519.
+	edwardsY := make([]byte, 32)
+	new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(20)).FillBytes(edwardsY)
+	smallOrder := map[opaque.Group][]byte{
+		opaque.Curve25519Sha512:   append([]byte{0x02}, make([]byte, 32)...),
+		opaque.Edwards25519Sha512: edwardsY,
+	}
+
+	for g, point := range smallOrder {
+		conf := opaque.DefaultConfiguration()
+		conf.AKEGroup = g
+		client := conf.Client()
+		server := conf.Server()
+		_, pks := keyGen(t, server)
+
+		r2, err := server.RegistrationResponse(client.RegistrationInit([]byte("yo")), pks, credID, oprfSeed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r2.Pks = point
+		if _, _, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, r2); !errors.Is(err, opaque.ErrSmallOrderComponent) {
+			t.Fatalf("group %d: expected error %q, got %v", g, opaque.ErrSmallOrderComponent, err)
+		}
+	}
+}
+
 func TestClientRegistrationFinalize_InvalidEvaluation(t *testing.T) {
 	/*
 		Oprf finalize - evaluation deserialization // element decoding
@@ -541,11 +3508,11 @@ func TestClientRegistrationFinalize_InvalidEvaluation(t *testing.T) {
 		client := conf.Conf.Client()
 		badr2 := &message.RegistrationResponse{
 			Data: getBadElement(t, conf),
-			Pks:  client.Group.Base().Bytes(),
+			Pks:  client.AKEGroup.Base().Bytes(),
 		}
 
 		expected := "building envelope: finalizing OPRF : "
-		if _, _, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, badr2); err == nil || !strings.HasPrefix(err.Error(), expected) {
+		if _, _, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, badr2); err == nil || !isStageError(err, opaque.StageOPRF, expected) {
 			t.Fatalf("expected error for invalid evualuated element - got %v", err)
 		}
 	}
@@ -565,7 +3532,7 @@ func TestClientFinish_BadEvaluation(t *testing.T) {
 		}
 
 		expected := "finalizing OPRF : could not decode element :"
-		if _, _, err := client.Finish(nil, nil, ke2); err == nil || !strings.HasPrefix(err.Error(), expected) {
+		if _, _, err := client.Finish(nil, nil, ke2); err == nil || !isStageError(err, opaque.StageOPRF, expected) {
 			t.Fatalf("expected error for invalid evaluated elemenet - got %v", err)
 		}
 	}
@@ -581,13 +3548,13 @@ func TestClientFinish_BadMaskedResponse(t *testing.T) {
 	for _, conf := range confs {
 		client := conf.Conf.Client()
 		server := conf.Conf.Server()
-		sks, pks := server.KeyGen()
+		sks, pks := keyGen(t, server)
 		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
 
 		ke1 := client.Init([]byte("yo"))
 		ke2, _ := server.Init(ke1, nil, sks, pks, oprfSeed, rec)
 
-		goodLength := encoding.PointLength[client.Group] + client.EnvelopeSize
+		goodLength := client.AkePointLength + client.EnvelopeSize
 		expected := "invalid masked response length"
 
 		// too short
@@ -614,7 +3581,7 @@ func TestClientFinish_InvalidEnvelopeTag(t *testing.T) {
 	for _, conf := range confs {
 		client := conf.Conf.Client()
 		server := conf.Conf.Server()
-		sks, pks := server.KeyGen()
+		sks, pks := keyGen(t, server)
 		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
 
 		ke1 := client.Init([]byte("yo"))
@@ -632,12 +3599,50 @@ func TestClientFinish_InvalidEnvelopeTag(t *testing.T) {
 
 		// too short
 		expected := "recover envelope: invalid envelope authentication tag"
-		if _, _, err := client.Finish(nil, nil, ke2); err == nil || !strings.HasPrefix(err.Error(), expected) {
+		if _, _, err := client.Finish(nil, nil, ke2); err == nil || !isStageError(err, opaque.StageEnvelope, expected) {
 			t.Fatalf("expected error for invalid envelope mac - got %v", err)
 		}
 	}
 }
 
+func TestClientFinish_AEADTamperedSecretKey(t *testing.T) {
+	/*
+		In the AEAD mode, a tampered secret key ciphertext is detected even with a valid envelope tag
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		c := *conf.Conf
+		c.Mode = opaque.ExternalAEAD
+		client := c.Client()
+		server := c.Server()
+		sks, pks := keyGen(t, server)
+		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
+
+		ke1 := client.Init([]byte("yo"))
+		ke2, _ := server.Init(ke1, nil, sks, pks, oprfSeed, rec)
+
+		env, randomizedPwd, err := getEnvelope(envelope.ExternalAEAD, client, ke2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// tamper the ciphertext, and authenticate it with the envelope tag
+		env.InnerEnvelope[0] ^= 0xff
+		authKey := client.KDF.Expand(randomizedPwd, encoding.SuffixString(env.Nonce, tag.AuthKey), client.KDF.Size())
+		ctc := envelope.CreateCleartextCredentials(rec.PublicKey, pks, nil, nil)
+		env.AuthTag = client.MAC.MAC(authKey, encoding.Concat3(env.Nonce, env.InnerEnvelope, ctc.Serialize()))
+		clear := encoding.Concat(pks, env.Serialize())
+		ke2.MaskedResponse = server.MaskResponse(rec.MaskingKey, ke2.MaskingNonce, clear)
+
+		expected := "recover envelope: can't recover envelope: invalid secret key ciphertext"
+		if _, _, err := client.Finish(nil, nil, ke2); err == nil || !isStageError(err, opaque.StageEnvelope, expected) {
+			t.Fatalf("expected error for tampered ciphertext - got %v", err)
+		}
+	}
+}
+
 func TestClientFinish_InvalidKE2KeyEncoding(t *testing.T) {
 	/*
 		Invalid envelope tag
@@ -648,7 +3653,7 @@ func TestClientFinish_InvalidKE2KeyEncoding(t *testing.T) {
 	for _, conf := range confs {
 		client := conf.Conf.Client()
 		server := conf.Conf.Server()
-		sks, pks := server.KeyGen()
+		sks, pks := keyGen(t, server)
 		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
 
 		ke1 := client.Init([]byte("yo"))
@@ -658,7 +3663,7 @@ func TestClientFinish_InvalidKE2KeyEncoding(t *testing.T) {
 		// tamper epks
 		ke2.EpkS = getBadElement(t, conf)
 		expected := " AKE finalization: decoding peer ephemeral public key:"
-		if _, _, err := client.Finish(nil, nil, ke2); err == nil || !strings.HasPrefix(err.Error(), expected) {
+		if _, _, err := client.Finish(nil, nil, ke2); err == nil || !isStageError(err, opaque.StageAKE, expected) {
 			t.Fatalf("expected error for invalid epks encoding - got %q", err)
 		}
 
@@ -680,7 +3685,7 @@ func TestClientFinish_InvalidKE2KeyEncoding(t *testing.T) {
 		ke2.MaskedResponse = server.MaskResponse(rec.MaskingKey, ke2.MaskingNonce, clear)
 
 		expected = " AKE finalization: decoding peer public key:"
-		if _, _, err := client.Finish(nil, nil, ke2); err == nil || !strings.HasPrefix(err.Error(), expected) {
+		if _, _, err := client.Finish(nil, nil, ke2); err == nil || !isStageError(err, opaque.StageAKE, expected) {
 			t.Fatalf("expected error for invalid epks encoding - got %q", err)
 		}
 	}
@@ -696,7 +3701,7 @@ func TestClientFinish_InvalidKE2Mac(t *testing.T) {
 	for _, conf := range confs {
 		client := conf.Conf.Client()
 		server := conf.Conf.Server()
-		sks, pks := server.KeyGen()
+		sks, pks := keyGen(t, server)
 		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
 
 		ke1 := client.Init([]byte("yo"))
@@ -704,32 +3709,330 @@ func TestClientFinish_InvalidKE2Mac(t *testing.T) {
 
 		ke2.Mac = internal.RandomBytes(client.MAC.Size())
 		expected := " AKE finalization: invalid server mac"
-		if _, _, err := client.Finish(nil, nil, ke2); err == nil || !strings.HasPrefix(err.Error(), expected) {
+		if _, _, err := client.Finish(nil, nil, ke2); err == nil || !isStageError(err, opaque.StageAKE, expected) {
 			t.Fatalf("expected error for invalid epks encoding - got %q", err)
 		}
 	}
 }
 
+func TestClient_MissingIdentity(t *testing.T) {
+	/*
+		Explicit identities are required, but the client or server identity is nil
+	*/
+	conf := opaque.DefaultConfiguration()
+	conf.RequireExplicitIdentities = true
+	client := conf.Client()
+	server := conf.Server()
+	_, pks := keyGen(t, server)
+	r1 := client.RegistrationInit([]byte("yo"))
+
+	r2, err := server.RegistrationResponse(r1, pks, internal.RandomBytes(32), internal.RandomBytes(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := &opaque.Credentials{Client: []byte("client")}
+	if _, _, err := client.RegistrationFinalize(nil, creds, r2); !errors.Is(err, opaque.ErrMissingIdentity) {
+		t.Fatalf("expected error on nil server identity - got %v", err)
+	}
+
+	if _, _, err := client.Finish([]byte("client"), nil, &message.KE2{}); !errors.Is(err, opaque.ErrMissingIdentity) {
+		t.Fatalf("expected error on nil server identity - got %v", err)
+	}
+
+	if _, _, err := client.Finish(nil, []byte("server"), &message.KE2{}); !errors.Is(err, opaque.ErrMissingIdentity) {
+		t.Fatalf("expected error on nil client identity - got %v", err)
+	}
+}
+
+func TestConfigurationServerIdentity(t *testing.T) {
+	/*
+		The server identity is the argument, then the configuration's, then the server public key, and the client
+		identity comes from the record
+	*/
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	idc := []byte("alice")
+
+	conf := opaque.DefaultConfiguration()
+	conf.ServerIdentity = []byte("config-server")
+	sks, pks := keyGen(t, conf.Server())
+
+	register := func(conf *opaque.Configuration, ids []byte) *opaque.ClientRecord {
+		client := conf.Client()
+
+		resp, err := conf.Server().RegistrationResponse(client.RegistrationInit([]byte("yo")), pks, credID, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		upload, _, err := client.RegistrationFinalize(nil, &opaque.Credentials{Client: idc, Server: ids}, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &opaque.ClientRecord{CredentialIdentifier: credID, ClientIdentity: idc, RegistrationUpload: upload}
+	}
+
+	login := func(conf *opaque.Configuration, rec *opaque.ClientRecord, clientIds, serverIds []byte) (*message.TranscriptInputs, error) {
+		client := conf.Client()
+
+		ke2, err := conf.Server().Init(client.Init([]byte("yo")), serverIds, sks, pks, seed, rec)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, _, err := client.Finish(idc, clientIds, ke2); err != nil {
+			return nil, err
+		}
+
+		return client.TranscriptInputs(), nil
+	}
+
+	tests := []struct {
+		name                 string
+		conf                 *opaque.Configuration
+		registered           []byte
+		clientIds, serverIds []byte
+		expected             []byte
+	}{
+		{"configuration", conf, nil, nil, nil, conf.ServerIdentity},
+		{"argument", conf, []byte("explicit"), []byte("explicit"), []byte("explicit"), []byte("explicit")},
+		{"public key", opaque.DefaultConfiguration(), nil, nil, nil, pks},
+	}
+
+	for _, test := range tests {
+		transcript, err := login(test.conf, register(test.conf, test.registered), test.clientIds, test.serverIds)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if !bytes.Equal(transcript.ServerIdentity, test.expected) || !bytes.Equal(transcript.ClientIdentity, idc) {
+			t.Fatalf("%s: unexpected identities", test.name)
+		}
+	}
+
+	rec := register(conf, nil)
+	if _, err := login(conf, rec, nil, []byte("other")); err == nil {
+		t.Fatal("expected error when the argument overrides the registered identity on one side only")
+	}
+
+	strict := *conf
+	strict.RequireExplicitIdentities = true
+
+	if _, err := login(&strict, register(&strict, nil), nil, nil); err != nil {
+		t.Fatalf("expected the configuration's identity to satisfy explicit identities: %v", err)
+	}
+}
+
+func TestClient_VerifiableOPRF(t *testing.T) {
+	/*
+		In the verifiable mode, the client verifies the server's proof, and rejects tampered proofs and evaluations
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		c := *conf.Conf
+		c.VerifiableOPRF = true
+		client := c.Client()
+		server := c.Server()
+		sks, pks := keyGen(t, server)
+
+		r1 := client.RegistrationInit([]byte("yo"))
+		r2, err := server.RegistrationResponse(r1, pks, credID, oprfSeed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// tampered proof
+		proof := r2.Proof
+		r2.Proof = internal.RandomBytes(len(proof))
+		if _, _, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, r2); !errors.Is(err, opaque.ErrOPRFProofInvalid) {
+			t.Fatalf("expected error on invalid proof - got %v", err)
+		}
+
+		// tampered evaluation
+		r2.Proof = proof
+		data := r2.Data
+		r2.Data = client.OPRFGroup.Base().Bytes()
+		if _, _, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, r2); !errors.Is(err, opaque.ErrOPRFProofInvalid) {
+			t.Fatalf("expected error on tampered evaluation - got %v", err)
+		}
+
+		r2.Data = data
+		r3, _, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, r2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := &opaque.ClientRecord{CredentialIdentifier: credID, RegistrationUpload: r3}
+		ke1 := client.Init([]byte("yo"))
+		ke2, err := server.Init(ke1, nil, sks, pks, oprfSeed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(ke2.OprfPublicKey, r2.OprfPublicKey) {
+			t.Fatal("OPRF key commitments differ between registration and login")
+		}
+
+		// tampered proof
+		proof = ke2.Proof
+		ke2.Proof = nil
+		if _, _, err := client.Finish(nil, nil, ke2); !errors.Is(err, opaque.ErrOPRFProofInvalid) {
+			t.Fatalf("expected error on missing proof - got %v", err)
+		}
+
+		ke2.Proof = proof
+		if _, _, err := client.Finish(nil, nil, ke2); err != nil {
+			t.Fatal(err)
+		}
+
+		// a client without pinned key can't log in
+		unpinned := c.Client()
+		ke2, err = server.Init(unpinned.Init([]byte("yo")), nil, sks, pks, oprfSeed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := unpinned.Finish(nil, nil, ke2); !errors.Is(err, opaque.ErrOPRFKeyNotPinned) {
+			t.Fatalf("expected ErrOPRFKeyNotPinned - got %v", err)
+		}
+
+		// a server evaluating with another key, with a valid proof for it, is rejected
+		pinned := c.Client()
+		pinned.SetOPRFPublicKey(client.OPRFPublicKey())
+		ke2, err = server.Init(pinned.Init([]byte("yo")), nil, sks, pks, internal.RandomBytes(32), rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := pinned.Finish(nil, nil, ke2); !errors.Is(err, opaque.ErrOPRFKeyMismatch) {
+			t.Fatalf("expected ErrOPRFKeyMismatch - got %v", err)
+		}
+	}
+}
+
+func TestVerifiableOPRF_Serialization(t *testing.T) {
+	/*
+		In the verifiable mode, the OPRF public key and proof are carried by the serialized responses
+	*/
+	credID := internal.RandomBytes(32)
+	oprfSeed := internal.RandomBytes(32)
+
+	for _, conf := range confs {
+		c := *conf.Conf
+		c.VerifiableOPRF = true
+		client := c.Client()
+		server := c.Server()
+		sks, pks := keyGen(t, server)
+
+		r2, err := server.RegistrationResponse(client.RegistrationInit([]byte("yo")), pks, credID, oprfSeed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encoded := r2.Serialize()
+		if len(encoded) != c.RegistrationResponseLength() || len(encoded) == conf.Conf.RegistrationResponseLength() {
+			t.Fatalf("unexpected registration response length %d", len(encoded))
+		}
+
+		// tampered proof
+		tampered := append([]byte{}, encoded...)
+		tampered[len(tampered)-1] ^= 0xff
+
+		r2, err = client.DeserializeRegistrationResponse(tampered)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, r2); !errors.Is(err, opaque.ErrOPRFProofInvalid) {
+			t.Fatalf("expected error on tampered proof - got %v", err)
+		}
+
+		if r2, err = client.DeserializeRegistrationResponse(encoded); err != nil {
+			t.Fatal(err)
+		}
+
+		r3, _, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, r2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := &opaque.ClientRecord{CredentialIdentifier: credID, RegistrationUpload: r3}
+		oprfPublicKey := client.OPRFPublicKey()
+		client = c.Client()
+		client.SetOPRFPublicKey(oprfPublicKey)
+		ke2, err := c.Server().Init(client.Init([]byte("yo")), nil, sks, pks, oprfSeed, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encoded = ke2.Serialize()
+		if len(encoded) != c.KE2Length() {
+			t.Fatalf("unexpected KE2 length %d", len(encoded))
+		}
+
+		// tampered evaluation
+		tampered = append([]byte{}, encoded...)
+		copy(tampered, ke2.OprfPublicKey)
+
+		if ke2, err = client.DeserializeKE2(tampered); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := client.Finish(nil, nil, ke2); !errors.Is(err, opaque.ErrOPRFProofInvalid) {
+			t.Fatalf("expected error on tampered evaluation - got %v", err)
+		}
+
+		if ke2, err = client.DeserializeKE2(encoded); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := client.Finish(nil, nil, ke2); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 /*
 	Magic errors appear: points are not modified but can't suddenly be decoded once past the tested function
 */
 
-//func TestServerInit_InvalidSecretKey(t *testing.T) {
-//	/*
-//		Invalid server secret key
-//	*/
-//	for _, conf := range confs {
-//		server := conf.Conf.Server()
-//		_, pk := server.KeyGen()
-//		expected := "invalid server secret key: "
-//
-//		// todo: computation hangs on bad NIST scalars: are they too high?
-//
-//		if _, err := server.Init(nil, nil, getBadScalar(t, conf), pk, nil, nil); err == nil || !strings.HasPrefix(err.Error(), expected) {
-//			t.Fatalf("expected error on bad secret key - got %s", err)
-//		}
-//	}
-//}
+func TestServerInit_InvalidSecretKey(t *testing.T) {
+	/*
+		Invalid server secret key: over the order, or over the scalar length, must fail promptly
+	*/
+	for _, conf := range confs {
+		server := conf.Conf.Server()
+		sk, pk := keyGen(t, server)
+		expected := "invalid server secret key: "
+		long := append([]byte{0}, sk...)
+
+		for _, bad := range [][]byte{getBadScalar(t, conf), long, sk[1:]} {
+			done := make(chan error, 1)
+
+			go func(bad []byte) {
+				_, err := server.Init(nil, nil, bad, pk, nil, nil)
+				done <- err
+			}(bad)
+
+			select {
+			case err := <-done:
+				if err == nil || !strings.HasPrefix(err.Error(), expected) || !errors.Is(err, opaque.ErrInvalidScalar) {
+					t.Fatalf("expected error on bad secret key - got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%v: decoding a bad secret key didn't return", conf.Conf.AKEGroup)
+			}
+
+			if err := conf.Conf.Server().SetStaticKeys(bad, pk); !errors.Is(err, opaque.ErrInvalidScalar) {
+				t.Fatalf("expected error on bad static secret key - got %v", err)
+			}
+		}
+	}
+}
 
 //func TestClientExternalInvalidKey(t *testing.T) {
 //	/*
@@ -743,7 +4046,7 @@ func TestClientFinish_InvalidKE2Mac(t *testing.T) {
 //		client := conf.Conf.Client()
 //		r1 := client.RegistrationInit([]byte("yo"))
 //		server := conf.Conf.Server()
-//		_, pks := server.KeyGen()
+//		_, pks := keyGen(t, server)
 //		r2, err := conf.Conf.Server().RegistrationResponse(r1, pks, credID, oprfSeed)
 //		if err != nil {
 //			t.Fatal(err)
@@ -774,7 +4077,7 @@ func TestClientFinish_InvalidKE2Mac(t *testing.T) {
 //		conf.Conf.Mode = opaque.External
 //		client := conf.Conf.Client()
 //		server := conf.Conf.Server()
-//		sks, pks := server.KeyGen()
+//		sks, pks := keyGen(t, server)
 //		rec := buildRecord(t, credID, oprfSeed, []byte("yo"), pks, client, server)
 //
 //		ke1 := client.Init([]byte("yo"))
@@ -805,3 +4108,66 @@ func TestClientFinish_InvalidKE2Mac(t *testing.T) {
 //		}
 //	}
 //}
+
+func TestZeroizeSecrets(t *testing.T) {
+	/*
+		Wiping the intermediate secrets doesn't affect the protocol, nor the keys returned to the caller
+	*/
+	conf := opaque.DefaultConfiguration()
+	conf.ZeroizeSecrets = true
+	credID := internal.RandomBytes(32)
+	seed := internal.RandomBytes(32)
+	server := conf.Server()
+	sk, pk := keyGen(t, server)
+
+	client := conf.Client()
+	r2, err := server.RegistrationResponse(client.RegistrationInit([]byte("yo")), pk, credID, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload, exportKeyReg, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, r2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &opaque.ClientRecord{CredentialIdentifier: credID, RegistrationUpload: upload}
+
+	client = conf.Client()
+	ke2, err := server.Init(client.Init([]byte("yo")), nil, sk, pk, seed, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ke3, exportKeyLogin, err := client.Finish(nil, nil, ke2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Finish(ke3); err != nil {
+		t.Fatal(err)
+	}
+
+	zero := make([]byte, len(exportKeyLogin))
+	if bytes.Equal(exportKeyLogin, zero) || !bytes.Equal(exportKeyReg, exportKeyLogin) {
+		t.Fatal("the export key was wiped")
+	}
+
+	if bytes.Equal(client.SessionKey(), zero) || !bytes.Equal(client.SessionKey(), server.SessionKey()) {
+		t.Fatal("the session key was wiped")
+	}
+
+	// Without the option, nothing is wiped.
+	b := []byte{1, 2, 3}
+	(&internal.Parameters{}).Wipe(b)
+
+	if !bytes.Equal(b, []byte{1, 2, 3}) {
+		t.Fatal("unexpected wipe")
+	}
+
+	(&internal.Parameters{ZeroizeSecrets: true}).Wipe(b)
+
+	if !bytes.Equal(b, []byte{0, 0, 0}) {
+		t.Fatal("expected wipe")
+	}
+}
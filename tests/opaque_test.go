@@ -10,10 +10,23 @@ package opaque_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/bytemare/cryptotools/hash"
+	"github.com/bytemare/cryptotools/mhf"
 
 	"github.com/bytemare/opaque"
 	"github.com/bytemare/opaque/internal"
+	"github.com/bytemare/opaque/message"
 )
 
 const dbgErr = "Mode %v: %v"
@@ -28,7 +41,7 @@ func TestFull(t *testing.T) {
 	username := []byte("client")
 	password := []byte("password")
 
-	modes := []opaque.Mode{opaque.Internal, opaque.External}
+	modes := []opaque.Mode{opaque.Internal, opaque.External, opaque.ExternalAEAD}
 
 	p := opaque.DefaultConfiguration()
 	p.Context = []byte("OPAQUETest")
@@ -44,7 +57,11 @@ func TestFull(t *testing.T) {
 
 	for _, mode := range modes {
 		test.Mode = mode
-		serverSecretKey, serverPublicKey := p.Server().KeyGen()
+		serverSecretKey, serverPublicKey, err := p.Server().KeyGen()
+		if err != nil {
+			t.Fatal(err)
+		}
+
 		test.serverSecretKey = serverSecretKey
 		test.serverPublicKey = serverPublicKey
 
@@ -105,7 +122,7 @@ func testRegistration(t *testing.T, p *testParams) (*opaque.ClientRecord, []byte
 		}
 
 		var clientSecretKey []byte
-		if p.Mode == opaque.External {
+		if p.Mode != opaque.Internal {
 			clientSecretKey, _ = client.KeyGen()
 		}
 
@@ -215,3 +232,1499 @@ func testAuthentication(t *testing.T, p *testParams, record *opaque.ClientRecord
 
 	return exportKeyLogin
 }
+
+func TestSelfTest(t *testing.T) {
+	for _, mode := range []opaque.Mode{opaque.Internal, opaque.External, opaque.ExternalAEAD} {
+		p := opaque.DefaultConfiguration()
+		p.Mode = mode
+
+		if err := p.SelfTest(); err != nil {
+			t.Errorf(dbgErr, mode, err)
+		}
+	}
+
+	// Different OPRF and AKE groups.
+	p := opaque.DefaultConfiguration()
+
+	for _, g := range []opaque.Group{opaque.Curve25519Sha512, opaque.Edwards25519Sha512, opaque.P256Sha256} {
+		p.AKEGroup = g
+
+		for _, mode := range []opaque.Mode{opaque.Internal, opaque.External, opaque.ExternalAEAD} {
+			p.Mode = mode
+
+			if err := p.SelfTest(); err != nil {
+				t.Errorf("group %d mode %v: %v", g, mode, err)
+			}
+		}
+	}
+
+	decoded, err := opaque.DeserializeConfiguration(p.Serialize())
+	if err != nil || decoded.OPRFGroup != opaque.RistrettoSha512 || decoded.AKEGroup != opaque.P256Sha256 {
+		t.Errorf("unexpected configuration decoding %v (%v)", decoded, err)
+	}
+
+	if err := opaque.SelfTest(nil); err != nil {
+		t.Errorf("unexpected error with the default configuration: %v", err)
+	}
+
+	p = opaque.DefaultConfiguration()
+	p.OPRFGroup = opaque.Curve25519Sha512
+
+	if err := p.Validate(); err == nil {
+		t.Error("expected error on an AKE-only OPRF group")
+	}
+
+	p.OPRFGroup = 0
+
+	if err := p.SelfTest(); err == nil {
+		t.Error("expected error on invalid configuration")
+	}
+
+	if err := opaque.SelfTest(p); err == nil || !strings.HasPrefix(err.Error(), "self-test configuration:") {
+		t.Errorf("expected error naming the configuration step, got %v", err)
+	}
+}
+
+// TestRistrettoSmoke is the test run for js/wasm with "make wasm", to check that browser-side clients work.
+func TestRistrettoSmoke(t *testing.T) {
+	for _, mode := range []opaque.Mode{opaque.Internal, opaque.External} {
+		p := opaque.DefaultConfiguration()
+		p.Mode = mode
+
+		if err := opaque.SelfTest(p); err != nil {
+			t.Fatalf(dbgErr, mode, err)
+		}
+	}
+}
+
+func TestSelfRegister(t *testing.T) {
+	password := []byte("password")
+
+	for _, mode := range []opaque.Mode{opaque.Internal, opaque.External} {
+		p := opaque.DefaultConfiguration()
+		p.Mode = mode
+
+		record, keys, exportKeyReg, err := opaque.SelfRegister(p, password)
+		if err != nil {
+			t.Fatalf(dbgErr, mode, err)
+		}
+
+		sessionKey, exportKey, err := opaque.SelfAuthenticate(p, record, keys, password)
+		if err != nil {
+			t.Fatalf(dbgErr, mode, err)
+		}
+
+		if len(sessionKey) == 0 {
+			t.Error("expected a session key")
+		}
+
+		if !bytes.Equal(exportKeyReg, exportKey) {
+			t.Error("export keys differ")
+		}
+
+		if _, _, err := opaque.SelfAuthenticate(p, record, keys, []byte("wrong")); err == nil {
+			t.Error("expected error on wrong password")
+		}
+	}
+}
+
+func TestRegistrationBatch(t *testing.T) {
+	p := opaque.DefaultConfiguration()
+	passwords := [][]byte{[]byte("password1"), []byte("password2"), []byte("password3")}
+	serverSecretKey, serverPublicKey, err := p.Server().KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oprfSeed := internal.RandomBytes(32)
+
+	client := p.Client()
+	requests, state, err := client.RegistrationInitBatch(passwords)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.Len() != len(passwords) {
+		t.Fatalf("expected %d entries, got %d", len(passwords), state.Len())
+	}
+
+	credIDs := make([][]byte, len(requests))
+	creds := make([]*opaque.Credentials, len(requests))
+	responses := make([]*message.RegistrationResponse, len(requests))
+
+	for i, req := range requests {
+		credIDs[i] = internal.RandomBytes(32)
+		creds[i] = &opaque.Credentials{}
+
+		resp, err := p.Server().RegistrationResponse(req, serverPublicKey, credIDs[i], oprfSeed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		responses[i] = resp
+	}
+
+	if _, _, err := client.RegistrationFinalizeBatch(state, nil, creds[1:], responses); !errors.Is(err, opaque.ErrBatchLength) {
+		t.Fatalf("expected error %q, got %v", opaque.ErrBatchLength, err)
+	}
+
+	uploads, exportKeys, err := client.RegistrationFinalizeBatch(state, nil, creds, responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each password logs in against its own record.
+	for i, password := range passwords {
+		test := &testParams{
+			Configuration:   p,
+			password:        password,
+			serverSecretKey: serverSecretKey,
+			serverPublicKey: serverPublicKey,
+			oprfSeed:        oprfSeed,
+		}
+
+		record := &opaque.ClientRecord{CredentialIdentifier: credIDs[i], RegistrationUpload: uploads[i]}
+		if exportKey := testAuthentication(t, test, record); !bytes.Equal(exportKey, exportKeys[i]) {
+			t.Fatalf("entry %d: export keys differ", i)
+		}
+	}
+}
+
+func TestRegistrationResponseBatch(t *testing.T) {
+	p := opaque.DefaultConfiguration()
+	server := p.Server()
+	_, serverPublicKey, err := server.KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests, _, err := p.Client().RegistrationInitBatch([][]byte{[]byte("password1"), []byte("password2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	credIDs := [][]byte{[]byte("cid1"), []byte("cid2")}
+	seeds := [][]byte{internal.RandomBytes(32), internal.RandomBytes(32)}
+
+	if _, err := server.RegistrationResponseBatch(requests, serverPublicKey, credIDs, seeds[1:]); !errors.Is(err, opaque.ErrBatchLength) {
+		t.Fatalf("expected error %q, got %v", opaque.ErrBatchLength, err)
+	}
+
+	responses, err := server.RegistrationResponseBatch(requests, serverPublicKey, credIDs, seeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each response is the one of RegistrationResponse for the entry.
+	for i, req := range requests {
+		resp, err := server.RegistrationResponse(req, serverPublicKey, credIDs[i], seeds[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(resp.Serialize(), responses[i].Serialize()) {
+			t.Fatalf("entry %d: responses differ", i)
+		}
+	}
+
+	requests[1].Data = bytes.Repeat([]byte{0xff}, len(requests[1].Data))
+
+	if _, err := server.RegistrationResponseBatch(requests, serverPublicKey, credIDs, seeds); err == nil ||
+		!strings.HasPrefix(err.Error(), "batch entry 1:") {
+		t.Fatalf("expected error on entry 1, got %v", err)
+	}
+}
+
+func TestVerifyPasswordsBatch(t *testing.T) {
+	p := opaque.DefaultConfiguration()
+	serverSecretKey, serverPublicKey, err := p.Server().KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := &opaque.ServerKeys{SecretKey: serverSecretKey, PublicKey: serverPublicKey, OprfSeed: internal.RandomBytes(32)}
+	passwords := [][]byte{[]byte("password1"), []byte("password2"), []byte("password3")}
+	entries := make([]opaque.PasswordCheck, len(passwords))
+
+	for i, password := range passwords {
+		test := &testParams{
+			Configuration:   p,
+			username:        []byte("client"),
+			serverID:        []byte("server"),
+			password:        password,
+			serverSecretKey: keys.SecretKey,
+			serverPublicKey: keys.PublicKey,
+			oprfSeed:        keys.OprfSeed,
+		}
+
+		record, _ := testRegistration(t, test)
+		entries[i] = opaque.PasswordCheck{Record: record, Password: password}
+	}
+
+	entries[1].Password = []byte("wrong")
+	server := p.Server()
+
+	results := server.VerifyPasswordsBatch(context.Background(), []byte("server"), keys, entries, 2)
+	for i, r := range results {
+		if (r.Err != nil) != (i == 1) {
+			t.Errorf("entry %d: unexpected result %v", i, r.Err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for i, r := range server.VerifyPasswordsBatch(ctx, []byte("server"), keys, entries, 2) {
+		if !errors.Is(r.Err, context.Canceled) {
+			t.Errorf("entry %d: expected cancellation, got %v", i, r.Err)
+		}
+	}
+}
+
+func TestConfigurationJSON(t *testing.T) {
+	p := opaque.FIPSConfiguration()
+	p.Mode = opaque.External
+	p.Context = []byte("context")
+	p.StrictMode = true
+
+	encoded, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{`"P384Sha512"`, `"SHA512"`, `"pbkdf2-sha512"`, `"external"`} {
+		if !strings.Contains(string(encoded), name) {
+			t.Errorf("expected %s in %s", name, encoded)
+		}
+	}
+
+	decoded := new(opaque.Configuration)
+	if err := json.Unmarshal(encoded, decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(p, decoded) {
+		t.Fatalf("decoded configuration differs: %v", decoded)
+	}
+
+	unknown := strings.Replace(string(encoded), `"pbkdf2-sha512"`, `"argon3"`, 1)
+	if err := json.Unmarshal([]byte(unknown), decoded); err == nil || err.Error() != `unknown MHF "argon3"` {
+		t.Fatalf("expected error on unknown MHF name, got %v", err)
+	}
+
+	p.AKEGroup = 2
+	if _, err := json.Marshal(p); err == nil {
+		t.Fatal("expected error on unknown group")
+	}
+}
+
+func TestConfigurationClone(t *testing.T) {
+	p := opaque.DefaultConfiguration()
+	p.Context = []byte("context")
+	p.MHFParameters = []int{1, 2, 3}
+
+	clone := p.Clone()
+	clone.Context[0] = 'C'
+	clone.MHFParameters[0] = 4
+
+	if string(p.Context) != "context" || p.MHFParameters[0] != 1 {
+		t.Fatal("modifying the clone modified the original")
+	}
+
+	keys := &opaque.ServerKeys{OprfSeed: internal.RandomBytes(32)}
+	var err error
+	keys.SecretKey, keys.PublicKey, err = p.Server().KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	password := []byte("password")
+
+	record, _, err := registerWith(p, keys, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := p.Client(), p.Server()
+	ke1 := client.Init(password)
+
+	// The client and server use the configuration as it was when they were built.
+	p.Context[0] = 'C'
+	p.Mode = opaque.External
+	p.KDFSalt = []byte("salt")
+
+	ke2, err := server.Init(ke1, nil, keys.SecretKey, keys.PublicKey, keys.OprfSeed, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ke3, _, err := client.Finish(nil, nil, ke2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Finish(ke3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMHFParameters_Hardening(t *testing.T) {
+	// The password is hardened with the parameters, so a client with other parameters can't log in.
+	c := opaque.DefaultConfiguration()
+	c.MHFParameters = []int{2, 32 * 1024, 1}
+	keys := &opaque.ServerKeys{OprfSeed: internal.RandomBytes(32)}
+	var err error
+	keys.SecretKey, keys.PublicKey, err = c.Server().KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	password := []byte("password")
+
+	record, _, err := registerWith(c, keys, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := opaque.DefaultConfiguration()
+	other.MHFParameters = []int{1, 32 * 1024, 1}
+	client := other.Client()
+
+	ke2, err := c.Server().Init(client.Init(password), nil, keys.SecretKey, keys.PublicKey, keys.OprfSeed, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := client.Finish(nil, nil, ke2); err == nil {
+		t.Fatal("expected error on different MHF parameters")
+	}
+}
+
+func TestMessagesJSON(t *testing.T) {
+	conf := opaque.DefaultConfiguration()
+	client := conf.Client()
+	server := conf.Server()
+	sks, pks, err := server.KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := internal.RandomBytes(32)
+	password := []byte("password")
+
+	type serializer interface{ Serialize() []byte }
+
+	roundTrip := func(m, decoded serializer, deserialize func([]byte) (serializer, error)) {
+		t.Helper()
+
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := json.Unmarshal(data, decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		validated, err := deserialize(decoded.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(validated.Serialize(), m.Serialize()) {
+			t.Fatalf("JSON round-trip mismatch for %T", m)
+		}
+	}
+
+	req := client.RegistrationInit(password)
+	roundTrip(req, new(message.RegistrationRequest), func(d []byte) (serializer, error) {
+		return server.DeserializeRegistrationRequest(d)
+	})
+
+	resp, err := server.RegistrationResponse(req, pks, []byte("cid"), seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roundTrip(resp, new(message.RegistrationResponse), func(d []byte) (serializer, error) {
+		return client.DeserializeRegistrationResponse(d)
+	})
+
+	upload, _, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roundTrip(upload, new(message.RegistrationUpload), func(d []byte) (serializer, error) {
+		return server.DeserializeRegistrationUpload(d)
+	})
+
+	record := &opaque.ClientRecord{CredentialIdentifier: []byte("cid"), RegistrationUpload: upload}
+	client = conf.Client()
+	ke1 := client.Init(password)
+	roundTrip(ke1, new(message.KE1), func(d []byte) (serializer, error) {
+		return server.DeserializeKE1(d)
+	})
+
+	ke2, err := server.Init(ke1, nil, sks, pks, seed, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roundTrip(ke2, new(message.KE2), func(d []byte) (serializer, error) {
+		return client.DeserializeKE2(d)
+	})
+
+	ke3, _, err := client.Finish(nil, nil, ke2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roundTrip(ke3, new(message.KE3), func(d []byte) (serializer, error) {
+		return server.DeserializeKE3(d)
+	})
+
+	// The lengths are validated with the configuration once decoded.
+	data, _ := json.Marshal(opaque.FIPSConfiguration().Client().Init(password))
+	decoded := new(message.KE1)
+
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := server.DeserializeKE1(decoded.Serialize()); !errors.Is(err, opaque.ErrInvalidMessageLength) {
+		t.Fatalf("expected %q, got %v", opaque.ErrInvalidMessageLength, err)
+	}
+
+	for _, invalid := range []string{`{}`, `"AAAA"`, `{"data":"AA==","n":"AA==","e":"AA==","x":"AA=="}`} {
+		if err := json.Unmarshal([]byte(invalid), new(message.KE1)); err == nil {
+			t.Fatalf("expected error on %s", invalid)
+		}
+	}
+
+	if err := json.Unmarshal([]byte(`{"m":""}`), new(message.KE3)); !errors.Is(err, message.ErrMissingField) {
+		t.Fatalf("expected %q, got %v", message.ErrMissingField, err)
+	}
+
+	// A record keeps all its fields.
+	record.ClientIdentity = []byte("client")
+	record.OPRFKeyTweak = []byte("tweak")
+	record.MaskingNonce, record.MaskedResponse = []byte("nonce"), []byte("response")
+	record.Fake = true
+
+	data, err = json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decodedRecord := new(opaque.ClientRecord)
+	if err := json.Unmarshal(data, decodedRecord); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decodedRecord, record) {
+		t.Fatalf("record JSON round-trip mismatch: %s", data)
+	}
+
+	if err := json.Unmarshal([]byte(`{"cid":"AA=="}`), decodedRecord); !errors.Is(err, message.ErrMissingField) {
+		t.Fatalf("expected %q, got %v", message.ErrMissingField, err)
+	}
+}
+
+func TestDeterministicRand(t *testing.T) {
+	serverSecretKey, serverPublicKey, err := opaque.DefaultConfiguration().Server().KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := internal.RandomBytes(32)
+	password := []byte("password")
+
+	run := func() [][]byte {
+		conf := opaque.DefaultConfiguration()
+		conf.Rand = rand.New(rand.NewSource(1))
+		client := conf.Client()
+		server := conf.Server()
+
+		req := client.RegistrationInit(password)
+
+		resp, err := server.RegistrationResponse(req, serverPublicKey, []byte("cid"), seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		upload, _, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		record := &opaque.ClientRecord{CredentialIdentifier: []byte("cid"), RegistrationUpload: upload}
+		ke1 := client.Init(password)
+
+		ke2, err := server.Init(ke1, nil, serverSecretKey, serverPublicKey, seed, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ke3, _, err := client.Finish(nil, nil, ke2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return [][]byte{req.Serialize(), upload.Serialize(), ke1.Serialize(), ke2.Serialize(), ke3.Serialize()}
+	}
+
+	first, second := run(), run()
+	for i := range first {
+		if !bytes.Equal(first[i], second[i]) {
+			t.Fatalf("message %d differs with the same randomness source", i)
+		}
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	p := opaque.DefaultConfiguration()
+	sk, pk, err := p.Server().KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := &opaque.ServerKeys{SecretKey: sk, PublicKey: pk, OprfSeed: internal.RandomBytes(32)}
+	auth := opaque.NewAuthenticator(p, opaque.NewMemoryStore(), []byte("server"), keys)
+	credID := []byte("alice")
+	password := []byte("password")
+	creds := &opaque.Credentials{Client: []byte("alice"), Server: []byte("server")}
+
+	// Registration
+	client := p.Client()
+
+	resp, err := auth.RegistrationResponse(credID, client.RegistrationInit(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload, exportKeyReg, err := client.RegistrationFinalize(nil, creds, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := auth.Register(credID, creds.Client, upload.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Login
+	client = p.Client()
+
+	// The Authenticator keeps its own copy of the configuration.
+	context := p.Context
+	p.Context = []byte("changed")
+
+	ke2, state, err := auth.LoginInit(credID, client.Init(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Context = context
+
+	ke3, exportKey, err := client.Finish(creds.Client, creds.Server, ke2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionKey, err := auth.LoginFinish(state, ke3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(sessionKey, client.SessionKey()) || !bytes.Equal(exportKey, exportKeyReg) {
+		t.Fatal("keys differ")
+	}
+
+	if err := auth.Register(credID, creds.Client, upload.Serialize()); !errors.Is(err, opaque.ErrRecordExists) {
+		t.Fatalf("expected error %q, got %v", opaque.ErrRecordExists, err)
+	}
+
+	if err := auth.Reregister(credID, creds.Client, upload.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unknown client gets a response built on a fake record, and fails to log in.
+	client = p.Client()
+
+	ke2, _, err = auth.LoginInit([]byte("bob"), client.Init(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := client.Finish(nil, creds.Server, ke2); err == nil {
+		t.Fatal("expected error on unknown client")
+	}
+}
+
+func TestServerSession(t *testing.T) {
+	p := opaque.DefaultConfiguration()
+	keys, password := &opaque.ServerKeys{OprfSeed: internal.RandomBytes(32)}, []byte("password")
+	var err error
+	keys.SecretKey, keys.PublicKey, err = p.Server().KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, exportKeyReg, err := registerWith(p, keys, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := opaque.NewServerSession(p, opaque.NewMemorySessionStore(0), nil, keys)
+	client := p.Client()
+
+	// The session keeps its own copy of the configuration.
+	context := p.Context
+	p.Context = []byte("changed")
+
+	ke2, sessionID, err := session.Begin(client.Init(password), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ke3, exportKey, err := client.Finish(nil, nil, ke2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionKey, err := session.Complete(sessionID, ke3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(sessionKey, client.SessionKey()) || !bytes.Equal(exportKey, exportKeyReg) {
+		t.Fatal("keys differ")
+	}
+
+	// A session can only be completed once.
+	if _, err := session.Complete(sessionID, ke3); !errors.Is(err, opaque.ErrSessionNotFound) {
+		t.Fatalf("expected error %q, got %v", opaque.ErrSessionNotFound, err)
+	}
+
+	// A session completed too late fails.
+	session.SetMaxAge(time.Millisecond)
+	p.Context = context
+	client = p.Client()
+
+	ke2, sessionID, err = session.Begin(client.Init(password), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ke3, _, err = client.Finish(nil, nil, ke2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	if _, err := session.Complete(sessionID, ke3); !errors.Is(err, opaque.ErrStateExpired) {
+		t.Fatalf("expected error %q, got %v", opaque.ErrStateExpired, err)
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	store := opaque.NewMemorySessionStore(10 * time.Millisecond)
+	id, state := []byte("id"), []byte("state")
+
+	if err := store.Put(id, state); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err := store.Get(id); err != nil || !bytes.Equal(s, state) {
+		t.Fatalf("unexpected state %v, %v", s, err)
+	}
+
+	// Abandoned states expire.
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := store.Get(id); !errors.Is(err, opaque.ErrSessionNotFound) {
+		t.Fatalf("expected error %q, got %v", opaque.ErrSessionNotFound, err)
+	}
+}
+
+func TestServerNonceCache(t *testing.T) {
+	p := opaque.DefaultConfiguration()
+	keys, password := &opaque.ServerKeys{OprfSeed: internal.RandomBytes(32)}, []byte("password")
+	var err error
+	keys.SecretKey, keys.PublicKey, err = p.Server().KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, _, err := registerWith(p, keys, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := opaque.NewMemoryNonceCache(time.Minute)
+	login := func(ke1 *message.KE1) error {
+		server := p.Server()
+		server.SetNonceCache(cache)
+
+		_, err := server.Init(ke1, nil, keys.SecretKey, keys.PublicKey, keys.OprfSeed, record)
+
+		return err
+	}
+
+	ke1 := p.Client().Init(password)
+	if err := login(ke1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := login(ke1); !errors.Is(err, opaque.ErrReplayedNonce) {
+		t.Fatalf("expected error %q, got %v", opaque.ErrReplayedNonce, err)
+	}
+
+	if err := login(p.Client().Init(password)); err != nil {
+		t.Fatalf("unexpected error on a fresh KE1: %v", err)
+	}
+
+	// Nonces are forgotten after twice the window.
+	short := opaque.NewMemoryNonceCache(time.Millisecond)
+	nonce := internal.RandomBytes(32)
+
+	if short.NonceSeen(nonce) || !short.NonceSeen(nonce) {
+		t.Fatal("expected the nonce to be recorded")
+	}
+
+	time.Sleep(3 * time.Millisecond)
+	short.NonceSeen(internal.RandomBytes(32))
+	time.Sleep(3 * time.Millisecond)
+
+	if short.NonceSeen(nonce) {
+		t.Fatal("expected the nonce to be forgotten after the window")
+	}
+
+	// After a long idle period, all nonces are forgotten at once.
+	short.NonceSeen(nonce)
+	time.Sleep(3 * time.Millisecond)
+
+	if short.NonceSeen(nonce) {
+		t.Fatal("expected the nonce to be forgotten after an idle period")
+	}
+
+	// A non-positive window falls back to the default one, and still detects replays.
+	for _, window := range []time.Duration{0, -time.Second} {
+		if c := opaque.NewMemoryNonceCache(window); c.NonceSeen(nonce) || !c.NonceSeen(nonce) {
+			t.Fatalf("expected a replay to be detected with a window of %v", window)
+		}
+	}
+}
+
+type tenant struct {
+	identity []byte
+	keys     *opaque.ServerKeys
+}
+
+var errUnknownTenant = errors.New("unknown tenant")
+
+// tenantResolver routes the logins to the tenant a credential identifier was registered with.
+type tenantResolver map[string]*tenant
+
+func (r tenantResolver) Resolve(_ *message.KE1,
+	record *opaque.ClientRecord) (identity, secretKey, publicKey, oprfSeed []byte, err error) {
+	t, ok := r[string(record.CredentialIdentifier)]
+	if !ok {
+		return nil, nil, nil, nil, errUnknownTenant
+	}
+
+	return t.identity, t.keys.SecretKey, t.keys.PublicKey, t.keys.OprfSeed, nil
+}
+
+func TestServerInitResolved(t *testing.T) {
+	p := opaque.DefaultConfiguration()
+	password := []byte("password")
+	resolver := tenantResolver{}
+	records := make([]*opaque.ClientRecord, 2)
+	sessionKeys := make([][]byte, 2)
+
+	for i, name := range []string{"tenant-a", "tenant-b"} {
+		tn := &tenant{identity: []byte(name), keys: &opaque.ServerKeys{OprfSeed: internal.RandomBytes(32)}}
+		var err error
+		tn.keys.SecretKey, tn.keys.PublicKey, err = p.Server().KeyGen()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		registration := *p
+		registration.ServerIdentity = tn.identity
+
+		record, _, err := registerWith(&registration, tn.keys, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resolver[string(record.CredentialIdentifier)] = tn
+		records[i] = record
+	}
+
+	for i, record := range records {
+		client := p.Client()
+		server := p.Server()
+
+		ke2, err := server.InitResolved(client.Init(password), resolver, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ke3, _, err := client.Finish(nil, resolver[string(record.CredentialIdentifier)].identity, ke2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := server.Finish(ke3); err != nil {
+			t.Fatal(err)
+		}
+
+		sessionKeys[i] = server.SessionKey()
+	}
+
+	if bytes.Equal(sessionKeys[0], sessionKeys[1]) {
+		t.Fatal("expected distinct session keys for the tenants")
+	}
+
+	unknown := &opaque.ClientRecord{CredentialIdentifier: []byte("nobody")}
+	if _, err := p.Server().InitResolved(p.Client().Init(password), resolver, unknown); !errors.Is(err, errUnknownTenant) {
+		t.Fatalf("expected error %q, got %v", errUnknownTenant, err)
+	}
+}
+
+// registerWith registers the password with the server keys, and returns the record and the export key.
+func registerWith(p *opaque.Configuration, keys *opaque.ServerKeys,
+	password []byte) (*opaque.ClientRecord, []byte, error) {
+	credID := internal.RandomBytes(32)
+	client := p.Client()
+
+	resp, err := p.Server().RegistrationResponse(client.RegistrationInit(password), keys.PublicKey, credID,
+		keys.OprfSeed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	upload, exportKey, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, resp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &opaque.ClientRecord{CredentialIdentifier: credID, RegistrationUpload: upload}, exportKey, nil
+}
+
+func TestBindAppContext(t *testing.T) {
+	p := opaque.DefaultConfiguration()
+	p.BindAppContext = true
+	keys := &opaque.ServerKeys{OprfSeed: internal.RandomBytes(32)}
+	var err error
+	keys.SecretKey, keys.PublicKey, err = p.Server().KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	password, credID := []byte("password"), []byte("alice")
+	creds := &opaque.Credentials{AppContext: []byte("device-1")}
+
+	client := p.Client()
+
+	resp, err := p.Server().RegistrationResponse(client.RegistrationInit(password), keys.PublicKey, credID,
+		keys.OprfSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload, exportKeyReg, err := client.RegistrationFinalize(nil, creds, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := &opaque.ClientRecord{CredentialIdentifier: credID, RegistrationUpload: upload}
+	login := func(creds *opaque.Credentials) ([]byte, error) {
+		client := p.Client()
+
+		ke2, err := p.Server().Init(client.Init(password), nil, keys.SecretKey, keys.PublicKey, keys.OprfSeed, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, exportKey, err := client.FinishWithCredentials(creds, ke2)
+
+		return exportKey, err
+	}
+
+	exportKey, err := login(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(exportKey, exportKeyReg) {
+		t.Fatal("export keys differ")
+	}
+
+	for name, c := range map[string]*opaque.Credentials{
+		"other context": {AppContext: []byte("device-2")},
+		"no context":    {},
+	} {
+		if _, err := login(c); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+
+	// Without the option, an application context is rejected.
+	client = opaque.DefaultConfiguration().Client()
+	if _, _, err := client.RegistrationFinalize(nil, creds, resp); !errors.Is(err, opaque.ErrAppContextNotBound) {
+		t.Fatalf("expected error %q, got %v", opaque.ErrAppContextNotBound, err)
+	}
+
+	if _, _, err := client.FinishWithCredentials(creds, nil); !errors.Is(err, opaque.ErrAppContextNotBound) {
+		t.Fatalf("expected error %q, got %v", opaque.ErrAppContextNotBound, err)
+	}
+}
+
+// countingEvaluator wraps the built-in OPRF evaluator, and counts the evaluations.
+type countingEvaluator struct {
+	opaque.OPRFEvaluator
+	evaluations int
+	identifiers [][]byte
+}
+
+func (c *countingEvaluator) DeriveKey(credentialIdentifier []byte) ([]byte, error) {
+	c.identifiers = append(c.identifiers, credentialIdentifier)
+	return c.OPRFEvaluator.DeriveKey(credentialIdentifier)
+}
+
+func (c *countingEvaluator) Evaluate(key, blindedElement []byte) ([]byte, error) {
+	c.evaluations++
+	return c.OPRFEvaluator.Evaluate(key, blindedElement)
+}
+
+func TestOPRFEvaluator(t *testing.T) {
+	p := opaque.DefaultConfiguration()
+	keys, password := &opaque.ServerKeys{OprfSeed: internal.RandomBytes(32)}, []byte("password")
+	var err error
+	keys.SecretKey, keys.PublicKey, err = p.Server().KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The evaluator holds the seed, and the one given to the server is ignored.
+	evaluator := &countingEvaluator{OPRFEvaluator: internal.NewOPRFEvaluator(p.Server().Parameters, keys.OprfSeed)}
+	p.OPRFEvaluator = evaluator
+	seed := keys.OprfSeed
+	keys.OprfSeed = nil
+
+	record, exportKeyReg, err := registerWith(p, keys, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys.OprfSeed = seed
+
+	// A login against the built-in evaluator yields the same keys.
+	client := opaque.DefaultConfiguration().Client()
+
+	ke2, err := opaque.DefaultConfiguration().Server().Init(client.Init(password), nil, keys.SecretKey,
+		keys.PublicKey, keys.OprfSeed, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, exportKey, err := client.Finish(nil, nil, ke2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(exportKey, exportKeyReg) {
+		t.Fatal("export keys differ")
+	}
+
+	if evaluator.evaluations != 1 || len(evaluator.identifiers) != 1 ||
+		!bytes.Equal(evaluator.identifiers[0], record.CredentialIdentifier) {
+		t.Fatalf("expected 1 evaluation for the credential identifier, got %d", evaluator.evaluations)
+	}
+}
+
+// countingObserver counts the events of the protocol stages.
+type countingObserver struct {
+	oprf, ake, mhf int
+	macFailures    []string
+}
+
+func (c *countingObserver) OnOPRFEvaluate(time.Duration) { c.oprf++ }
+func (c *countingObserver) OnAKEResponse(time.Duration)  { c.ake++ }
+func (c *countingObserver) OnMHF(time.Duration)          { c.mhf++ }
+func (c *countingObserver) OnMACFailure(stage string) {
+	c.macFailures = append(c.macFailures, stage)
+}
+
+func TestObserver(t *testing.T) {
+	observer := &countingObserver{}
+	p := opaque.DefaultConfiguration()
+	p.Observer = observer
+	keys, password := &opaque.ServerKeys{OprfSeed: internal.RandomBytes(32)}, []byte("password")
+	var err error
+	keys.SecretKey, keys.PublicKey, err = p.Server().KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, _, err := registerWith(p, keys, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(password []byte, tamper bool) {
+		client, server := p.Client(), p.Server()
+
+		ke2, err := server.Init(client.Init(password), nil, keys.SecretKey, keys.PublicKey, keys.OprfSeed, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ke3, _, err := client.Finish(nil, nil, ke2)
+		if err != nil {
+			return
+		}
+
+		if tamper {
+			ke3.Mac[0] ^= 0xff
+		}
+
+		_ = server.Finish(ke3)
+	}
+
+	login(password, false)
+
+	if observer.oprf != 2 || observer.ake != 1 || observer.mhf != 2 || len(observer.macFailures) != 0 {
+		t.Fatalf("unexpected events after a login: %+v", observer)
+	}
+
+	login([]byte("wrong"), false)
+	login(password, true)
+
+	expected := []string{opaque.StageEnvelope, opaque.StageAKE}
+	if observer.oprf != 4 || observer.ake != 3 || !reflect.DeepEqual(observer.macFailures, expected) {
+		t.Fatalf("unexpected events after failed logins: %+v", observer)
+	}
+
+	// Without an MHF, there's no MHF event.
+	mhf := observer.mhf
+	client := p.Client()
+	client.MHF = nil
+
+	resp, err := p.Server().RegistrationResponse(client.RegistrationInit(password), keys.PublicKey, []byte("cid"),
+		keys.OprfSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, resp); err != nil || observer.mhf != mhf {
+		t.Fatalf("unexpected MHF event without an MHF: %v", err)
+	}
+}
+
+func TestFraming(t *testing.T) {
+	p := opaque.DefaultConfiguration()
+	ke1 := p.Client().Init([]byte("password"))
+	ke3 := &message.KE3{Mac: internal.RandomBytes(p.KE3Length())}
+
+	var buf bytes.Buffer
+	if err := opaque.WriteKE1(&buf, ke1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := opaque.WriteKE3(&buf, ke3); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := buf.Bytes()
+
+	// Byte-by-byte reads of consecutive frames.
+	r := iotest.OneByteReader(bytes.NewReader(stream))
+
+	readKE1, err := opaque.ReadKE1(r, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readKE3, err := opaque.ReadKE3(r, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(readKE1.Serialize(), ke1.Serialize()) || !bytes.Equal(readKE3.Serialize(), ke3.Serialize()) {
+		t.Fatal("messages differ")
+	}
+
+	if _, err := opaque.ReadKE1(r, p); err != io.EOF {
+		t.Fatalf("expected io.EOF at the end of the stream, got %v", err)
+	}
+
+	// Truncated frame and truncated header.
+	for _, n := range []int{1, p.KE1Length()} {
+		if _, err := opaque.ReadKE1(bytes.NewReader(stream[:n]), p); err != io.ErrUnexpectedEOF {
+			t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+		}
+	}
+
+	// Oversized declared length.
+	oversized := append([]byte{0xff, 0xff}, stream[2:]...)
+
+	var lengthErr *opaque.MessageLengthError
+	if _, err := opaque.ReadKE1(bytes.NewReader(oversized), p); !errors.As(err, &lengthErr) ||
+		lengthErr.Actual != 0xffff || lengthErr.Expected != p.KE1Length() {
+		t.Fatalf("expected a message length error, got %v", err)
+	}
+}
+
+func TestClientLogin(t *testing.T) {
+	p := opaque.DefaultConfiguration()
+	keys, password := &opaque.ServerKeys{OprfSeed: internal.RandomBytes(32)}, []byte("password")
+	var err error
+	keys.SecretKey, keys.PublicKey, err = p.Server().KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, exportKeyReg, err := registerWith(p, keys, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := p.Server()
+	ke3, sessionKey, exportKey, err := p.Client().Login(password, nil, func(ke1 *message.KE1) (*message.KE2, error) {
+		return server.Init(ke1, nil, keys.SecretKey, keys.PublicKey, keys.OprfSeed, record)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Finish(ke3); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(sessionKey, server.SessionKey()) || !bytes.Equal(exportKey, exportKeyReg) {
+		t.Fatal("keys differ")
+	}
+
+	errTransport := errors.New("transport error")
+	if _, _, _, err := p.Client().Login(password, nil, func(*message.KE1) (*message.KE2, error) {
+		return nil, errTransport
+	}); !errors.Is(err, errTransport) {
+		t.Fatalf("expected error %q, got %v", errTransport, err)
+	}
+}
+
+func TestClientRegister(t *testing.T) {
+	for _, mode := range []opaque.Mode{opaque.Internal, opaque.External} {
+		p := opaque.DefaultConfiguration()
+		p.Mode = mode
+		keys, password, credID := &opaque.ServerKeys{OprfSeed: internal.RandomBytes(32)}, []byte("password"), []byte("alice")
+		var err error
+		keys.SecretKey, keys.PublicKey, err = p.Server().KeyGen()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exchange := func(req *message.RegistrationRequest) (*message.RegistrationResponse, error) {
+			return p.Server().RegistrationResponse(req, keys.PublicKey, credID, keys.OprfSeed)
+		}
+
+		upload, exportKeyReg, err := p.Client().Register(password, nil, exchange)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		record := &opaque.ClientRecord{CredentialIdentifier: credID, RegistrationUpload: upload}
+		server := p.Server()
+
+		_, _, exportKey, err := p.Client().Login(password, nil, func(ke1 *message.KE1) (*message.KE2, error) {
+			return server.Init(ke1, nil, keys.SecretKey, keys.PublicKey, keys.OprfSeed, record)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(exportKey, exportKeyReg) {
+			t.Fatalf("%v: export keys differ", mode)
+		}
+
+		if mode != opaque.External {
+			continue
+		}
+
+		// A given client secret key is used instead of a generated one.
+		sk, pk := p.Client().KeyGen()
+
+		upload, _, err = p.Client().Register(password, nil, exchange, opaque.WithClientSecretKey(sk))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(upload.PublicKey, pk) {
+			t.Fatal("the given client secret key was not used")
+		}
+	}
+}
+
+func TestDeserializeKE1Prefix(t *testing.T) {
+	p := opaque.DefaultConfiguration()
+	first := p.Client().Init([]byte("password1")).Serialize()
+	second := p.Client().Init([]byte("password2")).Serialize()
+	buf := append(append([]byte{}, first...), second...)
+	server := p.Server()
+
+	ke1, n, err := server.DeserializeKE1Prefix(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != len(first) || !bytes.Equal(ke1.Serialize(), first) {
+		t.Fatal("unexpected first KE1")
+	}
+
+	ke1, m, err := server.DeserializeKE1Prefix(buf[n:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n+m != len(buf) || !bytes.Equal(ke1.Serialize(), second) {
+		t.Fatal("unexpected second KE1")
+	}
+
+	if _, _, err := server.DeserializeKE1Prefix(buf[n+1:]); err == nil || err.Error() != "invalid message length" {
+		t.Fatalf("expected error on truncated buffer, got %v", err)
+	}
+}
+
+func TestServerRegisterClient(t *testing.T) {
+	p := opaque.DefaultConfiguration()
+	server := p.Server()
+	sk, pk, err := server.KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credID := internal.RandomBytes(32)
+	password := []byte("password")
+	req := p.Client().RegistrationInit(password)
+
+	if _, _, err := server.RegisterClient(req, pk, credID); !errors.Is(err, opaque.ErrNoMasterKey) {
+		t.Fatalf("expected error %q, got %v", opaque.ErrNoMasterKey, err)
+	}
+
+	if err := server.SetMasterKey(internal.RandomBytes(16)); err == nil {
+		t.Fatal("expected error on short master key")
+	}
+
+	masterKey := internal.RandomBytes(32)
+	if err := server.SetMasterKey(masterKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server keeps a copy of the master key.
+	masterKey[0] ^= 0xff
+
+	client := p.Client()
+	_, seed, err := server.RegisterClient(client.RegistrationInit(password), pk, credID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, _ := server.OPRFSeed(credID); !bytes.Equal(s, seed) {
+		t.Fatal("seed is not deterministic")
+	}
+
+	masterKey[0] ^= 0xff
+	other := p.Server()
+
+	if err := other.SetMasterKey(masterKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, _ := other.OPRFSeed(credID); !bytes.Equal(s, seed) {
+		t.Fatal("the master key was modified by the caller")
+	}
+
+	if s, _ := server.OPRFSeed(internal.RandomBytes(32)); bytes.Equal(s, seed) {
+		t.Fatal("expected a different seed for another credential")
+	}
+
+	test := &testParams{
+		Configuration:   p,
+		password:        password,
+		serverSecretKey: sk,
+		serverPublicKey: pk,
+		oprfSeed:        seed,
+	}
+
+	record, exportKeyReg := testRegistration(t, test)
+	if exportKey := testAuthentication(t, test, record); !bytes.Equal(exportKey, exportKeyReg) {
+		t.Fatal("export keys differ")
+	}
+}
+
+func TestPeekMessageType(t *testing.T) {
+	p := &opaque.Configuration{
+		OPRFGroup: opaque.P256Sha256,
+		AKEGroup:  opaque.P256Sha256,
+		KDF:       hash.SHA256,
+		MAC:       hash.SHA256,
+		Hash:      hash.SHA256,
+		MHF:       mhf.Scrypt,
+		Mode:      opaque.Internal,
+		NonceLen:  32,
+	}
+
+	client := p.Client()
+	server := p.Server()
+	sks, pks, err := server.KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := internal.RandomBytes(32)
+	credID := internal.RandomBytes(32)
+
+	r1 := client.RegistrationInit([]byte("password"))
+	r2, err := server.RegistrationResponse(r1, pks, credID, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r3, _, err := client.RegistrationFinalize(nil, &opaque.Credentials{}, r2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := &opaque.ClientRecord{CredentialIdentifier: credID, RegistrationUpload: r3}
+	ke1 := client.Init([]byte("password"))
+	ke2, err := server.Init(ke1, nil, sks, pks, seed, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ke3, _, err := client.Finish(nil, nil, ke2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := map[opaque.MessageType][]byte{
+		opaque.RegistrationRequestType:  r1.Serialize(),
+		opaque.RegistrationResponseType: r2.Serialize(),
+		opaque.RegistrationUploadType:   r3.Serialize(),
+		opaque.KE1Type:                  ke1.Serialize(),
+		opaque.KE2Type:                  ke2.Serialize(),
+		opaque.KE3Type:                  ke3.Serialize(),
+	}
+
+	lengths := map[opaque.MessageType]int{
+		opaque.RegistrationRequestType:  p.RegistrationRequestLength(),
+		opaque.RegistrationResponseType: p.RegistrationResponseLength(),
+		opaque.RegistrationUploadType:   p.RegistrationUploadLength(),
+		opaque.KE1Type:                  p.KE1Length(),
+		opaque.KE2Type:                  p.KE2Length(),
+		opaque.KE3Type:                  p.KE3Length(),
+	}
+
+	for expected, m := range messages {
+		if len(m) != lengths[expected] {
+			t.Fatalf("wrong length for %v. want %d, got %d", expected, lengths[expected], len(m))
+		}
+
+		mt, err := opaque.PeekMessageType(m, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mt != expected {
+			t.Fatalf("wrong message type. want %v, got %v", expected, mt)
+		}
+	}
+
+	if _, err := opaque.PeekMessageType(internal.RandomBytes(3), p); !errors.Is(err, opaque.ErrUnknownMessageType) {
+		t.Fatalf("expected error on unknown length. want %q, got %q", opaque.ErrUnknownMessageType, err)
+	}
+
+	// With Ristretto255 and SHA-512, a KE3 and a RegistrationResponse have the same length.
+	if _, err := opaque.PeekMessageType(internal.RandomBytes(64), opaque.DefaultConfiguration()); !errors.Is(err, opaque.ErrAmbiguousMessageType) {
+		t.Fatalf("expected error on ambiguous length. want %q, got %q", opaque.ErrAmbiguousMessageType, err)
+	}
+}
+
+func TestFIPSConfiguration(t *testing.T) {
+	p := opaque.FIPSConfiguration()
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	test := &testParams{
+		Configuration: p,
+		username:      []byte("client"),
+		userID:        []byte("client"),
+		serverID:      []byte("server"),
+		password:      []byte("password"),
+		oprfSeed:      internal.RandomBytes(32),
+	}
+	var err error
+	test.serverSecretKey, test.serverPublicKey, err = p.Server().KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, exportKeyReg := testRegistration(t, test)
+	exportKeyLogin := testAuthentication(t, test, record)
+
+	if !bytes.Equal(exportKeyReg, exportKeyLogin) {
+		t.Error("export keys differ")
+	}
+}
+
+func BenchmarkLoginLargeContext(b *testing.B) {
+	conf := opaque.DefaultConfiguration()
+	conf.Context = make([]byte, 1<<15)
+	password := []byte("password")
+
+	record, keys, _, err := opaque.SelfRegister(conf, password)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := opaque.SelfAuthenticate(conf, record, keys, password); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkServerInitPremasked(b *testing.B) {
+	conf := opaque.DefaultConfiguration()
+
+	record, keys, _, err := opaque.SelfRegister(conf, []byte("password"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ke1 := conf.Client().Init([]byte("password"))
+	records := map[string]*opaque.ClientRecord{
+		"default":   record,
+		"premasked": conf.Server().PremaskRecord(record, keys.PublicKey),
+	}
+
+	for name, rec := range records {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := conf.Server().Init(ke1, nil, keys.SecretKey, keys.PublicKey, keys.OprfSeed, rec); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
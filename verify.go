@@ -0,0 +1,92 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright (C) 2021 Daniel Bourdrez. All Rights Reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree or at
+// https://spdx.org/licenses/MIT.html
+
+package opaque
+
+import (
+	"context"
+	"sync"
+)
+
+// VerifyPassword checks whether the password matches the record, by running a full login in memory against the
+// given server identity and keys. It returns nil on success.
+func (s *Server) VerifyPassword(record *ClientRecord, password, serverIdentity []byte, keys *ServerKeys) error {
+	t := newLocal(s.conf, password, keys)
+	t.credentialIdentifier = record.CredentialIdentifier
+	t.clientIdentity = record.ClientIdentity
+	t.serverIdentity = serverIdentity
+
+	_, _, err := t.login(record)
+
+	return err
+}
+
+// PasswordCheck is an entry of VerifyPasswordsBatch.
+type PasswordCheck struct {
+	Record   *ClientRecord
+	Password []byte
+}
+
+// PasswordCheckResult is the outcome of a PasswordCheck, with a nil Err on success.
+type PasswordCheckResult struct {
+	Err error
+}
+
+// VerifyPasswordsBatch runs VerifyPassword on all entries with at most workers concurrent checks, and returns the
+// results in the same order. When ctx is cancelled, the entries that have not been checked yet get ctx.Err() as
+// result.
+func (s *Server) VerifyPasswordsBatch(ctx context.Context, serverIdentity []byte, keys *ServerKeys,
+	entries []PasswordCheck, workers int) []PasswordCheckResult {
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]PasswordCheckResult, len(entries))
+	sem := make(chan struct{}, workers)
+
+	var wg sync.WaitGroup
+
+	for i := range entries {
+		if !acquire(ctx, sem) {
+			for j := i; j < len(entries); j++ {
+				results[j].Err = ctx.Err()
+			}
+
+			break
+		}
+
+		wg.Add(1)
+
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			results[i].Err = s.VerifyPassword(entries[i].Record, entries[i].Password, serverIdentity, keys)
+		}(i)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// acquire takes a slot in sem, and returns false without taking it if ctx is done.
+func acquire(ctx context.Context, sem chan struct{}) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case sem <- struct{}{}:
+		return true
+	}
+}